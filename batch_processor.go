@@ -1,107 +1,658 @@
 package common
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"log"
 	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type ProcessFunction func([]interface{}, *sync.WaitGroup)
+//How long claimed events are skipped by other processes. Longer than any batch takes to process
+const DEFAULT_EVENT_LEASE = 10 * time.Minute
 
-type BatchProcessor struct {
-	ProcessFunc     ProcessFunction
+type ProcessFunction[T comparable] func([]T, *sync.WaitGroup)
+
+type EventEncoder[T comparable] func(T) ([]byte, error)
+
+type EventDecoder[T comparable] func([]byte) (T, error)
+
+type EventFilter[T comparable] func(T) bool
+
+//Failed events are retried with exponential backoff while their error type is retryable
+type RetryPolicy struct {
+	MaxAttempts     int
+	Backoff         time.Duration
+	MaxBackoff      time.Duration
+	RetryableErrors ErrorType
+}
+
+func NewRetryPolicy(maxAttempts int, backoff int, maxBackoff int, retryableErrors ErrorType) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:     maxAttempts,
+		Backoff:         time.Duration(backoff) * time.Second,
+		MaxBackoff:      time.Duration(maxBackoff) * time.Second,
+		RetryableErrors: retryableErrors,
+	}
+}
+
+//Errors other than request errors come from the database and are treated as server errors
+func (retryPolicy RetryPolicy) IsRetryable(err error) bool {
+	errorType := ServerError
+	if requestErr, ok := err.(RequestError); ok {
+		errorType = requestErr.Type
+	}
+
+	return errorType&retryPolicy.RetryableErrors != 0
+}
+
+func (retryPolicy RetryPolicy) ShouldRetry(attempts int, err error) bool {
+	return attempts < retryPolicy.MaxAttempts && retryPolicy.IsRetryable(err)
+}
+
+func (retryPolicy RetryPolicy) GetBackoff(attempts int) time.Duration {
+	backoff := retryPolicy.Backoff * time.Duration(math.Pow(2, float64(attempts-1)))
+	if backoff > retryPolicy.MaxBackoff || backoff <= 0 {
+		backoff = retryPolicy.MaxBackoff
+	}
+
+	return backoff
+}
+
+//Snapshot of batch processor counters
+type BatchMetrics struct {
+	Queue               string        `json:"queue"`
+	Running             bool          `json:"running"`
+	Queued              int64         `json:"queued"`
+	Processed           int64         `json:"processed"`
+	Failed              int64         `json:"failed"`
+	Retried             int64         `json:"retried"`
+	DeadLettered        int64         `json:"deadLettered"`
+	QueueDepth          int           `json:"queueDepth"`
+	Batches             int64         `json:"batches"`
+	LastBatchLatency    time.Duration `json:"lastBatchLatency"`
+	AverageBatchLatency time.Duration `json:"averageBatchLatency"`
+}
+
+//Implemented by batch processors of any event type
+type BatchRunner interface {
+	Start(ctx context.Context)
+	Shutdown(ctx context.Context) error
+	IsRunning() bool
+	GetMetrics() BatchMetrics
+}
+
+type batchEvent[T comparable] struct {
+	id          int64
+	event       T
+	attempts    int
+	availableAt time.Time
+	err         error
+	undecodable bool
+}
+
+//Persists events and dead letters in database tables
+type BatchStore[T comparable] struct {
+	Db              *sql.DB
+	Table           string
+	DeadLetterTable string
+	Queue           string
+	Lease           time.Duration
+	Encode          EventEncoder[T]
+	Decode          EventDecoder[T]
+	Storable        EventFilter[T]
+}
+
+func NewBatchStore[T comparable](db *sql.DB, table string, deadLetterTable string, queue string, encode EventEncoder[T], decode EventDecoder[T]) *BatchStore[T] {
+	batchStore := new(BatchStore[T])
+
+	batchStore.Db = db
+	batchStore.Table = table
+	batchStore.DeadLetterTable = deadLetterTable
+	batchStore.Queue = queue
+	batchStore.Lease = DEFAULT_EVENT_LEASE
+	batchStore.Encode = encode
+	batchStore.Decode = decode
+
+	return batchStore
+}
+
+//Events that must not be persisted, such as payments carrying card details, are only processed in memory
+func (batchStore *BatchStore[T]) IsStorable(event T) bool {
+	return nil == batchStore.Storable || batchStore.Storable(event)
+}
+
+func (batchStore *BatchStore[T]) AddEvent(event T) error {
+	return batchStore.saveEvent(&batchEvent[T]{event: event, availableAt: time.Now()})
+}
+
+func (batchStore *BatchStore[T]) saveEvent(saved *batchEvent[T]) error {
+	payload, err := batchStore.Encode(saved.event)
+	if nil != err {
+		return err
+	}
+
+	var eventErr sql.NullString
+	if nil != saved.err {
+		eventErr = CreateSqlString(saved.err.Error())
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s(queue, payload, attempts, available_at, error, created_at) VALUES($1, $2, $3, $4, $5, $6)", batchStore.Table)
+	_, err = batchStore.Db.Exec(query, batchStore.Queue, string(payload), saved.attempts, saved.availableAt, eventErr, time.Now())
+	return err
+}
+
+func (batchStore *BatchStore[T]) AddDeadLetter(event T, attempts int, eventErr error) error {
+	payload, err := batchStore.Encode(event)
+	if nil != err {
+		return err
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s(queue, payload, attempts, error, created_at) VALUES($1, $2, $3, $4, $5)", batchStore.DeadLetterTable)
+	_, err = batchStore.Db.Exec(query, batchStore.Queue, string(payload), attempts, eventErr.Error(), time.Now())
+	return err
+}
+
+func (batchStore *BatchStore[T]) GetPendingCount() (int, error) {
+	var count int
+	query := fmt.Sprintf("SELECT count(*) FROM %s WHERE queue = $1", batchStore.Table)
+	err := batchStore.Db.QueryRow(query, batchStore.Queue).Scan(&count)
+	return count, err
+}
+
+//Claimed events are leased instead of locked so no transaction is held while they are processed
+func (batchStore *BatchStore[T]) claimEvents(limit int) ([]*batchEvent[T], error) {
+	now := time.Now()
+	query := fmt.Sprintf("UPDATE %s SET available_at = $1 WHERE id IN (SELECT id FROM %s WHERE queue = $2 AND available_at <= $3 ORDER BY id LIMIT $4 FOR UPDATE SKIP LOCKED) RETURNING id, payload, attempts", batchStore.Table, batchStore.Table)
+	rows, err := batchStore.Db.Query(query, now.Add(batchStore.Lease), batchStore.Queue, now, limit)
+	if nil != err {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var batchEvents []*batchEvent[T]
+	for rows.Next() {
+		var claimed batchEvent[T]
+		var payload []byte
+		err = rows.Scan(&claimed.id, &payload, &claimed.attempts)
+		if nil != err {
+			break
+		}
+
+		//Undecodable events are dead lettered without being processed
+		var decodeErr error
+		claimed.event, decodeErr = batchStore.Decode(payload)
+		if nil != decodeErr {
+			log.Printf("Error decoding event %d from queue %s", claimed.id, batchStore.Queue)
+			log.Print(decodeErr)
+			claimed.err = RequestError{decodeErr.Error(), BadRequestError}
+			claimed.undecodable = true
+		}
+
+		batchEvents = append(batchEvents, &claimed)
+	}
+
+	if nil == err {
+		err = rows.Err()
+	}
+
+	if nil != err {
+		return nil, err
+	}
+
+	//Returned rows are not ordered
+	sort.Slice(batchEvents, func(i, j int) bool {
+		return batchEvents[i].id < batchEvents[j].id
+	})
+
+	return batchEvents, nil
+}
+
+func (batchStore *BatchStore[T]) completeEvent(completed *batchEvent[T]) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", batchStore.Table)
+	_, err := batchStore.Db.Exec(query, completed.id)
+	return err
+}
+
+func (batchStore *BatchStore[T]) retryEvent(retried *batchEvent[T]) error {
+	query := fmt.Sprintf("UPDATE %s SET attempts = $1, available_at = $2, error = $3 WHERE id = $4", batchStore.Table)
+	_, err := batchStore.Db.Exec(query, retried.attempts, retried.availableAt, retried.err.Error(), retried.id)
+	return err
+}
+
+//Moving the event is a single statement so it is never both pending and dead lettered
+func (batchStore *BatchStore[T]) deadLetterEvent(deadLetter *batchEvent[T]) error {
+	query := fmt.Sprintf("WITH dead AS (DELETE FROM %s WHERE id = $1 RETURNING queue, payload) INSERT INTO %s(queue, payload, attempts, error, created_at) SELECT queue, payload, $2, $3, $4 FROM dead", batchStore.Table, batchStore.DeadLetterTable)
+	_, err := batchStore.Db.Exec(query, deadLetter.id, deadLetter.attempts, deadLetter.err.Error(), time.Now())
+	return err
+}
+
+//Batches are flushed every process interval or as soon as max batch size events are queued
+type BatchProcessor[T comparable] struct {
+	Name            string
+	ProcessFunc     ProcessFunction[T]
 	ProcessInterval time.Duration
 	ThreadCount     int
-	Events          chan interface{}
-	Running         bool
+	MaxBatchSize    int
+	Events          chan T
+	Store           *BatchStore[T]
+	Durable         bool
+	RetryPolicy     RetryPolicy
 	WaitGroup       sync.WaitGroup
+	running         atomic.Bool
+	flush           chan struct{}
+	cancel          context.CancelFunc
+	drainCtx        context.Context
+	lock            sync.Mutex
+	inFlight        map[T]*batchEvent[T]
+	retries         []*batchEvent[T]
+	storedDepth     atomic.Int64
+	queued          atomic.Int64
+	processed       atomic.Int64
+	failed          atomic.Int64
+	retried         atomic.Int64
+	deadLettered    atomic.Int64
+	batches         atomic.Int64
+	lastLatency     atomic.Int64
+	totalLatency    atomic.Int64
 }
 
-func NewBatchProcessor(processFunc ProcessFunction, requestQueueSize int, processInterval int, threadCount int) *BatchProcessor {
-	batchProcessor := new(BatchProcessor)
+func NewBatchProcessor[T comparable](name string, processFunc ProcessFunction[T], requestQueueSize int, maxBatchSize int, processInterval int, threadCount int) *BatchProcessor[T] {
+	batchProcessor := new(BatchProcessor[T])
 
-	batchProcessor.Events = make(chan interface{}, requestQueueSize)
-	batchProcessor.ProcessInterval = time.Duration(processInterval)
+	batchProcessor.Name = name
+	batchProcessor.Events = make(chan T, requestQueueSize)
+	batchProcessor.ProcessInterval = time.Duration(processInterval) * time.Second
 	batchProcessor.ThreadCount = threadCount
+	batchProcessor.MaxBatchSize = maxBatchSize
 	batchProcessor.ProcessFunc = processFunc
+	batchProcessor.RetryPolicy = RetryPolicy{MaxAttempts: 1}
+	batchProcessor.flush = make(chan struct{}, 1)
 
 	return batchProcessor
 }
 
-func (batchProcessor *BatchProcessor) AddEvent(event interface{}) {
-	batchProcessor.Events <- event
+//Durable batch processors persist events to the store before acknowledging them
+func NewDurableBatchProcessor[T comparable](name string, processFunc ProcessFunction[T], store *BatchStore[T], requestQueueSize int, maxBatchSize int, processInterval int, threadCount int) *BatchProcessor[T] {
+	batchProcessor := NewBatchProcessor(name, processFunc, requestQueueSize, maxBatchSize, processInterval, threadCount)
+	batchProcessor.Store = store
+	batchProcessor.Durable = true
+	return batchProcessor
+}
+
+func (batchProcessor *BatchProcessor[T]) IsRunning() bool {
+	return batchProcessor.running.Load()
+}
+
+func (batchProcessor *BatchProcessor[T]) AddEvent(event T) error {
+	if batchProcessor.Durable && batchProcessor.Store.IsStorable(event) {
+		err := batchProcessor.Store.AddEvent(event)
+		if nil != err {
+			return err
+		}
+		batchProcessor.storedDepth.Add(1)
+	} else {
+		batchProcessor.Events <- event
+	}
+
+	batchProcessor.queued.Add(1)
+	if batchProcessor.getQueueDepth() >= batchProcessor.MaxBatchSize {
+		batchProcessor.requestFlush()
+	}
+
+	return nil
+}
+
+func (batchProcessor *BatchProcessor[T]) requestFlush() {
+	select {
+	case batchProcessor.flush <- struct{}{}:
+	default:
+	}
+}
+
+//Stored depth only counts events added by this process since they were last claimed
+func (batchProcessor *BatchProcessor[T]) getQueueDepth() int {
+	return len(batchProcessor.Events) + int(batchProcessor.storedDepth.Load())
+}
+
+func (batchProcessor *BatchProcessor[T]) GetMetrics() BatchMetrics {
+	metrics := BatchMetrics{
+		Queue:            batchProcessor.Name,
+		Running:          batchProcessor.IsRunning(),
+		Queued:           batchProcessor.queued.Load(),
+		Processed:        batchProcessor.processed.Load(),
+		Failed:           batchProcessor.failed.Load(),
+		Retried:          batchProcessor.retried.Load(),
+		DeadLettered:     batchProcessor.deadLettered.Load(),
+		QueueDepth:       batchProcessor.getQueueDepth(),
+		Batches:          batchProcessor.batches.Load(),
+		LastBatchLatency: time.Duration(batchProcessor.lastLatency.Load()),
+	}
+
+	if metrics.Batches > 0 {
+		metrics.AverageBatchLatency = time.Duration(batchProcessor.totalLatency.Load() / metrics.Batches)
+	}
+
+	return metrics
 }
 
-func (batchProcessor *BatchProcessor) Stop() {
-	batchProcessor.Running = false
-	batchProcessor.WaitGroup.Wait()
+//Records a failed event in the current batch and returns whether it will be retried
+func (batchProcessor *BatchProcessor[T]) FailEvent(event T, err error) bool {
+	batchProcessor.lock.Lock()
+	defer batchProcessor.lock.Unlock()
+
+	failed, exists := batchProcessor.inFlight[event]
+	if !exists {
+		return false
+	}
+
+	failed.err = err
+	return batchProcessor.RetryPolicy.ShouldRetry(failed.attempts+1, err)
 }
 
-func (batchProcessor *BatchProcessor) Start() {
-	go batchProcessor.process()
+//Number of previously failed attempts for an event in the current batch
+func (batchProcessor *BatchProcessor[T]) GetAttempts(event T) int {
+	batchProcessor.lock.Lock()
+	defer batchProcessor.lock.Unlock()
+
+	if inFlight, exists := batchProcessor.inFlight[event]; exists {
+		return inFlight.attempts
+	}
+
+	return 0
 }
 
-func (batchProcessor *BatchProcessor) process() {
-	log.Print("Started batch writing thread")
+//Processing stops after draining queued events once the context is done
+func (batchProcessor *BatchProcessor[T]) Start(ctx context.Context) {
+	if batchProcessor.Durable {
+		count, err := batchProcessor.Store.GetPendingCount()
+		if nil != err {
+			log.Printf("Error counting pending events in queue %s", batchProcessor.Name)
+			log.Print(err)
+		} else if count > 0 {
+			log.Printf("Replaying %d pending events from queue %s", count, batchProcessor.Name)
+		}
+	}
 
-	batchProcessor.Running = true
+	ctx, batchProcessor.cancel = context.WithCancel(ctx)
+	batchProcessor.running.Store(true)
 	batchProcessor.WaitGroup.Add(1)
+	go batchProcessor.process(ctx)
+}
+
+func (batchProcessor *BatchProcessor[T]) Stop() {
+	batchProcessor.Shutdown(context.Background())
+}
+
+//Stops processing after draining queued events or returns once the context is done
+func (batchProcessor *BatchProcessor[T]) Shutdown(ctx context.Context) error {
+	batchProcessor.running.Store(false)
+	batchProcessor.lock.Lock()
+	batchProcessor.drainCtx = ctx
+	batchProcessor.lock.Unlock()
+	if nil != batchProcessor.cancel {
+		batchProcessor.cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		batchProcessor.WaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (batchProcessor *BatchProcessor[T]) process(ctx context.Context) {
+	log.Printf("Started batch writing thread for queue %s", batchProcessor.Name)
+
 	defer batchProcessor.WaitGroup.Done()
 
-	for batchProcessor.Running {
-		time.Sleep(batchProcessor.ProcessInterval * time.Second)
-
-		var elements []interface{}
-		processing := true
-		for processing {
-			select {
-			case event, ok := <-batchProcessor.Events:
-				if ok {
-					elements = append(elements, event)
-					break
-				} else {
-					log.Print("Select channel closed")
-					processing = false
-					batchProcessor.Running = false
-					break
-				}
-			default:
-				processing = false
-				break
-			}
+	ticker := time.NewTicker(batchProcessor.ProcessInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			batchProcessor.running.Store(false)
+			batchProcessor.drain()
+			log.Printf("Stopped batch writing thread for queue %s", batchProcessor.Name)
+			return
+		case <-ticker.C:
+		case <-batchProcessor.flush:
+		}
+
+		batchProcessor.processBatch(true)
+
+		if batchProcessor.getQueueDepth() >= batchProcessor.MaxBatchSize {
+			batchProcessor.requestFlush()
+		}
+	}
+}
+
+func (batchProcessor *BatchProcessor[T]) processBatch(claimStored bool) {
+	start := time.Now()
+
+	//Stored events include those requeued from the dead letters
+	var batchEvents []*batchEvent[T]
+	if nil != batchProcessor.Store && claimStored {
+		var err error
+		batchEvents, err = batchProcessor.Store.claimEvents(batchProcessor.MaxBatchSize)
+		if nil != err {
+			log.Printf("Error claiming events from queue %s", batchProcessor.Name)
+			log.Print(err)
+		} else if batchProcessor.storedDepth.Add(-int64(len(batchEvents))) < 0 {
+			batchProcessor.storedDepth.Store(0)
+		}
+	}
+
+	batchEvents = append(batchEvents, batchProcessor.getMemoryEvents(batchProcessor.MaxBatchSize-len(batchEvents))...)
+
+	if len(batchEvents) <= 0 {
+		return
+	}
+
+	batchProcessor.processEvents(batchEvents)
+	batchProcessor.completeEvents(batchEvents)
+
+	latency := time.Since(start)
+	batchProcessor.batches.Add(1)
+	batchProcessor.lastLatency.Store(int64(latency))
+	batchProcessor.totalLatency.Add(int64(latency))
+}
+
+//Queued events are processed in batches until none are left or the shutdown deadline passes
+func (batchProcessor *BatchProcessor[T]) drain() {
+	batchProcessor.lock.Lock()
+	ctx := batchProcessor.drainCtx
+	batchProcessor.lock.Unlock()
+	if nil == ctx {
+		ctx = context.Background()
+	}
+
+	for len(batchProcessor.Events) > 0 && nil == ctx.Err() {
+		batchProcessor.processBatch(false)
+	}
+
+	batchProcessor.saveRemaining()
+}
+
+//Events still queued or waiting to be retried are stored so another process can handle them
+func (batchProcessor *BatchProcessor[T]) saveRemaining() {
+	remaining := batchProcessor.retries
+	batchProcessor.retries = nil
+
+	for queued := true; queued; {
+		select {
+		case event := <-batchProcessor.Events:
+			remaining = append(remaining, &batchEvent[T]{event: event, availableAt: time.Now()})
+		default:
+			queued = false
 		}
+	}
+
+	if len(remaining) == 0 {
+		return
+	}
 
-		if len(elements) <= 0 {
+	var dropped int
+	for _, unprocessed := range remaining {
+		if nil == batchProcessor.Store || !batchProcessor.Store.IsStorable(unprocessed.event) {
+			log.Printf("Dropping unprocessed event after %d attempts: %v", unprocessed.attempts, unprocessed.err)
+			dropped++
 			continue
 		}
 
-		log.Printf("Retrieved %d values.  Processing with %d connections", len(elements), batchProcessor.ThreadCount)
+		err := batchProcessor.Store.saveEvent(unprocessed)
+		if nil != err {
+			log.Printf("Error storing unprocessed event after %d attempts", unprocessed.attempts)
+			log.Print(err)
+			dropped++
+		}
+	}
+
+	log.Printf("%d events were not processed before stopping queue %s. Stored %d and dropped %d", len(remaining), batchProcessor.Name, len(remaining)-dropped, dropped)
+}
+
+func (batchProcessor *BatchProcessor[T]) getMemoryEvents(limit int) []*batchEvent[T] {
+	var batchEvents []*batchEvent[T]
+
+	now := time.Now()
+	var retries []*batchEvent[T]
+	for _, retry := range batchProcessor.retries {
+		if retry.availableAt.After(now) || len(batchEvents) >= limit {
+			retries = append(retries, retry)
+		} else {
+			retry.err = nil
+			batchEvents = append(batchEvents, retry)
+		}
+	}
+	batchProcessor.retries = retries
+
+	for processing := true; processing && len(batchEvents) < limit; {
+		select {
+		case event := <-batchProcessor.Events:
+			batchEvents = append(batchEvents, &batchEvent[T]{event: event})
+		default:
+			processing = false
+		}
+	}
+
+	return batchEvents
+}
 
-		sliceSize := int(math.Floor(float64(len(elements) / batchProcessor.ThreadCount)))
-		remainder := len(elements) % batchProcessor.ThreadCount
-		start := 0
-		end := 0
+//Waits for every thread so failures are known before events are completed
+func (batchProcessor *BatchProcessor[T]) processEvents(batchEvents []*batchEvent[T]) {
+	var elements []T
 
-		for iter := 0; iter < batchProcessor.ThreadCount; iter++ {
-			var leftover int
-			if remainder > 0 {
-				leftover = 1
-				remainder--
+	batchProcessor.lock.Lock()
+	batchProcessor.inFlight = make(map[T]*batchEvent[T])
+	for _, inFlight := range batchEvents {
+		if nil == inFlight.err {
+			batchProcessor.inFlight[inFlight.event] = inFlight
+			elements = append(elements, inFlight.event)
+		}
+	}
+	batchProcessor.lock.Unlock()
+
+	if len(elements) > 0 {
+		var waitGroup sync.WaitGroup
+		batchProcessor.dispatch(elements, &waitGroup)
+		waitGroup.Wait()
+	}
+
+	batchProcessor.lock.Lock()
+	batchProcessor.inFlight = nil
+	batchProcessor.lock.Unlock()
+}
+
+//Stored events that fail to complete are processed again once their lease expires
+func (batchProcessor *BatchProcessor[T]) completeEvents(batchEvents []*batchEvent[T]) {
+	for _, completed := range batchEvents {
+		if nil != completed.err {
+			completed.attempts++
+			batchProcessor.failed.Add(1)
+		} else {
+			batchProcessor.processed.Add(1)
+		}
+
+		var err error
+		switch {
+		case nil == completed.err:
+			if completed.id > 0 {
+				err = batchProcessor.Store.completeEvent(completed)
+			}
+		case batchProcessor.RetryPolicy.ShouldRetry(completed.attempts, completed.err):
+			batchProcessor.retried.Add(1)
+			backoff := batchProcessor.RetryPolicy.GetBackoff(completed.attempts)
+			completed.availableAt = time.Now().Add(backoff)
+			log.Printf("Retrying event in %s after %d attempts: %s", backoff, completed.attempts, completed.err)
+			if completed.id > 0 {
+				err = batchProcessor.Store.retryEvent(completed)
 			} else {
-				leftover = 0
+				batchProcessor.retries = append(batchProcessor.retries, completed)
+			}
+		case !completed.undecodable && !batchProcessor.RetryPolicy.IsRetryable(completed.err):
+			//Failures such as declined cards are final so only exhausted retries are dead lettered
+			log.Printf("Completing failed event after %d attempts: %s", completed.attempts, completed.err)
+			if completed.id > 0 {
+				err = batchProcessor.Store.completeEvent(completed)
 			}
+		case completed.id > 0:
+			batchProcessor.deadLettered.Add(1)
+			log.Printf("Dead lettering event %d after %d attempts: %s", completed.id, completed.attempts, completed.err)
+			err = batchProcessor.Store.deadLetterEvent(completed)
+		case nil != batchProcessor.Store && batchProcessor.Store.IsStorable(completed.event):
+			batchProcessor.deadLettered.Add(1)
+			log.Printf("Dead lettering event after %d attempts: %s", completed.attempts, completed.err)
+			err = batchProcessor.Store.AddDeadLetter(completed.event, completed.attempts, completed.err)
+		default:
+			log.Printf("Dropping event after %d attempts: %s", completed.attempts, completed.err)
+		}
 
-			end += sliceSize + leftover
+		if nil != err {
+			log.Printf("Error completing event %d from queue %s", completed.id, batchProcessor.Name)
+			log.Print(err)
+		}
+	}
+}
 
-			if start == end {
-				break
-			}
+func (batchProcessor *BatchProcessor[T]) dispatch(elements []T, waitGroup *sync.WaitGroup) {
+	log.Printf("Retrieved %d values.  Processing with %d connections", len(elements), batchProcessor.ThreadCount)
 
-			batchProcessor.WaitGroup.Add(1)
-			go batchProcessor.ProcessFunc(elements[start:end], &batchProcessor.WaitGroup)
+	sliceSize := int(math.Floor(float64(len(elements) / batchProcessor.ThreadCount)))
+	remainder := len(elements) % batchProcessor.ThreadCount
+	start := 0
+	end := 0
 
-			start = end
+	for iter := 0; iter < batchProcessor.ThreadCount; iter++ {
+		var leftover int
+		if remainder > 0 {
+			leftover = 1
+			remainder--
+		} else {
+			leftover = 0
 		}
+
+		end += sliceSize + leftover
+
+		if start == end {
+			break
+		}
+
+		waitGroup.Add(1)
+		go batchProcessor.ProcessFunc(elements[start:end], waitGroup)
+
+		start = end
 	}
 }
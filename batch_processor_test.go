@@ -0,0 +1,389 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+//Fails until it has been attempted the given number of times
+type testEvent struct {
+	Id        int
+	Failures  int
+	Retryable bool
+}
+
+func processTestEvents(batchProcessor **BatchProcessor[*testEvent]) ProcessFunction[*testEvent] {
+	return func(events []*testEvent, waitGroup *sync.WaitGroup) {
+		defer waitGroup.Done()
+		for _, event := range events {
+			if (*batchProcessor).GetAttempts(event) >= event.Failures {
+				continue
+			}
+
+			errorType := BadRequestError
+			if event.Retryable {
+				errorType = ServiceUnavailableError
+			}
+			(*batchProcessor).FailEvent(event, RequestError{fmt.Sprintf("Event %d failed", event.Id), errorType})
+		}
+	}
+}
+
+func newTestBatchProcessor(maxAttempts int) *BatchProcessor[*testEvent] {
+	var batchProcessor *BatchProcessor[*testEvent]
+	batchProcessor = NewBatchProcessor("test", processTestEvents(&batchProcessor), 100, 10, 60, 2)
+	batchProcessor.RetryPolicy = RetryPolicy{MaxAttempts: maxAttempts, RetryableErrors: ServiceUnavailableError}
+	return batchProcessor
+}
+
+//Database tests run against the funders schema in TEST_DATABASE_URL
+func getTestDatabase(t *testing.T) *sql.DB {
+	dbUrl := os.Getenv("TEST_DATABASE_URL")
+	if len(dbUrl) == 0 {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", dbUrl)
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func newTestBatchStore(t *testing.T, db *sql.DB) *BatchStore[*testEvent] {
+	queue := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	encode := func(event *testEvent) ([]byte, error) {
+		return json.Marshal(event)
+	}
+	decode := func(payload []byte) (*testEvent, error) {
+		event := new(testEvent)
+		err := json.Unmarshal(payload, event)
+		return event, err
+	}
+
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM funders.batch_jobs WHERE queue = $1", queue)
+		db.Exec("DELETE FROM funders.dead_letters WHERE queue = $1", queue)
+	})
+
+	return NewBatchStore(db, "funders.batch_jobs", "funders.dead_letters", queue, encode, decode)
+}
+
+func getDeadLetterCount(t *testing.T, batchStore *BatchStore[*testEvent]) int {
+	var count int
+	err := batchStore.Db.QueryRow("SELECT count(*) FROM funders.dead_letters WHERE queue = $1", batchStore.Queue).Scan(&count)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	retryPolicy := NewRetryPolicy(3, 1, 60, ServiceUnavailableError|ServerError)
+
+	if !retryPolicy.ShouldRetry(1, RequestError{"Unavailable", ServiceUnavailableError}) {
+		t.Error("Expected unavailable errors to be retried")
+	}
+	if !retryPolicy.ShouldRetry(2, fmt.Errorf("Database error")) {
+		t.Error("Expected errors other than request errors to be retried as server errors")
+	}
+	if retryPolicy.ShouldRetry(1, RequestError{"Declined", BadRequestError}) {
+		t.Error("Expected bad requests not to be retried")
+	}
+	if retryPolicy.ShouldRetry(3, RequestError{"Unavailable", ServiceUnavailableError}) {
+		t.Error("Expected retries to stop after max attempts")
+	}
+}
+
+func TestRetryPolicyGetBackoff(t *testing.T) {
+	retryPolicy := NewRetryPolicy(10, 2, 30, ServiceUnavailableError)
+
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for iter, backoff := range expected {
+		if actual := retryPolicy.GetBackoff(iter + 1); actual != backoff {
+			t.Errorf("Expected backoff of %s after %d attempts but was %s", backoff, iter+1, actual)
+		}
+	}
+}
+
+func TestBatchProcessorRetriesUntilSuccess(t *testing.T) {
+	batchProcessor := newTestBatchProcessor(3)
+
+	batchProcessor.AddEvent(&testEvent{Id: 1, Failures: 2, Retryable: true})
+	for iter := 0; iter < 3; iter++ {
+		batchProcessor.processBatch(false)
+	}
+
+	metrics := batchProcessor.GetMetrics()
+	if metrics.Processed != 1 || metrics.Failed != 2 || metrics.Retried != 2 || metrics.DeadLettered != 0 {
+		t.Fatalf("Expected event to succeed on third attempt but metrics were %+v", metrics)
+	}
+	if len(batchProcessor.retries) != 0 {
+		t.Fatalf("Expected no retries left but found %d", len(batchProcessor.retries))
+	}
+}
+
+func TestBatchProcessorBacksOffRetries(t *testing.T) {
+	batchProcessor := newTestBatchProcessor(3)
+	batchProcessor.RetryPolicy.Backoff = time.Minute
+	batchProcessor.RetryPolicy.MaxBackoff = time.Hour
+
+	batchProcessor.AddEvent(&testEvent{Id: 1, Failures: 1, Retryable: true})
+	batchProcessor.processBatch(false)
+	batchProcessor.processBatch(false)
+
+	metrics := batchProcessor.GetMetrics()
+	if metrics.Processed != 0 || metrics.Failed != 1 || len(batchProcessor.retries) != 1 {
+		t.Fatalf("Expected retry to wait for its backoff but metrics were %+v", metrics)
+	}
+	if retry := batchProcessor.retries[0]; retry.attempts != 1 || time.Until(retry.availableAt) <= 59*time.Second {
+		t.Fatalf("Expected retry after one minute but was available at %s after %d attempts", retry.availableAt, retry.attempts)
+	}
+}
+
+func TestBatchProcessorCompletesFinalFailures(t *testing.T) {
+	batchProcessor := newTestBatchProcessor(3)
+
+	batchProcessor.AddEvent(&testEvent{Id: 1, Failures: 1, Retryable: false})
+	batchProcessor.processBatch(false)
+
+	metrics := batchProcessor.GetMetrics()
+	if metrics.Failed != 1 || metrics.Retried != 0 || metrics.DeadLettered != 0 || len(batchProcessor.retries) != 0 {
+		t.Fatalf("Expected non retryable failure to complete without retries but metrics were %+v", metrics)
+	}
+}
+
+func TestBatchProcessorDropsExhaustedEventsWithoutStore(t *testing.T) {
+	batchProcessor := newTestBatchProcessor(2)
+
+	batchProcessor.AddEvent(&testEvent{Id: 1, Failures: 5, Retryable: true})
+	for iter := 0; iter < 3; iter++ {
+		batchProcessor.processBatch(false)
+	}
+
+	metrics := batchProcessor.GetMetrics()
+	if metrics.Failed != 2 || metrics.Retried != 1 || metrics.DeadLettered != 0 || len(batchProcessor.retries) != 0 {
+		t.Fatalf("Expected exhausted event to be dropped after two attempts but metrics were %+v", metrics)
+	}
+}
+
+func TestBatchProcessorDeadLettersExhaustedEvents(t *testing.T) {
+	db := getTestDatabase(t)
+	batchProcessor := newTestBatchProcessor(2)
+	batchProcessor.Store = newTestBatchStore(t, db)
+
+	batchProcessor.AddEvent(&testEvent{Id: 1, Failures: 5, Retryable: true})
+	batchProcessor.processBatch(false)
+	batchProcessor.processBatch(false)
+
+	if metrics := batchProcessor.GetMetrics(); metrics.DeadLettered != 1 {
+		t.Fatalf("Expected exhausted event to be dead lettered but metrics were %+v", metrics)
+	}
+	if count := getDeadLetterCount(t, batchProcessor.Store); count != 1 {
+		t.Fatalf("Expected one dead letter but found %d", count)
+	}
+}
+
+func TestBatchProcessorSkipsUnstorableDeadLetters(t *testing.T) {
+	db := getTestDatabase(t)
+	batchProcessor := newTestBatchProcessor(1)
+	batchProcessor.Store = newTestBatchStore(t, db)
+	batchProcessor.Store.Storable = func(event *testEvent) bool {
+		return false
+	}
+
+	batchProcessor.AddEvent(&testEvent{Id: 1, Failures: 1, Retryable: true})
+	batchProcessor.processBatch(false)
+
+	if count := getDeadLetterCount(t, batchProcessor.Store); count != 0 {
+		t.Fatalf("Expected unstorable event to be dropped but found %d dead letters", count)
+	}
+}
+
+func TestBatchStoreClaimEvents(t *testing.T) {
+	db := getTestDatabase(t)
+	batchStore := newTestBatchStore(t, db)
+
+	for iter := 1; iter <= 3; iter++ {
+		err := batchStore.AddEvent(&testEvent{Id: iter})
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	claimed, err := batchStore.claimEvents(2)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(claimed) != 2 || claimed[0].event.Id != 1 || claimed[1].event.Id != 2 || claimed[0].id >= claimed[1].id {
+		t.Fatalf("Expected first two events in id order but claimed %d", len(claimed))
+	}
+
+	//Leased events are skipped until they are completed or their lease expires
+	leased, err := batchStore.claimEvents(2)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(leased) != 1 || leased[0].event.Id != 3 {
+		t.Fatalf("Expected only the unclaimed event but claimed %d", len(leased))
+	}
+
+	for _, completed := range append(claimed, leased...) {
+		err = batchStore.completeEvent(completed)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := batchStore.GetPendingCount()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("Expected completed events to be removed but %d are pending", count)
+	}
+}
+
+func TestBatchStoreReclaimsExpiredLeases(t *testing.T) {
+	db := getTestDatabase(t)
+	batchStore := newTestBatchStore(t, db)
+	batchStore.Lease = 0
+
+	batchStore.AddEvent(&testEvent{Id: 1})
+	claimed, err := batchStore.claimEvents(10)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	reclaimed, err := batchStore.claimEvents(10)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || len(reclaimed) != 1 || claimed[0].id != reclaimed[0].id {
+		t.Fatal("Expected event to be claimed again once its lease expired")
+	}
+}
+
+func TestDurableBatchProcessorDeadLettersStoredEvents(t *testing.T) {
+	db := getTestDatabase(t)
+	batchProcessor := newTestBatchProcessor(1)
+	batchProcessor.Store = newTestBatchStore(t, db)
+	batchProcessor.Durable = true
+
+	batchProcessor.AddEvent(&testEvent{Id: 1, Failures: 1, Retryable: true})
+	batchProcessor.AddEvent(&testEvent{Id: 2})
+	batchProcessor.processBatch(true)
+
+	metrics := batchProcessor.GetMetrics()
+	if metrics.Processed != 1 || metrics.DeadLettered != 1 {
+		t.Fatalf("Expected one processed and one dead lettered event but metrics were %+v", metrics)
+	}
+
+	count, err := batchProcessor.Store.GetPendingCount()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("Expected no pending events but found %d", count)
+	}
+	if count = getDeadLetterCount(t, batchProcessor.Store); count != 1 {
+		t.Fatalf("Expected one dead letter but found %d", count)
+	}
+}
+
+func TestDurableBatchProcessorDeadLettersUndecodableEvents(t *testing.T) {
+	db := getTestDatabase(t)
+	batchProcessor := newTestBatchProcessor(3)
+	batchProcessor.Store = newTestBatchStore(t, db)
+	batchProcessor.Durable = true
+
+	_, err := db.Exec("INSERT INTO funders.batch_jobs(queue, payload, attempts, available_at, created_at) VALUES($1, $2, 0, $3, $3)", batchProcessor.Store.Queue, `{"Id": "invalid"}`, time.Now())
+	if nil != err {
+		t.Fatal(err)
+	}
+	batchProcessor.processBatch(true)
+
+	if count := getDeadLetterCount(t, batchProcessor.Store); count != 1 {
+		t.Fatalf("Expected undecodable event to be dead lettered but found %d dead letters", count)
+	}
+}
+
+func TestBatchProcessorDrainsEveryQueuedEventOnShutdown(t *testing.T) {
+	batchProcessor := newTestBatchProcessor(1)
+	batchProcessor.MaxBatchSize = 3
+
+	//Queued events are only processed once shutdown starts
+	for iter := 0; iter < 20; iter++ {
+		batchProcessor.AddEvent(&testEvent{Id: iter})
+	}
+	<-batchProcessor.flush
+	batchProcessor.Start(context.Background())
+
+	err := batchProcessor.Shutdown(context.Background())
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	metrics := batchProcessor.GetMetrics()
+	if metrics.Processed != 20 || metrics.QueueDepth != 0 || metrics.Running {
+		t.Fatalf("Expected every queued event to be processed but metrics were %+v", metrics)
+	}
+}
+
+func TestBatchProcessorDrainStopsAtDeadline(t *testing.T) {
+	batchProcessor := newTestBatchProcessor(3)
+	batchProcessor.MaxBatchSize = 3
+
+	for iter := 0; iter < 10; iter++ {
+		batchProcessor.AddEvent(&testEvent{Id: iter})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	batchProcessor.drainCtx = ctx
+	batchProcessor.drain()
+
+	metrics := batchProcessor.GetMetrics()
+	if metrics.Processed != 0 || metrics.QueueDepth != 0 {
+		t.Fatalf("Expected unprocessed events to be removed from the queue at the deadline but metrics were %+v", metrics)
+	}
+}
+
+func TestBatchProcessorStoresRemainingEventsOnShutdown(t *testing.T) {
+	db := getTestDatabase(t)
+	batchProcessor := newTestBatchProcessor(3)
+	batchProcessor.Store = newTestBatchStore(t, db)
+	batchProcessor.Store.Storable = func(event *testEvent) bool {
+		return event.Id%2 == 0
+	}
+
+	batchProcessor.AddEvent(&testEvent{Id: 0, Failures: 1, Retryable: true})
+	batchProcessor.processBatch(false)
+	for iter := 1; iter <= 10; iter++ {
+		batchProcessor.AddEvent(&testEvent{Id: iter})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	batchProcessor.drainCtx = ctx
+	batchProcessor.drain()
+
+	//The pending retry and the storable events left in the queue are stored
+	count, err := batchProcessor.Store.GetPendingCount()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if count != 6 {
+		t.Fatalf("Expected six stored events but %d are pending", count)
+	}
+}
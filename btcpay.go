@@ -0,0 +1,367 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/martini-contrib/binding"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BTCPAY_PROCESSOR           = "btcpay"
+	BTCPAY_SIGNATURE_HEADER    = "BTCPay-Sig"
+	BTCPAY_SIGNATURE_PREFIX    = "sha256="
+	BTCPAY_PAYMENT_ID_METADATA = "orderId"
+	BTCPAY_REQUEST_TIMEOUT     = 30 * time.Second
+)
+
+type BtcpayProcessor struct {
+	BaseUrl       string
+	StoreId       string
+	ApiKey        string
+	WebhookSecret string
+	Client        *http.Client
+}
+
+type BtcpayInvoice struct {
+	ID           string                 `json:"id"`
+	Status       string                 `json:"status"`
+	Amount       string                 `json:"amount"`
+	Currency     string                 `json:"currency"`
+	CheckoutLink string                 `json:"checkoutLink"`
+	Metadata     map[string]interface{} `json:"metadata"`
+}
+
+type BtcpayWebhookEvent struct {
+	DeliveryId         string                 `json:"deliveryId"`
+	OriginalDeliveryId string                 `json:"originalDeliveryId"`
+	Type               string                 `json:"type"`
+	StoreId            string                 `json:"storeId"`
+	InvoiceId          string                 `json:"invoiceId"`
+	Metadata           map[string]interface{} `json:"metadata"`
+}
+
+type btcpayInvoiceRequest struct {
+	Amount   string                 `json:"amount"`
+	Currency string                 `json:"currency"`
+	Metadata map[string]interface{} `json:"metadata"`
+	Checkout *btcpayCheckoutOptions `json:"checkout,omitempty"`
+}
+
+type btcpayCheckoutOptions struct {
+	RedirectURL string `json:"redirectURL,omitempty"`
+}
+
+type btcpayRefundRequest struct {
+	RefundVariant  string `json:"refundVariant"`
+	CustomAmount   string `json:"customAmount"`
+	CustomCurrency string `json:"customCurrency"`
+}
+
+type btcpayRefund struct {
+	ID       string `json:"id"`
+	ViewLink string `json:"viewLink"`
+}
+
+type btcpayError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func NewBtcpayProcessor(baseUrl string, storeId string, apiKey string) *BtcpayProcessor {
+	btcpayProcessor := new(BtcpayProcessor)
+	btcpayProcessor.BaseUrl = strings.TrimRight(baseUrl, "/")
+	btcpayProcessor.StoreId = storeId
+	btcpayProcessor.ApiKey = apiKey
+	btcpayProcessor.Client = &http.Client{Timeout: BTCPAY_REQUEST_TIMEOUT}
+	return btcpayProcessor
+}
+
+func (btcpayProcessor *BtcpayProcessor) GetName() string {
+	return BTCPAY_PROCESSOR
+}
+
+func (btcpayProcessor *BtcpayProcessor) Validate(payment *Payment, errors binding.Errors) binding.Errors {
+	return errors
+}
+
+//Payments stay pending until the invoice is settled
+func (btcpayProcessor *BtcpayProcessor) Charge(payment *Payment) error {
+	if payment.AccountType != "bitcoin" {
+		return RequestError{"Only bitcoin payments are currently supported", ServiceNotImplementedError}
+	}
+
+	if nil == payment.Campaign {
+		return RequestError{fmt.Sprintf("Campaign not found %d", payment.CampaignId), NotFoundError}
+	}
+
+	itemDesc := fmt.Sprintf("Perk %d for campaign %s", payment.PerkId, payment.Campaign.Name)
+	if payment.IsDonation() {
+		itemDesc = fmt.Sprintf("Donation to campaign %s", payment.Campaign.Name)
+	} else if payment.HasMultipleItems() {
+		itemDesc = fmt.Sprintf("Perks %s for campaign %s", payment.GetItemsDescription(), payment.Campaign.Name)
+	}
+
+	invoiceRequest := btcpayInvoiceRequest{
+		Amount:   strconv.FormatFloat(payment.Amount, 'f', -1, 64),
+		Currency: payment.Currency,
+		Metadata: map[string]interface{}{
+			BTCPAY_PAYMENT_ID_METADATA: payment.Id,
+			"itemDesc":                 itemDesc,
+		},
+	}
+
+	if len(payment.ContactEmail) > 0 {
+		invoiceRequest.Metadata["buyerEmail"] = payment.ContactEmail
+	}
+
+	if len(payment.BitcoinRedirectUrl) > 0 {
+		invoiceRequest.Checkout = &btcpayCheckoutOptions{RedirectURL: payment.BitcoinRedirectUrl}
+	}
+
+	invoice := &BtcpayInvoice{}
+	err := btcpayProcessor.callApi("POST", btcpayProcessor.getInvoicesPath(), invoiceRequest, invoice)
+	if nil != err {
+		log.Print(err)
+		log.Print("Failed creating invoice with processor")
+		payment.PaymentProcessorResponses = FormatPaymentProcessorResponse(err.Error())
+		payment.UpdateStatus("failure")
+		return err
+	}
+
+	log.Printf("Successfully created invoice %s with processor", invoice.ID)
+
+	jsonErr := payment.UpdatePaymentProcessorResponses(invoice)
+	if nil != jsonErr {
+		log.Print(jsonErr)
+		log.Printf("Unable to marshal invoice response %s from btcpay", invoice.ID)
+	}
+
+	payment.PaymentProcessorTransactionId = invoice.ID
+	payment.UpdateBitcoinPaymentUrl(invoice.CheckoutLink)
+	payment.UpdateStatus("pending")
+	return nil
+}
+
+//Invoices are settled by the processor so completing only checks the invoice
+func (btcpayProcessor *BtcpayProcessor) Complete(payment *Payment, completion PaymentCompletion) error {
+	status, err := btcpayProcessor.GetStatus(payment)
+	if nil != err {
+		return err
+	}
+
+	switch status {
+	case "success":
+		payment.UpdateStatus("success")
+		return nil
+	case "failure":
+		payment.UpdateStatus("failure")
+		payment.UpdateFailureReason("Invoice expired or invalid with processor")
+		return RequestError{fmt.Sprintf("Invoice %s expired or invalid with processor", payment.PaymentProcessorTransactionId), BadRequestError}
+	default:
+		return RequestError{fmt.Sprintf("Invoice %s has not been settled", payment.PaymentProcessorTransactionId), BadRequestError}
+	}
+}
+
+//Refunds are paid out once the customer claims them from the refund link
+func (btcpayProcessor *BtcpayProcessor) Refund(payment *Payment, amount float64) (string, error) {
+	if len(payment.PaymentProcessorTransactionId) == 0 {
+		return "", RequestError{fmt.Sprintf("No btcpay invoice found for payment %s", payment.Id), NotFoundError}
+	}
+
+	refundRequest := btcpayRefundRequest{
+		RefundVariant:  "Custom",
+		CustomAmount:   strconv.FormatFloat(amount, 'f', -1, 64),
+		CustomCurrency: payment.Currency,
+	}
+
+	refund := &btcpayRefund{}
+	err := btcpayProcessor.callApi("POST", fmt.Sprintf("%s/%s/refund", btcpayProcessor.getInvoicesPath(), payment.PaymentProcessorTransactionId), refundRequest, refund)
+	if nil != err {
+		log.Print(err)
+		log.Print("Failed refunding payment with processor")
+		return "", err
+	}
+
+	log.Printf("Successfully created refund %s for payment %s with processor", refund.ID, payment.Id)
+
+	jsonErr := payment.UpdatePaymentProcessorResponses(refund)
+	if nil != jsonErr {
+		log.Print(jsonErr)
+		log.Printf("Unable to marshal refund response %s from btcpay", refund.ID)
+	}
+
+	return refund.ID, nil
+}
+
+func (btcpayProcessor *BtcpayProcessor) GetStatus(payment *Payment) (string, error) {
+	invoice, err := btcpayProcessor.GetInvoice(payment.PaymentProcessorTransactionId)
+	if nil != err {
+		return "", err
+	}
+
+	return GetBtcpayInvoiceStatus(invoice.Status), nil
+}
+
+func (btcpayProcessor *BtcpayProcessor) GetInvoice(invoiceId string) (*BtcpayInvoice, error) {
+	if len(invoiceId) == 0 {
+		return nil, RequestError{"No btcpay invoice id specified", NotFoundError}
+	}
+
+	invoice := &BtcpayInvoice{}
+	err := btcpayProcessor.callApi("GET", fmt.Sprintf("%s/%s", btcpayProcessor.getInvoicesPath(), invoiceId), nil, invoice)
+	return invoice, err
+}
+
+//Maps btcpay invoice statuses to payment statuses
+func GetBtcpayInvoiceStatus(invoiceStatus string) string {
+	switch invoiceStatus {
+	case "Settled", "Complete", "Confirmed":
+		return "success"
+	case "Expired", "Invalid":
+		return "failure"
+	default:
+		return "pending"
+	}
+}
+
+func (btcpayProcessor *BtcpayProcessor) ParseWebhookEvent(payload []byte, signatureHeader string) (*BtcpayWebhookEvent, error) {
+	err := btcpayProcessor.verifyWebhookSignature(payload, signatureHeader)
+	if nil != err {
+		return nil, err
+	}
+
+	event := &BtcpayWebhookEvent{}
+	err = json.Unmarshal(payload, event)
+	if nil != err {
+		return nil, RequestError{fmt.Sprintf("Unable to parse btcpay event: %s", err.Error()), BadRequestError}
+	}
+
+	if len(event.DeliveryId) == 0 || len(event.Type) == 0 {
+		return nil, RequestError{"Btcpay event is missing delivery id or type", BadRequestError}
+	}
+
+	//Redelivered events keep the id of their original delivery
+	if len(event.OriginalDeliveryId) == 0 {
+		event.OriginalDeliveryId = event.DeliveryId
+	}
+
+	return event, nil
+}
+
+func (event *BtcpayWebhookEvent) GetPaymentId() string {
+	if paymentId, ok := event.Metadata[BTCPAY_PAYMENT_ID_METADATA].(string); ok {
+		return paymentId
+	}
+
+	return ""
+}
+
+//Header format is sha256=signature
+func (btcpayProcessor *BtcpayProcessor) verifyWebhookSignature(payload []byte, signatureHeader string) error {
+	if len(btcpayProcessor.WebhookSecret) == 0 {
+		return RequestError{"Btcpay webhook secret is not set", ServiceNotImplementedError}
+	}
+
+	if !strings.HasPrefix(signatureHeader, BTCPAY_SIGNATURE_PREFIX) {
+		return RequestError{fmt.Sprintf("Invalid %s header", BTCPAY_SIGNATURE_HEADER), BadRequestError}
+	}
+
+	mac := hmac.New(sha256.New, []byte(btcpayProcessor.WebhookSecret))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+
+	actual, err := hex.DecodeString(strings.TrimPrefix(signatureHeader, BTCPAY_SIGNATURE_PREFIX))
+	if nil != err || !hmac.Equal(expected, actual) {
+		return RequestError{"Btcpay event signature does not match", BadRequestError}
+	}
+
+	return nil
+}
+
+func (btcpayProcessor *BtcpayProcessor) getInvoicesPath() string {
+	return fmt.Sprintf("/api/v1/stores/%s/invoices", btcpayProcessor.StoreId)
+}
+
+func (btcpayProcessor *BtcpayProcessor) callApi(method string, path string, request interface{}, response interface{}) error {
+	var body []byte
+	if nil != request {
+		var err error
+		body, err = json.Marshal(request)
+		if nil != err {
+			return RequestError{err.Error(), ServerError}
+		}
+	}
+
+	req, err := http.NewRequest(method, btcpayProcessor.BaseUrl+path, bytes.NewReader(body))
+	if nil != err {
+		return RequestError{err.Error(), ServerError}
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", btcpayProcessor.ApiKey))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := btcpayProcessor.Client.Do(req)
+	if nil != err {
+		return ConvertNetworkError(BTCPAY_PROCESSOR, err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if nil != err {
+		return ConvertNetworkError(BTCPAY_PROCESSOR, err)
+	}
+
+	if res.StatusCode >= 300 {
+		return convertBtcpayError(res.StatusCode, resBody)
+	}
+
+	err = json.Unmarshal(resBody, response)
+	if nil != err {
+		return RequestError{fmt.Sprintf("Unable to parse btcpay response: %s", err.Error()), ServerError}
+	}
+
+	return nil
+}
+
+//Validation errors are returned as an array and other errors as a single object
+func convertBtcpayError(statusCode int, body []byte) error {
+	message := http.StatusText(statusCode)
+
+	var validationErrors []struct {
+		Path    string `json:"path"`
+		Message string `json:"message"`
+	}
+	singleError := &btcpayError{}
+
+	if nil == json.Unmarshal(body, &validationErrors) && len(validationErrors) > 0 {
+		var messages []string
+		for _, validationError := range validationErrors {
+			messages = append(messages, fmt.Sprintf("%s: %s", validationError.Path, validationError.Message))
+		}
+		message = strings.Join(messages, ", ")
+	} else if nil == json.Unmarshal(body, singleError) && len(singleError.Message) > 0 {
+		message = singleError.Message
+	}
+
+	switch {
+	case statusCode == http.StatusNotFound:
+		return RequestError{message, NotFoundError}
+	case statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		return RequestError{message, ServiceUnavailableError}
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return RequestError{message, ServerError}
+	default:
+		return RequestError{message, BadRequestError}
+	}
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func signBtcpayPayload(webhookSecret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write([]byte(payload))
+	return BTCPAY_SIGNATURE_PREFIX + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newTestBtcpayProcessor() *BtcpayProcessor {
+	btcpayProcessor := NewBtcpayProcessor("https://btcpay.example.com", "store", "key")
+	btcpayProcessor.WebhookSecret = "btcpay_secret"
+	return btcpayProcessor
+}
+
+func TestBtcpayWebhookEvent(t *testing.T) {
+	payload := `{"deliveryId": "dlv_1", "type": "InvoiceSettled", "invoiceId": "inv_1", "metadata": {"orderId": "payment_1"}}`
+
+	event, err := newTestBtcpayProcessor().ParseWebhookEvent([]byte(payload), signBtcpayPayload("btcpay_secret", payload))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if event.InvoiceId != "inv_1" || event.GetPaymentId() != "payment_1" {
+		t.Fatalf("Expected invoice inv_1 for payment_1 but was %s for %s", event.InvoiceId, event.GetPaymentId())
+	}
+	if event.OriginalDeliveryId != "dlv_1" {
+		t.Fatalf("Expected first delivery to be its own original but was %s", event.OriginalDeliveryId)
+	}
+}
+
+func TestBtcpayWebhookRejectsInvalidSignatures(t *testing.T) {
+	payload := `{"deliveryId": "dlv_1", "type": "InvoiceSettled", "invoiceId": "inv_1"}`
+
+	for _, signatureHeader := range []string{
+		"",
+		signBtcpayPayload("other_secret", payload),
+		signBtcpayPayload("btcpay_secret", payload)[len(BTCPAY_SIGNATURE_PREFIX):],
+		BTCPAY_SIGNATURE_PREFIX + "not_hex",
+	} {
+		_, err := newTestBtcpayProcessor().ParseWebhookEvent([]byte(payload), signatureHeader)
+		if requestErr, ok := err.(RequestError); !ok || requestErr.Type != BadRequestError {
+			t.Errorf("Expected signature %s to be a bad request but was %v", signatureHeader, err)
+		}
+	}
+
+	//Webhooks are turned off until a secret is configured
+	btcpayProcessor := newTestBtcpayProcessor()
+	btcpayProcessor.WebhookSecret = ""
+	_, err := btcpayProcessor.ParseWebhookEvent([]byte(payload), signBtcpayPayload("", payload))
+	if requestErr, ok := err.(RequestError); !ok || requestErr.Type != ServiceNotImplementedError {
+		t.Fatalf("Expected webhooks without secret to be not implemented but was %v", err)
+	}
+}
+
+func TestGetBtcpayInvoiceStatus(t *testing.T) {
+	statuses := map[string]string{
+		"Settled":    "success",
+		"Complete":   "success",
+		"Expired":    "failure",
+		"Invalid":    "failure",
+		"New":        "pending",
+		"Processing": "pending",
+	}
+
+	for invoiceStatus, status := range statuses {
+		if paymentStatus := GetBtcpayInvoiceStatus(invoiceStatus); paymentStatus != status {
+			t.Errorf("Expected %s invoice to be %s but was %s", invoiceStatus, status, paymentStatus)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	CAMPAIGN_DRAFT     = "draft"
+	CAMPAIGN_SCHEDULED = "scheduled"
+	CAMPAIGN_LIVE      = "live"
+	CAMPAIGN_SUCCEEDED = "succeeded"
+	CAMPAIGN_FAILED    = "failed"
+	CAMPAIGN_CANCELLED = "cancelled"
+)
+
+//Scheduled campaigns go live and live campaigns end by their dates. The rest are set by administrators
+var campaignStatusTransitions = map[string][]string{
+	CAMPAIGN_DRAFT:     []string{CAMPAIGN_SCHEDULED, CAMPAIGN_CANCELLED},
+	CAMPAIGN_SCHEDULED: []string{CAMPAIGN_DRAFT, CAMPAIGN_LIVE, CAMPAIGN_CANCELLED},
+	CAMPAIGN_LIVE:      []string{CAMPAIGN_SUCCEEDED, CAMPAIGN_FAILED, CAMPAIGN_CANCELLED},
+}
+
+func IsCampaignStatusTransitionAllowed(from string, to string) bool {
+	for _, status := range campaignStatusTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Statuses administrators can move campaigns to. Live, succeeded and failed follow from the campaign dates
+func IsManualCampaignStatus(status string) bool {
+	return status == CAMPAIGN_DRAFT || status == CAMPAIGN_SCHEDULED || status == CAMPAIGN_CANCELLED
+}
+
+//Campaign launch and close times. Timestamps without an offset are in the campaign time zone and dates start at midnight
+func ParseCampaignTime(value string, location *time.Location) (time.Time, error) {
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if nil == err {
+		return timestamp, nil
+	} else if nil == location {
+		return timestamp, fmt.Errorf("Invalid timestamp %s. Expected an ISO 8601 timestamp with offset (e.g. 2016-09-04T09:00:00-04:00)", value)
+	}
+
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", TIME_LAYOUT} {
+		timestamp, err = time.ParseInLocation(layout, value, location)
+		if nil == err {
+			return timestamp, nil
+		}
+	}
+
+	return timestamp, fmt.Errorf("Invalid timestamp %s. Expected a date, a local timestamp or an ISO 8601 timestamp with offset", value)
+}
+
+//Status of a campaign at the given time from its stored status and dates
+func GetCampaignStatus(status string, startDate time.Time, endDate time.Time, goalMet bool, now time.Time) string {
+	if status == CAMPAIGN_SCHEDULED && now.After(startDate) {
+		status = CAMPAIGN_LIVE
+	}
+
+	if status == CAMPAIGN_LIVE && now.After(endDate) {
+		if goalMet {
+			status = CAMPAIGN_SUCCEEDED
+		} else {
+			status = CAMPAIGN_FAILED
+		}
+	}
+
+	return status
+}
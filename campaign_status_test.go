@@ -0,0 +1,88 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCampaignStatusTransitions(t *testing.T) {
+	tests := []struct {
+		from    string
+		to      string
+		allowed bool
+	}{
+		{CAMPAIGN_DRAFT, CAMPAIGN_SCHEDULED, true},
+		{CAMPAIGN_SCHEDULED, CAMPAIGN_DRAFT, true},
+		{CAMPAIGN_LIVE, CAMPAIGN_CANCELLED, true},
+		{CAMPAIGN_DRAFT, CAMPAIGN_LIVE, false},
+		{CAMPAIGN_SUCCEEDED, CAMPAIGN_LIVE, false},
+		{CAMPAIGN_CANCELLED, CAMPAIGN_DRAFT, false},
+	}
+
+	for _, test := range tests {
+		if allowed := IsCampaignStatusTransitionAllowed(test.from, test.to); allowed != test.allowed {
+			t.Errorf("Expected transition from %s to %s to be allowed %t", test.from, test.to, test.allowed)
+		}
+	}
+}
+
+func TestGetCampaignStatus(t *testing.T) {
+	startDate := time.Date(2016, 9, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+	before := startDate.Add(-time.Hour)
+	during := startDate.Add(time.Hour)
+	after := endDate.Add(time.Hour)
+
+	tests := []struct {
+		status   string
+		goalMet  bool
+		now      time.Time
+		expected string
+	}{
+		{CAMPAIGN_SCHEDULED, false, before, CAMPAIGN_SCHEDULED},
+		{CAMPAIGN_SCHEDULED, false, during, CAMPAIGN_LIVE},
+		{CAMPAIGN_SCHEDULED, true, after, CAMPAIGN_SUCCEEDED},
+		{CAMPAIGN_LIVE, false, after, CAMPAIGN_FAILED},
+		{CAMPAIGN_DRAFT, false, during, CAMPAIGN_DRAFT},
+		{CAMPAIGN_CANCELLED, true, after, CAMPAIGN_CANCELLED},
+	}
+
+	//Only scheduled and live campaigns follow their dates
+	for _, test := range tests {
+		if status := GetCampaignStatus(test.status, startDate, endDate, test.goalMet, test.now); status != test.expected {
+			t.Errorf("Expected %s campaign at %s to be %s but was %s", test.status, test.now, test.expected, status)
+		}
+	}
+}
+
+func TestParseCampaignTime(t *testing.T) {
+	location := time.FixedZone("EDT", -4*60*60)
+	expected := time.Date(2016, 9, 4, 13, 0, 0, 0, time.UTC)
+
+	//Dates and local timestamps are in the campaign time zone
+	for value, expected := range map[string]time.Time{
+		"2016-09-04T09:00:00-04:00": expected,
+		"2016-09-04T13:00:00Z":      expected,
+		"2016-09-04T09:00:00":       expected,
+		"2016-09-04T09:00":          expected,
+		"2016-09-04":                expected.Add(-9 * time.Hour),
+	} {
+		timestamp, err := ParseCampaignTime(value, location)
+		if nil != err {
+			t.Errorf("Unable to parse %s: %s", value, err.Error())
+		} else if !timestamp.Equal(expected) {
+			t.Errorf("Expected %s to be %s but was %s", value, expected, timestamp.UTC())
+		}
+	}
+
+	for _, value := range []string{"2016-09-04 09:00", "09/04/2016", ""} {
+		if _, err := ParseCampaignTime(value, location); nil == err {
+			t.Errorf("Expected %s to be rejected", value)
+		}
+	}
+
+	//Without a time zone only timestamps with an offset are accepted
+	if _, err := ParseCampaignTime("2016-09-04T09:00:00", nil); nil == err {
+		t.Error("Expected local timestamp without a time zone to be rejected")
+	}
+}
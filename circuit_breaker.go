@@ -0,0 +1,116 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	CIRCUIT_CLOSED    = "closed"
+	CIRCUIT_OPEN      = "open"
+	CIRCUIT_HALF_OPEN = "half_open"
+)
+
+//Stops calling a processor after consecutive unavailable errors until the reset timeout passes
+type CircuitBreaker struct {
+	FailureThreshold int
+	ResetTimeout     time.Duration
+	lock             sync.Mutex
+	state            string
+	failures         int
+	openedAt         time.Time
+}
+
+//Snapshot of circuit breaker state
+type CircuitBreakerMetrics struct {
+	State    string    `json:"state"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"openedAt,omitempty"`
+}
+
+func NewCircuitBreaker(failureThreshold int, resetTimeout time.Duration) *CircuitBreaker {
+	circuitBreaker := new(CircuitBreaker)
+	circuitBreaker.FailureThreshold = failureThreshold
+	circuitBreaker.ResetTimeout = resetTimeout
+	circuitBreaker.state = CIRCUIT_CLOSED
+	return circuitBreaker
+}
+
+//Open breakers let a single trial call through once the reset timeout passes
+func (circuitBreaker *CircuitBreaker) Allow() bool {
+	circuitBreaker.lock.Lock()
+	defer circuitBreaker.lock.Unlock()
+
+	switch circuitBreaker.state {
+	case CIRCUIT_OPEN:
+		if time.Since(circuitBreaker.openedAt) < circuitBreaker.ResetTimeout {
+			return false
+		}
+		circuitBreaker.state = CIRCUIT_HALF_OPEN
+		return true
+	case CIRCUIT_HALF_OPEN:
+		return false
+	default:
+		return true
+	}
+}
+
+//Only unavailable and timed out calls count against the processor
+func (circuitBreaker *CircuitBreaker) RecordResult(err error) {
+	circuitBreaker.lock.Lock()
+	defer circuitBreaker.lock.Unlock()
+
+	if !IsServiceUnavailable(err) && !IsProcessorTimeout(err) {
+		circuitBreaker.state = CIRCUIT_CLOSED
+		circuitBreaker.failures = 0
+		return
+	}
+
+	circuitBreaker.failures++
+	if circuitBreaker.state == CIRCUIT_HALF_OPEN || circuitBreaker.failures >= circuitBreaker.FailureThreshold {
+		circuitBreaker.state = CIRCUIT_OPEN
+		circuitBreaker.openedAt = time.Now()
+	}
+}
+
+//Zero once calls are allowed again
+func (circuitBreaker *CircuitBreaker) GetRetryAfter() time.Duration {
+	circuitBreaker.lock.Lock()
+	defer circuitBreaker.lock.Unlock()
+
+	switch circuitBreaker.state {
+	case CIRCUIT_OPEN:
+		retryAfter := circuitBreaker.ResetTimeout - time.Since(circuitBreaker.openedAt)
+		if retryAfter < 0 {
+			return 0
+		}
+		return retryAfter
+	case CIRCUIT_HALF_OPEN:
+		return circuitBreaker.ResetTimeout
+	default:
+		return 0
+	}
+}
+
+func (circuitBreaker *CircuitBreaker) GetState() string {
+	circuitBreaker.lock.Lock()
+	defer circuitBreaker.lock.Unlock()
+	return circuitBreaker.state
+}
+
+func (circuitBreaker *CircuitBreaker) GetMetrics() CircuitBreakerMetrics {
+	circuitBreaker.lock.Lock()
+	defer circuitBreaker.lock.Unlock()
+	return CircuitBreakerMetrics{circuitBreaker.state, circuitBreaker.failures, circuitBreaker.openedAt}
+}
+
+func IsServiceUnavailable(err error) bool {
+	requestErr, ok := err.(RequestError)
+	return ok && requestErr.Type == ServiceUnavailableError
+}
+
+//Timed out calls may have been processed so they are neither retried nor failed over
+func IsProcessorTimeout(err error) bool {
+	requestErr, ok := err.(RequestError)
+	return ok && requestErr.Type == ProcessorTimeoutError
+}
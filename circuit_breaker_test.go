@@ -0,0 +1,109 @@
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var unavailableErr = RequestError{"Processor unavailable", ServiceUnavailableError}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	circuitBreaker := NewCircuitBreaker(2, time.Minute)
+
+	circuitBreaker.RecordResult(unavailableErr)
+	if state := circuitBreaker.GetState(); state != CIRCUIT_CLOSED {
+		t.Fatalf("Expected %s after one failure but was %s", CIRCUIT_CLOSED, state)
+	}
+	if !circuitBreaker.Allow() {
+		t.Fatal("Expected closed breaker to allow calls")
+	}
+
+	circuitBreaker.RecordResult(unavailableErr)
+	if state := circuitBreaker.GetState(); state != CIRCUIT_OPEN {
+		t.Fatalf("Expected %s after two failures but was %s", CIRCUIT_OPEN, state)
+	}
+	if circuitBreaker.Allow() {
+		t.Fatal("Expected open breaker to refuse calls")
+	}
+	if retryAfter := circuitBreaker.GetRetryAfter(); retryAfter <= 0 || retryAfter > time.Minute {
+		t.Fatalf("Expected retry after within reset timeout but was %s", retryAfter)
+	}
+}
+
+func TestCircuitBreakerCountsTimeouts(t *testing.T) {
+	circuitBreaker := NewCircuitBreaker(1, time.Minute)
+
+	circuitBreaker.RecordResult(RequestError{"Processor timed out", ProcessorTimeoutError})
+	if state := circuitBreaker.GetState(); state != CIRCUIT_OPEN {
+		t.Fatalf("Expected timeout to open breaker but was %s", state)
+	}
+}
+
+func TestCircuitBreakerIgnoresOtherErrors(t *testing.T) {
+	circuitBreaker := NewCircuitBreaker(2, time.Minute)
+
+	circuitBreaker.RecordResult(unavailableErr)
+	circuitBreaker.RecordResult(RequestError{"Card declined", BadRequestError})
+	circuitBreaker.RecordResult(errors.New("Unexpected error"))
+	circuitBreaker.RecordResult(unavailableErr)
+
+	metrics := circuitBreaker.GetMetrics()
+	if metrics.State != CIRCUIT_CLOSED || metrics.Failures != 1 {
+		t.Fatalf("Expected other errors to reset failures but was %+v", metrics)
+	}
+}
+
+func TestCircuitBreakerHalfOpenAllowsSingleTrial(t *testing.T) {
+	circuitBreaker := NewCircuitBreaker(1, 0)
+
+	circuitBreaker.RecordResult(unavailableErr)
+	if !circuitBreaker.Allow() {
+		t.Fatal("Expected trial call once reset timeout passed")
+	}
+	if state := circuitBreaker.GetState(); state != CIRCUIT_HALF_OPEN {
+		t.Fatalf("Expected %s after reset timeout but was %s", CIRCUIT_HALF_OPEN, state)
+	}
+	if circuitBreaker.Allow() {
+		t.Fatal("Expected half open breaker to refuse calls while trial is running")
+	}
+	if retryAfter := circuitBreaker.GetRetryAfter(); retryAfter != circuitBreaker.ResetTimeout {
+		t.Fatalf("Expected half open retry after of %s but was %s", circuitBreaker.ResetTimeout, retryAfter)
+	}
+}
+
+func TestCircuitBreakerHalfOpenCloses(t *testing.T) {
+	circuitBreaker := NewCircuitBreaker(1, 0)
+
+	circuitBreaker.RecordResult(unavailableErr)
+	circuitBreaker.Allow()
+	circuitBreaker.RecordResult(nil)
+
+	metrics := circuitBreaker.GetMetrics()
+	if metrics.State != CIRCUIT_CLOSED || metrics.Failures != 0 {
+		t.Fatalf("Expected successful trial to close breaker but was %+v", metrics)
+	}
+	if !circuitBreaker.Allow() {
+		t.Fatal("Expected closed breaker to allow calls")
+	}
+}
+
+func TestCircuitBreakerHalfOpenReopens(t *testing.T) {
+	circuitBreaker := NewCircuitBreaker(3, time.Minute)
+
+	for iter := 0; iter < 3; iter++ {
+		circuitBreaker.RecordResult(unavailableErr)
+	}
+	circuitBreaker.ResetTimeout = 0
+	circuitBreaker.Allow()
+	circuitBreaker.ResetTimeout = time.Minute
+
+	//A single failed trial reopens the breaker regardless of the threshold
+	circuitBreaker.RecordResult(unavailableErr)
+	if state := circuitBreaker.GetState(); state != CIRCUIT_OPEN {
+		t.Fatalf("Expected failed trial to reopen breaker but was %s", state)
+	}
+	if circuitBreaker.Allow() {
+		t.Fatal("Expected reopened breaker to refuse calls until reset timeout passes again")
+	}
+}
@@ -22,7 +22,7 @@ type Advertisement struct {
 	Type              string `json:"type"`
 	CampaignId        int64  `json:"campaignId"`
 	CampaignName      string `json:"campaignName"`
-	PerkId            int64  `json:"perkId"`
+	PerkId            int64  `json:"perkId,omitempty"`
 	PaymentOrPledgeId string `json:"paymentOrPledgeId"`
 	AdvertiseName     string `json:"advertiseName"`
 }
@@ -72,6 +72,18 @@ func (ads *Advertisements) AddAdvertisementFromPayment(campaignName string, paym
 	}
 }
 
+func (ads *Advertisements) RemoveAdvertisementFromPayment(campaignName string, payment *Payment) {
+	ads.lock.Lock()
+	defer ads.lock.Unlock()
+	advertisements := ads.nameValues[campaignName]
+	for index, advertisement := range advertisements {
+		if advertisement.Type == "payment" && advertisement.PaymentOrPledgeId == payment.Id {
+			ads.nameValues[campaignName] = append(advertisements[:index], advertisements[index+1:]...)
+			break
+		}
+	}
+}
+
 func (ads *Advertisements) AddAdvertisementFromPledge(campaignName string, pledge *Pledge) {
 	if pledge.Advertise {
 		var advertisement Advertisement
@@ -122,8 +134,10 @@ func getAdvertisementsFromDb(args ...string) ([]*Advertisement, error) {
 	var advertisements []*Advertisement
 	for rows.Next() {
 		var advertisement Advertisement
-		err = rows.Scan(&advertisement.Type, &advertisement.CampaignId, &advertisement.CampaignName, &advertisement.PerkId, &advertisement.PaymentOrPledgeId, &advertisement.AdvertiseName)
+		var perkId sql.NullInt64
+		err = rows.Scan(&advertisement.Type, &advertisement.CampaignId, &advertisement.CampaignName, &perkId, &advertisement.PaymentOrPledgeId, &advertisement.AdvertiseName)
 		if nil == err {
+			advertisement.PerkId = perkId.Int64
 			advertisements = append(advertisements, &advertisement)
 		} else {
 			break
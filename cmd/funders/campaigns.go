@@ -13,18 +13,28 @@ import (
 )
 
 const (
-	GET_ALL_CAMPAIGNS_QUERY = "SELECT id, name, description, goal, currency, amt_raised, num_backers, amt_pledged, num_pledgers, start_date, end_date, flexible FROM funders.campaign_backers WHERE active = TRUE"
-	GET_CAMPAIGN_QUERY      = "SELECT id, name, description, goal, currency, amt_raised, num_backers, amt_pledged, num_pledgers, start_date, end_date, flexible FROM funders.campaign_backers WHERE active = TRUE AND name = $1"
+	GET_ALL_CAMPAIGNS_QUERY = "SELECT id, name, description, goal, currency, amt_raised, num_backers, amt_pledged, num_pledgers, start_date, end_date, time_zone, flexible, status FROM funders.campaign_backers WHERE active = TRUE"
+	GET_CAMPAIGN_QUERY      = "SELECT id, name, description, goal, currency, amt_raised, num_backers, amt_pledged, num_pledgers, start_date, end_date, time_zone, flexible, status FROM funders.campaign_backers WHERE active = TRUE AND name = $1"
 	CAMPAIGN_URL            = "/campaigns"
 )
 
 type Campaign common.Campaign
 
+//Stretch goal with whether the amount raised has reached it
+type StretchGoalState struct {
+	common.StretchGoal
+	Reached bool `json:"reached"`
+}
+
 func (campaign *Campaign) IncrementAmtRaised(amount float64) float64 {
 	campaign.Lock.Lock()
-	defer campaign.Lock.Unlock()
+	previousAmtRaised := campaign.AmtRaised
 	campaign.AmtRaised += amount
-	return campaign.AmtRaised
+	amtRaised := campaign.AmtRaised
+	campaign.Lock.Unlock()
+
+	emitMilestones(campaign, previousAmtRaised, amtRaised)
+	return amtRaised
 }
 
 func (campaign *Campaign) IncrementNumBackers(amount int64) int64 {
@@ -48,6 +58,24 @@ func (campaign *Campaign) IncrementNumPledgers(amount int64) int64 {
 	return campaign.NumPledgers
 }
 
+func (campaign *Campaign) GetAmtRaised() float64 {
+	campaign.Lock.RLock()
+	defer campaign.Lock.RUnlock()
+	return campaign.AmtRaised
+}
+
+//Perks unlocked by a stretch goal can not be bought or pledged until it is reached
+func (campaign *Campaign) IsPerkLocked(perkId int64) bool {
+	amtRaised := campaign.GetAmtRaised()
+	for _, stretchGoal := range campaign.StretchGoals {
+		if stretchGoal.PerkId == perkId && amtRaised < stretchGoal.Amount {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (campaign *Campaign) HasStarted() bool {
 	return time.Now().After(campaign.StartDate)
 }
@@ -56,6 +84,25 @@ func (campaign *Campaign) HasEnded() bool {
 	return time.Now().After(campaign.EndDate)
 }
 
+func (campaign *Campaign) GetStatus() string {
+	return common.GetCampaignStatus(campaign.Status, campaign.StartDate, campaign.EndDate, campaign.GetAmtRaised() >= campaign.Goal, time.Now())
+}
+
+//Drafts are hidden unless a valid preview token is given
+func (campaign *Campaign) IsVisible(req *http.Request) bool {
+	if campaign.GetStatus() != common.CAMPAIGN_DRAFT {
+		return true
+	}
+
+	return common.VerifyPreviewToken(campaignPreviewSecret, campaign.Name, req.URL.Query().Get("preview"), time.Now())
+}
+
+//Drafts and cancelled campaigns are left out of the sitemap
+func (campaign *Campaign) IsListed() bool {
+	status := campaign.GetStatus()
+	return status != common.CAMPAIGN_DRAFT && status != common.CAMPAIGN_CANCELLED
+}
+
 func (campaign *Campaign) MarshalJSON() ([]byte, error) {
 	campaign.Lock.RLock()
 	amtRaised := campaign.AmtRaised
@@ -64,19 +111,42 @@ func (campaign *Campaign) MarshalJSON() ([]byte, error) {
 	numPledgers := campaign.NumPledgers
 	campaign.Lock.RUnlock()
 
+	now := time.Now()
+	status := common.GetCampaignStatus(campaign.Status, campaign.StartDate, campaign.EndDate, amtRaised >= campaign.Goal, now)
+
+	//Seconds until the campaign closes, zero once it has ended or been cancelled
+	var secondsRemaining int64
+	if status == common.CAMPAIGN_SCHEDULED || status == common.CAMPAIGN_LIVE || status == common.CAMPAIGN_DRAFT {
+		secondsRemaining = int64(campaign.EndDate.Sub(now) / time.Second)
+		if secondsRemaining < 0 {
+			secondsRemaining = 0
+		}
+	}
+
+	stretchGoals := make([]StretchGoalState, 0, len(campaign.StretchGoals))
+	for _, stretchGoal := range campaign.StretchGoals {
+		stretchGoals = append(stretchGoals, StretchGoalState{stretchGoal, amtRaised >= stretchGoal.Amount})
+	}
+
 	type MyCampaign Campaign
 	return json.Marshal(&struct {
-		AmtRaised   float64 `json:"amtRaised"`
-		NumBackers  int64   `json:"numBackers"`
-		AmtPledged  float64 `json:"amtPledged"`
-		NumPledgers int64   `json:"numPledgers"`
+		AmtRaised        float64            `json:"amtRaised"`
+		NumBackers       int64              `json:"numBackers"`
+		AmtPledged       float64            `json:"amtPledged"`
+		NumPledgers      int64              `json:"numPledgers"`
+		StretchGoals     []StretchGoalState `json:"stretchGoals"`
+		Status           string             `json:"status"`
+		SecondsRemaining int64              `json:"secondsRemaining"`
 		*MyCampaign
 	}{
-		AmtRaised:   amtRaised,
-		NumBackers:  numBackers,
-		AmtPledged:  amtPledged,
-		NumPledgers: numPledgers,
-		MyCampaign:  (*MyCampaign)(campaign),
+		AmtRaised:        amtRaised,
+		NumBackers:       numBackers,
+		AmtPledged:       amtPledged,
+		NumPledgers:      numPledgers,
+		StretchGoals:     stretchGoals,
+		Status:           status,
+		SecondsRemaining: secondsRemaining,
+		MyCampaign:       (*MyCampaign)(campaign),
 	})
 }
 
@@ -117,6 +187,16 @@ func (cm *Campaigns) GetCampaign(name string) (*Campaign, bool) {
 	return val, exists
 }
 
+func (cm *Campaigns) GetCampaigns() []*Campaign {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	campaigns := make([]*Campaign, 0, len(cm.idValues))
+	for _, campaign := range cm.idValues {
+		campaigns = append(campaigns, campaign)
+	}
+	return campaigns
+}
+
 func (cm *Campaigns) GetCampaignById(id int64) (*Campaign, bool) {
 	cm.lock.RLock()
 	defer cm.lock.RUnlock()
@@ -126,7 +206,25 @@ func (cm *Campaigns) GetCampaignById(id int64) (*Campaign, bool) {
 
 var campaigns = NewCampaigns()
 
+//Start and end dates are returned in the campaign time zone
+func setCampaignTimeZone(campaign *Campaign) {
+	location, err := time.LoadLocation(campaign.TimeZone)
+	if nil != err {
+		log.Print(err)
+		log.Printf("Invalid time zone %s for campaign %s. Defaulting to UTC.", campaign.TimeZone, campaign.Name)
+		location = time.UTC
+	}
+
+	campaign.StartDate = campaign.StartDate.In(location)
+	campaign.EndDate = campaign.EndDate.In(location)
+}
+
 func getCampaignsFromDb() ([]*Campaign, error) {
+	stretchGoals, err := getAllStretchGoalsFromDb()
+	if nil != err {
+		return nil, err
+	}
+
 	rows, err := db.Query(GET_ALL_CAMPAIGNS_QUERY)
 	if nil != err {
 		return nil, err
@@ -137,8 +235,10 @@ func getCampaignsFromDb() ([]*Campaign, error) {
 	var campaigns []*Campaign
 	for rows.Next() {
 		var campaign Campaign
-		err = rows.Scan(&campaign.Id, &campaign.Name, &campaign.Description, &campaign.Goal, &campaign.Currency, &campaign.AmtRaised, &campaign.NumBackers, &campaign.AmtPledged, &campaign.NumPledgers, &campaign.StartDate, &campaign.EndDate, &campaign.Flexible)
+		err = rows.Scan(&campaign.Id, &campaign.Name, &campaign.Description, &campaign.Goal, &campaign.Currency, &campaign.AmtRaised, &campaign.NumBackers, &campaign.AmtPledged, &campaign.NumPledgers, &campaign.StartDate, &campaign.EndDate, &campaign.TimeZone, &campaign.Flexible, &campaign.Status)
 		if nil == err {
+			setCampaignTimeZone(&campaign)
+			campaign.StretchGoals = stretchGoals[campaign.Id]
 			campaigns = append(campaigns, &campaign)
 		} else {
 			break
@@ -154,7 +254,11 @@ func getCampaignsFromDb() ([]*Campaign, error) {
 
 func getCampaignFromDb(name string) (Campaign, error) {
 	var campaign Campaign
-	err := db.QueryRow(GET_CAMPAIGN_QUERY, name).Scan(&campaign.Id, &campaign.Name, &campaign.Description, &campaign.Goal, &campaign.Currency, &campaign.AmtRaised, &campaign.NumBackers, &campaign.AmtPledged, &campaign.NumPledgers, &campaign.StartDate, &campaign.EndDate, &campaign.Flexible)
+	err := db.QueryRow(GET_CAMPAIGN_QUERY, name).Scan(&campaign.Id, &campaign.Name, &campaign.Description, &campaign.Goal, &campaign.Currency, &campaign.AmtRaised, &campaign.NumBackers, &campaign.AmtPledged, &campaign.NumPledgers, &campaign.StartDate, &campaign.EndDate, &campaign.TimeZone, &campaign.Flexible, &campaign.Status)
+	if nil == err {
+		setCampaignTimeZone(&campaign)
+		campaign.StretchGoals, err = getStretchGoalsFromDb(campaign.Id)
+	}
 	return campaign, err
 }
 
@@ -191,11 +295,13 @@ func getCampaignHandler(res http.ResponseWriter, req *http.Request) (int, string
 	} else {
 		campaign, err := getCampaign(campaignName)
 
-		if sql.ErrNoRows == err {
+		if sql.ErrNoRows == err || (nil == err && !campaign.IsVisible(req)) {
 			responseStr := fmt.Sprintf("%s not found", campaignName)
 			response = common.Response{Code: http.StatusNotFound, Message: responseStr}
 			log.Print(responseStr)
-			log.Print(err)
+			if nil != err {
+				log.Print(err)
+			}
 		} else if nil != err {
 			responseStr := "Could not get campaign due to server error"
 			response = common.Response{Code: http.StatusInternalServerError, Message: responseStr}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bitbucket.org/padium/funders"
+	"context"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -14,31 +16,36 @@ import (
 	"github.com/martini-contrib/secure"
 	"github.com/satori/go.uuid"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 const (
-	CONTENT_TYPE_HEADER = "Content-Type"
-	LOCATION_HEADER     = "Location"
-	ORIGIN_HEADER       = "Origin"
-	JSON_CONTENT_TYPE   = "application/json"
-	XML_CONTENT_TYPE    = "application/xml"
-	TEXT_CONTENT_TYPE   = "text/plain"
-	GET_METHOD          = "GET"
-	HEAD_METHOD         = "HEAD"
-	POST_METHOD         = "POST"
-	PUT_METHOD          = "PUT"
-	PATCH_METHOD        = "PATCH"
-	ROBOTS_TXT_URL      = "/robots.txt"
-	SITEMAP_XML_URL     = "/sitemap.xml"
-	FAVICON_ICO_URL     = "/favicon.ico"
+	CONTENT_TYPE_HEADER  = "Content-Type"
+	AUTHORIZATION_HEADER = "Authorization"
+	LOCATION_HEADER      = "Location"
+	RETRY_AFTER_HEADER   = "Retry-After"
+	ORIGIN_HEADER        = "Origin"
+	JSON_CONTENT_TYPE    = "application/json"
+	XML_CONTENT_TYPE     = "application/xml"
+	TEXT_CONTENT_TYPE    = "text/plain"
+	GET_METHOD           = "GET"
+	HEAD_METHOD          = "HEAD"
+	POST_METHOD          = "POST"
+	PUT_METHOD           = "PUT"
+	PATCH_METHOD         = "PATCH"
+	ROBOTS_TXT_URL       = "/robots.txt"
+	SITEMAP_XML_URL      = "/sitemap.xml"
+	FAVICON_ICO_URL      = "/favicon.ico"
 )
 
 var db *sql.DB
@@ -49,6 +56,11 @@ var gzipCompressionLevel int
 var robotsTxtResponse bool
 var sitemapXmlResponse bool
 var faviconIcoResponse bool
+var adminToken string
+var campaignPreviewSecret string
+var minContributionAmount float64
+var maxContributionAmount float64
+var httpServer = new(http.Server)
 
 func validateSizeLimit(field string, fieldName string, sizeLimit int, errors binding.Errors) binding.Errors {
 	if len(field) > sizeLimit {
@@ -58,6 +70,43 @@ func validateSizeLimit(field string, fieldName string, sizeLimit int, errors bin
 	return errors
 }
 
+//Amounts default to the perk price and can be raised above it. Donations without a perk must give an amount.
+func validateContributionAmount(amount float64, currency string, campaign *Campaign, perk *Perk, errors binding.Errors) (float64, string, binding.Errors) {
+	if nil == perk {
+		return validateContributionPrice(amount, currency, campaign.Currency, 0, errors)
+	}
+
+	return validateContributionPrice(amount, currency, perk.Currency, perk.Price, errors)
+}
+
+//Contributions pay at least the price of the perks bought. Zero price for donations
+func validateContributionPrice(amount float64, currency string, contributionCurrency string, price float64, errors binding.Errors) (float64, string, binding.Errors) {
+	if len(currency) > 0 && !strings.EqualFold(currency, contributionCurrency) {
+		message := fmt.Sprintf("Currency %s does not match campaign currency %s", currency, contributionCurrency)
+		errors = addError(errors, []string{"currency"}, binding.TypeError, message)
+	}
+
+	amount = math.Floor(amount*100+0.5) / 100
+	if 0 == amount && price > 0 {
+		amount = price
+	}
+
+	if price > 0 && amount < price {
+		message := fmt.Sprintf("Amount %.2f is less than perk price %.2f", amount, price)
+		errors = addError(errors, []string{"amount"}, binding.TypeError, message)
+	} else if 0 == price && amount <= 0 {
+		errors = addError(errors, []string{"amount", "perkId"}, binding.RequiredError, "Amount is required without a perk")
+	} else if (0 == price || amount != price) && amount < minContributionAmount {
+		message := fmt.Sprintf("Amount %.2f is less than minimum amount %.2f", amount, minContributionAmount)
+		errors = addError(errors, []string{"amount"}, binding.TypeError, message)
+	} else if maxContributionAmount > 0 && amount > maxContributionAmount {
+		message := fmt.Sprintf("Amount %.2f is more than maximum amount %.2f", amount, maxContributionAmount)
+		errors = addError(errors, []string{"amount"}, binding.TypeError, message)
+	}
+
+	return amount, contributionCurrency, errors
+}
+
 func addError(errors binding.Errors, fieldNames []string, classification string, message string) binding.Errors {
 	errors = append(errors, binding.Error{
 		FieldNames:     fieldNames,
@@ -100,11 +149,11 @@ func errorHandler(errors binding.Errors, res http.ResponseWriter) {
 			res.WriteHeader(http.StatusBadRequest)
 			response = common.Response{Code: http.StatusBadRequest, Message: errors[0].Error()}
 		} else if errors.Has(common.BOT_ERROR) {
-			if botDetection.PlayCoy && !paymentBatchProcessor.Running {
+			if botDetection.PlayCoy && (nil == paymentBatchProcessor || !paymentBatchProcessor.IsRunning()) {
 				res.WriteHeader(http.StatusCreated)
 				response = common.Response{Code: http.StatusCreated, Message: "Successfully added payment", Id: uuid.NewV4().String()}
 				log.Printf("Robot detected: %s. Playing coy.", errors[0].Error())
-			} else if botDetection.PlayCoy && paymentBatchProcessor.Running {
+			} else if botDetection.PlayCoy && paymentBatchProcessor.IsRunning() {
 				res.WriteHeader(http.StatusAccepted)
 				response = common.Response{Code: http.StatusAccepted, Message: "Successfully scheduled payment"}
 				log.Printf("Robot detected: %s. Playing coy.", errors[0].Error())
@@ -128,6 +177,38 @@ func errorHandler(errors binding.Errors, res http.ResponseWriter) {
 	}
 }
 
+func adminHandler(res http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get(AUTHORIZATION_HEADER), "Bearer ")
+	if len(adminToken) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		req.Close = true
+		res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+		res.WriteHeader(http.StatusUnauthorized)
+		response := common.Response{Code: http.StatusUnauthorized, Message: "Admin authorization required"}
+		log.Printf("Unauthorized admin request %s", req.URL)
+		jsonStr, _ := json.Marshal(response)
+		res.Write(jsonStr)
+	}
+}
+
+func getStatusCode(err error) int {
+	if requestErr, ok := err.(common.RequestError); ok {
+		switch requestErr.Type {
+		case common.BadRequestError:
+			return http.StatusBadRequest
+		case common.NotFoundError:
+			return http.StatusNotFound
+		case common.ServiceUnavailableError:
+			return http.StatusServiceUnavailable
+		case common.ServiceNotImplementedError:
+			return http.StatusNotImplemented
+		case common.ProcessorTimeoutError:
+			return http.StatusGatewayTimeout
+		}
+	}
+
+	return http.StatusInternalServerError
+}
+
 func notFoundHandler(res http.ResponseWriter, req *http.Request) (int, string) {
 	req.Close = true
 	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
@@ -141,7 +222,7 @@ func notFoundHandler(res http.ResponseWriter, req *http.Request) (int, string) {
 func runHttpServer() {
 	martini_ := martini.Classic()
 
-	allowHeaders := []string{ORIGIN_HEADER}
+	allowHeaders := []string{ORIGIN_HEADER, IDEMPOTENCY_KEY_HEADER}
 	if botDetection.FieldLocation == common.Header {
 		allowHeaders = append(allowHeaders, botDetection.FieldName)
 	}
@@ -200,6 +281,22 @@ func runHttpServer() {
 	martini_.Put(PAYMENTS_URL, binding.Form(UpdatePayment{}), errorHandler, updatePaymentHandler)
 	martini_.Patch(PAYMENTS_URL, binding.Form(UpdatePayment{}), errorHandler, updatePaymentHandler)
 
+	//Refund payments
+	if len(adminToken) > 0 {
+		martini_.Post(REFUNDS_URL, adminHandler, binding.Form(Refund{}), errorHandler, refundPaymentHandler)
+	}
+
+	//Record and confirm offline payments
+	if len(adminToken) > 0 {
+		martini_.Post(MANUAL_PAYMENTS_URL, adminHandler, binding.Form(ManualPayment{}), errorHandler, recordManualPaymentHandler)
+		martini_.Post(CONFIRM_PAYMENT_URL, adminHandler, confirmManualPaymentHandler)
+	}
+
+	//Batch processor metrics
+	if len(adminToken) > 0 {
+		martini_.Get(METRICS_URL, adminHandler, getMetricsHandler)
+	}
+
 	//Accept pledges
 	martini_.Post(PLEDGES_URL, binding.Form(Pledge{}), errorHandler, makePledgeHandler)
 
@@ -207,6 +304,20 @@ func runHttpServer() {
 	martini_.Get(ADVERTISEMENTS_URL, getAdvertisementHandler, errorHandler)
 	martini_.Head(ADVERTISEMENTS_URL, getAdvertisementHandler, errorHandler)
 
+	//Payment processor webhooks
+	if len(stripeProcessor.WebhookSecret) > 0 {
+		martini_.Post(STRIPE_WEBHOOKS_URL, newStripeWebhookHandler(stripeProcessor), errorHandler)
+	}
+	if nil != stripeSecondaryProcessor && len(stripeSecondaryProcessor.WebhookSecret) > 0 {
+		martini_.Post(STRIPE_SECONDARY_WEBHOOKS_URL, newStripeWebhookHandler(stripeSecondaryProcessor), errorHandler)
+	}
+	if len(paypalProcessor.WebhookId) > 0 {
+		martini_.Post(PAYPAL_WEBHOOKS_URL, paypalWebhookHandler, errorHandler)
+	}
+	if nil != btcpayProcessor && len(btcpayProcessor.WebhookSecret) > 0 {
+		martini_.Post(BTCPAY_WEBHOOKS_URL, btcpayWebhookHandler, errorHandler)
+	}
+
 	//robots.txt
 	if robotsTxtResponse {
 		getRobotsTxt := func(res http.ResponseWriter, req *http.Request) (int, string) {
@@ -229,7 +340,10 @@ func runHttpServer() {
 
 			campaigns.lock.RLock()
 			defer campaigns.lock.RUnlock()
-			for key, _ := range campaigns.nameValues {
+			for key, campaign := range campaigns.nameValues {
+				if !campaign.IsListed() {
+					continue
+				}
 				url := fmt.Sprintf("%s%s?name=%s", hostname, CAMPAIGN_URL, key)
 				urlSet.AddUrl(common.Url{Location: url, LastModification: time.Now(), ChangeFrequency: common.Always, Priority: 1.0})
 			}
@@ -237,6 +351,9 @@ func runHttpServer() {
 			perks.lock.RLock()
 			defer perks.lock.RUnlock()
 			for key, _ := range perks.nameValues {
+				if campaign, exists := campaigns.nameValues[key]; exists && !campaign.IsListed() {
+					continue
+				}
 				url := fmt.Sprintf("%s%s?campaign_name=%s", hostname, PERKS_URL, key)
 				urlSet.AddUrl(common.Url{Location: url, LastModification: time.Now(), ChangeFrequency: common.Always, Priority: 0.8})
 			}
@@ -244,6 +361,9 @@ func runHttpServer() {
 			advertisements.lock.RLock()
 			defer advertisements.lock.RUnlock()
 			for key, _ := range advertisements.nameValues {
+				if campaign, exists := campaigns.nameValues[key]; exists && !campaign.IsListed() {
+					continue
+				}
 				url := fmt.Sprintf("%s%s?campaign_name=%s", hostname, ADVERTISEMENTS_URL, key)
 				urlSet.AddUrl(common.Url{Location: url, LastModification: time.Now(), ChangeFrequency: common.Always, Priority: 0.3})
 			}
@@ -267,10 +387,85 @@ func runHttpServer() {
 	}
 
 	martini_.NotFound(notFoundHandler)
-	martini_.Run()
+
+	httpServer.Handler = martini_
+	err = httpServer.ListenAndServe()
+	if nil != err && http.ErrServerClosed != err {
+		log.Fatal(err)
+	}
+}
+
+func waitWithContext(ctx context.Context, waitGroup *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Stops accepting requests, waits for in-flight requests and drains the batch processors
+func shutdown(shutdownTimeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := httpServer.Shutdown(ctx)
+	if nil != err {
+		log.Print(err)
+		log.Print("HTTP server did not shut down cleanly")
+	} else {
+		log.Print("HTTP server shut down")
+	}
+
+	if settlementInterval > 0 {
+		err = stopSettlementJob(ctx)
+		if nil != err {
+			log.Print(err)
+			log.Print("Settlement job did not shut down cleanly")
+		} else {
+			log.Print("Settlement job shut down")
+		}
+	}
+
+	if sweeperInterval > 0 {
+		err = stopSweeperJob(ctx)
+		if nil != err {
+			log.Print(err)
+			log.Print("Sweeper job did not shut down cleanly")
+		} else {
+			log.Print("Sweeper job shut down")
+		}
+	}
+
+	for _, batchProcessor := range batchProcessors {
+		queue := batchProcessor.GetMetrics().Queue
+		err = batchProcessor.Shutdown(ctx)
+		if nil != err {
+			log.Print(err)
+			log.Printf("Batch processor for queue %s did not drain before shutdown", queue)
+		} else {
+			log.Printf("Batch processor for queue %s shut down", queue)
+		}
+	}
 }
 
 func main() {
+	//Structured logging also formats output from the log package
+	logFormat := common.GetenvWithDefault("LOG_FORMAT", common.LOG_FORMAT_LOGFMT)
+	logLevelStr := common.GetenvWithDefault("LOG_LEVEL", "info")
+	logLevel, logLevelErr := common.ParseLogLevel(logLevelStr)
+	slog.SetDefault(common.NewLogger(os.Stderr, logFormat, logLevel))
+	if nil != logLevelErr {
+		log.Printf("Error converting input for field LOG_LEVEL with value %s. Defaulting to info.", logLevelStr)
+		log.Print(logLevelErr)
+	}
+
 	dbUrl := os.Getenv("DATABASE_URL")
 	dbUser := os.Getenv("DB_USER")
 	dbPassword := os.Getenv("DB_PASSWORD")
@@ -298,7 +493,8 @@ func main() {
 
 	dbCredentials := common.DatabaseCredentials{common.DB_DRIVER, dbUrl, dbUser, dbPassword, dbName, dbHost, dbPort, dbMaxOpenConns, dbMaxIdleConns}
 	if !dbCredentials.IsValid() {
-		log.Fatalf("Database credentials NOT set correctly. %#v", dbCredentials)
+		slog.Error("Database credentials NOT set correctly", "credentials", dbCredentials)
+		os.Exit(1)
 	}
 
 	//Database connection
@@ -316,37 +512,241 @@ func main() {
 		log.Print(err)
 	}
 
+	//Get bounds on custom contribution amounts and donations
+	minContributionAmountStr := common.GetenvWithDefault("MIN_CONTRIBUTION_AMOUNT", "1")
+	minContributionAmount, err = strconv.ParseFloat(minContributionAmountStr, 64)
+	if nil != err || minContributionAmount < 0 {
+		minContributionAmount = 1
+		log.Printf("Error setting minimum contribution amount from value: %s. Default to %.2f", minContributionAmountStr, minContributionAmount)
+	}
+
+	maxContributionAmountStr := common.GetenvWithDefault("MAX_CONTRIBUTION_AMOUNT", "0")
+	maxContributionAmount, err = strconv.ParseFloat(maxContributionAmountStr, 64)
+	if nil != err || maxContributionAmount < 0 {
+		maxContributionAmount = 0
+		log.Printf("Error setting maximum contribution amount from value: %s. Default to no maximum", maxContributionAmountStr)
+	}
+
+	log.Printf("Contribution amounts are between %.2f and %.2f (0 is no maximum)", minContributionAmount, maxContributionAmount)
+
+	//Get how long perks are reserved for pending payments
+	perkReservationTtlStr := common.GetenvWithDefault("PERK_RESERVATION_TTL", "30")
+	perkReservationTtlMinutes, err := strconv.Atoi(perkReservationTtlStr)
+	if nil != err || perkReservationTtlMinutes <= 0 {
+		perkReservationTtlMinutes = 30
+		log.Printf("Error converting input for field PERK_RESERVATION_TTL. Defaulting to 30.")
+		log.Print(err)
+	}
+	perkReservationTtl = time.Duration(perkReservationTtlMinutes) * time.Minute
+	log.Printf("Perks reserved for pending payments for %d minutes", perkReservationTtlMinutes)
+
+	//Get admin token for administrative endpoints
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	if len(adminToken) > 0 {
+		log.Print("Admin token is set")
+	} else {
+		log.Print("Admin token is NOT set. Administrative endpoints disabled")
+	}
+
+	//Signs preview tokens for draft campaigns
+	campaignPreviewSecret = os.Getenv("CAMPAIGN_PREVIEW_SECRET")
+	if len(campaignPreviewSecret) > 0 {
+		log.Print("Campaign preview secret is set")
+	} else {
+		log.Print("Campaign preview secret is NOT set. Draft campaign previews disabled")
+	}
+
 	//Get access key for stripe
-	stripeKey = os.Getenv("STRIPE_KEY")
+	stripeKey := os.Getenv("STRIPE_KEY")
 	if len(stripeKey) > 0 {
-		log.Printf("Stripe key is set to: %s", stripeKey)
+		log.Print("Stripe key is set")
 	} else {
 		log.Fatal("Stripe key is NOT set")
 	}
 
+	//Get access key for secondary stripe account used by payment routes
+	stripeSecondaryKey := os.Getenv("STRIPE_SECONDARY_KEY")
+	if len(stripeSecondaryKey) > 0 {
+		log.Print("Secondary stripe key is set")
+	} else {
+		log.Print("Secondary stripe key is NOT set. Secondary stripe account disabled")
+	}
+
+	//Get webhook signing secret for stripe
+	stripeWebhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if len(stripeWebhookSecret) > 0 {
+		log.Print("Stripe webhook secret is set")
+	} else {
+		log.Print("Stripe webhook secret is NOT set. Stripe webhooks disabled")
+	}
+
+	//Get webhook signing secret for the secondary stripe account
+	stripeSecondaryWebhookSecret := os.Getenv("STRIPE_SECONDARY_WEBHOOK_SECRET")
+	if len(stripeSecondaryKey) > 0 && len(stripeSecondaryWebhookSecret) > 0 {
+		log.Print("Secondary stripe webhook secret is set")
+	} else if len(stripeSecondaryKey) > 0 {
+		log.Print("Secondary stripe webhook secret is NOT set. Secondary stripe webhooks disabled")
+	}
+
+	stripeWebhookToleranceStr := common.GetenvWithDefault("STRIPE_WEBHOOK_TOLERANCE", "300")
+	stripeWebhookTolerance, err := strconv.Atoi(stripeWebhookToleranceStr)
+	if nil != err {
+		stripeWebhookTolerance = 300
+		log.Printf("Error setting stripe webhook tolerance from value: %s. Default to %d", stripeWebhookToleranceStr, stripeWebhookTolerance)
+		log.Print(err)
+	}
+	log.Printf("Stripe webhook tolerance is %d seconds", stripeWebhookTolerance)
+
+	stripeLegacyCardNumbersStr := common.GetenvWithDefault("STRIPE_LEGACY_CARD_NUMBERS", "false")
+	stripeLegacyCardNumbers, err := strconv.ParseBool(stripeLegacyCardNumbersStr)
+	if nil != err {
+		stripeLegacyCardNumbers = false
+		log.Printf("Error converting boolean input for field %s with value %s. Defaulting to false.", "STRIPE_LEGACY_CARD_NUMBERS", stripeLegacyCardNumbersStr)
+		log.Print(err)
+	}
+	if stripeLegacyCardNumbers {
+		log.Print("Credit card account numbers accepted and sent to stripe")
+	} else {
+		log.Print("Only stripe tokens and payment methods accepted for credit cards")
+	}
+
 	//Get client and secret ids for paypal
 	paypalClientId := os.Getenv("PAYPAL_CLIENT_ID")
 	paypalSecretId := os.Getenv("PAYPAL_SECRET_ID")
 	if len(paypalClientId) > 0 && len(paypalSecretId) > 0 {
-		log.Printf("Paypal client id is %s, secret id is %s", paypalClientId, paypalSecretId)
+		slog.Info("Paypal client and secret ids are set", "clientId", paypalClientId)
 	} else {
 		log.Fatal("Both PAYPAL_CLIENT_ID and PAYPAL_SECRET_ID need to be set")
 	}
 
-	paypalClient, err = paypalsdk.NewClient(paypalClientId, paypalSecretId, paypalsdk.APIBaseSandBox)
+	//Get environment for paypal
+	paypalMode := common.GetenvWithDefault("PAYPAL_MODE", common.PAYPAL_MODE_SANDBOX)
+	paypalApiBase, err := common.GetPaypalApiBase(paypalMode, os.Getenv("PAYPAL_API_BASE"))
+	if nil != err {
+		log.Print(err)
+		log.Fatal("Error setting paypal api base")
+	} else {
+		log.Printf("Paypal mode is %s, api base is %s", paypalMode, paypalApiBase)
+	}
+
+	paypalClient, err := paypalsdk.NewClient(paypalClientId, paypalSecretId, paypalApiBase)
 	if nil != err {
 		log.Print(err)
 		log.Fatal("Error creating paypal client")
 	} else {
-		accessToken, err := paypalClient.GetAccessToken()
+		_, err := paypalClient.GetAccessToken()
 		if nil == err {
-			log.Printf("Successfully created paypal client with access token %s", accessToken)
+			log.Print("Successfully created paypal client with access token")
 		} else {
 			log.Print(err)
 			log.Fatal("Error creating paypal client with access token")
 		}
 	}
 
+	//Get webhook id and verification url for paypal
+	paypalWebhookId := os.Getenv("PAYPAL_WEBHOOK_ID")
+	paypalWebhookVerifyUrl := common.GetenvWithDefault("PAYPAL_WEBHOOK_VERIFY_URL", fmt.Sprintf("%s%s", paypalClient.APIBase, common.PAYPAL_VERIFY_WEBHOOK_PATH))
+	if len(paypalWebhookId) > 0 {
+		log.Printf("Paypal webhook id is %s, verification url is %s", paypalWebhookId, paypalWebhookVerifyUrl)
+	} else {
+		log.Print("Paypal webhook id is NOT set. Paypal webhooks disabled")
+	}
+
+	//Get invoice api settings for btcpay
+	btcpayUrl := os.Getenv("BTCPAY_URL")
+	btcpayStoreId := os.Getenv("BTCPAY_STORE_ID")
+	btcpayApiKey := os.Getenv("BTCPAY_API_KEY")
+	btcpayWebhookSecret := os.Getenv("BTCPAY_WEBHOOK_SECRET")
+	if len(btcpayUrl) > 0 && len(btcpayStoreId) > 0 && len(btcpayApiKey) > 0 {
+		log.Printf("Btcpay url is %s, store id is %s", btcpayUrl, btcpayStoreId)
+	} else if len(btcpayUrl) > 0 || len(btcpayStoreId) > 0 || len(btcpayApiKey) > 0 {
+		log.Fatal("All of BTCPAY_URL, BTCPAY_STORE_ID and BTCPAY_API_KEY need to be set")
+	} else {
+		log.Print("Btcpay url is NOT set. Bitcoin payments disabled")
+	}
+
+	if len(btcpayUrl) > 0 && len(btcpayWebhookSecret) > 0 {
+		log.Print("Btcpay webhook secret is set")
+	} else if len(btcpayUrl) > 0 {
+		log.Print("Btcpay webhook secret is NOT set. Btcpay webhooks disabled")
+	}
+
+	//Get timeout for each payment processor call
+	processorTimeoutStr := common.GetenvWithDefault("PROCESSOR_TIMEOUT", "30")
+	processorTimeout, err := strconv.Atoi(processorTimeoutStr)
+	if nil != err || processorTimeout <= 0 {
+		processorTimeout = 30
+		log.Printf("Error setting processor timeout from value: %s. Default to %d", processorTimeoutStr, processorTimeout)
+	}
+
+	log.Printf("Payment processor calls time out after %d seconds", processorTimeout)
+	common.SetStripeTimeout(time.Duration(processorTimeout) * time.Second)
+
+	//Get circuit breaker settings for payment processors
+	circuitBreakerFailuresStr := common.GetenvWithDefault("CIRCUIT_BREAKER_FAILURES", "5")
+	circuitBreakerFailures, err := strconv.Atoi(circuitBreakerFailuresStr)
+	if nil != err || circuitBreakerFailures <= 0 {
+		circuitBreakerFailures = 5
+		log.Printf("Error setting circuit breaker failures from value: %s. Default to %d", circuitBreakerFailuresStr, circuitBreakerFailures)
+	}
+
+	circuitBreakerResetStr := common.GetenvWithDefault("CIRCUIT_BREAKER_RESET", "30")
+	circuitBreakerReset, err := strconv.Atoi(circuitBreakerResetStr)
+	if nil != err || circuitBreakerReset <= 0 {
+		circuitBreakerReset = 30
+		log.Printf("Error setting circuit breaker reset from value: %s. Default to %d", circuitBreakerResetStr, circuitBreakerReset)
+	}
+
+	log.Printf("Circuit breakers open after %d unavailable errors and reset after %d seconds", circuitBreakerFailures, circuitBreakerReset)
+	paymentProcessors.SetCircuitBreakerSettings(circuitBreakerFailures, time.Duration(circuitBreakerReset)*time.Second)
+
+	//Payment processors
+	stripeProcessor = common.NewStripeProcessor(stripeKey)
+	stripeProcessor.WebhookSecret = stripeWebhookSecret
+	stripeProcessor.WebhookTolerance = time.Duration(stripeWebhookTolerance) * time.Second
+	stripeProcessor.LegacyCardNumbers = stripeLegacyCardNumbers
+	paymentProcessors.AddOrReplacePaymentProcessor("credit_card", stripeProcessor)
+	paypalProcessor = common.NewPaypalProcessor(paypalClient)
+	paypalProcessor.Timeout = time.Duration(processorTimeout) * time.Second
+	paypalProcessor.WebhookId = paypalWebhookId
+	paypalProcessor.WebhookVerifyUrl = paypalWebhookVerifyUrl
+	paymentProcessors.AddOrReplacePaymentProcessor("paypal", paypalProcessor)
+	manualProcessor := common.NewManualProcessor()
+	for _, accountType := range common.GetManualAccountTypes() {
+		paymentProcessors.AddOrReplacePaymentProcessor(accountType, manualProcessor)
+	}
+	if len(btcpayUrl) > 0 {
+		btcpayProcessor = common.NewBtcpayProcessor(btcpayUrl, btcpayStoreId, btcpayApiKey)
+		btcpayProcessor.Client.Timeout = time.Duration(processorTimeout) * time.Second
+		btcpayProcessor.WebhookSecret = btcpayWebhookSecret
+		paymentProcessors.AddOrReplacePaymentProcessor("bitcoin", btcpayProcessor)
+	}
+	if len(stripeSecondaryKey) > 0 {
+		stripeSecondaryProcessor = common.NewStripeProcessor(stripeSecondaryKey)
+		stripeSecondaryProcessor.Name = common.STRIPE_SECONDARY_PROCESSOR
+		stripeSecondaryProcessor.WebhookSecret = stripeSecondaryWebhookSecret
+		stripeSecondaryProcessor.WebhookTolerance = time.Duration(stripeWebhookTolerance) * time.Second
+		stripeSecondaryProcessor.LegacyCardNumbers = stripeLegacyCardNumbers
+		paymentProcessors.AddOrReplaceRoutedPaymentProcessor(stripeSecondaryProcessor)
+	}
+
+	//Get payment routes choosing processors by currency, country and amount
+	paymentRoutesStr := os.Getenv("PAYMENT_ROUTES")
+	if len(paymentRoutesStr) > 0 {
+		var paymentRoutes []common.PaymentRoute
+		err = json.Unmarshal([]byte(paymentRoutesStr), &paymentRoutes)
+		if nil == err {
+			err = paymentProcessors.SetPaymentRoutes(paymentRoutes)
+		}
+		if nil != err {
+			log.Fatalf("Error setting payment routes from value: %s. %s", paymentRoutesStr, err)
+		}
+
+		log.Printf("Payment routes: %s", paymentRoutesStr)
+	} else {
+		log.Print("Payment routes are NOT set. Payments use the processor of their account type")
+	}
+
 	//E-mail regular expression
 	log.Print("Compiling e-mail regular expression")
 	emailRegex, err = regexp.Compile(EMAIL_REGEX)
@@ -382,6 +782,18 @@ func main() {
 		log.Fatal("Unable to retrieve account types from database")
 	}
 
+	for _, accountType := range paymentProcessors.GetAccountTypes() {
+		if !accountTypes[accountType] {
+			log.Fatalf("Payment processor registered for unknown account type %s", accountType)
+		}
+	}
+
+	for accountType := range accountTypes {
+		if _, exists := paymentProcessors.GetPaymentProcessor(accountType); !exists {
+			log.Printf("No payment processor registered for account type %s", accountType)
+		}
+	}
+
 	//Allowable payment statuses
 	paymentStatusesStr := getPaymentStatuses()
 	if len(paymentStatusesStr) > 0 {
@@ -446,7 +858,7 @@ func main() {
 		log.Print(err)
 	} else if gzipCompressionLevel < 1 || gzipCompressionLevel > 9 {
 		gzipCompressionLevel = 6
-		log.Printf("Error setting gzip compression level from value: %d. Default to %d", gzipCompressionLevelStr, gzipCompressionLevel)
+		log.Printf("Error setting gzip compression level from value: %s. Default to %d", gzipCompressionLevelStr, gzipCompressionLevel)
 	}
 
 	gzipResponseStr := common.GetenvWithDefault("GZIP_RESPONSE", "true")
@@ -481,6 +893,59 @@ func main() {
 	}
 	log.Printf("Asynchronous process interval is %d seconds", asyncProcessInterval)
 
+	asyncBatchSizeStr := common.GetenvWithDefault("ASYNC_BATCH_SIZE", "1000")
+	asyncBatchSize, err := strconv.Atoi(asyncBatchSizeStr)
+	if nil != err {
+		asyncBatchSize = 1000
+		log.Printf("Error converting input for field ASYNC_BATCH_SIZE. Defaulting to 1000.")
+		log.Print(err)
+	} else if asyncBatchSize < 1 {
+		log.Printf("Error setting asynchronous batch size from value: %d. Defaulting to 1000.", asyncBatchSize)
+		asyncBatchSize = 1000
+	}
+	log.Printf("Asynchronous batches flushed at %d requests", asyncBatchSize)
+
+	asyncOutboxStr := common.GetenvWithDefault("ASYNC_OUTBOX", "false")
+	asyncOutbox, err = strconv.ParseBool(asyncOutboxStr)
+	if nil != err {
+		asyncOutbox = false
+		log.Printf("Error converting boolean input for field %s with value %s. Defaulting to false.", "ASYNC_OUTBOX", asyncOutboxStr)
+		log.Print(err)
+	}
+	if asyncOutbox {
+		log.Print("Asynchronous requests persisted to database outbox")
+	} else {
+		log.Print("Asynchronous requests kept in memory")
+	}
+
+	asyncMaxAttemptsStr := common.GetenvWithDefault("ASYNC_MAX_ATTEMPTS", "5")
+	asyncMaxAttempts, err := strconv.Atoi(asyncMaxAttemptsStr)
+	if nil != err {
+		asyncMaxAttempts = 5
+		log.Printf("Error converting input for field ASYNC_MAX_ATTEMPTS. Defaulting to 5.")
+		log.Print(err)
+	}
+
+	asyncRetryBackoffStr := common.GetenvWithDefault("ASYNC_RETRY_BACKOFF", "5")
+	asyncRetryBackoff, err := strconv.Atoi(asyncRetryBackoffStr)
+	if nil != err {
+		asyncRetryBackoff = 5
+		log.Printf("Error converting input for field ASYNC_RETRY_BACKOFF. Defaulting to 5.")
+		log.Print(err)
+	}
+
+	asyncMaxRetryBackoffStr := common.GetenvWithDefault("ASYNC_MAX_RETRY_BACKOFF", "300")
+	asyncMaxRetryBackoff, err := strconv.Atoi(asyncMaxRetryBackoffStr)
+	if nil != err {
+		asyncMaxRetryBackoff = 300
+		log.Printf("Error converting input for field ASYNC_MAX_RETRY_BACKOFF. Defaulting to 300.")
+		log.Print(err)
+	}
+
+	//Only transient processor and database errors are retried
+	asyncRetryPolicy = common.NewRetryPolicy(asyncMaxAttempts, asyncRetryBackoff, asyncMaxRetryBackoff, common.ServerError|common.ServiceUnavailableError)
+	log.Printf("Asynchronous requests attempted up to %d times with backoff from %d to %d seconds", asyncMaxAttempts, asyncRetryBackoff, asyncMaxRetryBackoff)
+
 	//Asynchronous payment request
 	asyncPaymentRequestStr := common.GetenvWithDefault("ASYNC_PAYMENT_REQUEST", "true")
 	asyncPaymentRequest, err = strconv.ParseBool(asyncPaymentRequestStr)
@@ -490,8 +955,9 @@ func main() {
 		log.Print(err)
 	} else if asyncPaymentRequest {
 		//Make payment processor
-		paymentBatchProcessor = common.NewBatchProcessor(processBatchPayment, asyncRequestSize, asyncProcessInterval, dbMaxOpenConns)
-		paymentBatchProcessor.Start()
+		paymentBatchProcessor = newBatchProcessor(processBatchPayment, PAYMENT_QUEUE, encodePaymentEvent, decodePaymentEvent, asyncRequestSize, asyncBatchSize, asyncProcessInterval, dbMaxOpenConns)
+		paymentBatchProcessor.Store.Storable = isStorablePaymentEvent
+		batchProcessors = append(batchProcessors, paymentBatchProcessor)
 		log.Print("Asynchronous payment requests enabled")
 	} else {
 		log.Print("Synchronous payment requests enabled")
@@ -506,8 +972,8 @@ func main() {
 		log.Print(err)
 	} else if asyncUpdatePaymentRequest {
 		//Update payment processor
-		updatePaymentBatchProcessor = common.NewBatchProcessor(processBatchUpdatePayment, asyncRequestSize, asyncProcessInterval, dbMaxOpenConns)
-		updatePaymentBatchProcessor.Start()
+		updatePaymentBatchProcessor = newBatchProcessor(processBatchUpdatePayment, UPDATE_PAYMENT_QUEUE, encodeUpdatePaymentEvent, decodeUpdatePaymentEvent, asyncRequestSize, asyncBatchSize, asyncProcessInterval, dbMaxOpenConns)
+		batchProcessors = append(batchProcessors, updatePaymentBatchProcessor)
 		log.Print("Asynchronous update payment requests enabled")
 	} else {
 		log.Print("Synchronous update payment requests enabled")
@@ -522,8 +988,8 @@ func main() {
 		log.Print(err)
 	} else if asyncPledgeRequest {
 		//Make pledge processor
-		pledgeBatchProcessor = common.NewBatchProcessor(processBatchPledge, asyncRequestSize, asyncProcessInterval, dbMaxOpenConns)
-		pledgeBatchProcessor.Start()
+		pledgeBatchProcessor = newBatchProcessor(processBatchPledge, PLEDGE_QUEUE, encodePledgeEvent, decodePledgeEvent, asyncRequestSize, asyncBatchSize, asyncProcessInterval, dbMaxOpenConns)
+		batchProcessors = append(batchProcessors, pledgeBatchProcessor)
 		log.Print("Asynchronous pledge requests enabled")
 	} else {
 		log.Print("Synchronous pledge requests enabled")
@@ -539,6 +1005,9 @@ func main() {
 		log.Printf("Initialized %d campaigns", len(cmps))
 	}
 
+	//Campaign milestones are logged as they are reached
+	milestoneListeners.AddListener(logMilestone)
+
 	//Initialize perks
 	prks, err := getPerksFromDb()
 	if nil != err {
@@ -579,6 +1048,63 @@ func main() {
 		log.Printf("Initialized %d advertisements", len(ads))
 	}
 
+	//Batch processors start after the caches since outbox events are replayed
+	for _, batchProcessor := range batchProcessors {
+		batchProcessor.Start(context.Background())
+	}
+
+	//Idempotency key retention
+	idempotencyKeyRetentionStr := common.GetenvWithDefault("IDEMPOTENCY_KEY_RETENTION", "24")
+	idempotencyKeyRetentionHours, err := strconv.Atoi(idempotencyKeyRetentionStr)
+	if nil != err {
+		idempotencyKeyRetentionHours = 24
+		log.Printf("Error converting input for field IDEMPOTENCY_KEY_RETENTION. Defaulting to 24.")
+		log.Print(err)
+	}
+	idempotencyKeyRetention = time.Duration(idempotencyKeyRetentionHours) * time.Hour
+	log.Printf("Idempotency keys retained for %d hours", idempotencyKeyRetentionHours)
+
+	//All-or-nothing campaign settlement
+	settlementIntervalStr := common.GetenvWithDefault("SETTLEMENT_INTERVAL", "60")
+	settlementInterval, err = strconv.Atoi(settlementIntervalStr)
+	if nil != err {
+		settlementInterval = 60
+		log.Printf("Error converting input for field SETTLEMENT_INTERVAL. Defaulting to 60.")
+		log.Print(err)
+	}
+
+	if settlementInterval > 0 {
+		startSettlementJob(settlementInterval)
+		log.Printf("Settling ended all-or-nothing campaigns every %d seconds", settlementInterval)
+	} else {
+		log.Print("All-or-nothing campaign settlement disabled")
+	}
+
+	//Stale pending payments and expired perk reservations
+	pendingPaymentMaxAgeStr := common.GetenvWithDefault("PENDING_PAYMENT_MAX_AGE", "60")
+	pendingPaymentMaxAgeMinutes, err := strconv.Atoi(pendingPaymentMaxAgeStr)
+	if nil != err || pendingPaymentMaxAgeMinutes <= 0 {
+		pendingPaymentMaxAgeMinutes = 60
+		log.Printf("Error converting input for field PENDING_PAYMENT_MAX_AGE. Defaulting to 60.")
+		log.Print(err)
+	}
+	pendingPaymentMaxAge = time.Duration(pendingPaymentMaxAgeMinutes) * time.Minute
+
+	sweeperIntervalStr := common.GetenvWithDefault("SWEEPER_INTERVAL", "300")
+	sweeperInterval, err = strconv.Atoi(sweeperIntervalStr)
+	if nil != err {
+		sweeperInterval = 300
+		log.Printf("Error converting input for field SWEEPER_INTERVAL. Defaulting to 300.")
+		log.Print(err)
+	}
+
+	if sweeperInterval > 0 {
+		startSweeperJob(sweeperInterval)
+		log.Printf("Sweeping payments pending for more than %d minutes every %d seconds", pendingPaymentMaxAgeMinutes, sweeperInterval)
+	} else {
+		log.Print("Pending payment sweeper disabled")
+	}
+
 	//robots.txt
 	robotsTxtResponseStr := common.GetenvWithDefault("ROBOTS_TXT", "false")
 	robotsTxtResponse, err = strconv.ParseBool(robotsTxtResponseStr)
@@ -624,37 +1150,38 @@ func main() {
 		log.Print("favicon.ico support disabled")
 	}
 
+	//Graceful shutdown
+	shutdownTimeoutStr := common.GetenvWithDefault("SHUTDOWN_TIMEOUT", "25")
+	shutdownTimeout, err := strconv.Atoi(shutdownTimeoutStr)
+	if nil != err {
+		shutdownTimeout = 25
+		log.Printf("Error converting input for field SHUTDOWN_TIMEOUT. Defaulting to 25.")
+		log.Print(err)
+	}
+	log.Printf("Shutdown timeout is %d seconds", shutdownTimeout)
+
+	//HTTP server
+	host := common.GetenvWithDefault("HOST", "")
+	port := common.GetenvWithDefault("PORT", "3000")
+	mode := common.GetenvWithDefault("MARTINI_ENV", "development")
+	httpServer.Addr = host + ":" + port
+
 	//Signal handler
-	signals := make(chan os.Signal)
+	shutdownComplete := make(chan struct{})
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
 	signal.Notify(signals, syscall.SIGTERM)
 	go func() {
 		<-signals
 		log.Print("Shutting down...")
-
-		if nil != paymentBatchProcessor {
-			paymentBatchProcessor.Stop()
-			log.Print("Payment batch processor shut down")
-		}
-
-		if nil != updatePaymentBatchProcessor {
-			updatePaymentBatchProcessor.Stop()
-			log.Print("Payment update batch processor shut down")
-		}
-
-		if nil != pledgeBatchProcessor {
-			pledgeBatchProcessor.Stop()
-			log.Print("Pledge batch processor shut down")
-		}
-
-		os.Exit(0)
+		shutdown(time.Duration(shutdownTimeout) * time.Second)
+		close(shutdownComplete)
 	}()
 
-	//HTTP server
-	host := common.GetenvWithDefault("HOST", "")
-	port := common.GetenvWithDefault("PORT", "3000")
-	mode := common.GetenvWithDefault("MARTINI_ENV", "development")
-
 	log.Printf("Running HTTP server on %s:%s in mode %s", host, port, mode)
 	runHttpServer()
+
+	//Database is closed once shutdown completes
+	<-shutdownComplete
+	log.Print("Shut down")
 }
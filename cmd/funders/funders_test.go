@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"database/sql"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"os"
+	"testing"
+	"time"
+)
+
+//Database tests run against the funders schema in TEST_DATABASE_URL
+func setTestDatabase(t *testing.T) {
+	dbUrl := os.Getenv("TEST_DATABASE_URL")
+	if len(dbUrl) == 0 {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	testDb, err := sql.Open("postgres", dbUrl)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	previousDb := db
+	db = testDb
+	t.Cleanup(func() {
+		db = previousDb
+		testDb.Close()
+	})
+}
+
+//Payments, perks and reservations of the campaign are deleted with it
+func addTestCampaign(t *testing.T, flexible bool) *Campaign {
+	now := time.Now()
+	campaign := &Campaign{
+		Name:        fmt.Sprintf("test_%d", now.UnixNano()),
+		Description: "Test campaign",
+		Goal:        1000,
+		Currency:    "USD",
+		StartDate:   now.Add(-time.Hour),
+		EndDate:     now.Add(time.Hour),
+		TimeZone:    "UTC",
+		Flexible:    flexible,
+		Status:      "live",
+	}
+
+	err := db.QueryRow("INSERT INTO funders.campaigns(name, description, goal, currency, start_date, end_date, time_zone, flexible, status, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $10) RETURNING id",
+		campaign.Name, campaign.Description, campaign.Goal, campaign.Currency, campaign.StartDate, campaign.EndDate, campaign.TimeZone, campaign.Flexible, campaign.Status, now).Scan(&campaign.Id)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	campaigns.AddOrReplaceCampaign(campaign)
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM funders.campaigns WHERE id = $1", campaign.Id)
+	})
+
+	return campaign
+}
+
+func addTestPerk(t *testing.T, campaign *Campaign, availableForPayment int64) *Perk {
+	now := time.Now()
+	perk := &Perk{
+		CampaignId:          campaign.Id,
+		CampaignName:        campaign.Name,
+		Name:                fmt.Sprintf("test_%d", now.UnixNano()),
+		Description:         "Test perk",
+		Price:               10,
+		Currency:            campaign.Currency,
+		AvailableForPayment: availableForPayment,
+		ShipDate:            now,
+	}
+
+	err := db.QueryRow("INSERT INTO funders.perks(campaign_id, name, description, price, currency, available_for_payment, available_for_pledge, ship_date, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, 0, $7, $7, $7) RETURNING id",
+		perk.CampaignId, perk.Name, perk.Description, perk.Price, perk.Currency, perk.AvailableForPayment, now).Scan(&perk.Id)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	perks.AddOrReplacePerks([]*Perk{perk})
+	return perk
+}
+
+func newTestPayment(campaign *Campaign) *Payment {
+	payment := &Payment{common.Payment{
+		CampaignId:    campaign.Id,
+		AccountType:   "credit_card",
+		NameOnPayment: "Test Backer",
+		FullName:      "Test Backer",
+		Address1:      "1 Test Street",
+		City:          "Test City",
+		PostalCode:    "12345",
+		Country:       "US",
+		Amount:        10,
+		Currency:      campaign.Currency,
+	}}
+
+	payment.Id = uuid.NewV4().String()
+	payment.UpdateStatus("pending")
+	return payment
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	IDEMPOTENCY_KEY_HEADER            = "Idempotency-Key"
+	IDEMPOTENT_REPLAYED_HEADER        = "Idempotent-Replayed"
+	IDEMPOTENCY_KEY_SIZE_LIMIT        = 255
+	DELETE_EXPIRED_IDEMPOTENCY_QUERY  = "DELETE FROM funders.idempotency_keys WHERE created_at < $1"
+	ADD_IDEMPOTENCY_KEY_QUERY         = "INSERT INTO funders.idempotency_keys(key, endpoint, fingerprint, resource_id, created_at) VALUES($1, $2, $3, $4, $5) ON CONFLICT (key, endpoint) DO NOTHING"
+	GET_IDEMPOTENCY_KEY_QUERY         = "SELECT fingerprint, resource_id, response_code, response_body FROM funders.idempotency_keys WHERE key = $1 AND endpoint = $2"
+	UPDATE_IDEMPOTENCY_RESPONSE_QUERY = "UPDATE funders.idempotency_keys SET response_code = $1, response_body = $2 WHERE key = $3 AND endpoint = $4"
+	DELETE_IDEMPOTENCY_KEY_QUERY      = "DELETE FROM funders.idempotency_keys WHERE key = $1 AND endpoint = $2"
+)
+
+//How long responses are kept for repeated requests
+var idempotencyKeyRetention time.Duration
+
+type idempotentRequest struct {
+	key         string
+	endpoint    string
+	fingerprint string
+	resourceId  string
+}
+
+//Form values are sorted when encoded so the same request always has the same fingerprint
+func getRequestFingerprint(req *http.Request, endpoint string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s %s\n%s", req.Method, endpoint, req.Form.Encode())))
+	return hex.EncodeToString(hash[:])
+}
+
+//Returns a non-zero response code for requests that should not be processed again
+func startIdempotentRequest(res http.ResponseWriter, req *http.Request, endpoint string) (*idempotentRequest, int, string) {
+	key := strings.TrimSpace(req.Header.Get(IDEMPOTENCY_KEY_HEADER))
+	if len(key) == 0 {
+		return nil, 0, ""
+	}
+
+	var response common.Response
+	request := &idempotentRequest{key, endpoint, getRequestFingerprint(req, endpoint), uuid.NewV4().String()}
+
+	if len(key) > IDEMPOTENCY_KEY_SIZE_LIMIT {
+		responseStr := fmt.Sprintf("Idempotency key can not be longer than %d characters", IDEMPOTENCY_KEY_SIZE_LIMIT)
+		response = common.Response{Code: http.StatusBadRequest, Message: responseStr}
+	} else if reserved, err := reserveIdempotencyKey(request); nil != err {
+		log.Print(err)
+		responseStr := "Could not check idempotency key due to server error"
+		response = common.Response{Code: http.StatusInternalServerError, Message: responseStr}
+	} else if reserved {
+		return request, 0, ""
+	} else if fingerprint, resourceId, responseCode, responseBody, err := getIdempotencyKey(key, endpoint); sql.ErrNoRows == err {
+		responseStr := fmt.Sprintf("Request with idempotency key %s expired while being checked", key)
+		response = common.Response{Code: http.StatusConflict, Message: responseStr}
+	} else if nil != err {
+		log.Print(err)
+		responseStr := "Could not check idempotency key due to server error"
+		response = common.Response{Code: http.StatusInternalServerError, Message: responseStr}
+	} else if fingerprint != request.fingerprint {
+		responseStr := fmt.Sprintf("Idempotency key %s was already used for a different request", key)
+		response = common.Response{Code: http.StatusUnprocessableEntity, Message: responseStr, Id: resourceId}
+	} else if !responseCode.Valid {
+		responseStr := fmt.Sprintf("Request with idempotency key %s is still being processed", key)
+		response = common.Response{Code: http.StatusConflict, Message: responseStr, Id: resourceId}
+	} else {
+		log.Printf("Replaying response for idempotency key %s", key)
+		res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+		res.Header().Set(LOCATION_HEADER, fmt.Sprintf("%s?id=%s", endpoint, resourceId))
+		res.Header().Set(IDEMPOTENT_REPLAYED_HEADER, "true")
+		return nil, int(responseCode.Int64), responseBody.String
+	}
+
+	log.Print(response.Message)
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+	jsonStr, _ := json.Marshal(response)
+	return nil, response.Code, string(jsonStr)
+}
+
+//Stores the response so repeated requests are answered without being processed again
+func finishIdempotentRequest(request *idempotentRequest, responseCode int, responseBody string) (int, string) {
+	if nil == request {
+		return responseCode, responseBody
+	}
+
+	_, err := db.Exec(UPDATE_IDEMPOTENCY_RESPONSE_QUERY, responseCode, responseBody, request.key, request.endpoint)
+	if nil != err {
+		log.Print(err)
+		log.Printf("Unable to store response for idempotency key %s", request.key)
+	}
+
+	return responseCode, responseBody
+}
+
+//Requests that never reached a payment processor can be retried with the same key
+func releaseIdempotentRequest(request *idempotentRequest, responseCode int, responseBody string) (int, string) {
+	if nil == request {
+		return responseCode, responseBody
+	}
+
+	_, err := db.Exec(DELETE_IDEMPOTENCY_KEY_QUERY, request.key, request.endpoint)
+	if nil != err {
+		log.Print(err)
+		log.Printf("Unable to release idempotency key %s", request.key)
+	}
+
+	return responseCode, responseBody
+}
+
+func reserveIdempotencyKey(request *idempotentRequest) (bool, error) {
+	now := time.Now()
+
+	_, err := db.Exec(DELETE_EXPIRED_IDEMPOTENCY_QUERY, now.Add(-idempotencyKeyRetention))
+	if nil != err {
+		return false, err
+	}
+
+	result, err := db.Exec(ADD_IDEMPOTENCY_KEY_QUERY, request.key, request.endpoint, request.fingerprint, request.resourceId, now)
+	if nil != err {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+func getIdempotencyKey(key string, endpoint string) (string, string, sql.NullInt64, sql.NullString, error) {
+	var fingerprint, resourceId string
+	var responseCode sql.NullInt64
+	var responseBody sql.NullString
+
+	err := db.QueryRow(GET_IDEMPOTENCY_KEY_QUERY, key, endpoint).Scan(&fingerprint, &resourceId, &responseCode, &responseBody)
+	return fingerprint, resourceId, responseCode, responseBody, err
+}
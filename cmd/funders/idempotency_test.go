@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"github.com/satori/go.uuid"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newIdempotentTestRequest(key string, form url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, PAYMENTS_URL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(key) > 0 {
+		req.Header.Set(IDEMPOTENCY_KEY_HEADER, key)
+	}
+	req.ParseForm()
+	return req
+}
+
+//Keys are unique to each test and deleted with it
+func newTestIdempotencyKey(t *testing.T) string {
+	previousRetention := idempotencyKeyRetention
+	idempotencyKeyRetention = time.Hour
+
+	key := uuid.NewV4().String()
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM funders.idempotency_keys WHERE key = $1", key)
+		idempotencyKeyRetention = previousRetention
+	})
+
+	return key
+}
+
+func TestRequestFingerprint(t *testing.T) {
+	req := newIdempotentTestRequest("", url.Values{"amount": {"10"}, "currency": {"USD"}})
+	reordered := httptest.NewRequest(http.MethodPost, PAYMENTS_URL, strings.NewReader("currency=USD&amount=10"))
+	reordered.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	reordered.ParseForm()
+	changed := newIdempotentTestRequest("", url.Values{"amount": {"11"}, "currency": {"USD"}})
+
+	fingerprint := getRequestFingerprint(req, PAYMENTS_URL)
+	if fingerprint != getRequestFingerprint(reordered, PAYMENTS_URL) {
+		t.Error("Expected the same fields in a different order to have the same fingerprint")
+	}
+	if fingerprint == getRequestFingerprint(changed, PAYMENTS_URL) {
+		t.Error("Expected a different amount to change the fingerprint")
+	}
+	if fingerprint == getRequestFingerprint(req, PLEDGES_URL) {
+		t.Error("Expected a different endpoint to change the fingerprint")
+	}
+}
+
+func TestStartIdempotentRequestWithoutKey(t *testing.T) {
+	request, retCode, _ := startIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest("", url.Values{}), PAYMENTS_URL)
+	if nil != request || retCode != 0 {
+		t.Fatalf("Expected requests without a key to be processed normally but status code was %d", retCode)
+	}
+}
+
+func TestStartIdempotentRequestRejectsLongKeys(t *testing.T) {
+	key := strings.Repeat("k", IDEMPOTENCY_KEY_SIZE_LIMIT+1)
+	request, retCode, _ := startIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest(key, url.Values{}), PAYMENTS_URL)
+	if nil != request || retCode != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d but was %d", http.StatusBadRequest, retCode)
+	}
+}
+
+func TestIdempotentRequestReplay(t *testing.T) {
+	setTestDatabase(t)
+	key := newTestIdempotencyKey(t)
+	form := url.Values{"amount": {"10"}, "currency": {"USD"}}
+
+	request, retCode, _ := startIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest(key, form), PAYMENTS_URL)
+	if nil == request || retCode != 0 {
+		t.Fatalf("Expected first request to be processed but status code was %d", retCode)
+	}
+
+	responseBody := fmt.Sprintf(`{"id": "%s"}`, request.resourceId)
+	finishIdempotentRequest(request, http.StatusCreated, responseBody)
+
+	res := httptest.NewRecorder()
+	replayed, retCode, replayedBody := startIdempotentRequest(res, newIdempotentTestRequest(key, form), PAYMENTS_URL)
+	if nil != replayed || retCode != http.StatusCreated || replayedBody != responseBody {
+		t.Fatalf("Expected stored response to be replayed but status code was %d with %s", retCode, replayedBody)
+	}
+	if res.Header().Get(IDEMPOTENT_REPLAYED_HEADER) != "true" || res.Header().Get(LOCATION_HEADER) != fmt.Sprintf("%s?id=%s", PAYMENTS_URL, request.resourceId) {
+		t.Fatalf("Expected replay headers for resource %s but were %v", request.resourceId, res.Header())
+	}
+}
+
+func TestIdempotentRequestMismatch(t *testing.T) {
+	setTestDatabase(t)
+	key := newTestIdempotencyKey(t)
+
+	request, _, _ := startIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest(key, url.Values{"amount": {"10"}}), PAYMENTS_URL)
+	if nil == request {
+		t.Fatal("Expected first request to be processed")
+	}
+	finishIdempotentRequest(request, http.StatusCreated, "{}")
+
+	mismatched, retCode, _ := startIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest(key, url.Values{"amount": {"20"}}), PAYMENTS_URL)
+	if nil != mismatched || retCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status code %d for a different request but was %d", http.StatusUnprocessableEntity, retCode)
+	}
+}
+
+func TestIdempotentRequestInProgress(t *testing.T) {
+	setTestDatabase(t)
+	key := newTestIdempotencyKey(t)
+	form := url.Values{"amount": {"10"}}
+
+	request, _, _ := startIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest(key, form), PAYMENTS_URL)
+	if nil == request {
+		t.Fatal("Expected first request to be processed")
+	}
+
+	concurrent, retCode, _ := startIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest(key, form), PAYMENTS_URL)
+	if nil != concurrent || retCode != http.StatusConflict {
+		t.Fatalf("Expected status code %d while the first request is processed but was %d", http.StatusConflict, retCode)
+	}
+}
+
+func TestIdempotentRequestRelease(t *testing.T) {
+	setTestDatabase(t)
+	key := newTestIdempotencyKey(t)
+	form := url.Values{"amount": {"10"}}
+
+	request, _, _ := startIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest(key, form), PAYMENTS_URL)
+	if nil == request {
+		t.Fatal("Expected first request to be processed")
+	}
+	releaseIdempotentRequest(request, http.StatusServiceUnavailable, "{}")
+
+	//Released keys can be retried and the retry is processed as a new request
+	retried, retCode, _ := startIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest(key, form), PAYMENTS_URL)
+	if nil == retried || retCode != 0 {
+		t.Fatalf("Expected released request to be processed again but status code was %d", retCode)
+	}
+}
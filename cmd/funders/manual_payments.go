@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/satori/go.uuid"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	MANUAL_PAYMENTS_URL = "/payments/manual"
+	CONFIRM_PAYMENT_URL = "/payments/:id/confirm"
+)
+
+//Cash, check and bank transfer payments recorded by administrators. The payment is embedded by pointer so handlers never copy its lock
+type ManualPayment struct {
+	*Payment
+	Reference string `form:"reference"`
+	Confirmed bool   `form:"confirmed"`
+}
+
+func (manualPayment *ManualPayment) Validate(errors binding.Errors, req *http.Request) binding.Errors {
+	//Forms without any payment fields leave the payment unset
+	if nil == manualPayment.Payment {
+		manualPayment.Payment = new(Payment)
+	}
+	payment := manualPayment.Payment
+
+	errors = validateSizeLimit(payment.AccountType, "accountType", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.NameOnPayment, "nameOnPayment", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.FullName, "fullName", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.Address1, "address1", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.Address2, "address2", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.City, "city", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.PostalCode, "postalCode", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.Country, "country", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.ContactEmail, "contactEmail", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.AdvertiseOther, "advertiseOther", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.Currency, "currency", stringSizeLimit, errors)
+	errors = validateSizeLimit(manualPayment.Reference, "reference", stringSizeLimit, errors)
+
+	if len(errors) == 0 {
+		if !common.IsManualAccountType(payment.AccountType) {
+			message := fmt.Sprintf("Invalid account type \"%s\" specified. Must be one of %s", payment.AccountType, strings.Join(common.GetManualAccountTypes(), ", "))
+			errors = addError(errors, []string{"accountType"}, binding.TypeError, message)
+		}
+
+		if len(payment.ContactEmail) > 0 && !emailRegex.MatchString(payment.ContactEmail) {
+			message := fmt.Sprintf("Invalid email \"%s\" format specified", payment.ContactEmail)
+			errors = addError(errors, []string{"contactEmail"}, binding.TypeError, message)
+		}
+
+		errors = validatePaymentItems(payment, errors)
+
+		campaign, exists := campaigns.GetCampaignById(payment.CampaignId)
+		if exists {
+			payment.Campaign = (*common.Campaign)(campaign)
+			if hasPaymentItemPerks(payment) {
+				price, priceCurrency := getPaymentItemsPrice(payment, campaign)
+				payment.Amount, payment.Currency, errors = validateContributionPrice(payment.Amount, payment.Currency, priceCurrency, price, errors)
+			}
+		} else {
+			message := fmt.Sprintf("Campaign not found with id: %d", payment.CampaignId)
+			errors = addError(errors, []string{"campaignId"}, binding.TypeError, message)
+		}
+	}
+
+	return errors
+}
+
+func recordManualPayment(payment *Payment, confirmed bool) error {
+	paymentProcessor, exists := paymentProcessors.GetPaymentProcessor(payment.AccountType)
+	if !exists {
+		return common.RequestError{fmt.Sprintf("Unsupported payment account type %s", payment.AccountType), common.ServiceNotImplementedError}
+	}
+
+	payment.PaymentProcessorUsed = paymentProcessor.GetName()
+	err := paymentProcessor.Charge(&payment.Payment)
+	if nil != err {
+		return err
+	}
+
+	err = addPayment(payment, nil, nil)
+	if nil == err {
+		_, err = updatePaymentInDb(payment)
+	}
+	if nil != err {
+		log.Print(err)
+		return common.RequestError{fmt.Sprintf("Unable to record payment %s", payment.Id), common.ServerError}
+	}
+
+	paymentsCache.AddOrReplacePayment(payment)
+
+	if confirmed {
+		return confirmManualPayment(payment)
+	}
+
+	return nil
+}
+
+//Confirmed payments count towards campaign and perk totals like any other successful payment
+func confirmManualPayment(payment *Payment) error {
+	if !common.IsManualAccountType(payment.AccountType) {
+		return common.RequestError{fmt.Sprintf("Only %s payments can be confirmed", strings.Join(common.GetManualAccountTypes(), " and ")), common.BadRequestError}
+	}
+
+	updatePayment := &UpdatePayment{
+		Id:          payment.Id,
+		AccountType: payment.AccountType,
+		Status:      payment.GetStatus(),
+		payment:     payment,
+	}
+
+	return executePaymentUpdate(updatePayment, false)
+}
+
+func recordManualPaymentHandler(res http.ResponseWriter, req *http.Request, manualPayment ManualPayment) (int, string) {
+	req.Close = true
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+
+	payment := manualPayment.Payment
+	payment.Id = uuid.NewV4().String()
+	payment.PaymentProcessorTransactionId = manualPayment.Reference
+
+	slog.Info("Received new manual payment", "payment", payment, "confirmed", manualPayment.Confirmed)
+
+	err := recordManualPayment(payment, manualPayment.Confirmed)
+	if nil == err {
+		log.Printf("Successfully recorded manual payment %s with status %s", payment.Id, payment.GetStatus())
+		res.Header().Set(LOCATION_HEADER, fmt.Sprintf("%s?id=%s", PAYMENTS_URL, payment.Id))
+		jsonStr, _ := json.Marshal(payment)
+		return http.StatusCreated, string(jsonStr)
+	}
+
+	response := common.Response{Code: getStatusCode(err), Message: err.Error(), Id: payment.Id}
+	log.Print(response.Message)
+	jsonStr, _ := json.Marshal(response)
+	return response.Code, string(jsonStr)
+}
+
+func confirmManualPaymentHandler(res http.ResponseWriter, req *http.Request, params martini.Params) (int, string) {
+	req.Close = true
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+	var response common.Response
+
+	paymentId := strings.TrimSpace(params["id"])
+
+	if !uuidRegex.MatchString(paymentId) {
+		responseStr := fmt.Sprintf("Payment id parameter %s is in the wrong format", paymentId)
+		response = common.Response{Code: http.StatusBadRequest, Message: responseStr}
+	} else if payment, err := getPayment(paymentId); sql.ErrNoRows == err {
+		responseStr := fmt.Sprintf("%s not found", paymentId)
+		response = common.Response{Code: http.StatusNotFound, Message: responseStr}
+	} else if nil != err {
+		log.Print(err)
+		responseStr := "Could not get payment due to server error"
+		response = common.Response{Code: http.StatusInternalServerError, Message: responseStr}
+	} else {
+		err = confirmManualPayment(payment)
+		if nil == err {
+			log.Printf("Successfully confirmed manual payment %s", paymentId)
+			jsonStr, _ := json.Marshal(payment)
+			return http.StatusOK, string(jsonStr)
+		}
+
+		response = common.Response{Code: getStatusCode(err), Message: err.Error(), Id: paymentId}
+	}
+
+	log.Print(response.Message)
+	jsonStr, _ := json.Marshal(response)
+	return response.Code, string(jsonStr)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+const (
+	METRICS_URL = "/metrics"
+)
+
+//Batch processors for every enabled asynchronous request type
+var batchProcessors []common.BatchRunner
+
+func getMetricsHandler(res http.ResponseWriter, req *http.Request) (int, string) {
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+
+	metrics := make([]common.BatchMetrics, 0, len(batchProcessors))
+	for _, batchProcessor := range batchProcessors {
+		metrics = append(metrics, batchProcessor.GetMetrics())
+	}
+
+	jsonStr, err := json.Marshal(&struct {
+		BatchProcessors   []common.BatchMetrics                   `json:"batchProcessors"`
+		PaymentProcessors map[string]common.CircuitBreakerMetrics `json:"paymentProcessors"`
+	}{
+		BatchProcessors:   metrics,
+		PaymentProcessors: paymentProcessors.GetCircuitBreakerMetrics(),
+	})
+	if nil != err {
+		log.Print(err)
+		response := common.Response{Code: http.StatusInternalServerError, Message: "Could not get metrics due to server error"}
+		jsonStr, _ = json.Marshal(response)
+		return response.Code, string(jsonStr)
+	}
+
+	return http.StatusOK, string(jsonStr)
+}
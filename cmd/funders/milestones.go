@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	GET_ALL_STRETCH_GOALS_QUERY = "SELECT id, campaign_id, amount, title, description, perk_id FROM funders.stretch_goals ORDER BY campaign_id ASC, amount ASC"
+	GET_STRETCH_GOALS_QUERY     = "SELECT id, campaign_id, amount, title, description, perk_id FROM funders.stretch_goals WHERE campaign_id = $1 ORDER BY amount ASC"
+	GOAL_MILESTONE_TITLE        = "Goal"
+)
+
+//Raised when a campaign reaches its goal or one of its stretch goals
+type Milestone struct {
+	CampaignId    int64     `json:"campaignId"`
+	CampaignName  string    `json:"campaignName"`
+	Title         string    `json:"title"`
+	Amount        float64   `json:"amount"`
+	AmtRaised     float64   `json:"amtRaised"`
+	StretchGoalId int64     `json:"stretchGoalId,omitempty"`
+	PerkId        int64     `json:"perkId,omitempty"`
+	ReachedAt     time.Time `json:"reachedAt"`
+}
+
+//Listeners run while totals are updated so slow work like emails should be handed off
+type MilestoneListener func(milestone Milestone)
+
+type MilestoneListeners struct {
+	lock      sync.RWMutex
+	listeners []MilestoneListener
+}
+
+func NewMilestoneListeners() *MilestoneListeners {
+	return new(MilestoneListeners)
+}
+
+func (ml *MilestoneListeners) AddListener(listener MilestoneListener) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	ml.listeners = append(ml.listeners, listener)
+}
+
+func (ml *MilestoneListeners) Emit(milestone Milestone) {
+	ml.lock.RLock()
+	defer ml.lock.RUnlock()
+	for _, listener := range ml.listeners {
+		listener(milestone)
+	}
+}
+
+var milestoneListeners = NewMilestoneListeners()
+
+func logMilestone(milestone Milestone) {
+	slog.Info("Campaign milestone reached", "campaign", milestone.CampaignName, "title", milestone.Title, "amount", milestone.Amount, "amtRaised", milestone.AmtRaised)
+}
+
+//Milestones are raised when they are crossed going up, again after refunds drop below them
+func emitMilestones(campaign *Campaign, previousAmtRaised float64, amtRaised float64) {
+	if amtRaised <= previousAmtRaised {
+		return
+	}
+
+	reachedAt := time.Now()
+	if previousAmtRaised < campaign.Goal && amtRaised >= campaign.Goal {
+		milestoneListeners.Emit(Milestone{CampaignId: campaign.Id, CampaignName: campaign.Name, Title: GOAL_MILESTONE_TITLE, Amount: campaign.Goal, AmtRaised: amtRaised, ReachedAt: reachedAt})
+	}
+
+	for _, stretchGoal := range campaign.StretchGoals {
+		if previousAmtRaised < stretchGoal.Amount && amtRaised >= stretchGoal.Amount {
+			milestoneListeners.Emit(Milestone{CampaignId: campaign.Id, CampaignName: campaign.Name, Title: stretchGoal.Title, Amount: stretchGoal.Amount, AmtRaised: amtRaised, StretchGoalId: stretchGoal.Id, PerkId: stretchGoal.PerkId, ReachedAt: reachedAt})
+		}
+	}
+}
+
+//Stretch goals of every campaign keyed by campaign id
+func getAllStretchGoalsFromDb() (map[int64][]common.StretchGoal, error) {
+	rows, err := db.Query(GET_ALL_STRETCH_GOALS_QUERY)
+	if nil != err {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	stretchGoals := make(map[int64][]common.StretchGoal)
+	for rows.Next() {
+		var stretchGoal common.StretchGoal
+		var perkId sql.NullInt64
+		err = rows.Scan(&stretchGoal.Id, &stretchGoal.CampaignId, &stretchGoal.Amount, &stretchGoal.Title, &stretchGoal.Description, &perkId)
+		if nil == err {
+			stretchGoal.PerkId = perkId.Int64
+			stretchGoals[stretchGoal.CampaignId] = append(stretchGoals[stretchGoal.CampaignId], stretchGoal)
+		} else {
+			break
+		}
+	}
+
+	if nil == err {
+		err = rows.Err()
+	}
+
+	return stretchGoals, err
+}
+
+func getStretchGoalsFromDb(campaignId int64) ([]common.StretchGoal, error) {
+	rows, err := db.Query(GET_STRETCH_GOALS_QUERY, campaignId)
+	if nil != err {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var stretchGoals []common.StretchGoal
+	for rows.Next() {
+		var stretchGoal common.StretchGoal
+		var perkId sql.NullInt64
+		err = rows.Scan(&stretchGoal.Id, &stretchGoal.CampaignId, &stretchGoal.Amount, &stretchGoal.Title, &stretchGoal.Description, &perkId)
+		if nil == err {
+			stretchGoal.PerkId = perkId.Int64
+			stretchGoals = append(stretchGoals, stretchGoal)
+		} else {
+			break
+		}
+	}
+
+	if nil == err {
+		err = rows.Err()
+	}
+
+	return stretchGoals, err
+}
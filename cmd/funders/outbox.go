@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"encoding/json"
+)
+
+const (
+	BATCH_JOBS_TABLE     = "funders.batch_jobs"
+	DEAD_LETTERS_TABLE   = "funders.dead_letters"
+	PAYMENT_QUEUE        = "payments"
+	UPDATE_PAYMENT_QUEUE = "update_payments"
+	PLEDGE_QUEUE         = "pledges"
+)
+
+//Durable asynchronous requests
+var asyncOutbox bool
+
+//Retry policy for failed asynchronous requests
+var asyncRetryPolicy common.RetryPolicy
+
+//Persisted payment fields. Card numbers, expiration dates and security codes are left out
+type paymentEvent struct {
+	Id                 string
+	CampaignId         int64
+	PerkId             int64
+	Items              []common.PaymentItem
+	AccountType        string
+	NameOnPayment      string
+	CreditCardToken    string
+	PaypalRedirectUrl  string
+	PaypalCancelUrl    string
+	StripeReturnUrl    string
+	BitcoinRedirectUrl string
+	FullName           string
+	Address1           string
+	Address2           string
+	City               string
+	PostalCode         string
+	Country            string
+	Amount             float64
+	Currency           string
+	Status             string
+	ContactEmail       string
+	ContactOptIn       bool
+	Advertise          bool
+	AdvertiseOther     string
+	PledgeId           string
+	IdempotencyKey     string
+}
+
+//Aliases drop the MarshalJSON methods used for responses so every field is persisted
+type updatePaymentEvent UpdatePayment
+type pledgeEvent Pledge
+
+//Stores are always used so failed events can be dead lettered and requeued
+func newBatchProcessor[T comparable](processFunc common.ProcessFunction[T], queue string, encode common.EventEncoder[T], decode common.EventDecoder[T], requestQueueSize int, maxBatchSize int, processInterval int, threadCount int) *common.BatchProcessor[T] {
+	var batchProcessor *common.BatchProcessor[T]
+
+	store := common.NewBatchStore(db, BATCH_JOBS_TABLE, DEAD_LETTERS_TABLE, queue, encode, decode)
+	if asyncOutbox {
+		batchProcessor = common.NewDurableBatchProcessor(queue, processFunc, store, requestQueueSize, maxBatchSize, processInterval, threadCount)
+	} else {
+		batchProcessor = common.NewBatchProcessor(queue, processFunc, requestQueueSize, maxBatchSize, processInterval, threadCount)
+		batchProcessor.Store = store
+	}
+
+	batchProcessor.RetryPolicy = asyncRetryPolicy
+	return batchProcessor
+}
+
+//Payments with card details are charged from memory and never written to the outbox or dead letters
+func isStorablePaymentEvent(payment *Payment) bool {
+	return !payment.HasCardDetails()
+}
+
+func encodePaymentEvent(payment *Payment) ([]byte, error) {
+	return json.Marshal(&paymentEvent{
+		Id:                 payment.Id,
+		CampaignId:         payment.CampaignId,
+		PerkId:             payment.PerkId,
+		Items:              payment.Items,
+		AccountType:        payment.AccountType,
+		NameOnPayment:      payment.NameOnPayment,
+		CreditCardToken:    payment.CreditCardToken,
+		PaypalRedirectUrl:  payment.PaypalRedirectUrl,
+		PaypalCancelUrl:    payment.PaypalCancelUrl,
+		StripeReturnUrl:    payment.StripeReturnUrl,
+		BitcoinRedirectUrl: payment.BitcoinRedirectUrl,
+		FullName:           payment.FullName,
+		Address1:           payment.Address1,
+		Address2:           payment.Address2,
+		City:               payment.City,
+		PostalCode:         payment.PostalCode,
+		Country:            payment.Country,
+		Amount:             payment.Amount,
+		Currency:           payment.Currency,
+		Status:             payment.GetStatus(),
+		ContactEmail:       payment.ContactEmail,
+		ContactOptIn:       payment.ContactOptIn,
+		Advertise:          payment.Advertise,
+		AdvertiseOther:     payment.AdvertiseOther,
+		PledgeId:           payment.PledgeId,
+		IdempotencyKey:     payment.IdempotencyKey,
+	})
+}
+
+func decodePaymentEvent(payload []byte) (*Payment, error) {
+	var event paymentEvent
+	err := json.Unmarshal(payload, &event)
+	if nil != err {
+		return nil, err
+	}
+
+	payment := new(Payment)
+	payment.Id = event.Id
+	payment.CampaignId = event.CampaignId
+	payment.PerkId = event.PerkId
+	payment.Items = event.Items
+	payment.AccountType = event.AccountType
+	payment.NameOnPayment = event.NameOnPayment
+	payment.CreditCardToken = event.CreditCardToken
+	payment.PaypalRedirectUrl = event.PaypalRedirectUrl
+	payment.PaypalCancelUrl = event.PaypalCancelUrl
+	payment.StripeReturnUrl = event.StripeReturnUrl
+	payment.BitcoinRedirectUrl = event.BitcoinRedirectUrl
+	payment.FullName = event.FullName
+	payment.Address1 = event.Address1
+	payment.Address2 = event.Address2
+	payment.City = event.City
+	payment.PostalCode = event.PostalCode
+	payment.Country = event.Country
+	payment.Amount = event.Amount
+	payment.Currency = event.Currency
+	payment.Status = event.Status
+	payment.ContactEmail = event.ContactEmail
+	payment.ContactOptIn = event.ContactOptIn
+	payment.Advertise = event.Advertise
+	payment.AdvertiseOther = event.AdvertiseOther
+	payment.PledgeId = event.PledgeId
+	payment.IdempotencyKey = event.IdempotencyKey
+
+	return payment, nil
+}
+
+func encodeUpdatePaymentEvent(updatePayment *UpdatePayment) ([]byte, error) {
+	return json.Marshal((*updatePaymentEvent)(updatePayment))
+}
+
+//Payment updates reference the payment so it is looked up again when replayed
+func decodeUpdatePaymentEvent(payload []byte) (*UpdatePayment, error) {
+	updatePayment := new(UpdatePayment)
+	err := json.Unmarshal(payload, (*updatePaymentEvent)(updatePayment))
+	if nil != err {
+		return nil, err
+	}
+
+	updatePayment.payment, err = getPayment(updatePayment.Id)
+	if nil != err {
+		return nil, err
+	}
+
+	campaign, campaignExists := campaigns.GetCampaignById(updatePayment.payment.CampaignId)
+	if campaignExists {
+		updatePayment.payment.Campaign = (*common.Campaign)(campaign)
+	}
+
+	perk, perkExists := getContributionPerk(updatePayment.payment.PerkId)
+	if perkExists {
+		updatePayment.payment.Perk = (*common.Perk)(perk)
+	}
+
+	return updatePayment, nil
+}
+
+func encodePledgeEvent(pledge *Pledge) ([]byte, error) {
+	//Campaign and perk are looked up from the caches when processed
+	pledgeCopy := pledgeEvent(*pledge)
+	pledgeCopy.Campaign = nil
+	pledgeCopy.Perk = nil
+	return json.Marshal(&pledgeCopy)
+}
+
+func decodePledgeEvent(payload []byte) (*Pledge, error) {
+	pledge := new(Pledge)
+	err := json.Unmarshal(payload, (*pledgeEvent)(pledge))
+	if nil != err {
+		return nil, err
+	}
+
+	return pledge, nil
+}
+
+func failBatch[T comparable](batchProcessor *common.BatchProcessor[T], batch []T, err error) {
+	for _, event := range batch {
+		batchProcessor.FailEvent(event, err)
+	}
+}
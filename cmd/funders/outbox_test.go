@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"strings"
+	"testing"
+)
+
+func newTestCardPayment() *Payment {
+	payment := newTestPayment(&Campaign{Id: 31337, Currency: "USD"})
+	payment.CreditCardAccountNumber = "4242424242424242"
+	payment.CreditCardExpirationDate = "12/2099"
+	payment.CreditCardCvv = "987"
+	payment.Items = []common.PaymentItem{{PerkId: 31340, Quantity: 2}}
+	payment.IdempotencyKey = "test-key"
+	return payment
+}
+
+func TestEncodePaymentEventOmitsCardDetails(t *testing.T) {
+	payment := newTestCardPayment()
+
+	payload, err := encodePaymentEvent(payment)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"CreditCardAccountNumber", "CreditCardExpirationDate", "CreditCardCvv", payment.CreditCardAccountNumber, payment.CreditCardExpirationDate, payment.CreditCardCvv} {
+		if strings.Contains(string(payload), value) {
+			t.Errorf("Expected %s to be left out of the stored payment", value)
+		}
+	}
+}
+
+func TestDecodePaymentEvent(t *testing.T) {
+	payment := newTestCardPayment()
+	payment.CreditCardToken = "pm_card_visa"
+
+	payload, err := encodePaymentEvent(payment)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodePaymentEvent(payload)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if decoded.Id != payment.Id || decoded.CampaignId != payment.CampaignId || decoded.CreditCardToken != payment.CreditCardToken || decoded.Amount != payment.Amount || decoded.GetStatus() != "pending" || decoded.IdempotencyKey != payment.IdempotencyKey {
+		t.Fatalf("Expected stored payment %s to be restored but was %#v", payment.Id, decoded)
+	}
+	if len(decoded.Items) != 1 || decoded.Items[0].PerkId != 31340 || decoded.Items[0].Quantity != 2 {
+		t.Fatalf("Expected payment items to be restored but were %v", decoded.Items)
+	}
+	if decoded.HasCardDetails() {
+		t.Fatal("Expected restored payment to have no card details")
+	}
+}
+
+func TestCardPaymentsAreNotStored(t *testing.T) {
+	payment := newTestCardPayment()
+	if isStorablePaymentEvent(payment) {
+		t.Fatal("Expected payment with card details not to be storable")
+	}
+
+	payment.CreditCardAccountNumber = ""
+	payment.CreditCardExpirationDate = ""
+	payment.CreditCardCvv = ""
+	payment.CreditCardToken = "pm_card_visa"
+	if !isStorablePaymentEvent(payment) {
+		t.Fatal("Expected tokenized payment to be storable")
+	}
+}
+
+func TestOutboxQueuesCardPaymentsInMemory(t *testing.T) {
+	previousAsyncOutbox := asyncOutbox
+	asyncOutbox = true
+	defer func() {
+		asyncOutbox = previousAsyncOutbox
+	}()
+
+	batchProcessor := newBatchProcessor(processBatchPayment, PAYMENT_QUEUE, encodePaymentEvent, decodePaymentEvent, 10, 10, 60, 1)
+	batchProcessor.Store.Storable = isStorablePaymentEvent
+
+	//Adding a stored payment would fail without a database
+	err := batchProcessor.AddEvent(newTestCardPayment())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(batchProcessor.Events) != 1 {
+		t.Fatalf("Expected card payment to be queued in memory but %d are queued", len(batchProcessor.Events))
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"database/sql"
+	"fmt"
+	"github.com/martini-contrib/binding"
+	"math"
+	"time"
+)
+
+const (
+	GET_PAYMENT_ITEMS_QUERY     = "SELECT payment_id, perk_id, quantity, price FROM funders.payment_items WHERE payment_id = $1 ORDER BY perk_id ASC"
+	GET_ALL_PAYMENT_ITEMS_QUERY = "SELECT payment_id, perk_id, quantity, price FROM funders.payment_items ORDER BY payment_id ASC, perk_id ASC"
+	ADD_PAYMENT_ITEM_QUERY      = "INSERT INTO funders.payment_items(payment_id, perk_id, quantity, price, created_at) VALUES($1, $2, $3, $4, $5) ON CONFLICT (payment_id, perk_id) DO NOTHING"
+)
+
+//Perks are bought with repeated itemPerkId and itemQuantity fields or a single perkId
+func validatePaymentItems(payment *Payment, errors binding.Errors) binding.Errors {
+	if len(payment.ItemPerkIds) == 0 && len(payment.ItemQuantities) > 0 {
+		return addError(errors, []string{"itemPerkId", "itemQuantity"}, binding.RequiredError, "Item perk ids are required with item quantities")
+	} else if len(payment.ItemPerkIds) > 0 && 0 != payment.PerkId {
+		return addError(errors, []string{"perkId", "itemPerkId"}, binding.TypeError, "Perk id can not be combined with item perk ids")
+	} else if len(payment.ItemQuantities) > 0 && len(payment.ItemQuantities) != len(payment.ItemPerkIds) {
+		message := fmt.Sprintf("%d item quantities specified for %d item perk ids", len(payment.ItemQuantities), len(payment.ItemPerkIds))
+		return addError(errors, []string{"itemPerkId", "itemQuantity"}, binding.TypeError, message)
+	}
+
+	itemPerkIds := payment.ItemPerkIds
+	if 0 != payment.PerkId {
+		itemPerkIds = []int64{payment.PerkId}
+	}
+
+	//Repeated perks are bought as one line item
+	payment.Items = nil
+	quantities := make(map[int64]int64)
+	for index, perkId := range itemPerkIds {
+		quantity := int64(1)
+		if len(payment.ItemQuantities) > 0 {
+			quantity = payment.ItemQuantities[index]
+		}
+
+		if quantity <= 0 {
+			message := fmt.Sprintf("Invalid quantity %d specified for perk %d", quantity, perkId)
+			errors = addError(errors, []string{"itemQuantity"}, binding.TypeError, message)
+			continue
+		}
+
+		if _, exists := quantities[perkId]; !exists {
+			payment.Items = append(payment.Items, common.PaymentItem{PerkId: perkId})
+		}
+		quantities[perkId] += quantity
+	}
+
+	var currency string
+	for index := range payment.Items {
+		item := &payment.Items[index]
+		item.Quantity = quantities[item.PerkId]
+
+		perk, exists := perks.GetPerk(item.PerkId)
+		if !exists || perk.CampaignId != payment.CampaignId {
+			message := fmt.Sprintf("Perk not found with id: %d for campaign: %d", item.PerkId, payment.CampaignId)
+			errors = addError(errors, []string{"perkId", "itemPerkId"}, binding.TypeError, message)
+		} else if campaign, exists := campaigns.GetCampaignById(payment.CampaignId); exists && campaign.IsPerkLocked(item.PerkId) {
+			message := fmt.Sprintf("Perk %d is locked until its stretch goal is reached", item.PerkId)
+			errors = addError(errors, []string{"perkId", "itemPerkId"}, binding.TypeError, message)
+		} else if !perk.IsAvailableForPaymentQuantity(item.Quantity) {
+			message := fmt.Sprintf("Perk %d is not available for quantity %d. (%d/%d) claimed", item.PerkId, item.Quantity, perk.NumClaimed, perk.AvailableForPayment)
+			errors = addError(errors, []string{"perkId", "itemQuantity"}, binding.TypeError, message)
+		} else if len(currency) > 0 && perk.Currency != currency {
+			message := fmt.Sprintf("Perk %d currency %s does not match currency %s of the other perks", item.PerkId, perk.Currency, currency)
+			errors = addError(errors, []string{"itemPerkId"}, binding.TypeError, message)
+		} else {
+			currency = perk.Currency
+			item.Perk = (*common.Perk)(perk)
+			item.Price = perk.Price
+		}
+	}
+
+	//Payments for a single perk keep referencing it
+	if len(payment.Items) == 1 {
+		payment.PerkId = payment.Items[0].PerkId
+		payment.Perk = payment.Items[0].Perk
+	}
+
+	return errors
+}
+
+//Line items found in the perk cache, false if any are missing
+func hasPaymentItemPerks(payment *Payment) bool {
+	for _, item := range payment.Items {
+		if nil == item.Perk {
+			return false
+		}
+	}
+
+	return true
+}
+
+//Total price of the line items and their currency, the campaign currency for donations
+func getPaymentItemsPrice(payment *Payment, campaign *Campaign) (float64, string) {
+	var price float64
+	currency := campaign.Currency
+	for _, item := range payment.Items {
+		price += item.Price * float64(item.Quantity)
+		if nil != item.Perk {
+			currency = item.Perk.Currency
+		}
+	}
+
+	return math.Floor(price*100+0.5) / 100, currency
+}
+
+//Perks are claimed by the quantity bought. Negative for payments that are no longer counted
+func incrementPaymentItemsClaimed(payment *Payment, sign int64) {
+	for _, item := range payment.Items {
+		if perk, exists := perks.GetPerk(item.PerkId); exists {
+			perk.IncrementNumClaimed(sign * item.Quantity)
+		}
+	}
+}
+
+func addPaymentItems(payment *Payment, statement *sql.Stmt) error {
+	for _, item := range payment.Items {
+		_, err := statement.Exec(payment.Id, item.PerkId, item.Quantity, item.Price, time.Now())
+		if nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getPaymentItemsFromDb(paymentId string) ([]common.PaymentItem, error) {
+	rows, err := db.Query(GET_PAYMENT_ITEMS_QUERY, paymentId)
+	if nil != err {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var items []common.PaymentItem
+	for rows.Next() {
+		var item common.PaymentItem
+		err = rows.Scan(&paymentId, &item.PerkId, &item.Quantity, &item.Price)
+		if nil == err {
+			items = append(items, item)
+		} else {
+			break
+		}
+	}
+
+	if nil == err {
+		err = rows.Err()
+	}
+
+	return items, err
+}
+
+//Line items of every payment keyed by payment id
+func getAllPaymentItemsFromDb() (map[string][]common.PaymentItem, error) {
+	rows, err := db.Query(GET_ALL_PAYMENT_ITEMS_QUERY)
+	if nil != err {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	items := make(map[string][]common.PaymentItem)
+	for rows.Next() {
+		var paymentId string
+		var item common.PaymentItem
+		err = rows.Scan(&paymentId, &item.PerkId, &item.Quantity, &item.Price)
+		if nil == err {
+			items[paymentId] = append(items[paymentId], item)
+		} else {
+			break
+		}
+	}
+
+	if nil == err {
+		err = rows.Err()
+	}
+
+	return items, err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"testing"
+)
+
+//Perks are only added to the cache. Negative ids are kept clear of the database
+func addTestCachedPerks(campaignId int64, price float64, availableForPayment ...int64) []*Perk {
+	var cachedPerks []*Perk
+	for index, available := range availableForPayment {
+		cachedPerks = append(cachedPerks, &Perk{
+			Id:                  campaignId*100 - int64(index),
+			CampaignId:          campaignId,
+			Price:               price,
+			Currency:            "USD",
+			AvailableForPayment: available,
+		})
+	}
+
+	perks.AddOrReplacePerks(cachedPerks)
+	return cachedPerks
+}
+
+func TestValidatePaymentItemsMergesRepeatedPerks(t *testing.T) {
+	cachedPerks := addTestCachedPerks(-1, 12.5, 5, 5)
+
+	payment := &Payment{common.Payment{
+		CampaignId:     cachedPerks[0].CampaignId,
+		ItemPerkIds:    []int64{cachedPerks[0].Id, cachedPerks[1].Id, cachedPerks[0].Id},
+		ItemQuantities: []int64{1, 2, 2},
+	}}
+
+	errors := validatePaymentItems(payment, nil)
+	if len(errors) > 0 {
+		t.Fatal(errors)
+	}
+
+	if len(payment.Items) != 2 || payment.Items[0].Quantity != 3 || payment.Items[1].Quantity != 2 {
+		t.Fatalf("Expected 3 of the first perk and 2 of the second but was %v", payment.Items)
+	}
+	if price, currency := getPaymentItemsPrice(payment, &Campaign{Currency: "EUR"}); price != 62.5 || currency != "USD" {
+		t.Fatalf("Expected items to cost 62.50 USD but was %.2f %s", price, currency)
+	}
+}
+
+func TestValidatePaymentItemsErrors(t *testing.T) {
+	cachedPerks := addTestCachedPerks(-2, 10, 2)
+	campaignId := cachedPerks[0].CampaignId
+	perkId := cachedPerks[0].Id
+
+	tests := []*Payment{
+		&Payment{common.Payment{CampaignId: campaignId, ItemQuantities: []int64{1}}},
+		&Payment{common.Payment{CampaignId: campaignId, PerkId: perkId, ItemPerkIds: []int64{perkId}}},
+		&Payment{common.Payment{CampaignId: campaignId, ItemPerkIds: []int64{perkId, perkId}, ItemQuantities: []int64{1}}},
+		&Payment{common.Payment{CampaignId: campaignId, ItemPerkIds: []int64{perkId}, ItemQuantities: []int64{0}}},
+		&Payment{common.Payment{CampaignId: campaignId, ItemPerkIds: []int64{perkId}, ItemQuantities: []int64{3}}},
+		&Payment{common.Payment{CampaignId: campaignId - 1, PerkId: perkId}},
+	}
+
+	for _, payment := range tests {
+		if errors := validatePaymentItems(payment, nil); len(errors) == 0 {
+			t.Errorf("Expected items %v with quantities %v and perk %d to be rejected", payment.ItemPerkIds, payment.ItemQuantities, payment.PerkId)
+		}
+	}
+}
+
+func TestValidatePaymentItemsSinglePerk(t *testing.T) {
+	cachedPerks := addTestCachedPerks(-3, 10, 1)
+
+	payment := &Payment{common.Payment{CampaignId: cachedPerks[0].CampaignId, PerkId: cachedPerks[0].Id}}
+	errors := validatePaymentItems(payment, nil)
+	if len(errors) > 0 {
+		t.Fatal(errors)
+	}
+
+	//Payments for a single perk keep referencing it
+	if len(payment.Items) != 1 || payment.Items[0].Quantity != 1 || nil == payment.Perk {
+		t.Fatalf("Expected one line item for the perk but was %v", payment.Items)
+	}
+}
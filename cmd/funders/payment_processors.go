@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+func makePayment(payment *Payment, waitGroup *sync.WaitGroup) error {
+	if nil != waitGroup {
+		defer waitGroup.Done()
+	}
+
+	err := chargePayment(payment)
+
+	if nil != waitGroup {
+		//Retried payments stay pending until their next attempt
+		if nil != err && paymentBatchProcessor.FailEvent(payment, err) {
+			payment.UpdateStatus("pending")
+		}
+
+		_, dbErr := updatePaymentInDb(payment)
+		if nil != dbErr {
+			log.Print(dbErr)
+			log.Printf("Error updating payment %s with information from processor", payment.Id)
+		} else {
+			log.Printf("Successfully updated payment %s in database", payment.Id)
+		}
+	}
+
+	return err
+}
+
+func chargePayment(payment *Payment) error {
+	campaign, campaignExists := campaigns.GetCampaignById(payment.CampaignId)
+	if !campaignExists {
+		return common.RequestError{fmt.Sprintf("Campaign not found %d", payment.CampaignId), common.NotFoundError}
+	}
+
+	perk, perkExists := getContributionPerk(payment.PerkId)
+	if !perkExists {
+		return common.RequestError{fmt.Sprintf("Perk not found %d", payment.PerkId), common.NotFoundError}
+	}
+
+	payment.Campaign = (*common.Campaign)(campaign)
+	payment.Perk = (*common.Perk)(perk)
+
+	routedProcessors := paymentProcessors.GetRoutedPaymentProcessors(&payment.Payment)
+	if len(routedProcessors) == 0 {
+		return common.RequestError{fmt.Sprintf("Unsupported payment account type %s", payment.AccountType), common.ServiceNotImplementedError}
+	}
+
+	//Unavailable processors fail over to the next processor on the route
+	var err error
+	var processorReached bool
+	for index, paymentProcessor := range routedProcessors {
+		if index > 0 {
+			log.Printf("Failing over payment %s to payment processor %s", payment.Id, paymentProcessor.GetName())
+			payment.PaymentProcessorTransactionId = ""
+			payment.UpdateStatus("pending")
+			payment.UpdateFailureReason("")
+		}
+
+		payment.PaymentProcessorUsed = paymentProcessor.GetName()
+		err = callPaymentProcessor(paymentProcessor, func() error {
+			processorReached = true
+			return chargeWithPaymentProcessor(paymentProcessor, payment, campaign)
+		})
+		if !common.IsServiceUnavailable(err) {
+			break
+		}
+	}
+
+	//Circuit breakers skipped every processor so none was used
+	if !processorReached {
+		payment.PaymentProcessorUsed = ""
+	}
+
+	if common.IsServiceUnavailable(err) {
+		payment.UpdateStatus("failure")
+		if len(payment.GetFailureReason()) == 0 {
+			payment.UpdateFailureReason(err.Error())
+		}
+	} else if common.IsProcessorTimeout(err) {
+		//The processor may have charged the payment so it is left for the sweeper or a webhook to reconcile
+		log.Printf("Payment %s timed out with payment processor %s. Leaving pending", payment.Id, payment.PaymentProcessorUsed)
+		payment.UpdateStatus("pending")
+	}
+
+	if isCountedStatus(payment.GetStatus()) {
+		addPaymentToTotals(payment, campaign)
+	}
+
+	paymentsCache.AddOrReplacePayment(payment)
+	return err
+}
+
+func chargeWithPaymentProcessor(paymentProcessor common.PaymentProcessor, payment *Payment, campaign *Campaign) error {
+	if campaign.Flexible {
+		return paymentProcessor.Charge(&payment.Payment)
+	} else if paymentAuthorizer, ok := paymentProcessor.(common.PaymentAuthorizer); ok {
+		//All-or-nothing campaigns are settled when the campaign ends
+		return paymentAuthorizer.Authorize(&payment.Payment)
+	}
+
+	return common.RequestError{fmt.Sprintf("Payment account type %s can not be authorized", payment.AccountType), common.ServiceNotImplementedError}
+}
+
+//Processors with an open circuit breaker fail fast instead of being called
+func callPaymentProcessor(paymentProcessor common.PaymentProcessor, call func() error) error {
+	name := paymentProcessor.GetName()
+	circuitBreaker, exists := paymentProcessors.GetCircuitBreaker(name)
+	if !exists {
+		return call()
+	}
+
+	if !circuitBreaker.Allow() {
+		log.Printf("Payment processor %s skipped. Circuit breaker is %s", name, circuitBreaker.GetState())
+		return common.RequestError{fmt.Sprintf("Payment processor %s is unavailable", name), common.ServiceUnavailableError}
+	}
+
+	err := call()
+	circuitBreaker.RecordResult(err)
+	return err
+}
+
+//Time until a processor on the payment route accepts calls again, zero if one does now
+func getPaymentProcessorRetryAfter(payment *Payment) time.Duration {
+	var retryAfter time.Duration
+	for _, paymentProcessor := range paymentProcessors.GetRoutedPaymentProcessors(&payment.Payment) {
+		circuitBreaker, exists := paymentProcessors.GetCircuitBreaker(paymentProcessor.GetName())
+		if !exists {
+			return 0
+		}
+
+		openFor := circuitBreaker.GetRetryAfter()
+		if openFor == 0 {
+			return 0
+		} else if retryAfter == 0 || openFor < retryAfter {
+			retryAfter = openFor
+		}
+	}
+
+	return retryAfter
+}
+
+//Payments are completed, settled and refunded by the processor that charged them
+func getPaymentProcessor(payment *Payment) (common.PaymentProcessor, bool) {
+	if paymentProcessor, exists := paymentProcessors.GetPaymentProcessorByName(payment.PaymentProcessorUsed); exists {
+		return paymentProcessor, true
+	}
+
+	return paymentProcessors.GetPaymentProcessor(payment.AccountType)
+}
+
+func completePayment(updatePayment *UpdatePayment, waitGroup *sync.WaitGroup) error {
+	if nil != waitGroup {
+		defer waitGroup.Done()
+	}
+
+	err := executePaymentUpdate(updatePayment, nil != waitGroup)
+	if nil != err && nil != waitGroup {
+		updatePaymentBatchProcessor.FailEvent(updatePayment, err)
+	}
+
+	return err
+}
+
+func executePaymentUpdate(updatePayment *UpdatePayment, batch bool) error {
+	payment := updatePayment.payment
+
+	paymentProcessor, exists := getPaymentProcessor(payment)
+	if !exists {
+		return common.RequestError{fmt.Sprintf("Unsupported payment update account type %s", payment.AccountType), common.ServiceNotImplementedError}
+	}
+
+	//Payments can also be completed from processor webhooks
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	if payment.GetStatus() != "pending" {
+		return common.RequestError{fmt.Sprintf("Only pending payments can be updated. Status: \"%s\" specified", payment.GetStatus()), common.BadRequestError}
+	}
+
+	campaign, campaignExists := campaigns.GetCampaignById(payment.CampaignId)
+	if !campaignExists {
+		return common.RequestError{fmt.Sprintf("Campaign not found %d", payment.CampaignId), common.NotFoundError}
+	}
+
+	_, perkExists := getContributionPerk(payment.PerkId)
+	if !perkExists {
+		return common.RequestError{fmt.Sprintf("Perk not found %d", payment.PerkId), common.NotFoundError}
+	}
+
+	var err error
+	if updatePayment.Status == "failure" {
+		message := "Failed status specified"
+		log.Print(message)
+
+		payment.UpdateStatus("failure")
+		payment.UpdateFailureReason(message)
+		err = common.RequestError{message, common.BadRequestError}
+	} else {
+		completion := common.PaymentCompletion{PayerId: updatePayment.PaypalPayerId, PaymentId: updatePayment.PaypalPaymentId, Token: updatePayment.PaypalToken}
+		err = callPaymentProcessor(paymentProcessor, func() error {
+			return paymentProcessor.Complete(&payment.Payment, completion)
+		})
+		if isCountedStatus(payment.GetStatus()) {
+			addPaymentToTotals(payment, campaign)
+		}
+	}
+
+	if nil != err {
+		if requestErr, ok := err.(common.RequestError); ok && requestErr.Type == common.ServiceNotImplementedError {
+			return err
+		}
+
+		//Retried and timed out payment updates stay pending until they are retried or reconciled
+		if batch && updatePaymentBatchProcessor.FailEvent(updatePayment, err) {
+			payment.UpdateStatus("pending")
+		} else if common.IsProcessorTimeout(err) {
+			payment.UpdateStatus("pending")
+		}
+	}
+
+	paymentsCache.AddOrReplacePayment(payment)
+	_, dbErr := updatePaymentInDb(payment)
+	if nil != dbErr {
+		log.Print(dbErr)
+		log.Printf("Error updating payment %s with information from processor", payment.Id)
+	} else {
+		log.Printf("Successfully updated payment %s in database", payment.Id)
+	}
+
+	return err
+}
+
+func addPaymentToTotals(payment *Payment, campaign *Campaign) {
+	campaign.IncrementAmtRaised(payment.Amount)
+	campaign.IncrementNumBackers(1)
+	advertisements.AddAdvertisementFromPayment(campaign.Name, payment)
+	incrementPaymentItemsClaimed(payment, 1)
+}
+
+func removePaymentFromTotals(payment *Payment, campaign *Campaign) {
+	campaign.IncrementAmtRaised(payment.GetAmountRefunded() - payment.Amount)
+	campaign.IncrementNumBackers(-1)
+	advertisements.RemoveAdvertisementFromPayment(campaign.Name, payment)
+	incrementPaymentItemsClaimed(payment, -1)
+}
+
+//Late processor events must not undo settled or refunded payments
+func canReconcileStatus(previousStatus string, status string) bool {
+	switch status {
+	case "authorized", "expired":
+		return previousStatus == "pending"
+	default:
+		return previousStatus != "voided" && previousStatus != "refunded"
+	}
+}
+
+//Serializes status changes reported asynchronously by payment processors
+var reconcileLock sync.Mutex
+
+func reconcilePayment(payment *Payment, status string, failureReason string, response interface{}) error {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	campaign, campaignExists := campaigns.GetCampaignById(payment.CampaignId)
+	if !campaignExists {
+		return common.RequestError{fmt.Sprintf("Campaign not found %d", payment.CampaignId), common.NotFoundError}
+	}
+
+	_, perkExists := getContributionPerk(payment.PerkId)
+	if !perkExists {
+		return common.RequestError{fmt.Sprintf("Perk not found %d", payment.PerkId), common.NotFoundError}
+	}
+
+	jsonErr := payment.UpdatePaymentProcessorResponses(response)
+	if nil != jsonErr {
+		log.Print(jsonErr)
+		log.Printf("Unable to marshal processor response for payment %s", payment.Id)
+	}
+
+	previousStatus := payment.GetStatus()
+	if previousStatus != status && !canReconcileStatus(previousStatus, status) {
+		log.Printf("Ignoring payment %s status change from %s to %s", payment.Id, previousStatus, status)
+		status = previousStatus
+	}
+
+	if previousStatus != status {
+		log.Printf("Reconciling payment %s status from %s to %s", payment.Id, previousStatus, status)
+		payment.UpdateStatus(status)
+		if len(failureReason) > 0 {
+			payment.UpdateFailureReason(failureReason)
+		}
+
+		if isCountedStatus(status) && !isCountedStatus(previousStatus) {
+			addPaymentToTotals(payment, campaign)
+		} else if !isCountedStatus(status) && isCountedStatus(previousStatus) {
+			removePaymentFromTotals(payment, campaign)
+		}
+	}
+
+	paymentsCache.AddOrReplacePayment(payment)
+	_, err := updatePaymentInDb(payment)
+	if nil != err {
+		log.Print(err)
+		log.Printf("Error updating payment %s with information from processor", payment.Id)
+		return common.RequestError{fmt.Sprintf("Unable to update payment %s", payment.Id), common.ServerError}
+	}
+
+	log.Printf("Successfully updated payment %s in database", payment.Id)
+	return nil
+}
@@ -8,125 +8,76 @@ import (
 	"github.com/martini-contrib/binding"
 	"github.com/satori/go.uuid"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	GET_ACCOUNT_TYPES_QUERY    = "SELECT enum_range(NULL::funders.account_type) AS account_types"
-	GET_PAYMENT_STATUSES_QUERY = "SELECT enum_range(NULL::funders.payment_status) AS payment_statuses"
-	GET_PAYMENTS_QUERY         = "SELECT id, campaign_id, perk_id, pledge_id, account_type, status FROM funders.active_payments"
-	GET_PAYMENT_QUERY          = "SELECT id, campaign_id, perk_id, pledge_id, account_type, status FROM funders.active_payments WHERE id = $1"
-	ADD_PAYMENT_QUERY          = "INSERT INTO funders.payments(id, campaign_id, perk_id, account_type, name_on_payment, full_name, address1, address2, city, postal_code, country, amount, currency, status, contact_email, contact_opt_in, advertise, advertise_other, pledge_id, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21) RETURNING id"
-	EMAIL_REGEX                = "^[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+$"
-	UUID_REGEX                 = "^[a-z0-9]{8}-[a-z0-9]{4}-[1-5][a-z0-9]{3}-[a-z0-9]{4}-[a-z0-9]{12}$"
-	PAYMENTS_URL               = "/payments"
+	GET_ACCOUNT_TYPES_QUERY          = "SELECT enum_range(NULL::funders.account_type) AS account_types"
+	GET_PAYMENT_STATUSES_QUERY       = "SELECT enum_range(NULL::funders.payment_status) AS payment_statuses"
+	GET_PAYMENTS_QUERY               = "SELECT id, campaign_id, perk_id, pledge_id, account_type, amount, currency, amount_refunded, status, payment_processor_used, payment_processor_transaction_id FROM funders.active_payments"
+	GET_PAYMENT_QUERY                = "SELECT id, campaign_id, perk_id, pledge_id, account_type, amount, currency, amount_refunded, status, payment_processor_used, payment_processor_transaction_id FROM funders.active_payments WHERE id = $1"
+	GET_PAYMENT_BY_TRANSACTION_QUERY = "SELECT id, campaign_id, perk_id, pledge_id, account_type, amount, currency, amount_refunded, status, payment_processor_used, payment_processor_transaction_id FROM funders.active_payments WHERE payment_processor_used = $1 AND payment_processor_transaction_id = $2"
+	ADD_PAYMENT_QUERY                = "INSERT INTO funders.payments(id, campaign_id, perk_id, account_type, name_on_payment, full_name, address1, address2, city, postal_code, country, amount, currency, status, contact_email, contact_opt_in, advertise, advertise_other, pledge_id, payment_processor_responses, payment_processor_used, payment_processor_transaction_id, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24) ON CONFLICT (id) DO NOTHING RETURNING id"
+	EMAIL_REGEX                      = "^[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+$"
+	UUID_REGEX                       = "^[a-z0-9]{8}-[a-z0-9]{4}-[1-5][a-z0-9]{3}-[a-z0-9]{4}-[a-z0-9]{12}$"
+	PAYMENTS_URL                     = "/payments"
 )
 
 type Payment struct {
-	Id                        string
-	CampaignId                int64 `form:"campaignId" binding:"required"`
-	Campaign                  *Campaign
-	PerkId                    int64 `form:"perkId" binding:"required"`
-	Perk                      *Perk
-	AccountType               string `form:"accountType" binding:"required"`
-	NameOnPayment             string `form:"nameOnPayment" binding:"required"`
-	CreditCardAccountNumber   string `form:"creditCardAccountNumber"`
-	CreditCardExpirationDate  string `form:"creditCardExpirationDate"`
-	CreditCardCvv             string `form:"creditCardCvv"`
-	CreditCardPostalCode      string `form:"creditCardPostalCode"`
-	PaypalRedirectUrl         string `form:"paypalRedirectUrl"`
-	PaypalCancelUrl           string `form:"paypalCancelUrl"`
-	PaypalApprovalUrl         string
-	BitcoinAddress            string `form:"bitcoinAddress"`
-	FullName                  string `form:"fullName" binding:"required"`
-	Address1                  string `form:"address1" "binding:"required"`
-	Address2                  string `form:"address2"`
-	City                      string `form:"city" binding:"required"`
-	PostalCode                string `form:"postalCode" binding:"required"`
-	Country                   string `form:"country" "binding:"required"`
-	Amount                    float64
-	Currency                  string
-	Status                    string
-	ContactEmail              string `form:"contactEmail"`
-	ContactOptIn              bool   `form:"contactOptIn"`
-	Advertise                 bool   `form:"advertise"`
-	AdvertiseOther            string `form:"advertiseOther"`
-	PaymentProcessorResponses string
-	PaymentProcessorUsed      string
-	FailureReason             string
-	PledgeId                  string `form:"pledgeId"`
-	lock                      sync.RWMutex
-}
-
-func (payment *Payment) UpdateStatus(status string) string {
-	payment.lock.Lock()
-	defer payment.lock.Unlock()
-	payment.Status = status
-	return payment.Status
-}
-
-func (payment *Payment) GetStatus() string {
-	payment.lock.RLock()
-	defer payment.lock.RUnlock()
-	return payment.Status
-}
-
-func (payment *Payment) UpdateFailureReason(failureReason string) string {
-	payment.lock.Lock()
-	defer payment.lock.Unlock()
-	payment.FailureReason = failureReason
-	return payment.FailureReason
-}
-
-func (payment *Payment) GetFailureReason() string {
-	payment.lock.RLock()
-	defer payment.lock.RUnlock()
-	return payment.FailureReason
-}
-
-func (payment *Payment) UpdatePaypalApprovalUrl(paypalApprovalUrl string) string {
-	payment.lock.Lock()
-	defer payment.lock.Unlock()
-	payment.PaypalApprovalUrl = paypalApprovalUrl
-	return payment.PaypalApprovalUrl
-}
-
-func (payment *Payment) GetPaypalApprovalUrl() string {
-	payment.lock.RLock()
-	defer payment.lock.RUnlock()
-	return payment.PaypalApprovalUrl
+	common.Payment
 }
 
 func (payment *Payment) MarshalJSON() ([]byte, error) {
-	payment.lock.RLock()
+	payment.Lock.RLock()
 	status := payment.Status
+	amountRefunded := payment.AmountRefunded
 	failureReason := payment.FailureReason
 	paypalApprovalUrl := payment.PaypalApprovalUrl
-	payment.lock.RUnlock()
+	stripeClientSecret := payment.StripeClientSecret
+	stripeRedirectUrl := payment.StripeRedirectUrl
+	bitcoinPaymentUrl := payment.BitcoinPaymentUrl
+	payment.Lock.RUnlock()
 
 	type MyPayment Payment
 	return json.Marshal(&struct {
-		Id                string    `json:"id"`
-		CampaignId        int64     `json:"campaignId"`
-		Campaign          *Campaign `json:"campaign"`
-		PerkId            int64     `json:"perkId"`
-		Perk              *Perk     `json:"perk"`
-		Status            string    `json:"status"`
-		FailureReason     string    `json:"failureReason,omitempty"`
-		PaypalApprovalUrl string    `json:"paypalApprovalUrl,omitempty"`
+		Id                 string               `json:"id"`
+		CampaignId         int64                `json:"campaignId"`
+		Campaign           *Campaign            `json:"campaign"`
+		PerkId             int64                `json:"perkId,omitempty"`
+		Perk               *Perk                `json:"perk,omitempty"`
+		Items              []common.PaymentItem `json:"items,omitempty"`
+		Amount             float64              `json:"amount"`
+		Currency           string               `json:"currency"`
+		Status             string               `json:"status"`
+		AmountRefunded     float64              `json:"amountRefunded,omitempty"`
+		FailureReason      string               `json:"failureReason,omitempty"`
+		PaypalApprovalUrl  string               `json:"paypalApprovalUrl,omitempty"`
+		StripeClientSecret string               `json:"stripeClientSecret,omitempty"`
+		StripeRedirectUrl  string               `json:"stripeRedirectUrl,omitempty"`
+		BitcoinPaymentUrl  string               `json:"bitcoinPaymentUrl,omitempty"`
 	}{
-		Id:                payment.Id,
-		CampaignId:        payment.CampaignId,
-		Campaign:          payment.Campaign,
-		PerkId:            payment.PerkId,
-		Perk:              payment.Perk,
-		Status:            status,
-		FailureReason:     failureReason,
-		PaypalApprovalUrl: paypalApprovalUrl,
+		Id:                 payment.Id,
+		CampaignId:         payment.CampaignId,
+		Campaign:           (*Campaign)(payment.Campaign),
+		PerkId:             payment.PerkId,
+		Perk:               (*Perk)(payment.Perk),
+		Items:              payment.Items,
+		Amount:             payment.Amount,
+		Currency:           payment.Currency,
+		Status:             status,
+		AmountRefunded:     amountRefunded,
+		FailureReason:      failureReason,
+		PaypalApprovalUrl:  paypalApprovalUrl,
+		StripeClientSecret: stripeClientSecret,
+		StripeRedirectUrl:  stripeRedirectUrl,
+		BitcoinPaymentUrl:  bitcoinPaymentUrl,
 	})
 }
 
@@ -137,9 +88,11 @@ func (payment *Payment) Validate(errors binding.Errors, req *http.Request) bindi
 	errors = validateSizeLimit(payment.CreditCardExpirationDate, "creditCardExpirationDate", stringSizeLimit, errors)
 	errors = validateSizeLimit(payment.CreditCardCvv, "creditCardCvv", stringSizeLimit, errors)
 	errors = validateSizeLimit(payment.CreditCardPostalCode, "creditCardPostalCode", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.CreditCardToken, "creditCardToken", stringSizeLimit, errors)
 	errors = validateSizeLimit(payment.PaypalRedirectUrl, "paypalRedirectUrl", stringSizeLimit, errors)
 	errors = validateSizeLimit(payment.PaypalCancelUrl, "paypalCancelUrl", stringSizeLimit, errors)
-	errors = validateSizeLimit(payment.BitcoinAddress, "bitcoinAddress", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.StripeReturnUrl, "stripeReturnUrl", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.BitcoinRedirectUrl, "bitcoinRedirectUrl", stringSizeLimit, errors)
 	errors = validateSizeLimit(payment.FullName, "fullName", stringSizeLimit, errors)
 	errors = validateSizeLimit(payment.Address1, "address1", stringSizeLimit, errors)
 	errors = validateSizeLimit(payment.Address2, "address2", stringSizeLimit, errors)
@@ -149,55 +102,65 @@ func (payment *Payment) Validate(errors binding.Errors, req *http.Request) bindi
 	errors = validateSizeLimit(payment.ContactEmail, "contactEmail", stringSizeLimit, errors)
 	errors = validateSizeLimit(payment.AdvertiseOther, "advertiseOther", stringSizeLimit, errors)
 	errors = validateSizeLimit(payment.PledgeId, "pledgeId", stringSizeLimit, errors)
+	errors = validateSizeLimit(payment.Currency, "currency", stringSizeLimit, errors)
 
 	if len(errors) == 0 {
-		if !accountTypes[payment.AccountType] {
+		paymentProcessor, exists := paymentProcessors.GetPaymentProcessor(payment.AccountType)
+		if exists && common.IsManualAccountType(payment.AccountType) {
+			message := fmt.Sprintf("Account type \"%s\" can only be recorded by administrators", payment.AccountType)
+			errors = addError(errors, []string{"accountType"}, binding.TypeError, message)
+		} else if exists {
+			errors = paymentProcessor.Validate(&payment.Payment, errors)
+		} else {
 			message := fmt.Sprintf("Invalid account type \"%s\" specified", payment.AccountType)
 			errors = addError(errors, []string{"accountType"}, binding.TypeError, message)
 		}
 
-		if payment.AccountType == "credit_card" && (len(payment.CreditCardAccountNumber) == 0 || len(payment.CreditCardExpirationDate) == 0 || len(payment.CreditCardCvv) == 0 || len(payment.CreditCardPostalCode) == 0) {
-			errors = addError(errors, []string{"accountType", "creditCardAccountNumber", "creditCardExpirationDate", "creditCardCvv", "creditCardPostalCode"}, binding.RequiredError, "Credit card account number, expiration date, cvv and postal code required with credit_card account type")
-		}
-
-		if payment.AccountType == "paypal" && (len(payment.PaypalRedirectUrl) == 0 || len(payment.PaypalCancelUrl) == 0) {
-			errors = addError(errors, []string{"accountType", "paypalRedirectUrl", "paypalCancelUrl"}, binding.RequiredError, "Paypal redirect and cancel url required with paypal account type")
-		}
-
-		if payment.AccountType == "bitcoin" && (len(payment.BitcoinAddress) == 0) {
-			errors = addError(errors, []string{"accountType", "bitcoinAddress"}, binding.RequiredError, "Bitcoin address required with bitcoin account type")
-		}
-
 		if len(payment.ContactEmail) > 0 && !emailRegex.MatchString(payment.ContactEmail) {
 			message := fmt.Sprintf("Invalid email \"%s\" format specified", payment.ContactEmail)
 			errors = addError(errors, []string{"contactEmail"}, binding.TypeError, message)
 		}
 
-		perk, exists := perks.GetPerk(payment.PerkId)
-		if exists {
-			if !perk.IsAvailableForPayment() {
-				message := fmt.Sprintf("Perk is not available. (%d/%d) claimed", perk.NumClaimed, perk.AvailableForPayment)
-				errors = addError(errors, []string{"perkId"}, binding.TypeError, message)
-			} else {
-				payment.Amount = perk.Price
-				payment.Currency = perk.Currency
-				payment.Perk = perk
-			}
-		} else {
-			message := fmt.Sprintf("Perk not found with id: %d for campaign: %d", payment.PerkId, payment.CampaignId)
-			errors = addError(errors, []string{"perkId"}, binding.TypeError, message)
-		}
+		//Payments without a perk are donations to the campaign
+		errors = validatePaymentItems(payment, errors)
 
 		campaign, exists := campaigns.GetCampaignById(payment.CampaignId)
 		if exists {
-			if campaign.HasEnded() {
-				message := fmt.Sprintf("Campaign %s with id: %d has expired on %s", campaign.Name, payment.CampaignId, campaign.EndDate)
+			switch status := campaign.GetStatus(); status {
+			case common.CAMPAIGN_LIVE:
+				payment.Campaign = (*common.Campaign)(campaign)
+			case common.CAMPAIGN_DRAFT:
+				message := fmt.Sprintf("Campaign not found with id: %d", payment.CampaignId)
 				errors = addError(errors, []string{"campaignId"}, binding.TypeError, message)
-			} else if !campaign.HasStarted() {
-				message := fmt.Sprintf("Campaign %s with id: %d will start on %s", campaign.Name, payment.CampaignId, campaign.StartDate)
+			case common.CAMPAIGN_SCHEDULED:
+				message := fmt.Sprintf("Campaign %s with id: %d will start on %s", campaign.Name, payment.CampaignId, campaign.StartDate.Format(time.RFC3339))
+				errors = addError(errors, []string{"campaignId"}, binding.TypeError, message)
+			case common.CAMPAIGN_SUCCEEDED, common.CAMPAIGN_FAILED:
+				message := fmt.Sprintf("Campaign %s with id: %d has expired on %s", campaign.Name, payment.CampaignId, campaign.EndDate.Format(time.RFC3339))
+				errors = addError(errors, []string{"campaignId"}, binding.TypeError, message)
+			default:
+				message := fmt.Sprintf("Campaign %s with id: %d is %s", campaign.Name, payment.CampaignId, status)
 				errors = addError(errors, []string{"campaignId"}, binding.TypeError, message)
-			} else {
-				payment.Campaign = campaign
+			}
+
+			//Pledges are paid at the pledged amount unless another is given
+			if 0 == payment.Amount && len(payment.PledgeId) > 0 {
+				if pledge, exists := pledges.GetPledge(payment.PledgeId); exists {
+					payment.Amount = pledge.Amount
+				}
+			}
+
+			if hasPaymentItemPerks(payment) {
+				price, priceCurrency := getPaymentItemsPrice(payment, campaign)
+				payment.Amount, payment.Currency, errors = validateContributionPrice(payment.Amount, payment.Currency, priceCurrency, price, errors)
+			}
+
+			if !campaign.Flexible {
+				paymentProcessor, _ := paymentProcessors.GetPaymentProcessor(payment.AccountType)
+				if paymentAuthorizer, ok := paymentProcessor.(common.PaymentAuthorizer); !ok || !paymentAuthorizer.SupportsAuthorization(&payment.Payment) {
+					message := fmt.Sprintf("Account type \"%s\" is not supported for all-or-nothing campaign %s", payment.AccountType, campaign.Name)
+					errors = addError(errors, []string{"accountType", "campaignId"}, binding.TypeError, message)
+				}
 			}
 		} else {
 			message := fmt.Sprintf("Campaign not found with id: %d", payment.CampaignId)
@@ -212,13 +175,14 @@ func (payment *Payment) Validate(errors binding.Errors, req *http.Request) bindi
 			} else if campaign.Id != pledge.CampaignId {
 				message := fmt.Sprintf("Pledge %s on campaign %d does not match requested campaign id: %d", pledge.Id, pledge.CampaignId, payment.CampaignId)
 				errors = addError(errors, []string{"pledgeId", "campaignId"}, binding.TypeError, message)
-			} else if perk.Id != pledge.PerkId {
+			} else if payment.PerkId != pledge.PerkId {
 				message := fmt.Sprintf("Pledge %s on perk %d does not match requested perk id: %d", pledge.Id, pledge.PerkId, payment.PerkId)
 				errors = addError(errors, []string{"pledgeId", "perkId"}, binding.TypeError, message)
 			}
 
-			_, exists = paymentsCache.GetPaymentByPledgeId(payment.PledgeId)
-			if exists {
+			//Failed and expired payments leave the pledge open for another payment
+			pledgePayment, exists := paymentsCache.GetPaymentByPledgeId(payment.PledgeId)
+			if exists && pledgePayment.GetStatus() != "failure" && pledgePayment.GetStatus() != "expired" {
 				message := fmt.Sprintf("Payment on pledge %s for perk %d already occurred", payment.PledgeId, payment.PerkId)
 				errors = addError(errors, []string{"pledgeId"}, binding.TypeError, message)
 			}
@@ -236,18 +200,24 @@ func (payment *Payment) Validate(errors binding.Errors, req *http.Request) bindi
 }
 
 type Payments struct {
-	lock          sync.RWMutex
-	paymentValues map[string]*Payment
-	pledgeValues  map[string]*Payment
+	lock              sync.RWMutex
+	paymentValues     map[string]*Payment
+	pledgeValues      map[string]*Payment
+	transactionValues map[string]*Payment
 }
 
 func NewPayments() *Payments {
 	payments := new(Payments)
 	payments.paymentValues = make(map[string]*Payment)
 	payments.pledgeValues = make(map[string]*Payment)
+	payments.transactionValues = make(map[string]*Payment)
 	return payments
 }
 
+func getTransactionKey(paymentProcessorUsed string, paymentProcessorTransactionId string) string {
+	return fmt.Sprintf("%s:%s", paymentProcessorUsed, paymentProcessorTransactionId)
+}
+
 func (ps *Payments) AddOrReplacePayment(payment *Payment) *Payment {
 	ps.lock.Lock()
 	defer ps.lock.Unlock()
@@ -255,6 +225,9 @@ func (ps *Payments) AddOrReplacePayment(payment *Payment) *Payment {
 	if len(payment.PledgeId) > 0 {
 		ps.pledgeValues[payment.PledgeId] = payment
 	}
+	if len(payment.PaymentProcessorTransactionId) > 0 {
+		ps.transactionValues[getTransactionKey(payment.PaymentProcessorUsed, payment.PaymentProcessorTransactionId)] = payment
+	}
 	return payment
 }
 
@@ -266,6 +239,9 @@ func (ps *Payments) AddOrReplacePayments(payments []*Payment) {
 		if len(payment.PledgeId) > 0 {
 			ps.pledgeValues[payment.PledgeId] = payment
 		}
+		if len(payment.PaymentProcessorTransactionId) > 0 {
+			ps.transactionValues[getTransactionKey(payment.PaymentProcessorUsed, payment.PaymentProcessorTransactionId)] = payment
+		}
 	}
 }
 
@@ -283,6 +259,13 @@ func (ps *Payments) GetPaymentByPledgeId(pledge_id string) (*Payment, bool) {
 	return val, exists
 }
 
+func (ps *Payments) GetPaymentByTransactionId(paymentProcessorUsed string, paymentProcessorTransactionId string) (*Payment, bool) {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	val, exists := ps.transactionValues[getTransactionKey(paymentProcessorUsed, paymentProcessorTransactionId)]
+	return val, exists
+}
+
 //Payment enumerations
 func getAccountTypes() string {
 	var accountTypesStr string
@@ -316,26 +299,19 @@ var uuidRegex *regexp.Regexp
 var accountTypes map[string]bool
 var paymentStatuses map[string]bool
 
+//Payment processors keyed by account type
+var paymentProcessors = common.NewPaymentProcessors()
+
 //Asynchronous payments
 var asyncPaymentRequest bool
 
 //Background payment threads
-var paymentBatchProcessor *common.BatchProcessor
+var paymentBatchProcessor *common.BatchProcessor[*Payment]
 
 func processPayment(payment *Payment) (error, int) {
-	var err error
 	var retCode int
 
-	switch payment.AccountType {
-	case "credit_card":
-		fallthrough
-	case "bitcoin":
-		err = makeStripePayment(payment, nil)
-	case "paypal":
-		err = makePaypalPayment(payment, nil)
-	default:
-		err = common.RequestError{fmt.Sprintf("Unsupported payment account type %s", payment.AccountType), common.ServiceNotImplementedError}
-	}
+	err := makePayment(payment, nil)
 
 	if nil == err {
 		//Success: StatusCreated (successful transaction from stripe and database)
@@ -354,6 +330,9 @@ func processPayment(payment *Payment) (error, int) {
 		case common.ServiceNotImplementedError:
 			//Error: StatusNotImplemented (stripe, paypal or database is down)
 			retCode = http.StatusNotImplemented
+		case common.ProcessorTimeoutError:
+			//Error: StatusGatewayTimeout (stripe or paypal did not answer, payment stays pending until reconciled)
+			retCode = http.StatusGatewayTimeout
 		case common.ServerError:
 			fallthrough
 		default:
@@ -364,16 +343,18 @@ func processPayment(payment *Payment) (error, int) {
 		retCode = http.StatusInternalServerError
 	}
 
-	dbErr := addPayment(payment, nil)
+	dbErr := addPayment(payment, nil, nil)
+	if nil == dbErr {
+		dbErr = updatePaymentReservations(payment)
+	}
 	if nil != dbErr {
-		log.Print(dbErr)
-		log.Printf("%#v", payment)
+		slog.Error("Unable to record payment", "error", dbErr, "payment", payment)
 	}
 
 	return err, retCode
 }
 
-func processBatchPayment(paymentBatch []interface{}, waitGroup *sync.WaitGroup) {
+func processBatchPayment(paymentBatch []*Payment, waitGroup *sync.WaitGroup) {
 	log.Printf("Starting batch processing of %d payments", len(paymentBatch))
 
 	defer waitGroup.Done()
@@ -382,6 +363,8 @@ func processBatchPayment(paymentBatch []interface{}, waitGroup *sync.WaitGroup)
 	if nil != err {
 		log.Print("Error creating transaction")
 		log.Print(err)
+		failBatch(paymentBatchProcessor, paymentBatch, err)
+		return
 	}
 
 	defer transaction.Rollback()
@@ -389,56 +372,126 @@ func processBatchPayment(paymentBatch []interface{}, waitGroup *sync.WaitGroup)
 	if nil != err {
 		log.Print("Error preparing SQL statement")
 		log.Print(err)
+		failBatch(paymentBatchProcessor, paymentBatch, err)
+		return
 	}
 
 	defer statement.Close()
+	itemStatement, err := transaction.Prepare(ADD_PAYMENT_ITEM_QUERY)
+	if nil != err {
+		log.Print("Error preparing SQL statement")
+		log.Print(err)
+		failBatch(paymentBatchProcessor, paymentBatch, err)
+		return
+	}
+
+	defer itemStatement.Close()
+
+	var payments []*Payment
+	for _, payment := range paymentBatch {
+		err = addPayment(payment, statement, itemStatement)
+		if sql.ErrNoRows == err {
+			var charge bool
+			charge, err = checkRecordedPayment(payment)
+			if nil == err && !charge {
+				continue
+			}
+		}
 
-	counter := 0
-	for _, paymentInterface := range paymentBatch {
-		payment := paymentInterface.(*Payment)
-		err = addPayment(payment, statement)
 		if nil != err {
-			log.Printf("Error processing payment %#v", payment)
-			log.Print(err)
+			slog.Error("Error processing payment", "error", err, "payment", payment)
+			paymentBatchProcessor.FailEvent(payment, err)
 			continue
 		}
 
-		counter++
-		switch payment.AccountType {
-		case "credit_card":
-			fallthrough
-		case "bitcoin":
-			waitGroup.Add(1)
-			go makeStripePayment(payment, waitGroup)
-		case "paypal":
-			waitGroup.Add(1)
-			go makePaypalPayment(payment, waitGroup)
-		default:
-			log.Printf("Unknown payment account type %s", payment.AccountType)
-		}
+		payments = append(payments, payment)
 	}
 
 	err = transaction.Commit()
 	if nil != err {
 		log.Print("Error committing transaction")
 		log.Print(err)
-	} else {
-		log.Printf("Processed %d payments", counter)
+		failBatch(paymentBatchProcessor, paymentBatch, err)
+		return
+	}
+
+	//Payments are only charged once they are recorded
+	for _, payment := range payments {
+		waitGroup.Add(1)
+		go makePayment(payment, waitGroup)
 	}
+
+	log.Printf("Processed %d payments", len(payments))
 }
 
-func addPayment(payment *Payment, statement *sql.Stmt) error {
-	var err error
+//Retried, requeued and restarted payments are already recorded. Returns whether the payment should be charged
+func checkRecordedPayment(payment *Payment) (bool, error) {
+	recordedPayment, err := getPaymentFromDb(payment.Id)
+	if nil != err {
+		return false, err
+	}
+
+	//Payments that completed on a previous attempt are not charged again
+	status := recordedPayment.GetStatus()
+	if status != "pending" && status != "failure" {
+		payment.UpdateStatus(status)
+		return false, nil
+	}
+
+	//Payments a processor may have charged before a restart are reconciled by the sweeper
+	if status == "pending" && (len(recordedPayment.PaymentProcessorTransactionId) > 0 || (len(recordedPayment.PaymentProcessorUsed) > 0 && paymentBatchProcessor.GetAttempts(payment) == 0)) {
+		log.Printf("Payment %s may have been charged by payment processor %s. Leaving for sweeper", payment.Id, recordedPayment.PaymentProcessorUsed)
+		payment.UpdateStatus("pending")
+		return false, nil
+	}
+
+	payment.UpdateStatus("pending")
+	return true, nil
+}
+
+//Payments are recorded with their line items in a single transaction
+func addPayment(payment *Payment, statement *sql.Stmt, itemStatement *sql.Stmt) error {
+	if nil == statement {
+		transaction, err := db.Begin()
+		if nil != err {
+			return err
+		}
+
+		defer transaction.Rollback()
+		statement, err = transaction.Prepare(ADD_PAYMENT_QUERY)
+		if nil != err {
+			return err
+		}
+
+		defer statement.Close()
+		itemStatement, err = transaction.Prepare(ADD_PAYMENT_ITEM_QUERY)
+		if nil != err {
+			return err
+		}
+
+		defer itemStatement.Close()
+		err = addPayment(payment, statement, itemStatement)
+		if nil == err {
+			err = transaction.Commit()
+		}
+
+		return err
+	}
 
 	address2 := common.CreateSqlString(payment.Address2)
 	contactEmail := common.CreateSqlString(payment.ContactEmail)
 	advertiseOther := common.CreateSqlString(payment.AdvertiseOther)
 	pledgeId := common.CreateSqlString(payment.PledgeId)
+	perkId := common.CreateSqlInt64(payment.PerkId)
 
-	if nil == statement {
-		err = db.QueryRow(ADD_PAYMENT_QUERY, payment.Id, payment.CampaignId, payment.PerkId, payment.AccountType, payment.NameOnPayment, payment.FullName, payment.Address1, address2, payment.City, payment.PostalCode, payment.Country, payment.Amount, payment.Currency, payment.GetStatus(), contactEmail, payment.ContactOptIn, payment.Advertise, advertiseOther, pledgeId, time.Now(), time.Now()).Scan(&payment.Id)
-	} else {
-		err = statement.QueryRow(payment.Id, payment.CampaignId, payment.PerkId, payment.AccountType, payment.NameOnPayment, payment.FullName, payment.Address1, address2, payment.City, payment.PostalCode, payment.Country, payment.Amount, payment.Currency, payment.GetStatus(), contactEmail, payment.ContactOptIn, payment.Advertise, advertiseOther, pledgeId, time.Now(), time.Now()).Scan(&payment.Id)
+	//Synchronous payments are charged before they are recorded so webhooks, refunds and settlement can find them by transaction
+	paymentProcessorResponses := common.CreateSqlString(payment.PaymentProcessorResponses)
+	paymentProcessorUsed := common.CreateSqlString(payment.PaymentProcessorUsed)
+	paymentProcessorTransactionId := common.CreateSqlString(payment.PaymentProcessorTransactionId)
+
+	err := statement.QueryRow(payment.Id, payment.CampaignId, perkId, payment.AccountType, payment.NameOnPayment, payment.FullName, payment.Address1, address2, payment.City, payment.PostalCode, payment.Country, payment.Amount, payment.Currency, payment.GetStatus(), contactEmail, payment.ContactOptIn, payment.Advertise, advertiseOther, pledgeId, paymentProcessorResponses, paymentProcessorUsed, paymentProcessorTransactionId, time.Now(), time.Now()).Scan(&payment.Id)
+	if nil == err {
+		err = addPaymentItems(payment, itemStatement)
 	}
 
 	if nil == err {
@@ -451,6 +504,11 @@ func addPayment(payment *Payment, statement *sql.Stmt) error {
 var paymentsCache = NewPayments()
 
 func getPaymentsFromDb() ([]*Payment, error) {
+	paymentItems, err := getAllPaymentItemsFromDb()
+	if nil != err {
+		return nil, err
+	}
+
 	rows, err := db.Query(GET_PAYMENTS_QUERY)
 	if nil != err {
 		return nil, err
@@ -461,12 +519,19 @@ func getPaymentsFromDb() ([]*Payment, error) {
 	var payments []*Payment
 	for rows.Next() {
 		var payment Payment
+		var perkId sql.NullInt64
 		var pledgeId sql.NullString
-		err = rows.Scan(&payment.Id, &payment.CampaignId, &payment.PerkId, &pledgeId, &payment.AccountType, &payment.Status)
+		var paymentProcessorUsed sql.NullString
+		var paymentProcessorTransactionId sql.NullString
+		err = rows.Scan(&payment.Id, &payment.CampaignId, &perkId, &pledgeId, &payment.AccountType, &payment.Amount, &payment.Currency, &payment.AmountRefunded, &payment.Status, &paymentProcessorUsed, &paymentProcessorTransactionId)
 		if nil == err {
+			payment.PerkId = perkId.Int64
+			payment.Items = paymentItems[payment.Id]
 			if pledgeId.Valid {
 				payment.PledgeId = pledgeId.String
 			}
+			payment.PaymentProcessorUsed = paymentProcessorUsed.String
+			payment.PaymentProcessorTransactionId = paymentProcessorTransactionId.String
 			payments = append(payments, &payment)
 		} else {
 			break
@@ -482,11 +547,63 @@ func getPaymentsFromDb() ([]*Payment, error) {
 
 func getPaymentFromDb(id string) (Payment, error) {
 	var payment Payment
+	var perkId sql.NullInt64
+	var pledgeId sql.NullString
+	var paymentProcessorUsed sql.NullString
+	var paymentProcessorTransactionId sql.NullString
+	err := db.QueryRow(GET_PAYMENT_QUERY, id).Scan(&payment.Id, &payment.CampaignId, &perkId, &pledgeId, &payment.AccountType, &payment.Amount, &payment.Currency, &payment.AmountRefunded, &payment.Status, &paymentProcessorUsed, &paymentProcessorTransactionId)
+	if nil == err {
+		payment.Items, err = getPaymentItemsFromDb(payment.Id)
+	}
+	payment.PerkId = perkId.Int64
+	if pledgeId.Valid {
+		payment.PledgeId = pledgeId.String
+	}
+	payment.PaymentProcessorUsed = paymentProcessorUsed.String
+	payment.PaymentProcessorTransactionId = paymentProcessorTransactionId.String
+	return payment, err
+}
+
+func getPaymentByTransactionIdFromDb(paymentProcessorUsed string, paymentProcessorTransactionId string) (Payment, error) {
+	var payment Payment
+	var perkId sql.NullInt64
 	var pledgeId sql.NullString
-	err := db.QueryRow(GET_PAYMENT_QUERY, id).Scan(&payment.Id, &payment.CampaignId, &payment.PerkId, &pledgeId, &payment.AccountType, &payment.Status)
+	var paymentProcessorUsedDb sql.NullString
+	var paymentProcessorTransactionIdDb sql.NullString
+	err := db.QueryRow(GET_PAYMENT_BY_TRANSACTION_QUERY, paymentProcessorUsed, paymentProcessorTransactionId).Scan(&payment.Id, &payment.CampaignId, &perkId, &pledgeId, &payment.AccountType, &payment.Amount, &payment.Currency, &payment.AmountRefunded, &payment.Status, &paymentProcessorUsedDb, &paymentProcessorTransactionIdDb)
+	if nil == err {
+		payment.Items, err = getPaymentItemsFromDb(payment.Id)
+	}
+	payment.PerkId = perkId.Int64
 	if pledgeId.Valid {
 		payment.PledgeId = pledgeId.String
 	}
+	payment.PaymentProcessorUsed = paymentProcessorUsedDb.String
+	payment.PaymentProcessorTransactionId = paymentProcessorTransactionIdDb.String
+	return payment, err
+}
+
+func getPaymentByTransactionId(paymentProcessorUsed string, paymentProcessorTransactionId string) (*Payment, error) {
+	var err error
+	payment, exists := paymentsCache.GetPaymentByTransactionId(paymentProcessorUsed, paymentProcessorTransactionId)
+	if !exists {
+		var paymentDb Payment
+		paymentDb, err = getPaymentByTransactionIdFromDb(paymentProcessorUsed, paymentProcessorTransactionId)
+		if nil == err {
+			//Payment may already be cached before its transaction id was known
+			if cachedPayment, cached := paymentsCache.GetPayment(paymentDb.Id); cached {
+				payment = cachedPayment
+			} else {
+				payment = paymentsCache.AddOrReplacePayment(&paymentDb)
+			}
+			log.Print("Retrieved payment from database")
+		} else {
+			log.Print("Payment not found in database")
+		}
+	} else {
+		log.Print("Retrieved payment from cache")
+	}
+
 	return payment, err
 }
 
@@ -545,38 +662,83 @@ func getPaymentHandler(res http.ResponseWriter, req *http.Request) (int, string)
 }
 
 func makePaymentHandler(res http.ResponseWriter, req *http.Request, payment Payment) (int, string) {
-	payment.Id = uuid.NewV4().String()
+	//Refuse payments while every processor that could charge them is unavailable
+	if retryAfter := getPaymentProcessorRetryAfter(&payment); retryAfter > 0 {
+		req.Close = true
+		res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+		res.Header().Set(RETRY_AFTER_HEADER, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		response := common.Response{Code: http.StatusServiceUnavailable, Message: "Payment processor is unavailable. Try again later"}
+		log.Print(response.Message)
+		jsonStr, _ := json.Marshal(response)
+		return response.Code, string(jsonStr)
+	}
+
+	idempotentRequest, retCode, responseStr := startIdempotentRequest(res, req, PAYMENTS_URL)
+	if retCode > 0 {
+		return retCode, responseStr
+	} else if nil != idempotentRequest {
+		payment.Id = idempotentRequest.resourceId
+		payment.IdempotencyKey = idempotentRequest.key
+	} else {
+		payment.Id = uuid.NewV4().String()
+	}
 	payment.UpdateStatus("pending")
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+	req.Close = true
+
+	//Perks are held until the payment succeeds, fails or the reservation expires
+	err := reservePaymentItems(&payment)
+	if nil != err {
+		response := common.Response{Code: getStatusCode(err), Message: err.Error(), Id: payment.Id}
+		log.Print(response.Message)
+		jsonStr, _ := json.Marshal(response)
+		if response.Code == http.StatusServiceUnavailable {
+			return releaseIdempotentRequest(idempotentRequest, response.Code, string(jsonStr))
+		}
+		return finishIdempotentRequest(idempotentRequest, response.Code, string(jsonStr))
+	}
 
 	paymentsCache.AddOrReplacePayment(&payment)
-	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
 	res.Header().Set(LOCATION_HEADER, fmt.Sprintf("%s?id=%s", PAYMENTS_URL, payment.Id))
 
-	log.Printf("Received new payment: %#v", payment)
+	slog.Info("Received new payment", "payment", &payment)
 
-	req.Close = true
 	var response common.Response
+	var paymentAccepted bool
 
-	if asyncPaymentRequest && nil != paymentBatchProcessor && paymentBatchProcessor.Running {
-		paymentBatchProcessor.AddEvent(&payment)
-		responseStr := "Successfully scheduled payment"
-		response = common.Response{Code: http.StatusAccepted, Message: responseStr, Id: payment.Id}
-		log.Print(responseStr)
+	if asyncPaymentRequest && nil != paymentBatchProcessor && paymentBatchProcessor.IsRunning() {
+		err := paymentBatchProcessor.AddEvent(&payment)
+		if nil != err {
+			log.Print(err)
+			responseStr := "Could not schedule payment due to server error"
+			response = common.Response{Code: http.StatusServiceUnavailable, Message: responseStr, Id: payment.Id}
+		} else {
+			paymentAccepted = true
+			responseStr := "Successfully scheduled payment"
+			response = common.Response{Code: http.StatusAccepted, Message: responseStr, Id: payment.Id}
+		}
+		log.Print(response.Message)
 	} else if !asyncPaymentRequest {
 		err, retCode := processPayment(&payment)
 		if nil != err {
+			//Payments skipped by every open circuit breaker never reached a processor
+			paymentAccepted = !common.IsServiceUnavailable(err) || len(payment.PaymentProcessorUsed) > 0
 			response = common.Response{Code: retCode, Message: err.Error(), Id: payment.Id}
 			log.Print(err)
 		} else {
 			jsonStr, _ := json.Marshal(&payment)
-			return retCode, string(jsonStr)
+			return finishIdempotentRequest(idempotentRequest, retCode, string(jsonStr))
 		}
-	} else if asyncPaymentRequest && (nil == paymentBatchProcessor || !paymentBatchProcessor.Running) {
+	} else if asyncPaymentRequest && (nil == paymentBatchProcessor || !paymentBatchProcessor.IsRunning()) {
 		responseStr := "Could not add payment due to server maintenance"
 		response = common.Response{Code: http.StatusServiceUnavailable, Message: responseStr, Id: payment.Id}
 		log.Print(responseStr)
 	}
 
 	jsonStr, _ := json.Marshal(response)
-	return response.Code, string(jsonStr)
+	if !paymentAccepted {
+		releasePaymentReservations(&payment)
+		return releaseIdempotentRequest(idempotentRequest, response.Code, string(jsonStr))
+	}
+	return finishIdempotentRequest(idempotentRequest, response.Code, string(jsonStr))
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"fmt"
+	"github.com/martini-contrib/binding"
+	"net/http"
+	"testing"
+)
+
+const TEST_PROCESSOR = "test"
+
+//Charges payments without calling out so tests can check what is recorded
+type testPaymentProcessor struct {
+	err     error
+	refunds []float64
+}
+
+func (testProcessor *testPaymentProcessor) GetName() string {
+	return TEST_PROCESSOR
+}
+
+func (testProcessor *testPaymentProcessor) Validate(payment *common.Payment, errors binding.Errors) binding.Errors {
+	return errors
+}
+
+func (testProcessor *testPaymentProcessor) Charge(payment *common.Payment) error {
+	payment.PaymentProcessorTransactionId = fmt.Sprintf("txn_%s", payment.Id)
+	payment.PaymentProcessorResponses = common.FormatPaymentProcessorResponse(fmt.Sprintf(`{"id": "%s"}`, payment.PaymentProcessorTransactionId))
+	if nil != testProcessor.err {
+		payment.UpdateStatus("failure")
+		return testProcessor.err
+	}
+
+	payment.UpdateStatus("success")
+	return nil
+}
+
+func (testProcessor *testPaymentProcessor) Complete(payment *common.Payment, completion common.PaymentCompletion) error {
+	return nil
+}
+
+func (testProcessor *testPaymentProcessor) Refund(payment *common.Payment, amount float64) (string, error) {
+	testProcessor.refunds = append(testProcessor.refunds, amount)
+	return fmt.Sprintf("re_%s_%d", payment.Id, len(testProcessor.refunds)), nil
+}
+
+func (testProcessor *testPaymentProcessor) GetStatus(payment *common.Payment) (string, error) {
+	return payment.GetStatus(), nil
+}
+
+//Replaces the processors for the test so charges never leave the process
+func setTestPaymentProcessor(t *testing.T, accountType string) *testPaymentProcessor {
+	testProcessor := new(testPaymentProcessor)
+
+	previousPaymentProcessors := paymentProcessors
+	paymentProcessors = common.NewPaymentProcessors()
+	paymentProcessors.AddOrReplacePaymentProcessor(accountType, testProcessor)
+	t.Cleanup(func() {
+		paymentProcessors = previousPaymentProcessors
+	})
+
+	return testProcessor
+}
+
+func TestProcessPaymentRecordsProcessorTransaction(t *testing.T) {
+	setTestDatabase(t)
+	campaign := addTestCampaign(t, true)
+	setTestPaymentProcessor(t, "credit_card")
+
+	payment := newTestPayment(campaign)
+	err, retCode := processPayment(payment)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if retCode != http.StatusCreated {
+		t.Fatalf("Expected status code %d but was %d", http.StatusCreated, retCode)
+	}
+
+	//Reloaded as webhooks, refunds and settlement do after a restart or cache eviction
+	recorded, err := getPaymentByTransactionIdFromDb(TEST_PROCESSOR, payment.PaymentProcessorTransactionId)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if recorded.Id != payment.Id || recorded.Status != "success" || recorded.PaymentProcessorUsed != TEST_PROCESSOR {
+		t.Fatalf("Expected successful payment %s from %s but found payment %s with status %s from %s", payment.Id, TEST_PROCESSOR, recorded.Id, recorded.Status, recorded.PaymentProcessorUsed)
+	}
+
+	var responses int
+	err = db.QueryRow("SELECT array_length(payment_processor_responses, 1) FROM funders.payments WHERE id = $1", payment.Id).Scan(&responses)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if responses != 1 {
+		t.Fatalf("Expected the processor response to be recorded but found %d", responses)
+	}
+}
+
+func TestProcessPaymentRecordsFailedTransaction(t *testing.T) {
+	setTestDatabase(t)
+	campaign := addTestCampaign(t, true)
+	testProcessor := setTestPaymentProcessor(t, "credit_card")
+	testProcessor.err = common.RequestError{"Card declined", common.BadRequestError}
+
+	payment := newTestPayment(campaign)
+	err, retCode := processPayment(payment)
+	if nil == err || retCode != http.StatusBadRequest {
+		t.Fatalf("Expected declined payment but status code was %d", retCode)
+	}
+
+	recorded, err := getPaymentFromDb(payment.Id)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if recorded.Status != "failure" || recorded.PaymentProcessorTransactionId != payment.PaymentProcessorTransactionId {
+		t.Fatalf("Expected failed payment with transaction %s but found status %s with transaction %s", payment.PaymentProcessorTransactionId, recorded.Status, recorded.PaymentProcessorTransactionId)
+	}
+}
@@ -21,7 +21,11 @@ const (
 type Perk common.Perk
 
 func (perk *Perk) IsAvailableForPayment() bool {
-	return perk.AvailableForPayment > perk.NumClaimed
+	return perk.IsAvailableForPaymentQuantity(1)
+}
+
+func (perk *Perk) IsAvailableForPaymentQuantity(quantity int64) bool {
+	return perk.AvailableForPayment-perk.NumClaimed >= quantity
 }
 
 func (perk *Perk) IsAvailableForPledge() bool {
@@ -101,6 +105,15 @@ func (pks *Perks) GetPerk(id int64) (*Perk, bool) {
 
 var perks = NewPerks()
 
+//Donations without a perk are found with no perk
+func getContributionPerk(perkId int64) (*Perk, bool) {
+	if 0 == perkId {
+		return nil, true
+	}
+
+	return perks.GetPerk(perkId)
+}
+
 func getPerksFromDb(args ...string) ([]*Perk, error) {
 	var rows *sql.Rows
 	var err error
@@ -171,12 +184,13 @@ func getPerkHandler(res http.ResponseWriter, req *http.Request) (int, string) {
 		response = common.Response{Code: http.StatusBadRequest, Message: responseStr}
 	} else {
 		perks, err := getPerks(campaignName)
+		campaign, campaignErr := getCampaign(campaignName)
 
 		if nil != err {
 			responseStr := "Could not get perks due to server error"
 			response = common.Response{Code: http.StatusInternalServerError, Message: responseStr}
 			log.Print(err)
-		} else if len(perks) <= 0 {
+		} else if len(perks) <= 0 || (nil == campaignErr && !campaign.IsVisible(req)) {
 			responseStr := fmt.Sprintf("%s not found", campaignName)
 			response = common.Response{Code: http.StatusNotFound, Message: responseStr}
 			log.Print(responseStr)
@@ -8,6 +8,7 @@ import (
 	"github.com/martini-contrib/binding"
 	"github.com/satori/go.uuid"
 	"log"
+	"log/slog"
 	"net/http"
 	"sync"
 	"time"
@@ -16,7 +17,7 @@ import (
 const (
 	GET_PLEDGES_QUERY = "SELECT id, campaign_id, perk_id, amount, currency FROM funders.active_pledges"
 	GET_PLEDGE_QUERY  = "SELECT id, campaign_id, perk_id, amount, currency FROM funders.active_pledges WHERE id = $1"
-	ADD_PLEDGE_QUERY  = "INSERT INTO funders.pledges(id, campaign_id, perk_id, contact_email, phone_number, contact_opt_in, amount, currency, advertise, advertise_name, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id"
+	ADD_PLEDGE_QUERY  = "INSERT INTO funders.pledges(id, campaign_id, perk_id, contact_email, phone_number, contact_opt_in, amount, currency, advertise, advertise_name, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) ON CONFLICT (id) DO NOTHING RETURNING id"
 	PLEDGES_URL       = "/pledges"
 )
 
@@ -24,15 +25,15 @@ type Pledge struct {
 	Id            string
 	CampaignId    int64 `form:"campaignId" binding:"required"`
 	Campaign      *Campaign
-	PerkId        int64 `form:"perkId" binding:"required"`
+	PerkId        int64 `form:"perkId"`
 	Perk          *Perk
-	ContactEmail  string `form:"contactEmail"`
-	PhoneNumber   string `form:"phoneNumber"`
-	ContactOptIn  bool   `form:"contactOptIn"`
-	Amount        float64
-	Currency      string
-	Advertise     bool   `form:"advertise"`
-	AdvertiseName string `form:"advertiseName"`
+	ContactEmail  string  `form:"contactEmail" log:"redact"`
+	PhoneNumber   string  `form:"phoneNumber" log:"redact"`
+	ContactOptIn  bool    `form:"contactOptIn"`
+	Amount        float64 `form:"amount"`
+	Currency      string  `form:"currency"`
+	Advertise     bool    `form:"advertise"`
+	AdvertiseName string  `form:"advertiseName"`
 }
 
 func (pledge *Pledge) MarshalJSON() ([]byte, error) {
@@ -41,14 +42,18 @@ func (pledge *Pledge) MarshalJSON() ([]byte, error) {
 		Id         string    `json:"id"`
 		CampaignId int64     `json:"campaignId"`
 		Campaign   *Campaign `json:"campaign"`
-		PerkId     int64     `json:"perkId"`
-		Perk       *Perk     `json:"perk"`
+		PerkId     int64     `json:"perkId,omitempty"`
+		Perk       *Perk     `json:"perk,omitempty"`
+		Amount     float64   `json:"amount"`
+		Currency   string    `json:"currency"`
 	}{
 		Id:         pledge.Id,
 		CampaignId: pledge.CampaignId,
 		Campaign:   pledge.Campaign,
 		PerkId:     pledge.PerkId,
 		Perk:       pledge.Perk,
+		Amount:     pledge.Amount,
+		Currency:   pledge.Currency,
 	})
 }
 
@@ -59,6 +64,7 @@ func (pledge *Pledge) Validate(errors binding.Errors, req *http.Request) binding
 	errors = validateSizeLimit(pledge.ContactEmail, "contactEmail", stringSizeLimit, errors)
 	errors = validateSizeLimit(pledge.PhoneNumber, "phoneNumber", stringSizeLimit, errors)
 	errors = validateSizeLimit(pledge.AdvertiseName, "advertiseName", stringSizeLimit, errors)
+	errors = validateSizeLimit(pledge.Currency, "currency", stringSizeLimit, errors)
 
 	if len(errors) == 0 {
 		if len(pledge.ContactEmail) == 0 && len(pledge.PhoneNumber) == 0 {
@@ -74,31 +80,44 @@ func (pledge *Pledge) Validate(errors binding.Errors, req *http.Request) binding
 			errors = addError(errors, []string{"advertise", "advertiseName"}, binding.TypeError, "Allowing advertisement without providing name")
 		}
 
-		perk, exists := perks.GetPerk(pledge.PerkId)
-		if exists {
-			if !perk.IsAvailableForPledge() {
+		//Pledges without a perk are donations to the campaign
+		if 0 != pledge.PerkId {
+			perk, exists := perks.GetPerk(pledge.PerkId)
+			if !exists || perk.CampaignId != pledge.CampaignId {
+				message := fmt.Sprintf("Perk not found with id: %d for campaign: %d", pledge.PerkId, pledge.CampaignId)
+				errors = addError(errors, []string{"perkId"}, binding.TypeError, message)
+			} else if campaign, exists := campaigns.GetCampaignById(pledge.CampaignId); exists && campaign.IsPerkLocked(pledge.PerkId) {
+				message := fmt.Sprintf("Perk %d is locked until its stretch goal is reached", pledge.PerkId)
+				errors = addError(errors, []string{"perkId"}, binding.TypeError, message)
+			} else if !perk.IsAvailableForPledge() {
 				message := fmt.Sprintf("Perk is not available. (%d/%d) pledged", perk.NumPledged, perk.AvailableForPledge)
 				errors = addError(errors, []string{"perkId"}, binding.TypeError, message)
 			} else {
-				pledge.Amount = perk.Price
-				pledge.Currency = perk.Currency
 				pledge.Perk = perk
 			}
-		} else {
-			message := fmt.Sprintf("Perk not found with id: %d for campaign: %d", pledge.PerkId, pledge.CampaignId)
-			errors = addError(errors, []string{"perkId"}, binding.TypeError, message)
 		}
 
 		campaign, exists := campaigns.GetCampaignById(pledge.CampaignId)
 		if exists {
-			if campaign.HasEnded() {
-				message := fmt.Sprintf("Campaign %s with id: %d has expired on %s", campaign.Name, pledge.CampaignId, campaign.EndDate)
+			switch status := campaign.GetStatus(); status {
+			case common.CAMPAIGN_LIVE:
+				pledge.Campaign = campaign
+			case common.CAMPAIGN_DRAFT:
+				message := fmt.Sprintf("Campaign not found with id: %d", pledge.CampaignId)
 				errors = addError(errors, []string{"campaignId"}, binding.TypeError, message)
-			} else if !campaign.HasStarted() {
-				message := fmt.Sprintf("Campaign %s with id: %d will start on %s", campaign.Name, pledge.CampaignId, campaign.StartDate)
+			case common.CAMPAIGN_SCHEDULED:
+				message := fmt.Sprintf("Campaign %s with id: %d will start on %s", campaign.Name, pledge.CampaignId, campaign.StartDate.Format(time.RFC3339))
+				errors = addError(errors, []string{"campaignId"}, binding.TypeError, message)
+			case common.CAMPAIGN_SUCCEEDED, common.CAMPAIGN_FAILED:
+				message := fmt.Sprintf("Campaign %s with id: %d has expired on %s", campaign.Name, pledge.CampaignId, campaign.EndDate.Format(time.RFC3339))
+				errors = addError(errors, []string{"campaignId"}, binding.TypeError, message)
+			default:
+				message := fmt.Sprintf("Campaign %s with id: %d is %s", campaign.Name, pledge.CampaignId, status)
 				errors = addError(errors, []string{"campaignId"}, binding.TypeError, message)
-			} else {
-				pledge.Campaign = campaign
+			}
+
+			if 0 == pledge.PerkId || nil != pledge.Perk {
+				pledge.Amount, pledge.Currency, errors = validateContributionAmount(pledge.Amount, pledge.Currency, campaign, pledge.Perk, errors)
 			}
 		} else {
 			message := fmt.Sprintf("Campaign not found with id: %d", pledge.CampaignId)
@@ -148,7 +167,7 @@ func (ps *Pledges) GetPledge(id string) (*Pledge, bool) {
 }
 
 //Background pledge threads
-var pledgeBatchProcessor *common.BatchProcessor
+var pledgeBatchProcessor *common.BatchProcessor[*Pledge]
 
 func processPledge(pledge *Pledge) error {
 	err := addPledge(pledge, nil)
@@ -158,7 +177,7 @@ func processPledge(pledge *Pledge) error {
 	return err
 }
 
-func processBatchPledge(pledgeBatch []interface{}, waitGroup *sync.WaitGroup) {
+func processBatchPledge(pledgeBatch []*Pledge, waitGroup *sync.WaitGroup) {
 	log.Printf("Starting batch processing of %d pledges", len(pledgeBatch))
 
 	defer waitGroup.Done()
@@ -167,6 +186,8 @@ func processBatchPledge(pledgeBatch []interface{}, waitGroup *sync.WaitGroup) {
 	if nil != err {
 		log.Print("Error creating transaction")
 		log.Print(err)
+		failBatch(pledgeBatchProcessor, pledgeBatch, err)
+		return
 	}
 
 	defer transaction.Rollback()
@@ -174,32 +195,42 @@ func processBatchPledge(pledgeBatch []interface{}, waitGroup *sync.WaitGroup) {
 	if nil != err {
 		log.Print("Error preparing SQL statement")
 		log.Print(err)
+		failBatch(pledgeBatchProcessor, pledgeBatch, err)
+		return
 	}
 
 	defer statement.Close()
 
-	counter := 0
-	for _, pledgeInterface := range pledgeBatch {
-		pledge := pledgeInterface.(*Pledge)
+	var pledgeList []*Pledge
+	for _, pledge := range pledgeBatch {
 		err = addPledge(pledge, statement)
-		if nil != err {
-			log.Printf("Error processing pledge %#v", pledge)
-			log.Print(err)
+		if sql.ErrNoRows == err {
+			//Pledges replayed after a restart are already recorded
+			log.Printf("Pledge %s already recorded", pledge.Id)
+			continue
+		} else if nil != err {
+			slog.Error("Error processing pledge", "error", err, "pledge", pledge)
+			pledgeBatchProcessor.FailEvent(pledge, err)
 			continue
 		}
 
-		counter++
-		waitGroup.Add(1)
-		go makePledge(pledge, waitGroup)
+		pledgeList = append(pledgeList, pledge)
 	}
 
 	err = transaction.Commit()
 	if nil != err {
 		log.Print("Error committing transaction")
 		log.Print(err)
-	} else {
-		log.Printf("Processed %d pledges", counter)
+		failBatch(pledgeBatchProcessor, pledgeBatch, err)
+		return
 	}
+
+	for _, pledge := range pledgeList {
+		waitGroup.Add(1)
+		go makePledge(pledge, waitGroup)
+	}
+
+	log.Printf("Processed %d pledges", len(pledgeList))
 }
 
 func addPledge(pledge *Pledge, statement *sql.Stmt) error {
@@ -210,9 +241,9 @@ func addPledge(pledge *Pledge, statement *sql.Stmt) error {
 	advertiseName := common.CreateSqlString(pledge.AdvertiseName)
 
 	if nil == statement {
-		err = db.QueryRow(ADD_PLEDGE_QUERY, pledge.Id, pledge.CampaignId, pledge.PerkId, contactEmail, phoneNumber, pledge.ContactOptIn, pledge.Amount, pledge.Currency, pledge.Advertise, advertiseName, time.Now(), time.Now()).Scan(&pledge.Id)
+		err = db.QueryRow(ADD_PLEDGE_QUERY, pledge.Id, pledge.CampaignId, common.CreateSqlInt64(pledge.PerkId), contactEmail, phoneNumber, pledge.ContactOptIn, pledge.Amount, pledge.Currency, pledge.Advertise, advertiseName, time.Now(), time.Now()).Scan(&pledge.Id)
 	} else {
-		err = statement.QueryRow(pledge.Id, pledge.CampaignId, pledge.PerkId, contactEmail, phoneNumber, pledge.ContactOptIn, pledge.Amount, pledge.Currency, pledge.Advertise, advertiseName, time.Now(), time.Now()).Scan(&pledge.Id)
+		err = statement.QueryRow(pledge.Id, pledge.CampaignId, common.CreateSqlInt64(pledge.PerkId), contactEmail, phoneNumber, pledge.ContactOptIn, pledge.Amount, pledge.Currency, pledge.Advertise, advertiseName, time.Now(), time.Now()).Scan(&pledge.Id)
 	}
 	if nil == err {
 		log.Printf("New pledge id = %s", pledge.Id)
@@ -226,11 +257,13 @@ func makePledge(pledge *Pledge, waitGroup *sync.WaitGroup) {
 		defer waitGroup.Done()
 	}
 
-	perk, exists := perks.GetPerk(pledge.PerkId)
-	if exists {
-		perk.IncrementNumPledged(1)
-	} else {
-		log.Printf("Perk %d not found for campaign %d", pledge.PerkId, pledge.CampaignId)
+	if 0 != pledge.PerkId {
+		perk, exists := perks.GetPerk(pledge.PerkId)
+		if exists {
+			perk.IncrementNumPledged(1)
+		} else {
+			log.Printf("Perk %d not found for campaign %d", pledge.PerkId, pledge.CampaignId)
+		}
 	}
 
 	campaign, exists := campaigns.GetCampaignById(pledge.CampaignId)
@@ -256,8 +289,10 @@ func getPledgesFromDb() ([]*Pledge, error) {
 	var pledges []*Pledge
 	for rows.Next() {
 		var pledge Pledge
-		err = rows.Scan(&pledge.Id, &pledge.CampaignId, &pledge.PerkId, &pledge.Amount, &pledge.Currency)
+		var perkId sql.NullInt64
+		err = rows.Scan(&pledge.Id, &pledge.CampaignId, &perkId, &pledge.Amount, &pledge.Currency)
 		if nil == err {
+			pledge.PerkId = perkId.Int64
 			pledges = append(pledges, &pledge)
 		} else {
 			break
@@ -273,7 +308,9 @@ func getPledgesFromDb() ([]*Pledge, error) {
 
 func getPledgeFromDb(id string) (Pledge, error) {
 	var pledge Pledge
-	err := db.QueryRow(GET_PLEDGE_QUERY, id).Scan(&pledge.Id, &pledge.CampaignId, &pledge.PerkId, &pledge.Amount, &pledge.Currency)
+	var perkId sql.NullInt64
+	err := db.QueryRow(GET_PLEDGE_QUERY, id).Scan(&pledge.Id, &pledge.CampaignId, &perkId, &pledge.Amount, &pledge.Currency)
+	pledge.PerkId = perkId.Int64
 	return pledge, err
 }
 
@@ -298,22 +335,35 @@ func getPledge(id string) (*Pledge, error) {
 }
 
 func makePledgeHandler(res http.ResponseWriter, req *http.Request, pledge Pledge) (int, string) {
-	pledge.Id = uuid.NewV4().String()
+	idempotentRequest, retCode, responseStr := startIdempotentRequest(res, req, PLEDGES_URL)
+	if retCode > 0 {
+		return retCode, responseStr
+	} else if nil != idempotentRequest {
+		pledge.Id = idempotentRequest.resourceId
+	} else {
+		pledge.Id = uuid.NewV4().String()
+	}
 
 	pledges.AddOrReplacePledge(&pledge)
 	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
 	res.Header().Set(LOCATION_HEADER, fmt.Sprintf("%s?id=%s", PLEDGES_URL, pledge.Id))
 
-	log.Printf("Received new pledge: %#v", pledge)
+	slog.Info("Received new pledge", "pledge", &pledge)
 
 	req.Close = true
 	var response common.Response
 
-	if asyncPledgeRequest && nil != pledgeBatchProcessor && pledgeBatchProcessor.Running {
-		pledgeBatchProcessor.AddEvent(&pledge)
-		responseStr := "Successfully scheduled pledge"
-		response = common.Response{Code: http.StatusAccepted, Message: responseStr, Id: pledge.Id}
-		log.Print(responseStr)
+	if asyncPledgeRequest && nil != pledgeBatchProcessor && pledgeBatchProcessor.IsRunning() {
+		err := pledgeBatchProcessor.AddEvent(&pledge)
+		if nil != err {
+			log.Print(err)
+			responseStr := "Could not schedule pledge due to server error"
+			response = common.Response{Code: http.StatusServiceUnavailable, Message: responseStr, Id: pledge.Id}
+		} else {
+			responseStr := "Successfully scheduled pledge"
+			response = common.Response{Code: http.StatusAccepted, Message: responseStr, Id: pledge.Id}
+		}
+		log.Print(response.Message)
 	} else if !asyncPledgeRequest {
 		err := processPledge(&pledge)
 		if nil != err {
@@ -321,14 +371,17 @@ func makePledgeHandler(res http.ResponseWriter, req *http.Request, pledge Pledge
 			log.Print(err)
 		} else {
 			jsonStr, _ := json.Marshal(&pledge)
-			return http.StatusCreated, string(jsonStr)
+			return finishIdempotentRequest(idempotentRequest, http.StatusCreated, string(jsonStr))
 		}
-	} else if asyncPledgeRequest && (nil == pledgeBatchProcessor || !pledgeBatchProcessor.Running) {
+	} else if asyncPledgeRequest && (nil == pledgeBatchProcessor || !pledgeBatchProcessor.IsRunning()) {
 		responseStr := "Could not add pledge due to server maintenance"
 		response = common.Response{Code: http.StatusServiceUnavailable, Message: responseStr, Id: pledge.Id}
 		log.Print(responseStr)
 	}
 
 	jsonStr, _ := json.Marshal(response)
-	return response.Code, string(jsonStr)
+	if response.Code == http.StatusServiceUnavailable {
+		return releaseIdempotentRequest(idempotentRequest, response.Code, string(jsonStr))
+	}
+	return finishIdempotentRequest(idempotentRequest, response.Code, string(jsonStr))
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/satori/go.uuid"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ADD_REFUND_QUERY             = "INSERT INTO funders.refunds(id, payment_id, amount, reason, payment_processor_refund_id, created_at) VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT (payment_id, payment_processor_refund_id) DO NOTHING"
+	UPDATE_PAYMENT_REFUNDS_QUERY = "UPDATE funders.payments SET updated_at = $1, payment_processor_responses = payment_processor_responses || $2, amount_refunded = refunded.amount, status = CASE WHEN payments.status NOT IN ('success', 'partially_refunded', 'refunded') THEN payments.status WHEN refunded.amount >= payments.amount THEN 'refunded'::funders.payment_status ELSE 'partially_refunded'::funders.payment_status END FROM (SELECT COALESCE(sum(amount), 0) AS amount FROM funders.refunds WHERE payment_id = $3) refunded WHERE payments.id = $3 RETURNING payments.amount_refunded, payments.status"
+	REFUNDS_URL                  = "/payments/:id/refunds"
+)
+
+type Refund struct {
+	Id        string
+	PaymentId string
+	Amount    float64 `form:"amount"`
+	Reason    string  `form:"reason"`
+	payment   *Payment
+}
+
+func (refund *Refund) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Id             string  `json:"id"`
+		PaymentId      string  `json:"paymentId"`
+		Amount         float64 `json:"amount"`
+		Reason         string  `json:"reason,omitempty"`
+		Status         string  `json:"status"`
+		AmountRefunded float64 `json:"amountRefunded"`
+	}{
+		Id:             refund.Id,
+		PaymentId:      refund.PaymentId,
+		Amount:         refund.Amount,
+		Reason:         refund.Reason,
+		Status:         refund.payment.GetStatus(),
+		AmountRefunded: refund.payment.GetAmountRefunded(),
+	})
+}
+
+func (refund *Refund) Validate(errors binding.Errors, req *http.Request) binding.Errors {
+	errors = validateSizeLimit(refund.Reason, "reason", stringSizeLimit, errors)
+
+	if refund.Amount < 0 {
+		message := fmt.Sprintf("Refund amount %f can not be negative", refund.Amount)
+		errors = addError(errors, []string{"amount"}, binding.TypeError, message)
+	}
+
+	return errors
+}
+
+type processorRefund struct {
+	refundId string
+	id       string
+	amount   float64
+	reason   string
+}
+
+//Counted statuses contribute to campaign and perk totals
+func isCountedStatus(status string) bool {
+	return status == "success" || status == "partially_refunded" || status == "authorized"
+}
+
+func isRefundableStatus(status string) bool {
+	return status == "success" || status == "partially_refunded"
+}
+
+//Caller must hold reconcileLock
+func recordRefunds(payment *Payment, processorRefunds []processorRefund) error {
+	transaction, err := db.Begin()
+	if nil != err {
+		return err
+	}
+
+	defer transaction.Rollback()
+
+	for _, processorRefund := range processorRefunds {
+		if len(processorRefund.refundId) == 0 {
+			processorRefund.refundId = uuid.NewV4().String()
+		}
+
+		_, err = transaction.Exec(ADD_REFUND_QUERY, processorRefund.refundId, payment.Id, processorRefund.amount, common.CreateSqlString(processorRefund.reason), processorRefund.id, time.Now())
+		if nil != err {
+			return err
+		}
+	}
+
+	var amountRefunded float64
+	var status string
+	err = transaction.QueryRow(UPDATE_PAYMENT_REFUNDS_QUERY, time.Now(), payment.PaymentProcessorResponses, payment.Id).Scan(&amountRefunded, &status)
+	if nil != err {
+		return err
+	}
+
+	err = transaction.Commit()
+	if nil != err {
+		return err
+	}
+
+	//Totals only change for payments that were counted towards the campaign
+	previousStatus := payment.GetStatus()
+	previousAmountRefunded := payment.GetAmountRefunded()
+	payment.UpdateAmountRefunded(amountRefunded)
+	payment.UpdateStatus(status)
+
+	campaign, campaignExists := campaigns.GetCampaignById(payment.CampaignId)
+	_, perkExists := getContributionPerk(payment.PerkId)
+	if isCountedStatus(previousStatus) && campaignExists && perkExists {
+		campaign.IncrementAmtRaised(previousAmountRefunded - amountRefunded)
+		if !isCountedStatus(status) {
+			campaign.IncrementNumBackers(-1)
+			advertisements.RemoveAdvertisementFromPayment(campaign.Name, payment)
+			incrementPaymentItemsClaimed(payment, -1)
+		}
+	}
+
+	paymentsCache.AddOrReplacePayment(payment)
+	log.Printf("Payment %s has %f refunded with status %s", payment.Id, amountRefunded, status)
+	return nil
+}
+
+//Refunds reported by payment processor webhooks
+func reconcileRefunds(payment *Payment, processorRefunds []processorRefund, response interface{}) error {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	jsonErr := payment.UpdatePaymentProcessorResponses(response)
+	if nil != jsonErr {
+		log.Print(jsonErr)
+		log.Printf("Unable to marshal processor response for payment %s", payment.Id)
+	}
+
+	err := recordRefunds(payment, processorRefunds)
+	if nil != err {
+		log.Print(err)
+		return common.RequestError{fmt.Sprintf("Unable to record refunds for payment %s", payment.Id), common.ServerError}
+	}
+
+	return nil
+}
+
+func refundPayment(refund *Refund) error {
+	payment := refund.payment
+
+	paymentProcessor, exists := getPaymentProcessor(payment)
+	if !exists {
+		return common.RequestError{fmt.Sprintf("Unsupported payment refund account type %s", payment.AccountType), common.ServiceNotImplementedError}
+	}
+
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	if !isRefundableStatus(payment.GetStatus()) {
+		return common.RequestError{fmt.Sprintf("Only successful payments can be refunded. Status: \"%s\"", payment.GetStatus()), common.BadRequestError}
+	}
+
+	//Default to refunding the remaining amount
+	remaining := payment.Amount - payment.GetAmountRefunded()
+	if refund.Amount == 0 {
+		refund.Amount = remaining
+	}
+
+	refund.Amount = math.Floor(refund.Amount*100+0.5) / 100
+	if refund.Amount <= 0 || refund.Amount > remaining+0.005 {
+		return common.RequestError{fmt.Sprintf("Refund amount %.2f must be between 0 and remaining amount %.2f", refund.Amount, remaining), common.BadRequestError}
+	}
+
+	var processorRefundId string
+	err := callPaymentProcessor(paymentProcessor, func() error {
+		var refundErr error
+		processorRefundId, refundErr = paymentProcessor.Refund(&payment.Payment, refund.Amount)
+		return refundErr
+	})
+	if nil != err {
+		return err
+	}
+
+	err = recordRefunds(payment, []processorRefund{{refund.Id, processorRefundId, refund.Amount, refund.Reason}})
+	if nil != err {
+		log.Print(err)
+		return common.RequestError{fmt.Sprintf("Refund %s issued but could not be recorded for payment %s", processorRefundId, payment.Id), common.ServerError}
+	}
+
+	return nil
+}
+
+func refundPaymentHandler(res http.ResponseWriter, req *http.Request, params martini.Params, refund Refund) (int, string) {
+	req.Close = true
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+	var response common.Response
+
+	refund.Id = uuid.NewV4().String()
+	refund.PaymentId = strings.TrimSpace(params["id"])
+
+	slog.Info("Received new refund", "refund", &refund)
+
+	if !uuidRegex.MatchString(refund.PaymentId) {
+		responseStr := fmt.Sprintf("Payment id parameter %s is in the wrong format", refund.PaymentId)
+		response = common.Response{Code: http.StatusBadRequest, Message: responseStr}
+	} else if payment, err := getPayment(refund.PaymentId); sql.ErrNoRows == err {
+		responseStr := fmt.Sprintf("%s not found", refund.PaymentId)
+		response = common.Response{Code: http.StatusNotFound, Message: responseStr}
+	} else if nil != err {
+		log.Print(err)
+		responseStr := "Could not get payment due to server error"
+		response = common.Response{Code: http.StatusInternalServerError, Message: responseStr}
+	} else {
+		refund.payment = payment
+		err = refundPayment(&refund)
+		if nil == err {
+			log.Printf("Successfully refunded %f for payment %s", refund.Amount, refund.PaymentId)
+			jsonStr, _ := json.Marshal(&refund)
+			return http.StatusCreated, string(jsonStr)
+		}
+
+		response = common.Response{Code: getStatusCode(err), Message: err.Error(), Id: refund.PaymentId}
+	}
+
+	log.Print(response.Message)
+	jsonStr, _ := json.Marshal(response)
+	return response.Code, string(jsonStr)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"math"
+	"testing"
+)
+
+func isAmount(amount float64, expected float64) bool {
+	return math.Abs(amount-expected) < 0.001
+}
+
+func newTestRefund(payment *Payment, amount float64) *Refund {
+	return &Refund{PaymentId: payment.Id, Amount: amount, payment: payment}
+}
+
+func TestRefundPaymentRejectsInvalidAmounts(t *testing.T) {
+	testProcessor := setTestPaymentProcessor(t, "credit_card")
+	payment := newTestPayment(&Campaign{Currency: "USD"})
+	payment.UpdateStatus("partially_refunded")
+	payment.UpdateAmountRefunded(4)
+
+	//Amounts are rounded to cents before they are compared to the remaining amount
+	for _, amount := range []float64{6.01, 6.006, 10, 0.004, -1} {
+		err := refundPayment(newTestRefund(payment, amount))
+		if requestErr, ok := err.(common.RequestError); !ok || requestErr.Type != common.BadRequestError {
+			t.Errorf("Expected refund of %f to be rejected but was %v", amount, err)
+		}
+	}
+
+	if len(testProcessor.refunds) != 0 {
+		t.Fatalf("Expected no refunds to be sent to the payment processor but sent %v", testProcessor.refunds)
+	}
+}
+
+func TestRefundPaymentRequiresSuccessfulPayment(t *testing.T) {
+	testProcessor := setTestPaymentProcessor(t, "credit_card")
+	payment := newTestPayment(&Campaign{Currency: "USD"})
+
+	for _, status := range []string{"pending", "authorized", "failure", "refunded", "voided"} {
+		payment.UpdateStatus(status)
+		err := refundPayment(newTestRefund(payment, 1))
+		if requestErr, ok := err.(common.RequestError); !ok || requestErr.Type != common.BadRequestError {
+			t.Errorf("Expected refund of %s payment to be rejected but was %v", status, err)
+		}
+	}
+
+	if len(testProcessor.refunds) != 0 {
+		t.Fatalf("Expected no refunds to be sent to the payment processor but sent %v", testProcessor.refunds)
+	}
+}
+
+func TestRefundPaymentPartiallyThenFully(t *testing.T) {
+	setTestDatabase(t)
+	campaign := addTestCampaign(t, true)
+	testProcessor := setTestPaymentProcessor(t, "credit_card")
+
+	payment := newTestPayment(campaign)
+	err, _ := processPayment(payment)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	err = refundPayment(newTestRefund(payment, 3.333))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if payment.GetStatus() != "partially_refunded" || payment.GetAmountRefunded() != 3.33 {
+		t.Fatalf("Expected 3.33 partially refunded but status was %s with %f refunded", payment.GetStatus(), payment.GetAmountRefunded())
+	}
+	if !isAmount(campaign.AmtRaised, 6.67) || campaign.NumBackers != 1 {
+		t.Fatalf("Expected partial refund to reduce amount raised to 6.67 but was %f with %d backers", campaign.AmtRaised, campaign.NumBackers)
+	}
+
+	//No amount refunds what remains
+	err = refundPayment(newTestRefund(payment, 0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if payment.GetStatus() != "refunded" || payment.GetAmountRefunded() != 10 {
+		t.Fatalf("Expected payment to be refunded but status was %s with %f refunded", payment.GetStatus(), payment.GetAmountRefunded())
+	}
+	if !isAmount(campaign.AmtRaised, 0) || campaign.NumBackers != 0 {
+		t.Fatalf("Expected full refund to remove the payment from totals but amount raised was %f with %d backers", campaign.AmtRaised, campaign.NumBackers)
+	}
+	if len(testProcessor.refunds) != 2 || !isAmount(testProcessor.refunds[0], 3.33) || !isAmount(testProcessor.refunds[1], 6.67) {
+		t.Fatalf("Expected refunds of 3.33 and 6.67 to be sent to the payment processor but sent %v", testProcessor.refunds)
+	}
+
+	recorded, err := getPaymentFromDb(payment.Id)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if recorded.Status != "refunded" || recorded.AmountRefunded != 10 {
+		t.Fatalf("Expected refunded payment to be recorded but found status %s with %f refunded", recorded.Status, recorded.AmountRefunded)
+	}
+}
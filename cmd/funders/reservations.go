@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	LOCK_PERK_QUERY             = "SELECT id FROM funders.perks WHERE id = $1 AND active = TRUE FOR UPDATE"
+	GET_PERK_AVAILABILITY_QUERY = "SELECT perk_claims.available_for_payment - perk_claims.num_claimed - COALESCE(sum(perk_reservations.quantity), 0) FROM funders.perk_claims LEFT OUTER JOIN funders.perk_reservations ON perk_claims.id = perk_reservations.perk_id AND perk_reservations.status = 'held' AND perk_reservations.expires_at > $2 AND perk_reservations.payment_id <> $3 WHERE perk_claims.id = $1 GROUP BY perk_claims.id, perk_claims.available_for_payment, perk_claims.num_claimed"
+	ADD_RESERVATION_QUERY       = "INSERT INTO funders.perk_reservations(payment_id, perk_id, quantity, status, expires_at, created_at, updated_at) VALUES($1, $2, $3, 'held', $4, $5, $5) ON CONFLICT (payment_id, perk_id) DO NOTHING"
+	CONVERT_RESERVATIONS_QUERY  = "UPDATE funders.perk_reservations SET status = 'converted', updated_at = $1 WHERE payment_id = $2 AND status = 'held'"
+	RELEASE_RESERVATIONS_QUERY  = "UPDATE funders.perk_reservations SET status = 'released', updated_at = $1 WHERE payment_id = $2 AND status = 'held'"
+)
+
+//How long perks are held for payments awaiting approval or authentication
+var perkReservationTtl time.Duration
+
+//Perks are reserved in postgres so concurrent requests and server instances can not oversell them
+func reservePaymentItems(payment *Payment) error {
+	if len(payment.Items) == 0 {
+		return nil
+	}
+
+	//Perks are locked in id order so concurrent reservations can not deadlock
+	items := make([]common.PaymentItem, len(payment.Items))
+	copy(items, payment.Items)
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].PerkId < items[j].PerkId
+	})
+
+	transaction, err := db.Begin()
+	if nil != err {
+		log.Print(err)
+		return common.RequestError{fmt.Sprintf("Unable to reserve perks for payment %s", payment.Id), common.ServiceUnavailableError}
+	}
+
+	defer transaction.Rollback()
+
+	now := time.Now()
+	for _, item := range items {
+		var available int64
+		err = transaction.QueryRow(LOCK_PERK_QUERY, item.PerkId).Scan(&item.PerkId)
+		if nil == err {
+			err = transaction.QueryRow(GET_PERK_AVAILABILITY_QUERY, item.PerkId, now, payment.Id).Scan(&available)
+		}
+
+		if sql.ErrNoRows == err {
+			return common.RequestError{fmt.Sprintf("Perk not found %d", item.PerkId), common.NotFoundError}
+		} else if nil != err {
+			log.Print(err)
+			return common.RequestError{fmt.Sprintf("Unable to reserve perk %d for payment %s", item.PerkId, payment.Id), common.ServiceUnavailableError}
+		} else if available < item.Quantity {
+			return common.RequestError{fmt.Sprintf("Perk %d is not available for quantity %d. %d available", item.PerkId, item.Quantity, available), common.BadRequestError}
+		}
+
+		_, err = transaction.Exec(ADD_RESERVATION_QUERY, payment.Id, item.PerkId, item.Quantity, now.Add(perkReservationTtl), now)
+		if nil != err {
+			log.Print(err)
+			return common.RequestError{fmt.Sprintf("Unable to reserve perk %d for payment %s", item.PerkId, payment.Id), common.ServiceUnavailableError}
+		}
+	}
+
+	err = transaction.Commit()
+	if nil != err {
+		log.Print(err)
+		return common.RequestError{fmt.Sprintf("Unable to reserve perks for payment %s", payment.Id), common.ServiceUnavailableError}
+	}
+
+	log.Printf("Reserved %d perks for payment %s until %s", len(items), payment.Id, now.Add(perkReservationTtl))
+	return nil
+}
+
+//Perks held for payments that were never accepted are released so retries and other supporters can claim them
+func releasePaymentReservations(payment *Payment) error {
+	if len(payment.Items) == 0 {
+		return nil
+	}
+
+	_, err := db.Exec(RELEASE_RESERVATIONS_QUERY, time.Now(), payment.Id)
+	if nil != err {
+		log.Print(err)
+		return common.RequestError{fmt.Sprintf("Unable to release perks for payment %s", payment.Id), common.ServiceUnavailableError}
+	}
+
+	log.Printf("Released perks for payment %s", payment.Id)
+	return nil
+}
+
+//Held perks are converted once payments are counted and released once they fail
+func updatePaymentReservations(payment *Payment) error {
+	var err error
+
+	switch status := payment.GetStatus(); {
+	case isCountedStatus(status):
+		_, err = db.Exec(CONVERT_RESERVATIONS_QUERY, time.Now(), payment.Id)
+	case status != "pending":
+		_, err = db.Exec(RELEASE_RESERVATIONS_QUERY, time.Now(), payment.Id)
+	}
+
+	return err
+}
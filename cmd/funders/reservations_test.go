@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestReservationPayment(campaign *Campaign, perk *Perk, quantity int64) *Payment {
+	payment := newTestPayment(campaign)
+	payment.Items = []common.PaymentItem{{PerkId: perk.Id, Quantity: quantity, Price: perk.Price}}
+	return payment
+}
+
+func getReservationStatus(t *testing.T, payment *Payment, perk *Perk) string {
+	var status string
+	err := db.QueryRow("SELECT status FROM funders.perk_reservations WHERE payment_id = $1 AND perk_id = $2", payment.Id, perk.Id).Scan(&status)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestReservePaymentItemsPreventsOverselling(t *testing.T) {
+	setTestDatabase(t)
+	campaign := addTestCampaign(t, true)
+	perk := addTestPerk(t, campaign, 3)
+
+	first := newTestReservationPayment(campaign, perk, 2)
+	err := reservePaymentItems(first)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	second := newTestReservationPayment(campaign, perk, 2)
+	err = reservePaymentItems(second)
+	if requestErr, ok := err.(common.RequestError); !ok || requestErr.Type != common.BadRequestError {
+		t.Fatalf("Expected perk held by another payment to be unavailable but was %v", err)
+	}
+
+	//Payments retried with the same id keep their reservation
+	err = reservePaymentItems(first)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	err = releasePaymentReservations(first)
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = reservePaymentItems(second)
+	if nil != err {
+		t.Fatalf("Expected released perks to be available but was %v", err)
+	}
+}
+
+func TestUpdatePaymentReservations(t *testing.T) {
+	setTestDatabase(t)
+	campaign := addTestCampaign(t, true)
+	perk := addTestPerk(t, campaign, 10)
+
+	statuses := map[string]string{
+		"pending": "held",
+		"success": "converted",
+		"failure": "released",
+		"expired": "released",
+	}
+
+	for paymentStatus, reservationStatus := range statuses {
+		payment := newTestReservationPayment(campaign, perk, 1)
+		err := reservePaymentItems(payment)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		payment.UpdateStatus(paymentStatus)
+		err = updatePaymentReservations(payment)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		if status := getReservationStatus(t, payment, perk); status != reservationStatus {
+			t.Errorf("Expected %s payment to leave reservation %s but was %s", paymentStatus, reservationStatus, status)
+		}
+	}
+}
+
+func TestMakePaymentReleasesReservationsWhenNotAccepted(t *testing.T) {
+	setTestDatabase(t)
+	campaign := addTestCampaign(t, true)
+	perk := addTestPerk(t, campaign, 1)
+
+	previousAsyncPaymentRequest := asyncPaymentRequest
+	previousPaymentBatchProcessor := paymentBatchProcessor
+	asyncPaymentRequest = true
+	paymentBatchProcessor = nil
+	defer func() {
+		asyncPaymentRequest = previousAsyncPaymentRequest
+		paymentBatchProcessor = previousPaymentBatchProcessor
+	}()
+
+	//Payments are refused while the batch processor is stopped for maintenance
+	req := httptest.NewRequest(http.MethodPost, PAYMENTS_URL, nil)
+	retCode, _ := makePaymentHandler(httptest.NewRecorder(), req, Payment{common.Payment{
+		CampaignId:  campaign.Id,
+		AccountType: "credit_card",
+		Amount:      perk.Price,
+		Currency:    perk.Currency,
+		Items:       []common.PaymentItem{{PerkId: perk.Id, Quantity: 1, Price: perk.Price}},
+	}})
+	if retCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status code %d but was %d", http.StatusServiceUnavailable, retCode)
+	}
+
+	//The only perk is available again for the next payment
+	err := reservePaymentItems(newTestReservationPayment(campaign, perk, 1))
+	if nil != err {
+		t.Fatalf("Expected perk of refused payment to be released but was %v", err)
+	}
+}
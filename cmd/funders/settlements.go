@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	GET_AUTHORIZED_PAYMENTS_QUERY = "SELECT id FROM funders.payments WHERE campaign_id = $1 AND status = 'authorized'"
+	ADD_CAMPAIGN_SETTLEMENT_QUERY = "INSERT INTO funders.campaign_settlements(campaign_id, goal_met, amt_raised, created_at) VALUES($1, $2, $3, $4) ON CONFLICT (campaign_id) DO NOTHING"
+	GET_CAMPAIGN_SETTLEMENT_QUERY = "SELECT goal_met FROM funders.campaign_settlements WHERE campaign_id = $1"
+)
+
+func getAuthorizedPaymentIdsFromDb(campaignId int64) ([]string, error) {
+	rows, err := db.Query(GET_AUTHORIZED_PAYMENTS_QUERY, campaignId)
+	if nil != err {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var paymentIds []string
+	for rows.Next() {
+		var paymentId string
+		err = rows.Scan(&paymentId)
+		if nil == err {
+			paymentIds = append(paymentIds, paymentId)
+		} else {
+			break
+		}
+	}
+
+	if nil == err {
+		err = rows.Err()
+	}
+
+	return paymentIds, err
+}
+
+//Decision is made once so failed captures can not flip it for the remaining payments. Cancelled campaigns never meet their goal
+func getCampaignSettlement(campaign *Campaign) (bool, error) {
+	amtRaised := campaign.GetAmtRaised()
+	_, err := db.Exec(ADD_CAMPAIGN_SETTLEMENT_QUERY, campaign.Id, campaign.GetStatus() == common.CAMPAIGN_SUCCEEDED, amtRaised, time.Now())
+	if nil != err {
+		return false, err
+	}
+
+	var goalMet bool
+	err = db.QueryRow(GET_CAMPAIGN_SETTLEMENT_QUERY, campaign.Id).Scan(&goalMet)
+	return goalMet, err
+}
+
+func settlePayment(payment *Payment, goalMet bool) error {
+	paymentProcessor, exists := getPaymentProcessor(payment)
+	if !exists {
+		return common.RequestError{fmt.Sprintf("Unsupported payment account type %s", payment.AccountType), common.ServiceNotImplementedError}
+	}
+
+	paymentAuthorizer, ok := paymentProcessor.(common.PaymentAuthorizer)
+	if !ok {
+		return common.RequestError{fmt.Sprintf("Payment account type %s can not be authorized", payment.AccountType), common.ServiceNotImplementedError}
+	}
+
+	campaign, campaignExists := campaigns.GetCampaignById(payment.CampaignId)
+	if !campaignExists {
+		return common.RequestError{fmt.Sprintf("Campaign not found %d", payment.CampaignId), common.NotFoundError}
+	}
+
+	_, perkExists := getContributionPerk(payment.PerkId)
+	if !perkExists {
+		return common.RequestError{fmt.Sprintf("Perk not found %d", payment.PerkId), common.NotFoundError}
+	}
+
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	if payment.GetStatus() != "authorized" {
+		return nil
+	}
+
+	err := callPaymentProcessor(paymentProcessor, func() error {
+		if goalMet {
+			return paymentAuthorizer.Capture(&payment.Payment)
+		}
+		return paymentAuthorizer.Void(&payment.Payment)
+	})
+
+	if !isCountedStatus(payment.GetStatus()) {
+		removePaymentFromTotals(payment, campaign)
+	}
+
+	paymentsCache.AddOrReplacePayment(payment)
+	_, dbErr := updatePaymentInDb(payment)
+	if nil != dbErr {
+		log.Print(dbErr)
+		log.Printf("Error updating payment %s with settlement from processor", payment.Id)
+	} else {
+		log.Printf("Settled payment %s with status %s", payment.Id, payment.GetStatus())
+	}
+
+	return err
+}
+
+func settleCampaign(campaign *Campaign) error {
+	paymentIds, err := getAuthorizedPaymentIdsFromDb(campaign.Id)
+	if nil != err || len(paymentIds) == 0 {
+		return err
+	}
+
+	goalMet, err := getCampaignSettlement(campaign)
+	if nil != err {
+		return err
+	}
+
+	log.Printf("Settling %d authorized payments for campaign %s (goal met: %t)", len(paymentIds), campaign.Name, goalMet)
+
+	for _, paymentId := range paymentIds {
+		payment, err := getPayment(paymentId)
+		if nil != err {
+			log.Print(err)
+			log.Printf("Unable to settle payment %s", paymentId)
+			continue
+		}
+
+		//Failed payments are retried on the next settlement run
+		err = settlePayment(payment, goalMet)
+		if nil != err {
+			log.Print(err)
+			log.Printf("Unable to settle payment %s", paymentId)
+		}
+	}
+
+	return nil
+}
+
+func settleCampaigns() {
+	for _, campaign := range campaigns.GetCampaigns() {
+		status := campaign.GetStatus()
+		if campaign.Flexible || (status != common.CAMPAIGN_SUCCEEDED && status != common.CAMPAIGN_FAILED && status != common.CAMPAIGN_CANCELLED) {
+			continue
+		}
+
+		err := settleCampaign(campaign)
+		if nil != err {
+			log.Print(err)
+			log.Printf("Unable to settle campaign %s", campaign.Name)
+		}
+	}
+}
+
+//Settlement job
+var settlementInterval int
+var settlementStop = make(chan struct{})
+var settlementWaitGroup sync.WaitGroup
+
+func startSettlementJob(settlementInterval int) {
+	settlementWaitGroup.Add(1)
+	go func() {
+		defer settlementWaitGroup.Done()
+
+		ticker := time.NewTicker(time.Duration(settlementInterval) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				settleCampaigns()
+			case <-settlementStop:
+				return
+			}
+		}
+	}()
+}
+
+//Waits for an in-progress settlement so captures and voids are recorded
+func stopSettlementJob(ctx context.Context) error {
+	close(settlementStop)
+	return waitWithContext(ctx, &settlementWaitGroup)
+}
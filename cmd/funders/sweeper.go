@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	GET_STALE_PAYMENTS_QUERY           = "SELECT id FROM funders.payments WHERE status = 'pending' AND account_type NOT IN ('manual', 'bank_transfer') AND created_at < $1 ORDER BY created_at ASC"
+	RELEASE_EXPIRED_RESERVATIONS_QUERY = "UPDATE funders.perk_reservations SET status = 'released', updated_at = $1 WHERE status = 'held' AND expires_at <= $1"
+)
+
+//Recorded with swept payments in place of a processor response
+type sweptPayment struct {
+	Status        string `json:"status"`
+	FailureReason string `json:"failureReason,omitempty"`
+}
+
+func getStalePaymentIdsFromDb(createdBefore time.Time) ([]string, error) {
+	rows, err := db.Query(GET_STALE_PAYMENTS_QUERY, createdBefore)
+	if nil != err {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var paymentIds []string
+	for rows.Next() {
+		var paymentId string
+		err = rows.Scan(&paymentId)
+		if nil == err {
+			paymentIds = append(paymentIds, paymentId)
+		} else {
+			break
+		}
+	}
+
+	if nil == err {
+		err = rows.Err()
+	}
+
+	return paymentIds, err
+}
+
+//Abandoned payments are expired unless the processor completed them in the meantime
+func sweepPayment(payment *Payment) error {
+	paymentProcessor, exists := getPaymentProcessor(payment)
+	if !exists {
+		return common.RequestError{fmt.Sprintf("Unsupported payment account type %s", payment.AccountType), common.ServiceNotImplementedError}
+	}
+
+	var status string
+	err := callPaymentProcessor(paymentProcessor, func() error {
+		var err error
+		status, err = paymentProcessor.GetStatus(&payment.Payment)
+		return err
+	})
+
+	var failureReason string
+	if requestErr, ok := err.(common.RequestError); ok && requestErr.Type == common.NotFoundError {
+		//Stripe looks up timed out charges by payment id so not found payments never reached the processor
+		status = "expired"
+		failureReason = fmt.Sprintf("Payment expired before reaching payment processor: %s", requestErr.Message)
+	} else if nil != err {
+		return err
+	}
+
+	switch status {
+	case "pending":
+		status = "expired"
+		failureReason = fmt.Sprintf("Payment expired after %s pending with payment processor %s", pendingPaymentMaxAge, paymentProcessor.GetName())
+	case "failure":
+		failureReason = "Payment failed with payment processor"
+	}
+
+	log.Printf("Sweeping payment %s pending for more than %s with status %s", payment.Id, pendingPaymentMaxAge, status)
+	return reconcilePayment(payment, status, failureReason, sweptPayment{status, failureReason})
+}
+
+func sweepPayments() {
+	now := time.Now()
+
+	result, err := db.Exec(RELEASE_EXPIRED_RESERVATIONS_QUERY, now)
+	if nil != err {
+		log.Print(err)
+		log.Print("Unable to release expired perk reservations")
+	} else if released, _ := result.RowsAffected(); released > 0 {
+		log.Printf("Released %d expired perk reservations", released)
+	}
+
+	paymentIds, err := getStalePaymentIdsFromDb(now.Add(-pendingPaymentMaxAge))
+	if nil != err {
+		log.Print(err)
+		log.Print("Unable to get stale pending payments")
+		return
+	}
+
+	for _, paymentId := range paymentIds {
+		payment, err := getPayment(paymentId)
+		if nil != err {
+			log.Print(err)
+			log.Printf("Unable to sweep payment %s", paymentId)
+			continue
+		}
+
+		//Unavailable processors are asked again on the next sweep
+		err = sweepPayment(payment)
+		if nil != err {
+			log.Print(err)
+			log.Printf("Unable to sweep payment %s", paymentId)
+		}
+	}
+}
+
+//Sweeper job
+var sweeperInterval int
+var pendingPaymentMaxAge time.Duration
+var sweeperStop = make(chan struct{})
+var sweeperWaitGroup sync.WaitGroup
+
+func startSweeperJob(sweeperInterval int) {
+	sweeperWaitGroup.Add(1)
+	go func() {
+		defer sweeperWaitGroup.Done()
+
+		ticker := time.NewTicker(time.Duration(sweeperInterval) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				sweepPayments()
+			case <-sweeperStop:
+				return
+			}
+		}
+	}()
+}
+
+func stopSweeperJob(ctx context.Context) error {
+	close(sweeperStop)
+	return waitWithContext(ctx, &sweeperWaitGroup)
+}
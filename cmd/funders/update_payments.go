@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/martini-contrib/binding"
 	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
@@ -13,7 +14,7 @@ import (
 )
 
 const (
-	UPDATE_PAYMENT_QUERY = "UPDATE funders.payments SET updated_at = $1, payment_processor_responses = payment_processor_responses || $2, payment_processor_used = $3, status = $4 WHERE id = $5"
+	UPDATE_PAYMENT_QUERY = "UPDATE funders.payments SET updated_at = $1, payment_processor_responses = payment_processor_responses || $2, payment_processor_used = $3, payment_processor_transaction_id = $4, status = $5 WHERE id = $6"
 )
 
 type UpdatePayment struct {
@@ -29,19 +30,21 @@ type UpdatePayment struct {
 func (updatePayment *UpdatePayment) MarshalJSON() ([]byte, error) {
 	type MyUpdatePayment UpdatePayment
 	return json.Marshal(&struct {
-		Id            string    `json:"id"`
-		CampaignId    int64     `json:"campaignId"`
-		Campaign      *Campaign `json:"campaign"`
-		PerkId        int64     `json:"perkId"`
-		Perk          *Perk     `json:"perk"`
-		Status        string    `json:"status"`
-		FailureReason string    `json:"failureReason,omitempty"`
+		Id            string               `json:"id"`
+		CampaignId    int64                `json:"campaignId"`
+		Campaign      *Campaign            `json:"campaign"`
+		PerkId        int64                `json:"perkId"`
+		Perk          *Perk                `json:"perk"`
+		Items         []common.PaymentItem `json:"items,omitempty"`
+		Status        string               `json:"status"`
+		FailureReason string               `json:"failureReason,omitempty"`
 	}{
 		Id:            updatePayment.Id,
 		CampaignId:    updatePayment.payment.CampaignId,
-		Campaign:      updatePayment.payment.Campaign,
+		Campaign:      (*Campaign)(updatePayment.payment.Campaign),
 		PerkId:        updatePayment.payment.PerkId,
-		Perk:          updatePayment.payment.Perk,
+		Perk:          (*Perk)(updatePayment.payment.Perk),
+		Items:         updatePayment.payment.Items,
 		Status:        updatePayment.payment.Status,
 		FailureReason: updatePayment.payment.FailureReason,
 	})
@@ -55,13 +58,17 @@ func (updatePayment *UpdatePayment) Validate(errors binding.Errors, req *http.Re
 	errors = validateSizeLimit(updatePayment.PaypalToken, "paypalToken", stringSizeLimit, errors)
 
 	if len(errors) == 0 {
-		if !accountTypes[updatePayment.AccountType] {
+		if _, exists := paymentProcessors.GetPaymentProcessor(updatePayment.AccountType); !exists {
 			message := fmt.Sprintf("Invalid account type \"%s\" specified", updatePayment.AccountType)
 			errors = addError(errors, []string{"accountType"}, binding.TypeError, message)
+		} else if common.IsManualAccountType(updatePayment.AccountType) {
+			message := fmt.Sprintf("Account type \"%s\" can only be confirmed by administrators", updatePayment.AccountType)
+			errors = addError(errors, []string{"accountType"}, binding.TypeError, message)
 		}
 
-		if updatePayment.AccountType == "paypal" && (len(updatePayment.PaypalPayerId) == 0 || len(updatePayment.PaypalPaymentId) == 0 || len(updatePayment.PaypalToken) == 0) {
-			errors = addError(errors, []string{"accountType", "paypalPayerId", "paypalPaymentId", "paypalToken"}, binding.RequiredError, "PaypalPayerId, PaypalPaymentId, and PaypalToken required to update a paypal payment")
+		//Paypal payment id is only sent back for payments made before the orders api
+		if updatePayment.AccountType == "paypal" && (len(updatePayment.PaypalPayerId) == 0 || len(updatePayment.PaypalToken) == 0) {
+			errors = addError(errors, []string{"accountType", "paypalPayerId", "paypalToken"}, binding.RequiredError, "PaypalPayerId and PaypalToken required to update a paypal payment")
 		}
 
 		var err error
@@ -76,16 +83,16 @@ func (updatePayment *UpdatePayment) Validate(errors binding.Errors, req *http.Re
 				errors = addError(errors, []string{"accountType"}, binding.TypeError, message)
 			} else {
 				//Get campaign and perk
-				perk, exists := perks.GetPerk(updatePayment.payment.PerkId)
+				perk, exists := getContributionPerk(updatePayment.payment.PerkId)
 				if exists {
-					updatePayment.payment.Perk = perk
+					updatePayment.payment.Perk = (*common.Perk)(perk)
 				} else {
 					log.Printf("Could not find perk %d for campaign %d for payment %s", updatePayment.payment.PerkId, updatePayment.payment.CampaignId, updatePayment.Id)
 				}
 
 				campaign, exists := campaigns.GetCampaignById(updatePayment.payment.CampaignId)
 				if exists {
-					updatePayment.payment.Campaign = campaign
+					updatePayment.payment.Campaign = (*common.Campaign)(campaign)
 				} else {
 					log.Printf("Could not find campaign %d for payment %s", updatePayment.payment.CampaignId, updatePayment.Id)
 				}
@@ -112,22 +119,12 @@ func (updatePayment *UpdatePayment) Validate(errors binding.Errors, req *http.Re
 var asyncUpdatePaymentRequest bool
 
 //Background payment threads
-var updatePaymentBatchProcessor *common.BatchProcessor
+var updatePaymentBatchProcessor *common.BatchProcessor[*UpdatePayment]
 
 func processUpdatePayment(updatePayment *UpdatePayment) (error, int) {
-	var err error
 	var retCode int
 
-	switch updatePayment.AccountType {
-	case "paypal":
-		err = executePaypalPayment(updatePayment, nil)
-	case "credit_card":
-		fallthrough
-	case "bitcoin":
-		fallthrough
-	default:
-		err = common.RequestError{fmt.Sprintf("Unsupported payment update account type %s", updatePayment.AccountType), common.ServiceNotImplementedError}
-	}
+	err := completePayment(updatePayment, nil)
 
 	if nil == err {
 		//Success: StatusOK (successful transaction from paypal and database)
@@ -146,6 +143,9 @@ func processUpdatePayment(updatePayment *UpdatePayment) (error, int) {
 		case common.ServiceNotImplementedError:
 			//Error: StatusNotImplemented (paypal or database is down)
 			retCode = http.StatusNotImplemented
+		case common.ProcessorTimeoutError:
+			//Error: StatusGatewayTimeout (paypal did not answer, payment stays pending until reconciled)
+			retCode = http.StatusGatewayTimeout
 		case common.ServerError:
 			fallthrough
 		default:
@@ -159,28 +159,21 @@ func processUpdatePayment(updatePayment *UpdatePayment) (error, int) {
 	return err, retCode
 }
 
-func processBatchUpdatePayment(updatePaymentBatch []interface{}, waitGroup *sync.WaitGroup) {
+func processBatchUpdatePayment(updatePaymentBatch []*UpdatePayment, waitGroup *sync.WaitGroup) {
 	log.Printf("Starting batch processing of %d updatePayments", len(updatePaymentBatch))
 	defer waitGroup.Done()
 
-	for _, updatePaymentInterface := range updatePaymentBatch {
-		updatePayment := updatePaymentInterface.(*UpdatePayment)
-		switch updatePayment.AccountType {
-		case "paypal":
-			waitGroup.Add(1)
-			go executePaypalPayment(updatePayment, waitGroup)
-		case "credit_card":
-			fallthrough
-		case "bitcoin":
-			fallthrough
-		default:
-			log.Printf("Unsupported payment update account type %s", updatePayment.AccountType)
-		}
+	for _, updatePayment := range updatePaymentBatch {
+		waitGroup.Add(1)
+		go completePayment(updatePayment, waitGroup)
 	}
 }
 
 func updatePaymentInDb(payment *Payment) (*Payment, error) {
-	_, err := db.Exec(UPDATE_PAYMENT_QUERY, time.Now(), payment.PaymentProcessorResponses, payment.PaymentProcessorUsed, payment.GetStatus(), payment.Id)
+	_, err := db.Exec(UPDATE_PAYMENT_QUERY, time.Now(), payment.PaymentProcessorResponses, payment.PaymentProcessorUsed, common.CreateSqlString(payment.PaymentProcessorTransactionId), payment.GetStatus(), payment.Id)
+	if nil == err {
+		err = updatePaymentReservations(payment)
+	}
 	return payment, err
 }
 
@@ -189,13 +182,19 @@ func updatePaymentHandler(res http.ResponseWriter, req *http.Request, updatePaym
 	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
 	var response common.Response
 
-	log.Printf("Received new payment update: %#v", updatePayment)
+	slog.Info("Received new payment update", "updatePayment", &updatePayment)
 
-	if asyncUpdatePaymentRequest && updatePaymentBatchProcessor.Running {
-		updatePaymentBatchProcessor.AddEvent(&updatePayment)
-		responseStr := "Successfully scheduled payment update"
-		response = common.Response{Code: http.StatusAccepted, Message: responseStr, Id: updatePayment.Id}
-		log.Print(responseStr)
+	if asyncUpdatePaymentRequest && nil != updatePaymentBatchProcessor && updatePaymentBatchProcessor.IsRunning() {
+		err := updatePaymentBatchProcessor.AddEvent(&updatePayment)
+		if nil != err {
+			log.Print(err)
+			responseStr := "Could not schedule payment update due to server error"
+			response = common.Response{Code: http.StatusServiceUnavailable, Message: responseStr, Id: updatePayment.Id}
+		} else {
+			responseStr := "Successfully scheduled payment update"
+			response = common.Response{Code: http.StatusAccepted, Message: responseStr, Id: updatePayment.Id}
+		}
+		log.Print(response.Message)
 	} else if !asyncUpdatePaymentRequest {
 		err, retCode := processUpdatePayment(&updatePayment)
 		if nil != err {
@@ -205,7 +204,7 @@ func updatePaymentHandler(res http.ResponseWriter, req *http.Request, updatePaym
 			jsonStr, _ := json.Marshal(&updatePayment)
 			return retCode, string(jsonStr)
 		}
-	} else if asyncUpdatePaymentRequest && (nil == updatePaymentBatchProcessor || !updatePaymentBatchProcessor.Running) {
+	} else if asyncUpdatePaymentRequest && (nil == updatePaymentBatchProcessor || !updatePaymentBatchProcessor.IsRunning()) {
 		responseStr := "Could not add payment update due to server maintenance"
 		response = common.Response{Code: http.StatusServiceUnavailable, Message: responseStr, Id: updatePayment.Id}
 		log.Print(responseStr)
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/stripe/stripe-go"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ADD_PROCESSOR_EVENT_QUERY     = "INSERT INTO funders.processor_events(id, payment_processor, type, created_at) VALUES($1, $2, $3, $4) ON CONFLICT (id, payment_processor) DO NOTHING"
+	DELETE_PROCESSOR_EVENT_QUERY  = "DELETE FROM funders.processor_events WHERE id = $1 AND payment_processor = $2"
+	STRIPE_WEBHOOKS_URL           = "/webhooks/stripe"
+	STRIPE_SECONDARY_WEBHOOKS_URL = "/webhooks/stripe_secondary"
+	PAYPAL_WEBHOOKS_URL           = "/webhooks/paypal"
+	BTCPAY_WEBHOOKS_URL           = "/webhooks/btcpay"
+	WEBHOOK_BODY_SIZE_LIMIT       = 1 << 20
+)
+
+//Payment processors used to verify webhook events
+var stripeProcessor *common.StripeProcessor
+var stripeSecondaryProcessor *common.StripeProcessor
+var paypalProcessor *common.PaypalProcessor
+var btcpayProcessor *common.BtcpayProcessor
+
+//Returns false if the event was already recorded
+func addProcessorEvent(paymentProcessor string, id string, eventType string) (bool, error) {
+	result, err := db.Exec(ADD_PROCESSOR_EVENT_QUERY, id, paymentProcessor, eventType, time.Now())
+	if nil != err {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+func deleteProcessorEvent(paymentProcessor string, id string) error {
+	_, err := db.Exec(DELETE_PROCESSOR_EVENT_QUERY, id, paymentProcessor)
+	return err
+}
+
+func processWebhookEvent(paymentProcessor string, id string, eventType string, handler func() error) common.Response {
+	added, err := addProcessorEvent(paymentProcessor, id, eventType)
+	if nil != err {
+		log.Print(err)
+		return common.Response{Code: http.StatusInternalServerError, Message: fmt.Sprintf("Could not record %s event %s due to server error", paymentProcessor, id)}
+	} else if !added {
+		responseStr := fmt.Sprintf("Already processed %s event %s", paymentProcessor, id)
+		log.Print(responseStr)
+		return common.Response{Code: http.StatusOK, Message: responseStr}
+	}
+
+	err = handler()
+	if nil != err {
+		log.Print(err)
+
+		//Allow the processor to redeliver the event
+		dbErr := deleteProcessorEvent(paymentProcessor, id)
+		if nil != dbErr {
+			log.Print(dbErr)
+			log.Printf("Unable to remove %s event %s", paymentProcessor, id)
+		}
+
+		return common.Response{Code: getStatusCode(err), Message: err.Error()}
+	}
+
+	responseStr := fmt.Sprintf("Successfully processed %s event %s (%s)", paymentProcessor, id, eventType)
+	log.Print(responseStr)
+	return common.Response{Code: http.StatusOK, Message: responseStr}
+}
+
+//Finds the payment a processor event refers to. Unknown payments are ignored.
+func getWebhookPayment(paymentProcessor string, transactionId string, paymentId string) (*Payment, error) {
+	payment, err := getPaymentByTransactionId(paymentProcessor, transactionId)
+	if nil == err {
+		return payment, nil
+	} else if sql.ErrNoRows != err {
+		return nil, common.RequestError{fmt.Sprintf("Could not get payment for transaction %s due to server error", transactionId), common.ServerError}
+	}
+
+	//Payment exists but the processor call that created the transaction has not finished
+	if len(paymentId) > 0 {
+		if _, exists := paymentsCache.GetPayment(paymentId); exists {
+			return nil, common.RequestError{fmt.Sprintf("Payment %s is still being processed", paymentId), common.ServiceUnavailableError}
+		}
+	}
+
+	log.Printf("No payment found for %s transaction %s", paymentProcessor, transactionId)
+	return nil, nil
+}
+
+//Each stripe account signs events for its own endpoint and payments are looked up under its processor name
+func newStripeWebhookHandler(paymentProcessor *common.StripeProcessor) func(http.ResponseWriter, *http.Request) (int, string) {
+	return func(res http.ResponseWriter, req *http.Request) (int, string) {
+		req.Close = true
+		res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+		var response common.Response
+
+		name := paymentProcessor.GetName()
+		payload, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, WEBHOOK_BODY_SIZE_LIMIT))
+		if nil != err {
+			log.Print(err)
+			response = common.Response{Code: http.StatusBadRequest, Message: fmt.Sprintf("Unable to read %s event", name)}
+		} else if event, err := paymentProcessor.ParseWebhookEvent(payload, req.Header.Get(common.STRIPE_SIGNATURE_HEADER)); nil != err {
+			log.Print(err)
+			response = common.Response{Code: getStatusCode(err), Message: err.Error()}
+		} else {
+			log.Printf("Received %s event %s (%s)", name, event.ID, event.Type)
+			response = processWebhookEvent(name, event.ID, event.Type, func() error {
+				return processStripeEvent(name, event)
+			})
+		}
+
+		jsonStr, _ := json.Marshal(response)
+		return response.Code, string(jsonStr)
+	}
+}
+
+func processStripeEvent(paymentProcessor string, event *stripe.Event) error {
+	switch event.Type {
+	case "charge.succeeded":
+		if event.GetObjValue("captured") == "false" {
+			return reconcileStripeCharge(paymentProcessor, event, getStripeTransactionId(event, "id"), "authorized", "")
+		}
+		return reconcileStripeCharge(paymentProcessor, event, getStripeTransactionId(event, "id"), "success", "")
+	case "charge.captured":
+		return reconcileStripeCharge(paymentProcessor, event, getStripeTransactionId(event, "id"), "success", "")
+	case "charge.expired":
+		return reconcileStripeCharge(paymentProcessor, event, getStripeTransactionId(event, "id"), "failure", "Payment authorization expired with processor")
+	case "charge.failed":
+		return reconcileStripeCharge(paymentProcessor, event, getStripeTransactionId(event, "id"), "failure", event.GetObjValue("failure_message"))
+	case "charge.refunded":
+		return reconcileStripeRefunds(paymentProcessor, event, getStripeTransactionId(event, "id"))
+	case "charge.dispute.created":
+		return reconcileStripeCharge(paymentProcessor, event, getStripeTransactionId(event, "charge"), "", "")
+	case "charge.dispute.closed":
+		if event.GetObjValue("status") == "lost" {
+			return reconcileStripeCharge(paymentProcessor, event, getStripeTransactionId(event, "charge"), "failure", "Payment dispute lost with processor")
+		}
+		return reconcileStripeCharge(paymentProcessor, event, getStripeTransactionId(event, "charge"), "", "")
+	case "payment_intent.succeeded":
+		return reconcileStripeCharge(paymentProcessor, event, event.GetObjValue("id"), "success", "")
+	case "payment_intent.amount_capturable_updated":
+		return reconcileStripeCharge(paymentProcessor, event, event.GetObjValue("id"), "authorized", "")
+	case "payment_intent.payment_failed":
+		return reconcileStripeCharge(paymentProcessor, event, event.GetObjValue("id"), "failure", getStripePaymentIntentFailureReason(event))
+	case "payment_intent.canceled":
+		return reconcileStripeCharge(paymentProcessor, event, event.GetObjValue("id"), "failure", "Payment intent canceled with processor")
+	default:
+		log.Printf("Ignoring %s event %s (%s)", paymentProcessor, event.ID, event.Type)
+		return nil
+	}
+}
+
+//Empty status keeps the current payment status and only records the event
+func reconcileStripeCharge(paymentProcessor string, event *stripe.Event, chargeId string, status string, failureReason string) error {
+	payment, err := getWebhookPayment(paymentProcessor, chargeId, getStripeEventPaymentId(event))
+	if nil != err || nil == payment {
+		return err
+	}
+
+	if len(status) == 0 {
+		status = payment.GetStatus()
+	}
+
+	return reconcilePayment(payment, status, failureReason, event.Data.Obj)
+}
+
+func reconcileStripeRefunds(paymentProcessor string, event *stripe.Event, chargeId string) error {
+	payment, err := getWebhookPayment(paymentProcessor, chargeId, getStripeEventPaymentId(event))
+	if nil != err || nil == payment {
+		return err
+	}
+
+	charge := &struct {
+		Refunds struct {
+			Data []struct {
+				ID     string `json:"id"`
+				Amount uint64 `json:"amount"`
+				Reason string `json:"reason"`
+			} `json:"data"`
+		} `json:"refunds"`
+	}{}
+
+	err = json.Unmarshal(event.Data.Raw, charge)
+	if nil != err {
+		return common.RequestError{fmt.Sprintf("Unable to parse refunds for charge %s", chargeId), common.BadRequestError}
+	}
+
+	var processorRefunds []processorRefund
+	for _, refund := range charge.Refunds.Data {
+		processorRefunds = append(processorRefunds, processorRefund{"", refund.ID, float64(refund.Amount) / 100, refund.Reason})
+	}
+
+	if len(processorRefunds) == 0 {
+		return reconcilePayment(payment, payment.GetStatus(), "", event.Data.Obj)
+	}
+
+	return reconcileRefunds(payment, processorRefunds, event.Data.Obj)
+}
+
+//Charges made through payment intents are stored under the payment intent id
+func getStripeTransactionId(event *stripe.Event, chargeField string) string {
+	if paymentIntentId := event.GetObjValue("payment_intent"); len(paymentIntentId) > 0 {
+		return paymentIntentId
+	}
+
+	return event.GetObjValue(chargeField)
+}
+
+func getStripePaymentIntentFailureReason(event *stripe.Event) string {
+	if lastPaymentError, ok := event.Data.Obj["last_payment_error"].(map[string]interface{}); ok {
+		if message, ok := lastPaymentError["message"].(string); ok {
+			return message
+		}
+	}
+
+	return "Payment method declined by processor"
+}
+
+func getStripeEventPaymentId(event *stripe.Event) string {
+	if metadata, ok := event.Data.Obj["metadata"].(map[string]interface{}); ok {
+		if paymentId, ok := metadata[common.STRIPE_PAYMENT_ID_METADATA].(string); ok {
+			return paymentId
+		}
+	}
+
+	return ""
+}
+
+func paypalWebhookHandler(res http.ResponseWriter, req *http.Request) (int, string) {
+	req.Close = true
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+	var response common.Response
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, WEBHOOK_BODY_SIZE_LIMIT))
+	if nil != err {
+		log.Print(err)
+		response = common.Response{Code: http.StatusBadRequest, Message: "Unable to read paypal event"}
+	} else if event, err := paypalProcessor.ParseWebhookEvent(payload, req.Header); nil != err {
+		log.Print(err)
+		response = common.Response{Code: getStatusCode(err), Message: err.Error()}
+	} else {
+		log.Printf("Received paypal event %s (%s)", event.ID, event.EventType)
+		response = processWebhookEvent(common.PAYPAL_PROCESSOR, event.ID, event.EventType, func() error {
+			return processPaypalEvent(event)
+		})
+	}
+
+	jsonStr, _ := json.Marshal(response)
+	return response.Code, string(jsonStr)
+}
+
+func processPaypalEvent(event *common.PaypalWebhookEvent) error {
+	resource := event.Resource
+
+	switch event.EventType {
+	case "PAYMENTS.PAYMENT.CREATED":
+		return executePaypalPayment(event, resource.ID)
+	case "PAYMENT.SALE.COMPLETED":
+		return reconcilePaypalPayment(event, resource.ParentPayment, "success", "")
+	case "PAYMENT.SALE.PENDING":
+		return reconcilePaypalPayment(event, resource.ParentPayment, "", "")
+	case "PAYMENT.SALE.DENIED":
+		return reconcilePaypalPayment(event, resource.ParentPayment, "failure", "Payment denied with processor")
+	case "PAYMENT.SALE.REVERSED":
+		return reconcilePaypalPayment(event, resource.ParentPayment, "failure", "Payment reversed with processor")
+	case "PAYMENT.SALE.REFUNDED":
+		return reconcilePaypalRefund(event, resource.ParentPayment)
+	case "CHECKOUT.ORDER.APPROVED":
+		return capturePaypalOrder(event, resource.ID)
+	case "PAYMENT.CAPTURE.COMPLETED":
+		return reconcilePaypalPayment(event, getPaypalOrderId(resource), "success", "")
+	case "PAYMENT.CAPTURE.PENDING":
+		return reconcilePaypalPayment(event, getPaypalOrderId(resource), "", "")
+	case "PAYMENT.CAPTURE.DENIED":
+		return reconcilePaypalPayment(event, getPaypalOrderId(resource), "failure", "Payment denied with processor")
+	case "PAYMENT.CAPTURE.REVERSED":
+		return reconcilePaypalPayment(event, getPaypalOrderId(resource), "failure", "Payment reversed with processor")
+	case "PAYMENT.CAPTURE.REFUNDED":
+		return reconcilePaypalRefund(event, getPaypalOrderId(resource))
+	default:
+		log.Printf("Ignoring paypal event %s (%s)", event.ID, event.EventType)
+		return nil
+	}
+}
+
+//Empty status keeps the current payment status and only records the event
+func reconcilePaypalPayment(event *common.PaypalWebhookEvent, paypalPaymentId string, status string, failureReason string) error {
+	payment, err := getWebhookPayment(common.PAYPAL_PROCESSOR, paypalPaymentId, "")
+	if nil != err || nil == payment {
+		return err
+	}
+
+	if len(status) == 0 {
+		status = payment.GetStatus()
+	}
+
+	return reconcilePayment(payment, status, failureReason, event)
+}
+
+func reconcilePaypalRefund(event *common.PaypalWebhookEvent, paypalPaymentId string) error {
+	payment, err := getWebhookPayment(common.PAYPAL_PROCESSOR, paypalPaymentId, "")
+	if nil != err || nil == payment {
+		return err
+	}
+
+	if nil == event.Resource.Amount {
+		return common.RequestError{fmt.Sprintf("Paypal refund %s is missing amount", event.Resource.ID), common.BadRequestError}
+	}
+
+	refundAmount, err := strconv.ParseFloat(event.Resource.Amount.GetTotal(), 64)
+	if nil != err {
+		log.Print(err)
+		return common.RequestError{fmt.Sprintf("Paypal refund %s has invalid amount %s", event.Resource.ID, event.Resource.Amount.GetTotal()), common.BadRequestError}
+	}
+
+	return reconcileRefunds(payment, []processorRefund{{"", event.Resource.ID, math.Abs(refundAmount), ""}}, event)
+}
+
+//Buyer approved the payment but never returned to complete it
+func executePaypalPayment(event *common.PaypalWebhookEvent, paypalPaymentId string) error {
+	resource := event.Resource
+	if nil == resource.Payer || nil == resource.Payer.PayerInfo || len(resource.Payer.PayerInfo.PayerID) == 0 {
+		log.Printf("Paypal payment %s has not been approved", paypalPaymentId)
+		return nil
+	}
+
+	payment, err := getWebhookPayment(common.PAYPAL_PROCESSOR, paypalPaymentId, "")
+	if nil != err || nil == payment {
+		return err
+	}
+
+	updatePayment := &UpdatePayment{
+		Id:              payment.Id,
+		AccountType:     payment.AccountType,
+		Status:          payment.GetStatus(),
+		PaypalPayerId:   resource.Payer.PayerInfo.PayerID,
+		PaypalPaymentId: paypalPaymentId,
+		payment:         payment,
+	}
+
+	err = completePayment(updatePayment, nil)
+
+	//Already completed or declined payments should not be redelivered
+	if requestErr, ok := err.(common.RequestError); ok && requestErr.Type == common.BadRequestError {
+		log.Print(err)
+		return nil
+	}
+
+	return err
+}
+
+//Buyer approved the order but never returned to complete it
+func capturePaypalOrder(event *common.PaypalWebhookEvent, paypalOrderId string) error {
+	if event.Resource.Status != "APPROVED" {
+		log.Printf("Paypal order %s has not been approved", paypalOrderId)
+		return nil
+	}
+
+	payment, err := getWebhookPayment(common.PAYPAL_PROCESSOR, paypalOrderId, "")
+	if nil != err || nil == payment {
+		return err
+	}
+
+	updatePayment := &UpdatePayment{
+		Id:          payment.Id,
+		AccountType: payment.AccountType,
+		Status:      payment.GetStatus(),
+		PaypalToken: paypalOrderId,
+		payment:     payment,
+	}
+
+	err = completePayment(updatePayment, nil)
+
+	//Already completed or declined payments should not be redelivered
+	if requestErr, ok := err.(common.RequestError); ok && requestErr.Type == common.BadRequestError {
+		log.Print(err)
+		return nil
+	}
+
+	return err
+}
+
+//Capture and refund events refer to their order through supplementary data
+func getPaypalOrderId(resource *common.PaypalWebhookResource) string {
+	if nil != resource.SupplementaryData {
+		return resource.SupplementaryData.RelatedIds.OrderId
+	}
+
+	return ""
+}
+
+func btcpayWebhookHandler(res http.ResponseWriter, req *http.Request) (int, string) {
+	req.Close = true
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+	var response common.Response
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, WEBHOOK_BODY_SIZE_LIMIT))
+	if nil != err {
+		log.Print(err)
+		response = common.Response{Code: http.StatusBadRequest, Message: "Unable to read btcpay event"}
+	} else if event, err := btcpayProcessor.ParseWebhookEvent(payload, req.Header.Get(common.BTCPAY_SIGNATURE_HEADER)); nil != err {
+		log.Print(err)
+		response = common.Response{Code: getStatusCode(err), Message: err.Error()}
+	} else {
+		log.Printf("Received btcpay event %s (%s)", event.OriginalDeliveryId, event.Type)
+		response = processWebhookEvent(common.BTCPAY_PROCESSOR, event.OriginalDeliveryId, event.Type, func() error {
+			return processBtcpayEvent(event)
+		})
+	}
+
+	jsonStr, _ := json.Marshal(response)
+	return response.Code, string(jsonStr)
+}
+
+func processBtcpayEvent(event *common.BtcpayWebhookEvent) error {
+	switch event.Type {
+	case "InvoiceSettled":
+		return reconcileBtcpayInvoice(event, "success", "")
+	case "InvoiceProcessing", "InvoiceReceivedPayment":
+		return reconcileBtcpayInvoice(event, "", "")
+	case "InvoiceExpired":
+		return reconcileBtcpayInvoice(event, "failure", "Invoice expired with processor")
+	case "InvoiceInvalid":
+		return reconcileBtcpayInvoice(event, "failure", "Invoice marked invalid with processor")
+	default:
+		log.Printf("Ignoring btcpay event %s (%s)", event.OriginalDeliveryId, event.Type)
+		return nil
+	}
+}
+
+//Empty status keeps the current payment status and only records the event
+func reconcileBtcpayInvoice(event *common.BtcpayWebhookEvent, status string, failureReason string) error {
+	if event.StoreId != btcpayProcessor.StoreId {
+		log.Printf("Ignoring btcpay event %s for store %s", event.OriginalDeliveryId, event.StoreId)
+		return nil
+	}
+
+	payment, err := getWebhookPayment(common.BTCPAY_PROCESSOR, event.InvoiceId, event.GetPaymentId())
+	if nil != err || nil == payment {
+		return err
+	}
+
+	if len(status) == 0 {
+		status = payment.GetStatus()
+	}
+
+	return reconcilePayment(payment, status, failureReason, event)
+}
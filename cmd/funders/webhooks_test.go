@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bitbucket.org/padium/funders"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStripeProcessor(name string, webhookSecret string) *common.StripeProcessor {
+	stripeProcessor := common.NewStripeProcessor("sk_test")
+	stripeProcessor.Name = name
+	stripeProcessor.WebhookSecret = webhookSecret
+	stripeProcessor.WebhookTolerance = 5 * time.Minute
+	return stripeProcessor
+}
+
+func newStripeWebhookRequest(webhookSecret string, payload string) *http.Request {
+	timestamp := time.Now().Unix()
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write([]byte(fmt.Sprintf("%d.%s", timestamp, payload)))
+
+	req := httptest.NewRequest(http.MethodPost, STRIPE_WEBHOOKS_URL, strings.NewReader(payload))
+	req.Header.Set(common.STRIPE_SIGNATURE_HEADER, fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil))))
+	return req
+}
+
+//Events are unique to each test and deleted with it
+func newTestStripeChargeEvent(t *testing.T, chargeId string) string {
+	eventId := fmt.Sprintf("evt_%s", uuid.NewV4().String())
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM funders.processor_events WHERE id = $1", eventId)
+	})
+
+	return fmt.Sprintf(`{"id": "%s", "type": "charge.succeeded", "data": {"object": {"id": "%s", "captured": true, "status": "succeeded"}}}`, eventId, chargeId)
+}
+
+func TestStripeWebhookRequiresAccountSecret(t *testing.T) {
+	handler := newStripeWebhookHandler(newTestStripeProcessor(common.STRIPE_SECONDARY_PROCESSOR, "whsec_secondary"))
+
+	//Events signed for the primary account are not accepted on the secondary endpoint
+	retCode, _ := handler(httptest.NewRecorder(), newStripeWebhookRequest("whsec_primary", `{"id": "evt_test", "type": "charge.succeeded", "data": {"object": {"id": "ch_test"}}}`))
+	if retCode != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d but was %d", http.StatusBadRequest, retCode)
+	}
+}
+
+func TestStripeWebhookReconcilesSigningAccountPayments(t *testing.T) {
+	setTestDatabase(t)
+	campaign := addTestCampaign(t, true)
+
+	payment := newTestPayment(campaign)
+	payment.PaymentProcessorUsed = common.STRIPE_SECONDARY_PROCESSOR
+	payment.PaymentProcessorTransactionId = fmt.Sprintf("ch_%s", uuid.NewV4().String())
+	err := addPayment(payment, nil, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	//The primary account does not know the charge so its event is ignored
+	primaryHandler := newStripeWebhookHandler(newTestStripeProcessor(common.STRIPE_PROCESSOR, "whsec_primary"))
+	retCode, _ := primaryHandler(httptest.NewRecorder(), newStripeWebhookRequest("whsec_primary", newTestStripeChargeEvent(t, payment.PaymentProcessorTransactionId)))
+	if retCode != http.StatusOK {
+		t.Fatalf("Expected status code %d but was %d", http.StatusOK, retCode)
+	}
+	if recorded, _ := getPaymentFromDb(payment.Id); recorded.Status != "pending" {
+		t.Fatalf("Expected payment to stay pending but was %s", recorded.Status)
+	}
+
+	secondaryHandler := newStripeWebhookHandler(newTestStripeProcessor(common.STRIPE_SECONDARY_PROCESSOR, "whsec_secondary"))
+	retCode, responseStr := secondaryHandler(httptest.NewRecorder(), newStripeWebhookRequest("whsec_secondary", newTestStripeChargeEvent(t, payment.PaymentProcessorTransactionId)))
+	if retCode != http.StatusOK {
+		t.Fatalf("Expected status code %d but was %d: %s", http.StatusOK, retCode, responseStr)
+	}
+
+	recorded, err := getPaymentFromDb(payment.Id)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if recorded.Status != "success" {
+		t.Fatalf("Expected secondary account payment to succeed but was %s", recorded.Status)
+	}
+}
@@ -5,11 +5,16 @@ import (
 	"bufio"
 	"bytes"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	_ "github.com/lib/pq"
+	"github.com/logpacker/PayPal-Go-SDK"
+	"github.com/satori/go.uuid"
 	"log"
+	"log/slog"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -17,14 +22,29 @@ import (
 )
 
 const (
-	ADD_CAMPAIGN_QUERY    = "INSERT INTO funders.campaigns (name, description, goal, currency, start_date, end_date, flexible, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id"
-	ADD_PERK_QUERY        = "INSERT INTO funders.perks (campaign_id, name, description, price, currency, available_for_payment, available_for_pledge, ship_date, created_at, updated_at) VALUES((SELECT id FROM funders.campaigns WHERE name = $1), $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id"
-	RM_CAMPAIGN_QUERY     = "DELETE FROM funders.campaigns WHERE name = $1"
-	RM_PERK_QUERY         = "DELETE FROM funders.perks WHERE name = $1 AND campaign_id IN (SELECT id FROM funders.campaigns WHERE name = $2)"
-	UPDATE_CAMPAIGN_QUERY = "UPDATE funders.campaigns SET updated_at = $1, ? WHERE name = ?"
-	UPDATE_PERK_QUERY     = "UPDATE funders.perks SET updated_at = $1, ? WHERE name = ? AND campaign_id IN (SELECT id FROM funders.campaigns WHERE name = ?)"
-	ACTIVE_CAMPAIGN_QUERY = "UPDATE funders.campaigns SET updated_at = $1, active = $2 WHERE name = $3"
-	ACTIVE_PERK_QUERY     = "UPDATE funders.perks SET updated_at = $1, active = $2 WHERE name = $3 AND campaign_id IN (SELECT id FROM funders.campaigns WHERE name = $4)"
+	ADD_CAMPAIGN_QUERY            = "INSERT INTO funders.campaigns (name, description, goal, currency, start_date, end_date, time_zone, flexible, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id"
+	ADD_PERK_QUERY                = "INSERT INTO funders.perks (campaign_id, name, description, price, currency, available_for_payment, available_for_pledge, ship_date, created_at, updated_at) VALUES((SELECT id FROM funders.campaigns WHERE name = $1), $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id"
+	ADD_STRETCH_GOAL_QUERY        = "INSERT INTO funders.stretch_goals (campaign_id, amount, title, description, perk_id, created_at, updated_at) SELECT campaigns.id, $2, $3, $4, perks.id, $6, $6 FROM funders.campaigns LEFT OUTER JOIN funders.perks ON perks.campaign_id = campaigns.id AND perks.name = $5 WHERE campaigns.name = $1 AND ($5 = '' OR perks.id IS NOT NULL) RETURNING id"
+	RM_STRETCH_GOAL_QUERY         = "DELETE FROM funders.stretch_goals WHERE title = $1 AND campaign_id IN (SELECT id FROM funders.campaigns WHERE name = $2)"
+	LIST_STRETCH_GOALS_QUERY      = "SELECT stretch_goals.id, stretch_goals.amount, stretch_goals.title, COALESCE(perks.name, '') FROM funders.stretch_goals INNER JOIN funders.campaigns ON stretch_goals.campaign_id = campaigns.id LEFT OUTER JOIN funders.perks ON stretch_goals.perk_id = perks.id WHERE campaigns.name = $1 ORDER BY stretch_goals.amount ASC"
+	GET_CAMPAIGN_STATUS_QUERY     = "SELECT status, start_date, end_date, amt_raised >= goal FROM funders.campaign_backers WHERE name = $1"
+	TRANSITION_CAMPAIGN_QUERY     = "UPDATE funders.campaigns SET updated_at = $1, status = $2 WHERE name = $3 AND status = $4"
+	RM_CAMPAIGN_QUERY             = "DELETE FROM funders.campaigns WHERE name = $1"
+	RM_PERK_QUERY                 = "DELETE FROM funders.perks WHERE name = $1 AND campaign_id IN (SELECT id FROM funders.campaigns WHERE name = $2)"
+	UPDATE_CAMPAIGN_QUERY         = "UPDATE funders.campaigns SET updated_at = $1, ? WHERE name = ?"
+	UPDATE_PERK_QUERY             = "UPDATE funders.perks SET updated_at = $1, ? WHERE name = ? AND campaign_id IN (SELECT id FROM funders.campaigns WHERE name = ?)"
+	ACTIVE_CAMPAIGN_QUERY         = "UPDATE funders.campaigns SET updated_at = $1, active = $2 WHERE name = $3"
+	ACTIVE_PERK_QUERY             = "UPDATE funders.perks SET updated_at = $1, active = $2 WHERE name = $3 AND campaign_id IN (SELECT id FROM funders.campaigns WHERE name = $4)"
+	GET_PAYMENT_QUERY             = "SELECT id, account_type, amount, currency, amount_refunded, status, payment_processor_used, payment_processor_transaction_id FROM funders.payments WHERE id = $1"
+	ADD_REFUND_QUERY              = "INSERT INTO funders.refunds(id, payment_id, amount, reason, payment_processor_refund_id, created_at) VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT (payment_id, payment_processor_refund_id) DO NOTHING"
+	LIST_DEAD_LETTERS_QUERY       = "SELECT id, queue, attempts, error, created_at FROM funders.dead_letters ORDER BY id"
+	GET_DEAD_LETTER_QUERY         = "SELECT id, queue, payload, attempts, error, created_at FROM funders.dead_letters WHERE id = $1"
+	REQUEUE_DEAD_LETTER_QUERY     = "INSERT INTO funders.batch_jobs(queue, payload, attempts, available_at, created_at) SELECT queue, payload, attempts, $1, $1 FROM funders.dead_letters WHERE id = $2"
+	RM_DEAD_LETTER_QUERY          = "DELETE FROM funders.dead_letters WHERE id = $1"
+	ADD_MANUAL_PAYMENT_QUERY      = "INSERT INTO funders.payments(id, campaign_id, perk_id, account_type, name_on_payment, full_name, address1, address2, city, postal_code, country, amount, currency, status, contact_email, contact_opt_in, advertise, payment_processor_responses, payment_processor_used, payment_processor_transaction_id, created_at, updated_at) SELECT $1, perks.campaign_id, perks.id, $2, $3, $4, $5, $6, $7, $8, $9, perks.price, perks.currency, $10, $11, $12, $13, $14, $15, $16, $17, $17 FROM funders.perks INNER JOIN funders.campaigns ON perks.campaign_id = campaigns.id WHERE campaigns.name = $18 AND perks.name = $19 RETURNING amount, currency"
+	ADD_MANUAL_PAYMENT_ITEM_QUERY = "INSERT INTO funders.payment_items(payment_id, perk_id, quantity, price, created_at) SELECT payments.id, perks.id, 1, perks.price, payments.created_at FROM funders.payments INNER JOIN funders.perks ON payments.perk_id = perks.id WHERE payments.id = $1"
+	CONFIRM_PAYMENT_QUERY         = "UPDATE funders.payments SET updated_at = $1, payment_processor_responses = payment_processor_responses || $2, status = 'success' WHERE id = $3 AND status = 'pending' AND payment_processor_used = $4 RETURNING id"
+	UPDATE_REFUNDS_QUERY          = "UPDATE funders.payments SET updated_at = $1, payment_processor_responses = payment_processor_responses || $2, amount_refunded = refunded.amount, status = CASE WHEN refunded.amount >= payments.amount THEN 'refunded'::funders.payment_status ELSE 'partially_refunded'::funders.payment_status END FROM (SELECT COALESCE(sum(amount), 0) AS amount FROM funders.refunds WHERE payment_id = $3) refunded WHERE payments.id = $3 RETURNING payments.amount_refunded, payments.status"
 )
 
 func getCampaignFromCommandLine() (common.Campaign, error) {
@@ -35,6 +55,7 @@ func getCampaignFromCommandLine() (common.Campaign, error) {
 		startDateStr string
 		endDateStr   string
 		flexibleStr  string
+		location     *time.Location
 	)
 
 	for {
@@ -68,16 +89,24 @@ func getCampaignFromCommandLine() (common.Campaign, error) {
 			break
 		}
 
-		fmt.Print("Enter campaign start date (e.g. 2016-09-04): ")
+		fmt.Print("Enter campaign time zone (e.g. America/New_York): ")
+		campaign.TimeZone, err = reader.ReadString('\n')
+		campaign.TimeZone = strings.TrimSpace(campaign.TimeZone)
+		location, err = time.LoadLocation(campaign.TimeZone)
+		if nil != err {
+			break
+		}
+
+		fmt.Print("Enter campaign start in campaign time zone (e.g. 2016-09-04T09:00 or 2016-09-04T09:00:00-04:00): ")
 		startDateStr, err = reader.ReadString('\n')
-		campaign.StartDate, err = time.Parse(common.TIME_LAYOUT, strings.TrimSpace(startDateStr))
+		campaign.StartDate, err = common.ParseCampaignTime(strings.TrimSpace(startDateStr), location)
 		if nil != err {
 			break
 		}
 
-		fmt.Print("Enter campaign end date (e.g. 2016-09-04): ")
+		fmt.Print("Enter campaign end in campaign time zone (e.g. 2016-10-04T17:00 or 2016-10-04T17:00:00-04:00): ")
 		endDateStr, err = reader.ReadString('\n')
-		campaign.EndDate, err = time.Parse(common.TIME_LAYOUT, strings.TrimSpace(endDateStr))
+		campaign.EndDate, err = common.ParseCampaignTime(strings.TrimSpace(endDateStr), location)
 		if nil != err {
 			break
 		}
@@ -171,7 +200,7 @@ func getPerkFromCommandLine() (common.Perk, error) {
 }
 
 func addCampaignToDatabase(db *sql.DB, campaign *common.Campaign) (int64, error) {
-	err := db.QueryRow(ADD_CAMPAIGN_QUERY, campaign.Name, campaign.Description, campaign.Goal, campaign.Currency, campaign.StartDate, campaign.EndDate, campaign.Flexible, time.Now(), time.Now()).Scan(&campaign.Id)
+	err := db.QueryRow(ADD_CAMPAIGN_QUERY, campaign.Name, campaign.Description, campaign.Goal, campaign.Currency, campaign.StartDate, campaign.EndDate, campaign.TimeZone, campaign.Flexible, time.Now(), time.Now()).Scan(&campaign.Id)
 	return campaign.Id, err
 }
 
@@ -180,6 +209,142 @@ func addPerkToDatabase(db *sql.DB, perk *common.Perk) (int64, error) {
 	return perk.Id, err
 }
 
+func getStretchGoalFromCommandLine() (common.StretchGoal, string, string, error) {
+	var (
+		stretchGoal  common.StretchGoal
+		campaignName string
+		perkName     string
+		err          error
+		amountStr    string
+	)
+
+	for {
+		reader := bufio.NewReader(os.Stdin)
+
+		fmt.Print("Enter campaign name: ")
+		campaignName, err = reader.ReadString('\n')
+		campaignName = strings.TrimSpace(campaignName)
+		if nil != err {
+			break
+		}
+
+		fmt.Print("Enter stretch goal amount: ")
+		amountStr, err = reader.ReadString('\n')
+		stretchGoal.Amount, err = strconv.ParseFloat(strings.TrimSpace(amountStr), 64)
+		if nil != err {
+			break
+		}
+
+		fmt.Print("Enter stretch goal title: ")
+		stretchGoal.Title, err = reader.ReadString('\n')
+		stretchGoal.Title = strings.TrimSpace(stretchGoal.Title)
+		if nil != err {
+			break
+		}
+
+		fmt.Print("Enter stretch goal description: ")
+		stretchGoal.Description, err = reader.ReadString('\n')
+		stretchGoal.Description = strings.TrimSpace(stretchGoal.Description)
+		if nil != err {
+			break
+		}
+
+		fmt.Print("Enter name of perk unlocked by stretch goal (blank for none): ")
+		perkName, err = reader.ReadString('\n')
+		perkName = strings.TrimSpace(perkName)
+
+		break
+	}
+
+	return stretchGoal, campaignName, perkName, err
+}
+
+func addStretchGoalToDatabase(db *sql.DB, stretchGoal *common.StretchGoal, campaignName string, perkName string) (int64, error) {
+	err := db.QueryRow(ADD_STRETCH_GOAL_QUERY, campaignName, stretchGoal.Amount, stretchGoal.Title, stretchGoal.Description, perkName, time.Now()).Scan(&stretchGoal.Id)
+	if sql.ErrNoRows == err {
+		if len(perkName) > 0 {
+			err = fmt.Errorf("Perk name %s not found for campaign %s", perkName, campaignName)
+		} else {
+			err = fmt.Errorf("Campaign name %s not found", campaignName)
+		}
+	}
+	return stretchGoal.Id, err
+}
+
+func getStretchGoalAndCampaignNameFromCommandLine() (string, string, error) {
+	var (
+		campaignName string
+		title        string
+		err          error
+	)
+	for {
+		reader := bufio.NewReader(os.Stdin)
+
+		fmt.Print("Enter campaign name: ")
+		campaignName, err = reader.ReadString('\n')
+		campaignName = strings.TrimSpace(campaignName)
+		if nil != err {
+			break
+		}
+
+		fmt.Print("Enter stretch goal title: ")
+		title, err = reader.ReadString('\n')
+		title = strings.TrimSpace(title)
+
+		break
+	}
+
+	return campaignName, title, err
+}
+
+func removeStretchGoalFromDatabase(db *sql.DB, campaignName string, title string) error {
+	var (
+		err    error
+		result sql.Result
+	)
+
+	result, err = db.Exec(RM_STRETCH_GOAL_QUERY, title, campaignName)
+	if nil == err {
+		var rowsAffected int64
+		rowsAffected, err = result.RowsAffected()
+		if nil != err || rowsAffected <= 0 {
+			err = errors.New(fmt.Sprintf("Stretch goal %s not found for campaign %s", title, campaignName))
+		}
+	}
+	return err
+}
+
+//Stretch goal with the name of the perk it unlocks
+type StretchGoalListing struct {
+	common.StretchGoal
+	PerkName string
+}
+
+func listStretchGoalsFromDatabase(db *sql.DB, campaignName string) ([]StretchGoalListing, error) {
+	rows, err := db.Query(LIST_STRETCH_GOALS_QUERY, campaignName)
+	if nil != err {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var stretchGoals []StretchGoalListing
+	for rows.Next() {
+		var stretchGoal StretchGoalListing
+		err = rows.Scan(&stretchGoal.Id, &stretchGoal.Amount, &stretchGoal.Title, &stretchGoal.PerkName)
+		if nil != err {
+			break
+		}
+		stretchGoals = append(stretchGoals, stretchGoal)
+	}
+
+	if nil == err {
+		err = rows.Err()
+	}
+
+	return stretchGoals, err
+}
+
 func getCampaignNameFromCommandLine() (string, error) {
 	reader := bufio.NewReader(os.Stdin)
 
@@ -227,7 +392,7 @@ func getCampaignFieldsFromCommandLine() (map[string]interface{}, error) {
 
 	for {
 		reader := bufio.NewReader(os.Stdin)
-		fmt.Print("Enter campaign field name (name, description, goal, currency, start_date, end_date, flexible): ")
+		fmt.Print("Enter campaign field name (name, description, goal, currency, start_date, end_date, time_zone, flexible): ")
 		campaignFieldName, err = reader.ReadString('\n')
 		campaignFieldName = strings.TrimSpace(campaignFieldName)
 		if nil != err {
@@ -252,7 +417,12 @@ func getCampaignFieldsFromCommandLine() (map[string]interface{}, error) {
 		case "start_date":
 			fallthrough
 		case "end_date":
-			campaignFieldNames[campaignFieldName], err = time.Parse(common.TIME_LAYOUT, strings.TrimSpace(campaignFieldValue))
+			//The campaign time zone is not known here so an offset is required (e.g. 2016-09-04T09:00:00-04:00)
+			campaignFieldNames[campaignFieldName], err = common.ParseCampaignTime(strings.TrimSpace(campaignFieldValue), nil)
+		case "time_zone":
+			campaignFieldValue = strings.TrimSpace(campaignFieldValue)
+			_, err = time.LoadLocation(campaignFieldValue)
+			campaignFieldNames[campaignFieldName] = campaignFieldValue
 		case "flexible":
 			campaignFieldNames[campaignFieldName], err = strconv.ParseBool(strings.TrimSpace(campaignFieldValue))
 		default:
@@ -432,6 +602,103 @@ func updatePerkFromDatabase(db *sql.DB, values map[string]interface{}, campaignN
 	return err
 }
 
+func getCampaignStatusFromCommandLine() (string, string, error) {
+	var (
+		campaignName string
+		status       string
+		err          error
+	)
+	for {
+		reader := bufio.NewReader(os.Stdin)
+
+		fmt.Print("Enter campaign name: ")
+		campaignName, err = reader.ReadString('\n')
+		campaignName = strings.TrimSpace(campaignName)
+		if nil != err {
+			break
+		}
+
+		fmt.Print("Enter campaign status (draft, scheduled or cancelled): ")
+		status, err = reader.ReadString('\n')
+		status = strings.TrimSpace(status)
+
+		break
+	}
+
+	return campaignName, status, err
+}
+
+//Live, succeeded and failed are reached by the campaign dates so only draft, scheduled and cancelled are set here
+func transitionCampaignFromDatabase(db *sql.DB, campaignName string, status string) error {
+	if !common.IsManualCampaignStatus(status) {
+		return fmt.Errorf("Campaign status %s can not be set. Only %s, %s and %s can be set", status, common.CAMPAIGN_DRAFT, common.CAMPAIGN_SCHEDULED, common.CAMPAIGN_CANCELLED)
+	}
+
+	var (
+		storedStatus string
+		startDate    time.Time
+		endDate      time.Time
+		goalMet      bool
+	)
+
+	err := db.QueryRow(GET_CAMPAIGN_STATUS_QUERY, campaignName).Scan(&storedStatus, &startDate, &endDate, &goalMet)
+	if sql.ErrNoRows == err {
+		return fmt.Errorf("Campaign name %s not found", campaignName)
+	} else if nil != err {
+		return err
+	}
+
+	currentStatus := common.GetCampaignStatus(storedStatus, startDate, endDate, goalMet, time.Now())
+	if !common.IsCampaignStatusTransitionAllowed(currentStatus, status) {
+		return fmt.Errorf("Campaign %s can not move from %s to %s", campaignName, currentStatus, status)
+	}
+
+	//Stored status is checked again so concurrent transitions can not be overwritten
+	result, err := db.Exec(TRANSITION_CAMPAIGN_QUERY, time.Now(), status, campaignName, storedStatus)
+	if nil != err {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if nil != err {
+		return err
+	} else if rowsAffected <= 0 {
+		return fmt.Errorf("Campaign %s status changed from %s while updating", campaignName, storedStatus)
+	}
+
+	return nil
+}
+
+func getCampaignPreviewFromCommandLine() (string, int, error) {
+	var (
+		campaignName string
+		hours        int
+		err          error
+		hoursStr     string
+	)
+	for {
+		reader := bufio.NewReader(os.Stdin)
+
+		fmt.Print("Enter campaign name: ")
+		campaignName, err = reader.ReadString('\n')
+		campaignName = strings.TrimSpace(campaignName)
+		if nil != err {
+			break
+		}
+
+		fmt.Print("Enter hours preview is valid for: ")
+		hoursStr, err = reader.ReadString('\n')
+		hours, err = strconv.Atoi(strings.TrimSpace(hoursStr))
+		if nil == err && hours <= 0 {
+			err = fmt.Errorf("Invalid hours %d specified", hours)
+		}
+
+		break
+	}
+
+	return campaignName, hours, err
+}
+
 func flipActivationForCampaign(db *sql.DB, campaignName string, active bool) error {
 	var (
 		err    error
@@ -466,7 +733,385 @@ func flipActivationForPerk(db *sql.DB, campaignName string, perkName string, act
 	return err
 }
 
+func getRefundFromCommandLine() (string, float64, string, error) {
+	var (
+		paymentId string
+		amountStr string
+		amount    float64
+		reason    string
+		err       error
+	)
+
+	for {
+		reader := bufio.NewReader(os.Stdin)
+
+		fmt.Print("Enter payment id: ")
+		paymentId, err = reader.ReadString('\n')
+		paymentId = strings.TrimSpace(paymentId)
+		if nil != err {
+			break
+		}
+
+		fmt.Print("Enter refund amount (blank for remaining amount): ")
+		amountStr, err = reader.ReadString('\n')
+		amountStr = strings.TrimSpace(amountStr)
+		if nil != err {
+			break
+		}
+
+		if len(amountStr) > 0 {
+			amount, err = strconv.ParseFloat(amountStr, 64)
+			if nil != err {
+				break
+			}
+		}
+
+		fmt.Print("Enter refund reason: ")
+		reason, err = reader.ReadString('\n')
+		reason = strings.TrimSpace(reason)
+
+		break
+	}
+
+	return paymentId, amount, reason, err
+}
+
+func getPaymentFromDatabase(db *sql.DB, paymentId string) (*common.Payment, error) {
+	var (
+		payment                       common.Payment
+		paymentProcessorUsed          sql.NullString
+		paymentProcessorTransactionId sql.NullString
+	)
+
+	err := db.QueryRow(GET_PAYMENT_QUERY, paymentId).Scan(&payment.Id, &payment.AccountType, &payment.Amount, &payment.Currency, &payment.AmountRefunded, &payment.Status, &paymentProcessorUsed, &paymentProcessorTransactionId)
+	if sql.ErrNoRows == err {
+		err = errors.New(fmt.Sprintf("Payment id %s not found", paymentId))
+	}
+
+	payment.PaymentProcessorUsed = paymentProcessorUsed.String
+	payment.PaymentProcessorTransactionId = paymentProcessorTransactionId.String
+	return &payment, err
+}
+
+func getPaymentProcessor(paymentProcessorUsed string) (common.PaymentProcessor, error) {
+	switch paymentProcessorUsed {
+	case common.STRIPE_PROCESSOR:
+		stripeKey := os.Getenv("STRIPE_KEY")
+		if len(stripeKey) == 0 {
+			return nil, errors.New("Stripe key is NOT set")
+		}
+		return common.NewStripeProcessor(stripeKey), nil
+	case common.STRIPE_SECONDARY_PROCESSOR:
+		stripeSecondaryKey := os.Getenv("STRIPE_SECONDARY_KEY")
+		if len(stripeSecondaryKey) == 0 {
+			return nil, errors.New("Secondary stripe key is NOT set")
+		}
+		stripeProcessor := common.NewStripeProcessor(stripeSecondaryKey)
+		stripeProcessor.Name = common.STRIPE_SECONDARY_PROCESSOR
+		return stripeProcessor, nil
+	case common.PAYPAL_PROCESSOR:
+		paypalClientId := os.Getenv("PAYPAL_CLIENT_ID")
+		paypalSecretId := os.Getenv("PAYPAL_SECRET_ID")
+		if len(paypalClientId) == 0 || len(paypalSecretId) == 0 {
+			return nil, errors.New("Both PAYPAL_CLIENT_ID and PAYPAL_SECRET_ID need to be set")
+		}
+
+		paypalApiBase, err := common.GetPaypalApiBase(common.GetenvWithDefault("PAYPAL_MODE", common.PAYPAL_MODE_SANDBOX), os.Getenv("PAYPAL_API_BASE"))
+		if nil != err {
+			return nil, err
+		}
+
+		paypalClient, err := paypalsdk.NewClient(paypalClientId, paypalSecretId, paypalApiBase)
+		if nil == err {
+			_, err = paypalClient.GetAccessToken()
+		}
+		if nil != err {
+			return nil, err
+		}
+		return common.NewPaypalProcessor(paypalClient), nil
+	case common.MANUAL_PROCESSOR:
+		return common.NewManualProcessor(), nil
+	case common.BTCPAY_PROCESSOR:
+		btcpayUrl := os.Getenv("BTCPAY_URL")
+		btcpayStoreId := os.Getenv("BTCPAY_STORE_ID")
+		btcpayApiKey := os.Getenv("BTCPAY_API_KEY")
+		if len(btcpayUrl) == 0 || len(btcpayStoreId) == 0 || len(btcpayApiKey) == 0 {
+			return nil, errors.New("All of BTCPAY_URL, BTCPAY_STORE_ID and BTCPAY_API_KEY need to be set")
+		}
+		return common.NewBtcpayProcessor(btcpayUrl, btcpayStoreId, btcpayApiKey), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported payment processor %s", paymentProcessorUsed))
+	}
+}
+
+func refundPaymentFromDatabase(db *sql.DB, paymentId string, amount float64, reason string) (*common.Payment, error) {
+	payment, err := getPaymentFromDatabase(db, paymentId)
+	if nil != err {
+		return nil, err
+	}
+
+	if payment.Status != "success" && payment.Status != "partially_refunded" {
+		return nil, errors.New(fmt.Sprintf("Only successful payments can be refunded. Status: %s", payment.Status))
+	}
+
+	//Default to refunding the remaining amount
+	remaining := payment.Amount - payment.AmountRefunded
+	if amount == 0 {
+		amount = remaining
+	}
+
+	amount = math.Floor(amount*100+0.5) / 100
+	if amount <= 0 || amount > remaining+0.005 {
+		return nil, errors.New(fmt.Sprintf("Refund amount %.2f must be between 0 and remaining amount %.2f", amount, remaining))
+	}
+
+	paymentProcessor, err := getPaymentProcessor(payment.PaymentProcessorUsed)
+	if nil != err {
+		return nil, err
+	}
+
+	processorRefundId, err := paymentProcessor.Refund(payment, amount)
+	if nil != err {
+		return nil, err
+	}
+
+	log.Printf("Issued refund %s with %s", processorRefundId, payment.PaymentProcessorUsed)
+
+	transaction, err := db.Begin()
+	if nil != err {
+		return nil, err
+	}
+
+	defer transaction.Rollback()
+
+	_, err = transaction.Exec(ADD_REFUND_QUERY, uuid.NewV4().String(), payment.Id, amount, common.CreateSqlString(reason), processorRefundId, time.Now())
+	if nil == err {
+		err = transaction.QueryRow(UPDATE_REFUNDS_QUERY, time.Now(), payment.PaymentProcessorResponses, payment.Id).Scan(&payment.AmountRefunded, &payment.Status)
+	}
+	if nil == err {
+		err = transaction.Commit()
+	}
+	if nil != err {
+		return nil, errors.New(fmt.Sprintf("Refund %s issued but could not be recorded: %s", processorRefundId, err.Error()))
+	}
+
+	return payment, nil
+}
+
+type DeadLetter struct {
+	Id        int64
+	Queue     string
+	Payload   []byte
+	Attempts  int
+	Error     string
+	CreatedAt time.Time
+}
+
+func getManualPaymentFromCommandLine() (*common.Payment, string, string, bool, error) {
+	var (
+		payment      = new(common.Payment)
+		campaignName string
+		perkName     string
+		advertiseStr string
+		receivedStr  string
+		received     bool
+		err          error
+	)
+
+	prompts := []struct {
+		prompt string
+		value  *string
+	}{
+		{"Enter campaign name: ", &campaignName},
+		{"Enter perk name: ", &perkName},
+		{fmt.Sprintf("Enter account type (%s): ", strings.Join(common.GetManualAccountTypes(), " or ")), &payment.AccountType},
+		{"Enter name on payment: ", &payment.NameOnPayment},
+		{"Enter full name: ", &payment.FullName},
+		{"Enter address 1: ", &payment.Address1},
+		{"Enter address 2: ", &payment.Address2},
+		{"Enter city: ", &payment.City},
+		{"Enter postal code: ", &payment.PostalCode},
+		{"Enter country: ", &payment.Country},
+		{"Enter contact email: ", &payment.ContactEmail},
+		{"Enter reference (check number, wire reference, etc): ", &payment.PaymentProcessorTransactionId},
+		{"Enter advertise payment (true/false): ", &advertiseStr},
+		{"Enter payment received (true/false): ", &receivedStr},
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for _, prompt := range prompts {
+		fmt.Print(prompt.prompt)
+		*prompt.value, err = reader.ReadString('\n')
+		*prompt.value = strings.TrimSpace(*prompt.value)
+		if nil != err {
+			return payment, campaignName, perkName, received, err
+		}
+	}
+
+	if !common.IsManualAccountType(payment.AccountType) {
+		return payment, campaignName, perkName, received, errors.New(fmt.Sprintf("Invalid account type %s", payment.AccountType))
+	}
+
+	payment.Advertise, err = strconv.ParseBool(advertiseStr)
+	if nil == err {
+		received, err = strconv.ParseBool(receivedStr)
+	}
+
+	return payment, campaignName, perkName, received, err
+}
+
+func recordManualPaymentToDatabase(db *sql.DB, payment *common.Payment, campaignName string, perkName string, received bool) error {
+	manualProcessor := common.NewManualProcessor()
+	payment.Id = uuid.NewV4().String()
+	payment.PaymentProcessorUsed = manualProcessor.GetName()
+
+	if received {
+		manualProcessor.Complete(payment, common.PaymentCompletion{})
+	} else {
+		manualProcessor.Charge(payment)
+	}
+
+	//Perks are claimed by the payment items recorded with the payment
+	transaction, err := db.Begin()
+	if nil != err {
+		return err
+	}
+
+	defer transaction.Rollback()
+	err = transaction.QueryRow(ADD_MANUAL_PAYMENT_QUERY, payment.Id, payment.AccountType, payment.NameOnPayment, payment.FullName, payment.Address1, common.CreateSqlString(payment.Address2), payment.City, payment.PostalCode, payment.Country, payment.Status, common.CreateSqlString(payment.ContactEmail), len(payment.ContactEmail) > 0, payment.Advertise, payment.PaymentProcessorResponses, payment.PaymentProcessorUsed, common.CreateSqlString(payment.PaymentProcessorTransactionId), time.Now(), campaignName, perkName).Scan(&payment.Amount, &payment.Currency)
+	if sql.ErrNoRows == err {
+		return errors.New(fmt.Sprintf("Perk %s not found on campaign %s", perkName, campaignName))
+	} else if nil != err {
+		return err
+	}
+
+	_, err = transaction.Exec(ADD_MANUAL_PAYMENT_ITEM_QUERY, payment.Id)
+	if nil != err {
+		return err
+	}
+
+	return transaction.Commit()
+}
+
+func getPaymentIdFromCommandLine() (string, error) {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Print("Enter payment id: ")
+	paymentId, err := reader.ReadString('\n')
+	return strings.TrimSpace(paymentId), err
+}
+
+func confirmManualPaymentFromDatabase(db *sql.DB, paymentId string) error {
+	payment := common.Payment{Id: paymentId}
+	manualProcessor := common.NewManualProcessor()
+	manualProcessor.Complete(&payment, common.PaymentCompletion{})
+
+	err := db.QueryRow(CONFIRM_PAYMENT_QUERY, time.Now(), payment.PaymentProcessorResponses, paymentId, manualProcessor.GetName()).Scan(&paymentId)
+	if sql.ErrNoRows == err {
+		err = errors.New(fmt.Sprintf("Payment %s is not a pending manual payment", paymentId))
+	}
+
+	return err
+}
+
+//Card details in payment payloads are masked before printing
+var redactedPayloadFields = []string{"CreditCardAccountNumber", "CreditCardCvv", "CreditCardExpirationDate"}
+
+func getDeadLetterIdFromCommandLine() (int64, error) {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Print("Enter dead letter id: ")
+	deadLetterIdStr, err := reader.ReadString('\n')
+	if nil != err {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(deadLetterIdStr), 10, 64)
+}
+
+func listDeadLettersFromDatabase(db *sql.DB) ([]DeadLetter, error) {
+	rows, err := db.Query(LIST_DEAD_LETTERS_QUERY)
+	if nil != err {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var deadLetters []DeadLetter
+	for rows.Next() {
+		var deadLetter DeadLetter
+		err = rows.Scan(&deadLetter.Id, &deadLetter.Queue, &deadLetter.Attempts, &deadLetter.Error, &deadLetter.CreatedAt)
+		if nil != err {
+			break
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	if nil == err {
+		err = rows.Err()
+	}
+
+	return deadLetters, err
+}
+
+func getDeadLetterFromDatabase(db *sql.DB, deadLetterId int64) (DeadLetter, error) {
+	var deadLetter DeadLetter
+	err := db.QueryRow(GET_DEAD_LETTER_QUERY, deadLetterId).Scan(&deadLetter.Id, &deadLetter.Queue, &deadLetter.Payload, &deadLetter.Attempts, &deadLetter.Error, &deadLetter.CreatedAt)
+	if sql.ErrNoRows == err {
+		err = fmt.Errorf("Dead letter %d not found", deadLetterId)
+	}
+
+	return deadLetter, err
+}
+
+func formatDeadLetterPayload(payload []byte) (string, error) {
+	var fields map[string]interface{}
+	err := json.Unmarshal(payload, &fields)
+	if nil != err {
+		return "", err
+	}
+
+	for _, fieldName := range redactedPayloadFields {
+		if value, ok := fields[fieldName].(string); ok && len(value) > 0 {
+			fields[fieldName] = strings.Repeat("*", len(value))
+		}
+	}
+
+	formatted, err := json.MarshalIndent(fields, "", "  ")
+	return string(formatted), err
+}
+
+func requeueDeadLetterFromDatabase(db *sql.DB, deadLetterId int64) error {
+	transaction, err := db.Begin()
+	if nil != err {
+		return err
+	}
+
+	defer transaction.Rollback()
+
+	result, err := transaction.Exec(REQUEUE_DEAD_LETTER_QUERY, time.Now(), deadLetterId)
+	if nil != err {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if nil != err {
+		return err
+	} else if rowsAffected <= 0 {
+		return fmt.Errorf("Dead letter %d not found", deadLetterId)
+	}
+
+	_, err = transaction.Exec(RM_DEAD_LETTER_QUERY, deadLetterId)
+	if nil != err {
+		return err
+	}
+
+	return transaction.Commit()
+}
+
 func main() {
+	slog.SetDefault(common.NewLogger(os.Stderr, common.LOG_FORMAT_LOGFMT, slog.LevelInfo))
+
 	dbUrl := os.Getenv("DATABASE_URL")
 	dbUser := os.Getenv("DB_USER")
 	dbPassword := os.Getenv("DB_PASSWORD")
@@ -494,7 +1139,8 @@ func main() {
 
 	dbCredentials := common.DatabaseCredentials{common.DB_DRIVER, dbUrl, dbUser, dbPassword, dbName, dbHost, dbPort, dbMaxOpenConns, dbMaxIdleConns}
 	if !dbCredentials.IsValid() {
-		log.Fatalf("Database credentials NOT set correctly. %#v", dbCredentials)
+		slog.Error("Database credentials NOT set correctly", "credentials", dbCredentials)
+		os.Exit(1)
 	}
 
 	//Database connection
@@ -507,6 +1153,13 @@ func main() {
 	addCampaignFlag := flag.Bool("add_campaign", false, "Add campaign for crowdfunding")
 	addPerkFlag := flag.Bool("add_perk", false, "Add perk for existing campaign")
 
+	addStretchGoalFlag := flag.Bool("add_stretch_goal", false, "Add stretch goal for existing campaign")
+	rmStretchGoalFlag := flag.Bool("rm_stretch_goal", false, "Remove stretch goal for existing campaign")
+	listStretchGoalsFlag := flag.Bool("list_stretch_goals", false, "List stretch goals for existing campaign")
+
+	transitionCampaignFlag := flag.Bool("transition_campaign", false, "Move campaign to draft, scheduled or cancelled status")
+	previewCampaignFlag := flag.Bool("preview_campaign", false, "Create preview token for draft campaign")
+
 	rmCampaignFlag := flag.Bool("rm_campaign", false, "Remove campaign for crowdfunding")
 	rmPerkFlag := flag.Bool("rm_perk", false, "Remove perk for existing campaign")
 
@@ -518,6 +1171,15 @@ func main() {
 
 	activatePerkFlag := flag.Bool("activate_perk", false, "Activate deactive perk")
 	deactivatePerkFlag := flag.Bool("deactivate_perk", false, "Deactivate active perk")
+
+	refundPaymentFlag := flag.Bool("refund_payment", false, "Refund all or part of successful payment")
+
+	recordPaymentFlag := flag.Bool("record_payment", false, "Record cash, check or bank transfer payment")
+	confirmPaymentFlag := flag.Bool("confirm_payment", false, "Confirm receipt of recorded cash, check or bank transfer payment")
+
+	listDeadLettersFlag := flag.Bool("list_dead_letters", false, "List failed asynchronous payments, pledges and payment updates")
+	inspectDeadLetterFlag := flag.Bool("inspect_dead_letter", false, "Show failed asynchronous request")
+	requeueDeadLetterFlag := flag.Bool("requeue_dead_letter", false, "Requeue failed asynchronous request for processing")
 	flag.Parse()
 
 	if *addCampaignFlag {
@@ -531,6 +1193,7 @@ func main() {
 				log.Fatal(err)
 			} else {
 				log.Printf("Id is %d", id)
+				log.Print("Campaign added as draft. Schedule it with -transition_campaign")
 			}
 		}
 	} else if *addPerkFlag {
@@ -546,6 +1209,76 @@ func main() {
 				log.Printf("Id is %d", id)
 			}
 		}
+	} else if *addStretchGoalFlag {
+		log.Print("Adding stretch goal")
+		stretchGoal, campaignName, perkName, err := getStretchGoalFromCommandLine()
+		if nil != err {
+			log.Fatal(err)
+		} else {
+			id, err := addStretchGoalToDatabase(db, &stretchGoal, campaignName, perkName)
+			if nil != err {
+				log.Fatal(err)
+			} else {
+				log.Printf("Id is %d", id)
+			}
+		}
+	} else if *rmStretchGoalFlag {
+		log.Print("Removing stretch goal")
+		campaignName, title, err := getStretchGoalAndCampaignNameFromCommandLine()
+		if nil != err {
+			log.Fatal(err)
+		} else {
+			err := removeStretchGoalFromDatabase(db, campaignName, title)
+			if nil != err {
+				log.Fatal(err)
+			} else {
+				log.Printf("Removed stretch goal %s from campaign %s", title, campaignName)
+			}
+		}
+	} else if *listStretchGoalsFlag {
+		log.Print("Listing stretch goals")
+		campaignName, err := getCampaignNameFromCommandLine()
+		if nil != err {
+			log.Fatal(err)
+		} else {
+			stretchGoals, err := listStretchGoalsFromDatabase(db, campaignName)
+			if nil != err {
+				log.Fatal(err)
+			} else {
+				for _, stretchGoal := range stretchGoals {
+					fmt.Printf("%d\t%.2f\t%s\t%s\n", stretchGoal.Id, stretchGoal.Amount, stretchGoal.Title, stretchGoal.PerkName)
+				}
+				log.Printf("Found %d stretch goals for campaign %s", len(stretchGoals), campaignName)
+			}
+		}
+	} else if *transitionCampaignFlag {
+		log.Print("Transitioning campaign")
+		campaignName, status, err := getCampaignStatusFromCommandLine()
+		if nil != err {
+			log.Fatal(err)
+		} else {
+			err := transitionCampaignFromDatabase(db, campaignName, status)
+			if nil != err {
+				log.Fatal(err)
+			} else {
+				log.Printf("Campaign %s is %s", campaignName, status)
+			}
+		}
+	} else if *previewCampaignFlag {
+		log.Print("Creating campaign preview token")
+		previewSecret := os.Getenv("CAMPAIGN_PREVIEW_SECRET")
+		if len(previewSecret) == 0 {
+			log.Fatal("CAMPAIGN_PREVIEW_SECRET is required to create preview tokens")
+		}
+
+		campaignName, hours, err := getCampaignPreviewFromCommandLine()
+		if nil != err {
+			log.Fatal(err)
+		} else {
+			expiresAt := time.Now().Add(time.Duration(hours) * time.Hour)
+			fmt.Println(common.CreatePreviewToken(previewSecret, campaignName, expiresAt))
+			log.Printf("Preview token for campaign %s expires at %s", campaignName, expiresAt.Format(time.RFC3339))
+		}
 	} else if *rmCampaignFlag {
 		log.Print("Removing campaign")
 		campaignName, err := getCampaignNameFromCommandLine()
@@ -660,6 +1393,87 @@ func main() {
 				log.Printf("Deactivated perk %s on campaign %s", perkName, campaignName)
 			}
 		}
+	} else if *refundPaymentFlag {
+		log.Print("Refunding payment")
+		paymentId, amount, reason, err := getRefundFromCommandLine()
+		if nil != err {
+			log.Fatal(err)
+		} else {
+			payment, err := refundPaymentFromDatabase(db, paymentId, amount, reason)
+			if nil != err {
+				log.Fatal(err)
+			} else {
+				log.Printf("Refunded payment %s. Total refunded %.2f with status %s", payment.Id, payment.AmountRefunded, payment.Status)
+			}
+		}
+	} else if *recordPaymentFlag {
+		log.Print("Recording payment")
+		payment, campaignName, perkName, received, err := getManualPaymentFromCommandLine()
+		if nil != err {
+			log.Fatal(err)
+		} else {
+			err := recordManualPaymentToDatabase(db, payment, campaignName, perkName, received)
+			if nil != err {
+				log.Fatal(err)
+			} else {
+				log.Printf("Recorded payment %s of %.2f %s with status %s", payment.Id, payment.Amount, payment.Currency, payment.Status)
+			}
+		}
+	} else if *confirmPaymentFlag {
+		log.Print("Confirming payment")
+		paymentId, err := getPaymentIdFromCommandLine()
+		if nil != err {
+			log.Fatal(err)
+		} else {
+			err := confirmManualPaymentFromDatabase(db, paymentId)
+			if nil != err {
+				log.Fatal(err)
+			} else {
+				log.Printf("Confirmed payment %s", paymentId)
+			}
+		}
+	} else if *listDeadLettersFlag {
+		log.Print("Listing dead letters")
+		deadLetters, err := listDeadLettersFromDatabase(db)
+		if nil != err {
+			log.Fatal(err)
+		} else {
+			for _, deadLetter := range deadLetters {
+				fmt.Printf("%d\t%s\t%d attempts\t%s\t%s\n", deadLetter.Id, deadLetter.Queue, deadLetter.Attempts, deadLetter.CreatedAt.Format(time.RFC3339), deadLetter.Error)
+			}
+			log.Printf("Found %d dead letters", len(deadLetters))
+		}
+	} else if *inspectDeadLetterFlag {
+		log.Print("Inspecting dead letter")
+		deadLetterId, err := getDeadLetterIdFromCommandLine()
+		if nil != err {
+			log.Fatal(err)
+		} else {
+			deadLetter, err := getDeadLetterFromDatabase(db, deadLetterId)
+			if nil != err {
+				log.Fatal(err)
+			}
+
+			payload, err := formatDeadLetterPayload(deadLetter.Payload)
+			if nil != err {
+				log.Fatal(err)
+			}
+
+			fmt.Printf("Id: %d\nQueue: %s\nAttempts: %d\nError: %s\nCreated at: %s\nPayload: %s\n", deadLetter.Id, deadLetter.Queue, deadLetter.Attempts, deadLetter.Error, deadLetter.CreatedAt.Format(time.RFC3339), payload)
+		}
+	} else if *requeueDeadLetterFlag {
+		log.Print("Requeuing dead letter")
+		deadLetterId, err := getDeadLetterIdFromCommandLine()
+		if nil != err {
+			log.Fatal(err)
+		} else {
+			err := requeueDeadLetterFromDatabase(db, deadLetterId)
+			if nil != err {
+				log.Fatal(err)
+			} else {
+				log.Printf("Requeued dead letter %d", deadLetterId)
+			}
+		}
 	} else {
 		flag.Usage()
 	}
@@ -17,19 +17,32 @@ const (
 )
 
 type Campaign struct {
-	Id          int64        `json:"id"`
-	Name        string       `json:"name"`
-	Description string       `json:"description"`
-	Goal        float64      `json:"goal"`
-	Currency    string       `json:"currency"`
-	AmtRaised   float64      `json:"-"`
-	NumBackers  int64        `json:"-"`
-	AmtPledged  float64      `json:"-"`
-	NumPledgers int64        `json:"-"`
-	StartDate   time.Time    `json:"startDate"`
-	EndDate     time.Time    `json:"endDate"`
-	Flexible    bool         `json:"flexible"`
-	Lock        sync.RWMutex `json:"-"`
+	Id           int64         `json:"id"`
+	Name         string        `json:"name"`
+	Description  string        `json:"description"`
+	Goal         float64       `json:"goal"`
+	Currency     string        `json:"currency"`
+	AmtRaised    float64       `json:"-"`
+	NumBackers   int64         `json:"-"`
+	AmtPledged   float64       `json:"-"`
+	NumPledgers  int64         `json:"-"`
+	StartDate    time.Time     `json:"startDate"`
+	EndDate      time.Time     `json:"endDate"`
+	TimeZone     string        `json:"timeZone"`
+	Flexible     bool          `json:"flexible"`
+	Status       string        `json:"-"`
+	StretchGoals []StretchGoal `json:"-"`
+	Lock         sync.RWMutex  `json:"-"`
+}
+
+//Amount raised beyond the goal that unlocks more for the campaign. Ordered by amount
+type StretchGoal struct {
+	Id          int64   `json:"id"`
+	CampaignId  int64   `json:"campaignId"`
+	Amount      float64 `json:"amount"`
+	Title       string  `json:"title"`
+	Description string  `json:"description"`
+	PerkId      int64   `json:"perkId,omitempty"`
 }
 
 type Perk struct {
@@ -62,6 +75,7 @@ const (
 	ServerError
 	ServiceUnavailableError
 	ServiceNotImplementedError
+	ProcessorTimeoutError
 )
 
 type RequestError struct {
@@ -91,6 +105,14 @@ func CreateSqlString(value string) sql.NullString {
 	return nullValue
 }
 
+func CreateSqlInt64(value int64) sql.NullInt64 {
+	var nullValue sql.NullInt64
+	if 0 != value {
+		nullValue = sql.NullInt64{value, true}
+	}
+	return nullValue
+}
+
 func GetScheme(request *http.Request) string {
 	prot := request.Header.Get(XFP_HEADER)
 	if len(prot) > 0 {
@@ -8,9 +8,9 @@ import (
 
 type DatabaseCredentials struct {
 	Driver       string
-	Url          string
+	Url          string `log:"redact"`
 	User         string
-	Password     string
+	Password     string `log:"redact"`
 	Name         string
 	Host         string
 	Port         string
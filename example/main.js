@@ -10,11 +10,8 @@ function buyPerkCreditCard(event)
                           "perkId" : perkId,
                           "accountType" : "credit_card",
                           "nameOnPayment" : "John Doe",
-                          //"creditCardAccountNumber" : "4000000000000002", //Reject number
-                          "creditCardAccountNumber" : "5555555555554444",  //Accept number
-                          "creditCardExpirationDate" : "2019-09-01",
-                          "creditCardCvv" : "444",
-                          "creditCardPostalCode" : "10467",
+                          //"creditCardToken" : "tok_chargeDeclined", //Reject token
+                          "creditCardToken" : "tok_mastercard",  //Accept token
                           "fullName" : "John Doe",
                           "address1" : "55555 White Plains Road",
                           "address2" : "Apt. 555",
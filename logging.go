@@ -0,0 +1,144 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+)
+
+const (
+	LOG_FORMAT_JSON   = "json"
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_TAG           = "log"
+	LOG_TAG_REDACT    = "redact"
+	LOG_TAG_MASK      = "mask"
+	LOG_TAG_OMIT      = "-"
+	REDACTED_VALUE    = "[REDACTED]"
+)
+
+//Attributes with these words in their keys hold credentials and are always redacted
+var redactedLogKeys = []string{"password", "secret", "token", "key", "authorization", "cvv"}
+
+//Creates a leveled logger that redacts credentials and struct fields tagged with log:"redact" or log:"mask"
+func NewLogger(writer io.Writer, format string, level slog.Level) *slog.Logger {
+	options := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactLogAttr,
+	}
+
+	if format == LOG_FORMAT_JSON {
+		return slog.New(slog.NewJSONHandler(writer, options))
+	}
+
+	return slog.New(slog.NewTextHandler(writer, options))
+}
+
+func ParseLogLevel(levelStr string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(levelStr))
+	return level, err
+}
+
+func IsRedactedLogKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, redactedKey := range redactedLogKeys {
+		if strings.Contains(key, redactedKey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func redactLogAttr(groups []string, attr slog.Attr) slog.Attr {
+	if IsRedactedLogKey(attr.Key) && !attr.Value.Equal(slog.StringValue("")) {
+		return slog.String(attr.Key, REDACTED_VALUE)
+	}
+
+	if attr.Value.Kind() == slog.KindAny {
+		attr.Value = RedactLogValue(attr.Value.Any())
+	}
+
+	return attr
+}
+
+//Structs are logged as groups of their fields with sensitive fields masked
+func RedactLogValue(value interface{}) slog.Value {
+	switch value.(type) {
+	case error, fmt.Stringer, slog.LogValuer:
+		return slog.AnyValue(value)
+	}
+
+	reflectValue := reflect.ValueOf(value)
+	for reflectValue.Kind() == reflect.Ptr {
+		if reflectValue.IsNil() {
+			return slog.AnyValue(value)
+		}
+		reflectValue = reflectValue.Elem()
+	}
+
+	if reflectValue.Kind() != reflect.Struct {
+		return slog.AnyValue(value)
+	}
+
+	return slog.GroupValue(redactStructFields(reflectValue)...)
+}
+
+func redactStructFields(structValue reflect.Value) []slog.Attr {
+	var attrs []slog.Attr
+
+	structType := structValue.Type()
+	for iter := 0; iter < structType.NumField(); iter++ {
+		field := structType.Field(iter)
+		fieldValue := structValue.Field(iter)
+		tag := field.Tag.Get(LOG_TAG)
+
+		//Embedded structs are flattened into their parent
+		if field.Anonymous && fieldValue.Kind() == reflect.Struct {
+			attrs = append(attrs, redactStructFields(fieldValue)...)
+			continue
+		}
+
+		//Only exported fields with plain values are logged
+		if len(field.PkgPath) > 0 || tag == LOG_TAG_OMIT {
+			continue
+		}
+
+		switch fieldValue.Kind() {
+		case reflect.String:
+			attrs = append(attrs, slog.String(field.Name, redactLogString(field, fieldValue.String())))
+		case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+			if tag == LOG_TAG_REDACT {
+				attrs = append(attrs, slog.String(field.Name, REDACTED_VALUE))
+			} else {
+				attrs = append(attrs, slog.Any(field.Name, fieldValue.Interface()))
+			}
+		}
+	}
+
+	return attrs
+}
+
+func redactLogString(field reflect.StructField, str string) string {
+	tag := field.Tag.Get(LOG_TAG)
+	if len(str) > 0 && (tag == LOG_TAG_REDACT || IsRedactedLogKey(field.Name)) {
+		return REDACTED_VALUE
+	} else if tag == LOG_TAG_MASK {
+		return maskCardNumber(str)
+	}
+
+	return str
+}
+
+//String field of a struct as it is logged by the structured logger
+func RedactLogField(value interface{}, fieldName string) string {
+	structValue := reflect.Indirect(reflect.ValueOf(value))
+	field, found := structValue.Type().FieldByName(fieldName)
+	if !found || field.Type.Kind() != reflect.String {
+		return ""
+	}
+
+	return redactLogString(field, structValue.FieldByIndex(field.Index).String())
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func newTestLogPayment() *Payment {
+	return &Payment{
+		Id:                       "5a2f4c1e-0000-4000-8000-000000000000",
+		AccountType:              "credit_card",
+		NameOnPayment:            "Ada Backer",
+		CreditCardAccountNumber:  "4242424242424242",
+		CreditCardExpirationDate: "12/2099",
+		CreditCardCvv:            "987",
+		CreditCardToken:          "tok_visa_secret",
+		FullName:                 "Ada Backer",
+		Address1:                 "1 Private Lane",
+		ContactEmail:             "ada@example.com",
+		Amount:                   25,
+		Currency:                 "USD",
+	}
+}
+
+func assertRedacted(t *testing.T, output string, payment *Payment) {
+	for _, value := range []string{payment.NameOnPayment, payment.CreditCardAccountNumber, payment.CreditCardExpirationDate, payment.CreditCardCvv, payment.CreditCardToken, payment.Address1, payment.ContactEmail} {
+		if strings.Contains(output, value) {
+			t.Errorf("Expected %s to be redacted from %s", value, output)
+		}
+	}
+
+	if !strings.Contains(output, payment.Id) || !strings.Contains(output, "************4242") {
+		t.Errorf("Expected payment id and masked card number in %s", output)
+	}
+}
+
+func TestLoggerRedactsPayments(t *testing.T) {
+	for _, format := range []string{LOG_FORMAT_JSON, LOG_FORMAT_LOGFMT} {
+		var buffer bytes.Buffer
+		logger := NewLogger(&buffer, format, slog.LevelInfo)
+
+		payment := newTestLogPayment()
+		logger.Info("Received new payment", "payment", payment)
+		assertRedacted(t, buffer.String(), payment)
+	}
+}
+
+func TestLoggerRedactsCredentialKeys(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, LOG_FORMAT_LOGFMT, slog.LevelInfo)
+
+	logger.Info("Configured", "stripeKey", "sk_live_secret", "webhookSecret", "whsec_secret", "adminToken", "", "queue", "payments")
+	output := buffer.String()
+
+	if strings.Contains(output, "sk_live_secret") || strings.Contains(output, "whsec_secret") {
+		t.Errorf("Expected credentials to be redacted from %s", output)
+	}
+	if !strings.Contains(output, "queue=payments") || !strings.Contains(output, `adminToken=""`) {
+		t.Errorf("Expected other and empty values to be logged as is in %s", output)
+	}
+}
+
+func TestLoggerKeepsErrors(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, LOG_FORMAT_LOGFMT, slog.LevelInfo)
+
+	logger.Error("Unable to record payment", "error", errors.New("connection refused"))
+	if !strings.Contains(buffer.String(), "connection refused") {
+		t.Errorf("Expected error message in %s", buffer.String())
+	}
+}
+
+func TestPaymentGoStringRedactsCardDetails(t *testing.T) {
+	payment := newTestLogPayment()
+	assertRedacted(t, fmt.Sprintf("%#v", payment), payment)
+}
+
+func TestRedactLogField(t *testing.T) {
+	payment := newTestLogPayment()
+
+	if field := RedactLogField(payment, "CreditCardToken"); field != REDACTED_VALUE {
+		t.Errorf("Expected token to be redacted but was %s", field)
+	}
+	if field := RedactLogField(payment, "AccountType"); field != "credit_card" {
+		t.Errorf("Expected account type to be logged as is but was %s", field)
+	}
+	if field := RedactLogField(payment, "Amount"); len(field) > 0 {
+		t.Errorf("Expected fields that are not strings to be empty but was %s", field)
+	}
+}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"github.com/martini-contrib/binding"
+	"github.com/satori/go.uuid"
+	"log"
+	"time"
+)
+
+const (
+	MANUAL_PROCESSOR = "manual"
+)
+
+//Offline payments are recorded and confirmed by administrators
+var manualAccountTypes = []string{"manual", "bank_transfer"}
+
+type ManualProcessor struct {
+}
+
+type manualPaymentRecord struct {
+	Status     string    `json:"status"`
+	Reference  string    `json:"reference,omitempty"`
+	RecordedAt time.Time `json:"recordedAt"`
+}
+
+func NewManualProcessor() *ManualProcessor {
+	return new(ManualProcessor)
+}
+
+func IsManualAccountType(accountType string) bool {
+	for _, manualAccountType := range manualAccountTypes {
+		if accountType == manualAccountType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func GetManualAccountTypes() []string {
+	return manualAccountTypes
+}
+
+func (manualProcessor *ManualProcessor) GetName() string {
+	return MANUAL_PROCESSOR
+}
+
+func (manualProcessor *ManualProcessor) Validate(payment *Payment, errors binding.Errors) binding.Errors {
+	if !IsManualAccountType(payment.AccountType) {
+		errors = addError(errors, []string{"accountType"}, binding.TypeError, "Only manual and bank_transfer payments can be recorded")
+	}
+
+	return errors
+}
+
+//Payments stay pending until the money is received
+func (manualProcessor *ManualProcessor) Charge(payment *Payment) error {
+	manualProcessor.record(payment, "pending")
+	payment.UpdateStatus("pending")
+	return nil
+}
+
+func (manualProcessor *ManualProcessor) Complete(payment *Payment, completion PaymentCompletion) error {
+	manualProcessor.record(payment, "success")
+	payment.UpdateStatus("success")
+	return nil
+}
+
+//Money is returned to the backer outside of any processor
+func (manualProcessor *ManualProcessor) Refund(payment *Payment, amount float64) (string, error) {
+	return uuid.NewV4().String(), nil
+}
+
+func (manualProcessor *ManualProcessor) GetStatus(payment *Payment) (string, error) {
+	return payment.GetStatus(), nil
+}
+
+func (manualProcessor *ManualProcessor) record(payment *Payment, status string) {
+	jsonErr := payment.UpdatePaymentProcessorResponses(&manualPaymentRecord{status, payment.PaymentProcessorTransactionId, time.Now()})
+	if nil != jsonErr {
+		log.Print(jsonErr)
+		log.Printf("Unable to marshal manual payment record for payment %s", payment.Id)
+	}
+}
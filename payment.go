@@ -0,0 +1,194 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//Perk bought with a payment, priced when the payment was made
+type PaymentItem struct {
+	PerkId   int64   `json:"perkId"`
+	Perk     *Perk   `json:"-"`
+	Quantity int64   `json:"quantity"`
+	Price    float64 `json:"price"`
+}
+
+type Payment struct {
+	Id                            string
+	CampaignId                    int64 `form:"campaignId" binding:"required"`
+	Campaign                      *Campaign
+	PerkId                        int64 `form:"perkId"`
+	Perk                          *Perk
+	ItemPerkIds                   []int64 `form:"itemPerkId"`
+	ItemQuantities                []int64 `form:"itemQuantity"`
+	Items                         []PaymentItem
+	AccountType                   string `form:"accountType" binding:"required"`
+	NameOnPayment                 string `form:"nameOnPayment" binding:"required" log:"redact"`
+	CreditCardAccountNumber       string `form:"creditCardAccountNumber" log:"mask"`
+	CreditCardExpirationDate      string `form:"creditCardExpirationDate" log:"redact"`
+	CreditCardCvv                 string `form:"creditCardCvv" log:"redact"`
+	CreditCardPostalCode          string `form:"creditCardPostalCode" log:"redact"`
+	CreditCardToken               string `form:"creditCardToken" log:"redact"`
+	PaypalRedirectUrl             string `form:"paypalRedirectUrl"`
+	PaypalCancelUrl               string `form:"paypalCancelUrl"`
+	PaypalApprovalUrl             string
+	StripeReturnUrl               string `form:"stripeReturnUrl"`
+	StripeClientSecret            string
+	StripeRedirectUrl             string
+	BitcoinRedirectUrl            string `form:"bitcoinRedirectUrl"`
+	BitcoinPaymentUrl             string
+	FullName                      string  `form:"fullName" binding:"required" log:"redact"`
+	Address1                      string  `form:"address1" binding:"required" log:"redact"`
+	Address2                      string  `form:"address2" log:"redact"`
+	City                          string  `form:"city" binding:"required" log:"redact"`
+	PostalCode                    string  `form:"postalCode" binding:"required" log:"redact"`
+	Country                       string  `form:"country" binding:"required"`
+	Amount                        float64 `form:"amount"`
+	Currency                      string  `form:"currency"`
+	AmountRefunded                float64
+	Status                        string
+	ContactEmail                  string `form:"contactEmail" log:"redact"`
+	ContactOptIn                  bool   `form:"contactOptIn"`
+	Advertise                     bool   `form:"advertise"`
+	AdvertiseOther                string `form:"advertiseOther"`
+	PaymentProcessorResponses     string `log:"-"`
+	PaymentProcessorUsed          string
+	PaymentProcessorTransactionId string
+	FailureReason                 string
+	PledgeId                      string `form:"pledgeId"`
+	IdempotencyKey                string
+	Lock                          sync.RWMutex
+}
+
+//Payments without a perk are donations to the campaign
+func (payment *Payment) IsDonation() bool {
+	return 0 == payment.PerkId && len(payment.Items) == 0
+}
+
+//Payments for several perks or several of one perk are described by their line items
+func (payment *Payment) HasMultipleItems() bool {
+	return len(payment.Items) > 1 || (len(payment.Items) == 1 && payment.Items[0].Quantity > 1)
+}
+
+//Card numbers are only accepted in legacy mode and must never be stored
+func (payment *Payment) HasCardDetails() bool {
+	return len(payment.CreditCardAccountNumber) > 0 || len(payment.CreditCardExpirationDate) > 0 || len(payment.CreditCardCvv) > 0
+}
+
+//Perk ids and quantities such as "31337 x 2, 31340 x 1"
+func (payment *Payment) GetItemsDescription() string {
+	items := make([]string, 0, len(payment.Items))
+	for _, item := range payment.Items {
+		items = append(items, fmt.Sprintf("%d x %d", item.PerkId, item.Quantity))
+	}
+
+	return strings.Join(items, ", ")
+}
+
+//Card details are redacted by their log tags so payments can be logged
+func (payment *Payment) GoString() string {
+	return fmt.Sprintf("&common.Payment{Id:%q, CampaignId:%d, PerkId:%d, AccountType:%q, CreditCardAccountNumber:%q, CreditCardToken:%q, Items:%v, Amount:%f, Currency:%q, Status:%q, PledgeId:%q}",
+		payment.Id, payment.CampaignId, payment.PerkId, payment.AccountType, RedactLogField(payment, "CreditCardAccountNumber"), RedactLogField(payment, "CreditCardToken"), payment.GetItemsDescription(), payment.Amount, payment.Currency, payment.GetStatus(), payment.PledgeId)
+}
+
+func maskCardNumber(cardNumber string) string {
+	if len(cardNumber) <= 4 {
+		return strings.Repeat("*", len(cardNumber))
+	}
+
+	return strings.Repeat("*", len(cardNumber)-4) + cardNumber[len(cardNumber)-4:]
+}
+
+func (payment *Payment) UpdateStatus(status string) string {
+	payment.Lock.Lock()
+	defer payment.Lock.Unlock()
+	payment.Status = status
+	return payment.Status
+}
+
+func (payment *Payment) GetStatus() string {
+	payment.Lock.RLock()
+	defer payment.Lock.RUnlock()
+	return payment.Status
+}
+
+func (payment *Payment) UpdateAmountRefunded(amountRefunded float64) float64 {
+	payment.Lock.Lock()
+	defer payment.Lock.Unlock()
+	payment.AmountRefunded = amountRefunded
+	return payment.AmountRefunded
+}
+
+func (payment *Payment) GetAmountRefunded() float64 {
+	payment.Lock.RLock()
+	defer payment.Lock.RUnlock()
+	return payment.AmountRefunded
+}
+
+func (payment *Payment) UpdateFailureReason(failureReason string) string {
+	payment.Lock.Lock()
+	defer payment.Lock.Unlock()
+	payment.FailureReason = failureReason
+	return payment.FailureReason
+}
+
+func (payment *Payment) GetFailureReason() string {
+	payment.Lock.RLock()
+	defer payment.Lock.RUnlock()
+	return payment.FailureReason
+}
+
+func (payment *Payment) UpdatePaypalApprovalUrl(paypalApprovalUrl string) string {
+	payment.Lock.Lock()
+	defer payment.Lock.Unlock()
+	payment.PaypalApprovalUrl = paypalApprovalUrl
+	return payment.PaypalApprovalUrl
+}
+
+func (payment *Payment) GetPaypalApprovalUrl() string {
+	payment.Lock.RLock()
+	defer payment.Lock.RUnlock()
+	return payment.PaypalApprovalUrl
+}
+
+//Customer authentication still required by stripe before the payment can complete
+func (payment *Payment) UpdateStripeNextAction(clientSecret string, redirectUrl string) {
+	payment.Lock.Lock()
+	defer payment.Lock.Unlock()
+	payment.StripeClientSecret = clientSecret
+	payment.StripeRedirectUrl = redirectUrl
+}
+
+func (payment *Payment) GetStripeNextAction() (string, string) {
+	payment.Lock.RLock()
+	defer payment.Lock.RUnlock()
+	return payment.StripeClientSecret, payment.StripeRedirectUrl
+}
+
+func (payment *Payment) UpdateBitcoinPaymentUrl(bitcoinPaymentUrl string) string {
+	payment.Lock.Lock()
+	defer payment.Lock.Unlock()
+	payment.BitcoinPaymentUrl = bitcoinPaymentUrl
+	return payment.BitcoinPaymentUrl
+}
+
+func (payment *Payment) GetBitcoinPaymentUrl() string {
+	payment.Lock.RLock()
+	defer payment.Lock.RUnlock()
+	return payment.BitcoinPaymentUrl
+}
+
+//Processor responses are stored as a postgres JSONB array literal
+func (payment *Payment) UpdatePaymentProcessorResponses(response interface{}) error {
+	jsonStr, err := json.Marshal(response)
+	if nil == err {
+		payment.PaymentProcessorResponses = FormatPaymentProcessorResponse(string(jsonStr))
+	}
+	return err
+}
+
+func FormatPaymentProcessorResponse(response string) string {
+	return fmt.Sprintf("{\"%s\"}", strings.Replace(response, "\"", "\\\"", -1))
+}
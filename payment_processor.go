@@ -0,0 +1,239 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"github.com/martini-contrib/binding"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Refused connections never reached the processor. Any other network error may have been processed
+func ConvertNetworkError(processorName string, err error) RequestError {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return RequestError{fmt.Sprintf("Unable to reach %s: %s", processorName, err.Error()), ServiceUnavailableError}
+	}
+
+	return RequestError{fmt.Sprintf("No response from %s: %s", processorName, err.Error()), ProcessorTimeoutError}
+}
+
+type PaymentCompletion struct {
+	PayerId   string
+	PaymentId string
+	Token     string
+}
+
+type PaymentProcessor interface {
+	GetName() string
+	Validate(payment *Payment, errors binding.Errors) binding.Errors
+	Charge(payment *Payment) error
+	Complete(payment *Payment, completion PaymentCompletion) error
+	Refund(payment *Payment, amount float64) (string, error)
+	GetStatus(payment *Payment) (string, error)
+}
+
+//Implemented by processors that can hold funds until a campaign ends
+type PaymentAuthorizer interface {
+	SupportsAuthorization(payment *Payment) bool
+	Authorize(payment *Payment) error
+	Capture(payment *Payment) error
+	Void(payment *Payment) error
+}
+
+//Processors tried in order for payments of the account type matching every other set field
+type PaymentRoute struct {
+	Campaign    string   `json:"campaign"`
+	AccountType string   `json:"accountType"`
+	Currencies  []string `json:"currencies"`
+	Countries   []string `json:"countries"`
+	MinAmount   float64  `json:"minAmount"`
+	MaxAmount   float64  `json:"maxAmount"`
+	Processors  []string `json:"processors"`
+}
+
+func (route *PaymentRoute) Matches(payment *Payment) bool {
+	if route.AccountType != payment.AccountType {
+		return false
+	} else if len(route.Campaign) > 0 && (nil == payment.Campaign || route.Campaign != payment.Campaign.Name) {
+		return false
+	} else if len(route.Currencies) > 0 && !containsFold(route.Currencies, payment.Currency) {
+		return false
+	} else if len(route.Countries) > 0 && !containsFold(route.Countries, payment.Country) {
+		return false
+	} else if route.MinAmount > 0 && payment.Amount < route.MinAmount {
+		return false
+	} else if route.MaxAmount > 0 && payment.Amount > route.MaxAmount {
+		return false
+	}
+
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, val := range values {
+		if strings.EqualFold(val, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type PaymentProcessors struct {
+	lock                sync.RWMutex
+	values              map[string]PaymentProcessor
+	nameValues          map[string]PaymentProcessor
+	circuitBreakers     map[string]*CircuitBreaker
+	routes              []PaymentRoute
+	breakerThreshold    int
+	breakerResetTimeout time.Duration
+}
+
+func NewPaymentProcessors() *PaymentProcessors {
+	paymentProcessors := new(PaymentProcessors)
+	paymentProcessors.values = make(map[string]PaymentProcessor)
+	paymentProcessors.nameValues = make(map[string]PaymentProcessor)
+	paymentProcessors.circuitBreakers = make(map[string]*CircuitBreaker)
+	paymentProcessors.breakerThreshold = 5
+	paymentProcessors.breakerResetTimeout = 30 * time.Second
+	return paymentProcessors
+}
+
+//Default processor for the account type
+func (pps *PaymentProcessors) AddOrReplacePaymentProcessor(accountType string, paymentProcessor PaymentProcessor) PaymentProcessor {
+	pps.lock.Lock()
+	defer pps.lock.Unlock()
+	pps.values[accountType] = paymentProcessor
+	pps.addPaymentProcessor(paymentProcessor)
+	return paymentProcessor
+}
+
+//Processors only reachable through payment routes
+func (pps *PaymentProcessors) AddOrReplaceRoutedPaymentProcessor(paymentProcessor PaymentProcessor) PaymentProcessor {
+	pps.lock.Lock()
+	defer pps.lock.Unlock()
+	pps.addPaymentProcessor(paymentProcessor)
+	return paymentProcessor
+}
+
+func (pps *PaymentProcessors) addPaymentProcessor(paymentProcessor PaymentProcessor) {
+	name := paymentProcessor.GetName()
+	pps.nameValues[name] = paymentProcessor
+	if _, exists := pps.circuitBreakers[name]; !exists {
+		pps.circuitBreakers[name] = NewCircuitBreaker(pps.breakerThreshold, pps.breakerResetTimeout)
+	}
+}
+
+//Applies to circuit breakers of processors added afterwards
+func (pps *PaymentProcessors) SetCircuitBreakerSettings(failureThreshold int, resetTimeout time.Duration) {
+	pps.lock.Lock()
+	defer pps.lock.Unlock()
+	pps.breakerThreshold = failureThreshold
+	pps.breakerResetTimeout = resetTimeout
+}
+
+func (pps *PaymentProcessors) GetPaymentProcessorByName(name string) (PaymentProcessor, bool) {
+	pps.lock.RLock()
+	defer pps.lock.RUnlock()
+	val, exists := pps.nameValues[name]
+	return val, exists
+}
+
+func (pps *PaymentProcessors) GetCircuitBreaker(name string) (*CircuitBreaker, bool) {
+	pps.lock.RLock()
+	defer pps.lock.RUnlock()
+	val, exists := pps.circuitBreakers[name]
+	return val, exists
+}
+
+func (pps *PaymentProcessors) GetCircuitBreakerMetrics() map[string]CircuitBreakerMetrics {
+	pps.lock.RLock()
+	defer pps.lock.RUnlock()
+	metrics := make(map[string]CircuitBreakerMetrics, len(pps.circuitBreakers))
+	for name, circuitBreaker := range pps.circuitBreakers {
+		metrics[name] = circuitBreaker.GetMetrics()
+	}
+	return metrics
+}
+
+//Campaign routes are matched before global routes, each in the order given
+func (pps *PaymentProcessors) SetPaymentRoutes(routes []PaymentRoute) error {
+	pps.lock.Lock()
+	defer pps.lock.Unlock()
+
+	var campaignRoutes, globalRoutes []PaymentRoute
+	for index, route := range routes {
+		if _, exists := pps.values[route.AccountType]; !exists {
+			return fmt.Errorf("Payment route %d has unsupported account type \"%s\"", index, route.AccountType)
+		} else if len(route.Processors) == 0 {
+			return fmt.Errorf("Payment route %d has no processors", index)
+		}
+
+		for _, name := range route.Processors {
+			if _, exists := pps.nameValues[name]; !exists {
+				return fmt.Errorf("Payment route %d uses unknown processor %s", index, name)
+			}
+		}
+
+		if len(route.Campaign) > 0 {
+			campaignRoutes = append(campaignRoutes, route)
+		} else {
+			globalRoutes = append(globalRoutes, route)
+		}
+	}
+
+	pps.routes = append(campaignRoutes, globalRoutes...)
+	return nil
+}
+
+//Processors to try in order, falling back to the account type default
+func (pps *PaymentProcessors) GetRoutedPaymentProcessors(payment *Payment) []PaymentProcessor {
+	pps.lock.RLock()
+	defer pps.lock.RUnlock()
+
+	for _, route := range pps.routes {
+		if route.Matches(payment) {
+			routedProcessors := make([]PaymentProcessor, 0, len(route.Processors))
+			for _, name := range route.Processors {
+				routedProcessors = append(routedProcessors, pps.nameValues[name])
+			}
+			return routedProcessors
+		}
+	}
+
+	if val, exists := pps.values[payment.AccountType]; exists {
+		return []PaymentProcessor{val}
+	}
+
+	return nil
+}
+
+func (pps *PaymentProcessors) GetPaymentProcessor(accountType string) (PaymentProcessor, bool) {
+	pps.lock.RLock()
+	defer pps.lock.RUnlock()
+	val, exists := pps.values[accountType]
+	return val, exists
+}
+
+func (pps *PaymentProcessors) GetAccountTypes() []string {
+	pps.lock.RLock()
+	defer pps.lock.RUnlock()
+	accountTypes := make([]string, 0, len(pps.values))
+	for accountType := range pps.values {
+		accountTypes = append(accountTypes, accountType)
+	}
+	sort.Strings(accountTypes)
+	return accountTypes
+}
+
+func addError(errors binding.Errors, fieldNames []string, classification string, message string) binding.Errors {
+	errors = append(errors, binding.Error{
+		FieldNames:     fieldNames,
+		Classification: classification,
+		Message:        message,
+	})
+	return errors
+}
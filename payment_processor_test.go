@@ -0,0 +1,119 @@
+package common
+
+import (
+	"github.com/martini-contrib/binding"
+	"strings"
+	"testing"
+)
+
+type testPaymentProcessor struct {
+	name string
+}
+
+func (testProcessor *testPaymentProcessor) GetName() string {
+	return testProcessor.name
+}
+
+func (testProcessor *testPaymentProcessor) Validate(payment *Payment, errors binding.Errors) binding.Errors {
+	return errors
+}
+
+func (testProcessor *testPaymentProcessor) Charge(payment *Payment) error {
+	return nil
+}
+
+func (testProcessor *testPaymentProcessor) Complete(payment *Payment, completion PaymentCompletion) error {
+	return nil
+}
+
+func (testProcessor *testPaymentProcessor) Refund(payment *Payment, amount float64) (string, error) {
+	return "", nil
+}
+
+func (testProcessor *testPaymentProcessor) GetStatus(payment *Payment) (string, error) {
+	return payment.GetStatus(), nil
+}
+
+func newTestPaymentProcessors(t *testing.T, routes []PaymentRoute) *PaymentProcessors {
+	paymentProcessors := NewPaymentProcessors()
+	paymentProcessors.AddOrReplacePaymentProcessor("credit_card", &testPaymentProcessor{"primary"})
+	paymentProcessors.AddOrReplaceRoutedPaymentProcessor(&testPaymentProcessor{"secondary"})
+	paymentProcessors.AddOrReplaceRoutedPaymentProcessor(&testPaymentProcessor{"regional"})
+
+	err := paymentProcessors.SetPaymentRoutes(routes)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return paymentProcessors
+}
+
+func getRoutedNames(paymentProcessors *PaymentProcessors, payment *Payment) []string {
+	var names []string
+	for _, paymentProcessor := range paymentProcessors.GetRoutedPaymentProcessors(payment) {
+		names = append(names, paymentProcessor.GetName())
+	}
+	return names
+}
+
+func TestPaymentRouteMatches(t *testing.T) {
+	route := PaymentRoute{AccountType: "credit_card", Currencies: []string{"EUR"}, Countries: []string{"de", "fr"}, MinAmount: 10, MaxAmount: 100}
+
+	tests := []struct {
+		payment *Payment
+		matches bool
+	}{
+		{&Payment{AccountType: "credit_card", Currency: "eur", Country: "DE", Amount: 50}, true},
+		{&Payment{AccountType: "credit_card", Currency: "EUR", Country: "FR", Amount: 10}, true},
+		{&Payment{AccountType: "paypal", Currency: "EUR", Country: "DE", Amount: 50}, false},
+		{&Payment{AccountType: "credit_card", Currency: "USD", Country: "DE", Amount: 50}, false},
+		{&Payment{AccountType: "credit_card", Currency: "EUR", Country: "US", Amount: 50}, false},
+		{&Payment{AccountType: "credit_card", Currency: "EUR", Country: "DE", Amount: 9.99}, false},
+		{&Payment{AccountType: "credit_card", Currency: "EUR", Country: "DE", Amount: 100.01}, false},
+	}
+
+	for _, test := range tests {
+		if matches := route.Matches(test.payment); matches != test.matches {
+			t.Errorf("Expected %s payment of %f %s from %s to match %t", test.payment.AccountType, test.payment.Amount, test.payment.Currency, test.payment.Country, test.matches)
+		}
+	}
+}
+
+func TestGetRoutedPaymentProcessors(t *testing.T) {
+	paymentProcessors := newTestPaymentProcessors(t, []PaymentRoute{
+		{AccountType: "credit_card", Currencies: []string{"EUR"}, Processors: []string{"regional", "primary"}},
+		{AccountType: "credit_card", Campaign: "Launch", Processors: []string{"secondary"}},
+	})
+
+	tests := []struct {
+		payment *Payment
+		names   []string
+	}{
+		{&Payment{AccountType: "credit_card", Currency: "EUR"}, []string{"regional", "primary"}},
+		{&Payment{AccountType: "credit_card", Currency: "USD"}, []string{"primary"}},
+		{&Payment{AccountType: "credit_card", Currency: "EUR", Campaign: &Campaign{Name: "Launch"}}, []string{"secondary"}},
+		{&Payment{AccountType: "paypal", Currency: "EUR"}, nil},
+	}
+
+	//Campaign routes are matched before routes given earlier for every campaign
+	for _, test := range tests {
+		names := getRoutedNames(paymentProcessors, test.payment)
+		if strings.Join(names, ",") != strings.Join(test.names, ",") {
+			t.Errorf("Expected %s payment in %s to be routed to %v but was %v", test.payment.AccountType, test.payment.Currency, test.names, names)
+		}
+	}
+}
+
+func TestSetPaymentRoutesRejectsInvalidRoutes(t *testing.T) {
+	paymentProcessors := newTestPaymentProcessors(t, nil)
+
+	for _, route := range []PaymentRoute{
+		{AccountType: "bitcoin", Processors: []string{"primary"}},
+		{AccountType: "credit_card"},
+		{AccountType: "credit_card", Processors: []string{"primary", "unknown"}},
+	} {
+		if err := paymentProcessors.SetPaymentRoutes([]PaymentRoute{route}); nil == err {
+			t.Errorf("Expected route for %s through %v to be rejected", route.AccountType, route.Processors)
+		}
+	}
+}
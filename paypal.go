@@ -0,0 +1,388 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/logpacker/PayPal-Go-SDK"
+	"github.com/martini-contrib/binding"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PAYPAL_PROCESSOR                = "paypal"
+	PAYPAL_AUTH_ALGO_HEADER         = "Paypal-Auth-Algo"
+	PAYPAL_CERT_URL_HEADER          = "Paypal-Cert-Url"
+	PAYPAL_TRANSMISSION_ID_HEADER   = "Paypal-Transmission-Id"
+	PAYPAL_TRANSMISSION_SIG_HEADER  = "Paypal-Transmission-Sig"
+	PAYPAL_TRANSMISSION_TIME_HEADER = "Paypal-Transmission-Time"
+	PAYPAL_VERIFY_WEBHOOK_PATH      = "/v1/notifications/verify-webhook-signature"
+	PAYPAL_MODE_SANDBOX             = "sandbox"
+	PAYPAL_MODE_LIVE                = "live"
+)
+
+type PaypalProcessor struct {
+	Client           *paypalsdk.Client
+	WebhookId        string
+	WebhookVerifyUrl string
+	Timeout          time.Duration
+}
+
+type PaypalWebhookEvent struct {
+	ID           string                 `json:"id"`
+	EventType    string                 `json:"event_type"`
+	ResourceType string                 `json:"resource_type"`
+	Resource     *PaypalWebhookResource `json:"resource"`
+}
+
+type PaypalWebhookResource struct {
+	ID                string                     `json:"id"`
+	State             string                     `json:"state"`
+	Status            string                     `json:"status"`
+	ParentPayment     string                     `json:"parent_payment"`
+	CustomId          string                     `json:"custom_id"`
+	Amount            *PaypalWebhookAmount       `json:"amount"`
+	Payer             *paypalsdk.Payer           `json:"payer"`
+	SupplementaryData *PaypalSupplementaryData   `json:"supplementary_data"`
+	StatusDetails     *PaypalWebhookStatusDetail `json:"status_details"`
+}
+
+//Payments api amounts have a total while orders api amounts have a value
+type PaypalWebhookAmount struct {
+	Total        string `json:"total"`
+	Currency     string `json:"currency"`
+	Value        string `json:"value"`
+	CurrencyCode string `json:"currency_code"`
+}
+
+type PaypalSupplementaryData struct {
+	RelatedIds struct {
+		OrderId   string `json:"order_id"`
+		CaptureId string `json:"capture_id"`
+	} `json:"related_ids"`
+}
+
+type PaypalWebhookStatusDetail struct {
+	Reason string `json:"reason"`
+}
+
+type paypalVerifyWebhookRequest struct {
+	AuthAlgo         string          `json:"auth_algo"`
+	CertUrl          string          `json:"cert_url"`
+	TransmissionId   string          `json:"transmission_id"`
+	TransmissionSig  string          `json:"transmission_sig"`
+	TransmissionTime string          `json:"transmission_time"`
+	WebhookId        string          `json:"webhook_id"`
+	WebhookEvent     json.RawMessage `json:"webhook_event"`
+}
+
+type paypalVerifyWebhookResponse struct {
+	VerificationStatus string `json:"verification_status"`
+}
+
+type paypalSaleResources struct {
+	ID           string `json:"id"`
+	State        string `json:"state"`
+	Transactions []struct {
+		RelatedResources []struct {
+			Sale *paypalsdk.Sale `json:"sale,omitempty"`
+		} `json:"related_resources"`
+	} `json:"transactions"`
+}
+
+//An explicit api base takes precedence over the mode
+func GetPaypalApiBase(mode string, apiBase string) (string, error) {
+	if len(apiBase) > 0 {
+		return strings.TrimRight(apiBase, "/"), nil
+	}
+
+	switch mode {
+	case PAYPAL_MODE_SANDBOX:
+		return paypalsdk.APIBaseSandBox, nil
+	case PAYPAL_MODE_LIVE:
+		return paypalsdk.APIBaseLive, nil
+	default:
+		return "", fmt.Errorf("Invalid paypal mode %s. Must be %s or %s", mode, PAYPAL_MODE_SANDBOX, PAYPAL_MODE_LIVE)
+	}
+}
+
+func NewPaypalProcessor(client *paypalsdk.Client) *PaypalProcessor {
+	paypalProcessor := new(PaypalProcessor)
+	paypalProcessor.Client = client
+	return paypalProcessor
+}
+
+func (paypalProcessor *PaypalProcessor) GetName() string {
+	return PAYPAL_PROCESSOR
+}
+
+func (paypalProcessor *PaypalProcessor) Validate(payment *Payment, errors binding.Errors) binding.Errors {
+	if len(payment.PaypalRedirectUrl) == 0 || len(payment.PaypalCancelUrl) == 0 {
+		errors = addError(errors, []string{"accountType", "paypalRedirectUrl", "paypalCancelUrl"}, binding.RequiredError, "Paypal redirect and cancel url required with paypal account type")
+	}
+
+	return errors
+}
+
+func (paypalProcessor *PaypalProcessor) Charge(payment *Payment) error {
+	if payment.AccountType != "paypal" {
+		return RequestError{"Only paypal payments are currently supported", ServiceNotImplementedError}
+	}
+
+	if nil == payment.Campaign {
+		return RequestError{fmt.Sprintf("Campaign not found %d", payment.CampaignId), NotFoundError}
+	}
+
+	if nil == payment.Perk && 0 != payment.PerkId {
+		return RequestError{fmt.Sprintf("Perk not found %d", payment.PerkId), NotFoundError}
+	}
+
+	hasParameters := func(uri string) (bool, string) {
+		if strings.Contains(uri, "?") {
+			return true, "&"
+		} else {
+			return false, "?"
+		}
+	}
+
+	_, redirectURIDelim := hasParameters(payment.PaypalRedirectUrl)
+	_, cancelURIDelim := hasParameters(payment.PaypalCancelUrl)
+
+	redirectURI := fmt.Sprintf("%s%spaymentId=%s", payment.PaypalRedirectUrl, redirectURIDelim, payment.Id)
+	cancelURI := fmt.Sprintf("%s%spaymentId=%s", payment.PaypalCancelUrl, cancelURIDelim, payment.Id)
+	order, err := paypalProcessor.createOrder(payment, redirectURI, cancelURI)
+
+	if nil == err {
+		jsonErr := payment.UpdatePaymentProcessorResponses(order)
+		if nil != jsonErr {
+			log.Print(jsonErr)
+			log.Printf("Unable to marshal order response (%#v) from paypal", order)
+		}
+
+		payment.PaymentProcessorTransactionId = order.ID
+
+		//Set approval url
+		payment.UpdatePaypalApprovalUrl(getPaypalApprovalUrl(order.Links))
+	} else {
+		log.Printf("%#v", err)
+		log.Print("Failed processing payment with processor")
+
+		jsonErr := payment.UpdatePaymentProcessorResponses(err)
+		if nil != jsonErr {
+			log.Print(jsonErr)
+			log.Print("Unable to marshal paypal error")
+		}
+
+		payment.UpdateStatus("failure")
+
+		if _, urlErr := url.Parse(redirectURI); nil != urlErr {
+			err = RequestError{fmt.Sprintf("Redirect URI is invalid: %s", redirectURI), BadRequestError}
+		} else if _, urlErr := url.Parse(cancelURI); nil != urlErr {
+			err = RequestError{fmt.Sprintf("Cancel URI is invalid: %s", cancelURI), BadRequestError}
+		} else {
+			err = convertPaypalError(err)
+		}
+	}
+
+	return err
+}
+
+func (paypalProcessor *PaypalProcessor) Complete(payment *Payment, completion PaymentCompletion) error {
+	if !IsPaypalLegacyPayment(payment.PaymentProcessorTransactionId) {
+		return paypalProcessor.captureOrder(payment, completion)
+	}
+
+	paymentId := completion.PaymentId
+	if len(paymentId) == 0 {
+		paymentId = payment.PaymentProcessorTransactionId
+	}
+
+	executeResult := &paypalsdk.ExecuteResponse{}
+	err := paypalProcessor.callApi("POST", fmt.Sprintf("/v1/payments/payment/%s/execute", paymentId), map[string]string{"payer_id": completion.PayerId}, executeResult)
+	if nil == err && len(executeResult.ID) == 0 {
+		err = RequestError{fmt.Sprintf("Unable to execute paypal payment %s", paymentId), BadRequestError}
+	}
+
+	if nil == err {
+		payment.UpdateStatus("success")
+		payment.PaymentProcessorTransactionId = executeResult.ID
+
+		jsonErr := payment.UpdatePaymentProcessorResponses(executeResult)
+		if nil != jsonErr {
+			log.Print(jsonErr)
+			log.Printf("Unable to marshal payment response (%#v) from paypal", executeResult)
+		}
+	} else {
+		log.Print(err)
+
+		jsonErr := payment.UpdatePaymentProcessorResponses(err)
+		if nil != jsonErr {
+			log.Print(jsonErr)
+			log.Printf("Unable to marshal payment response (%#v) from paypal", executeResult)
+		}
+
+		if _, ok := err.(RequestError); !ok {
+			err = convertPaypalError(err)
+		}
+
+		//Unavailable processor errors leave the payment pending to be retried
+		if requestErr, ok := err.(RequestError); ok && requestErr.Type == BadRequestError {
+			payment.UpdateStatus("failure")
+			payment.UpdateFailureReason(requestErr.Message)
+		}
+	}
+
+	return err
+}
+
+func (paypalProcessor *PaypalProcessor) Refund(payment *Payment, amount float64) (string, error) {
+	if !IsPaypalLegacyPayment(payment.PaymentProcessorTransactionId) {
+		return paypalProcessor.refundOrder(payment, amount)
+	}
+
+	resources, err := paypalProcessor.getSaleResources(payment)
+	if nil != err {
+		return "", err
+	}
+
+	var saleId string
+	for _, transaction := range resources.Transactions {
+		for _, relatedResource := range transaction.RelatedResources {
+			if nil != relatedResource.Sale && len(relatedResource.Sale.ID) > 0 {
+				saleId = relatedResource.Sale.ID
+			}
+		}
+	}
+
+	if len(saleId) == 0 {
+		return "", RequestError{fmt.Sprintf("No paypal sale found for payment %s", payment.Id), NotFoundError}
+	}
+
+	refundAmount := &paypalsdk.Amount{
+		Total:    strconv.FormatFloat(amount, 'f', 2, 64),
+		Currency: payment.Currency,
+	}
+
+	refund := &paypalsdk.Refund{}
+	err = paypalProcessor.callApi("POST", fmt.Sprintf("/v1/payments/sale/%s/refund", saleId), map[string]*paypalsdk.Amount{"amount": refundAmount}, refund)
+	if nil == err {
+		jsonErr := payment.UpdatePaymentProcessorResponses(refund)
+		if nil != jsonErr {
+			log.Print(jsonErr)
+			log.Printf("Unable to marshal refund response (%#v) from paypal", refund)
+		}
+	} else {
+		log.Print(err)
+		log.Print("Failed refunding payment with processor")
+		payment.UpdatePaymentProcessorResponses(err)
+		return "", convertPaypalError(err)
+	}
+
+	return refund.ID, nil
+}
+
+func (paypalProcessor *PaypalProcessor) GetStatus(payment *Payment) (string, error) {
+	if !IsPaypalLegacyPayment(payment.PaymentProcessorTransactionId) {
+		return paypalProcessor.getOrderStatus(payment)
+	}
+
+	resources, err := paypalProcessor.getSaleResources(payment)
+	if nil != err {
+		return "", err
+	}
+
+	switch resources.State {
+	case "approved":
+		return "success", nil
+	case "created":
+		return "pending", nil
+	default:
+		return "failure", nil
+	}
+}
+
+func (paypalProcessor *PaypalProcessor) ParseWebhookEvent(payload []byte, header http.Header) (*PaypalWebhookEvent, error) {
+	event := &PaypalWebhookEvent{}
+	err := json.Unmarshal(payload, event)
+	if nil != err {
+		return nil, RequestError{fmt.Sprintf("Unable to parse paypal event: %s", err.Error()), BadRequestError}
+	}
+
+	if len(event.ID) == 0 || nil == event.Resource {
+		return nil, RequestError{"Paypal event is missing id or resource", BadRequestError}
+	}
+
+	err = paypalProcessor.verifyWebhookSignature(payload, header)
+	if nil != err {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+//Paypal verifies the signature so the event is posted back with the transmission headers
+func (paypalProcessor *PaypalProcessor) verifyWebhookSignature(payload []byte, header http.Header) error {
+	if len(paypalProcessor.WebhookId) == 0 {
+		return RequestError{"Paypal webhook id is not set", ServiceNotImplementedError}
+	}
+
+	verifyRequest := paypalVerifyWebhookRequest{
+		AuthAlgo:         header.Get(PAYPAL_AUTH_ALGO_HEADER),
+		CertUrl:          header.Get(PAYPAL_CERT_URL_HEADER),
+		TransmissionId:   header.Get(PAYPAL_TRANSMISSION_ID_HEADER),
+		TransmissionSig:  header.Get(PAYPAL_TRANSMISSION_SIG_HEADER),
+		TransmissionTime: header.Get(PAYPAL_TRANSMISSION_TIME_HEADER),
+		WebhookId:        paypalProcessor.WebhookId,
+		WebhookEvent:     json.RawMessage(payload),
+	}
+
+	if len(verifyRequest.TransmissionId) == 0 || len(verifyRequest.TransmissionSig) == 0 {
+		return RequestError{"Paypal transmission headers are missing", BadRequestError}
+	}
+
+	verifyUrl := paypalProcessor.WebhookVerifyUrl
+	if len(verifyUrl) == 0 {
+		verifyUrl = fmt.Sprintf("%s%s", paypalProcessor.Client.APIBase, PAYPAL_VERIFY_WEBHOOK_PATH)
+	}
+
+	verifyResponse := &paypalVerifyWebhookResponse{}
+	err := paypalProcessor.callUrl("POST", verifyUrl, verifyRequest, verifyResponse)
+	if nil != err {
+		log.Print(err)
+		return RequestError{fmt.Sprintf("Unable to verify paypal event: %s", err.Error()), ServiceUnavailableError}
+	}
+
+	if verifyResponse.VerificationStatus != "SUCCESS" {
+		return RequestError{fmt.Sprintf("Paypal event verification status is %s", verifyResponse.VerificationStatus), BadRequestError}
+	}
+
+	return nil
+}
+
+func (paypalProcessor *PaypalProcessor) getSaleResources(payment *Payment) (*paypalSaleResources, error) {
+	if len(payment.PaymentProcessorTransactionId) == 0 {
+		return nil, RequestError{fmt.Sprintf("No paypal payment found for payment %s", payment.Id), NotFoundError}
+	}
+
+	//The sdk payment type does not expose related resources
+	resources := &paypalSaleResources{}
+	err := paypalProcessor.callApi("GET", fmt.Sprintf("/v1/payments/payment/%s", payment.PaymentProcessorTransactionId), nil, resources)
+	if nil != err {
+		log.Print(err)
+		return nil, convertPaypalError(err)
+	}
+
+	return resources, nil
+}
+
+func (amount *PaypalWebhookAmount) GetTotal() string {
+	if len(amount.Value) > 0 {
+		return amount.Value
+	}
+
+	return amount.Total
+}
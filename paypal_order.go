@@ -0,0 +1,308 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/logpacker/PayPal-Go-SDK"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	PAYPAL_LEGACY_PAYMENT_PREFIX = "PAY-"
+	PAYPAL_ORDERS_PATH           = "/v2/checkout/orders"
+	PAYPAL_CAPTURES_PATH         = "/v2/payments/captures"
+)
+
+type paypalOrderAmount struct {
+	CurrencyCode string `json:"currency_code"`
+	Value        string `json:"value"`
+}
+
+type paypalOrderRequest struct {
+	Intent             string                         `json:"intent"`
+	PurchaseUnits      []paypalOrderPurchaseUnit      `json:"purchase_units"`
+	ApplicationContext *paypalOrderApplicationContext `json:"application_context,omitempty"`
+}
+
+type paypalOrderPurchaseUnit struct {
+	CustomId    string             `json:"custom_id,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Amount      *paypalOrderAmount `json:"amount,omitempty"`
+	Payments    *struct {
+		Captures []paypalCapture `json:"captures"`
+	} `json:"payments,omitempty"`
+}
+
+type paypalOrderApplicationContext struct {
+	ReturnUrl          string `json:"return_url"`
+	CancelUrl          string `json:"cancel_url"`
+	ShippingPreference string `json:"shipping_preference"`
+	UserAction         string `json:"user_action"`
+}
+
+type paypalOrder struct {
+	ID            string                    `json:"id"`
+	Status        string                    `json:"status"`
+	PurchaseUnits []paypalOrderPurchaseUnit `json:"purchase_units"`
+	Links         []paypalsdk.Links         `json:"links"`
+}
+
+type paypalCapture struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	StatusDetails *struct {
+		Reason string `json:"reason"`
+	} `json:"status_details,omitempty"`
+}
+
+type paypalRefundRequest struct {
+	Amount *paypalOrderAmount `json:"amount"`
+}
+
+type paypalRefund struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+//Payments created before the orders api use the v1 payments api
+func IsPaypalLegacyPayment(transactionId string) bool {
+	return strings.HasPrefix(transactionId, PAYPAL_LEGACY_PAYMENT_PREFIX)
+}
+
+func (paypalProcessor *PaypalProcessor) callApi(method string, path string, request interface{}, response interface{}) error {
+	return paypalProcessor.callUrl(method, fmt.Sprintf("%s%s", paypalProcessor.Client.APIBase, path), request, response)
+}
+
+//The sdk http client has no timeout so each request carries its own deadline
+func (paypalProcessor *PaypalProcessor) callUrl(method string, url string, request interface{}, response interface{}) error {
+	req, err := paypalProcessor.Client.NewRequest(method, url, request)
+	if nil != err {
+		return err
+	}
+
+	if paypalProcessor.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), paypalProcessor.Timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	return paypalProcessor.Client.SendWithAuth(req, response)
+}
+
+func (paypalProcessor *PaypalProcessor) createOrder(payment *Payment, returnUrl string, cancelUrl string) (*paypalOrder, error) {
+	description := fmt.Sprintf("Donation to Campaign(%s). Payment id(%s)", payment.Campaign.Name, payment.Id)
+	if payment.HasMultipleItems() {
+		description = fmt.Sprintf("Perks(%s) for Campaign(%s). Payment id(%s)", payment.GetItemsDescription(), payment.Campaign.Name, payment.Id)
+	} else if !payment.IsDonation() {
+		description = fmt.Sprintf("Perk(%s) for Campaign(%s). Payment id(%s)", payment.Perk.Name, payment.Campaign.Name, payment.Id)
+	}
+
+	orderRequest := &paypalOrderRequest{
+		Intent: "CAPTURE",
+		PurchaseUnits: []paypalOrderPurchaseUnit{{
+			CustomId:    payment.Id,
+			Description: description,
+			Amount: &paypalOrderAmount{
+				CurrencyCode: payment.Currency,
+				Value:        strconv.FormatFloat(payment.Amount, 'f', 2, 64),
+			},
+		}},
+		ApplicationContext: &paypalOrderApplicationContext{
+			ReturnUrl:          returnUrl,
+			CancelUrl:          cancelUrl,
+			ShippingPreference: "NO_SHIPPING",
+			UserAction:         "PAY_NOW",
+		},
+	}
+
+	order := &paypalOrder{}
+	err := paypalProcessor.callApi("POST", PAYPAL_ORDERS_PATH, orderRequest, order)
+	return order, err
+}
+
+func (paypalProcessor *PaypalProcessor) getOrder(payment *Payment) (*paypalOrder, error) {
+	if len(payment.PaymentProcessorTransactionId) == 0 {
+		return nil, RequestError{fmt.Sprintf("No paypal order found for payment %s", payment.Id), NotFoundError}
+	}
+
+	order := &paypalOrder{}
+	err := paypalProcessor.callApi("GET", fmt.Sprintf("%s/%s", PAYPAL_ORDERS_PATH, payment.PaymentProcessorTransactionId), nil, order)
+	if nil != err {
+		log.Print(err)
+		return nil, convertPaypalError(err)
+	}
+
+	return order, nil
+}
+
+//Captures the order once the buyer has approved it
+func (paypalProcessor *PaypalProcessor) captureOrder(payment *Payment, completion PaymentCompletion) error {
+	orderId := payment.PaymentProcessorTransactionId
+	if len(completion.Token) > 0 && completion.Token != orderId {
+		return RequestError{fmt.Sprintf("Paypal token %s does not match payment %s", completion.Token, payment.Id), BadRequestError}
+	}
+
+	order := &paypalOrder{}
+	err := paypalProcessor.callApi("POST", fmt.Sprintf("%s/%s/capture", PAYPAL_ORDERS_PATH, orderId), struct{}{}, order)
+	if nil != err {
+		log.Print(err)
+		log.Print("Failed capturing order with processor")
+
+		jsonErr := payment.UpdatePaymentProcessorResponses(err)
+		if nil != jsonErr {
+			log.Print(jsonErr)
+			log.Print("Unable to marshal paypal error")
+		}
+
+		err = convertPaypalError(err)
+		if requestErr, ok := err.(RequestError); ok && requestErr.Type == BadRequestError {
+			payment.UpdateStatus("failure")
+			payment.UpdateFailureReason(requestErr.Message)
+		}
+
+		return err
+	}
+
+	log.Printf("Successfully captured order %s with processor", order.ID)
+
+	jsonErr := payment.UpdatePaymentProcessorResponses(order)
+	if nil != jsonErr {
+		log.Print(jsonErr)
+		log.Printf("Unable to marshal capture response %s from paypal", order.ID)
+	}
+
+	switch getPaypalOrderStatus(order) {
+	case "success":
+		payment.UpdateStatus("success")
+	case "pending":
+		//Captures under review are completed by webhook
+		log.Printf("Paypal order %s capture is pending", order.ID)
+		payment.UpdateStatus("pending")
+	default:
+		failureReason := "Payment declined by processor"
+		if capture := getPaypalCapture(order); nil != capture && nil != capture.StatusDetails && len(capture.StatusDetails.Reason) > 0 {
+			failureReason = capture.StatusDetails.Reason
+		}
+
+		payment.UpdateStatus("failure")
+		payment.UpdateFailureReason(failureReason)
+		return RequestError{failureReason, BadRequestError}
+	}
+
+	return nil
+}
+
+func (paypalProcessor *PaypalProcessor) refundOrder(payment *Payment, amount float64) (string, error) {
+	order, err := paypalProcessor.getOrder(payment)
+	if nil != err {
+		return "", err
+	}
+
+	capture := getPaypalCapture(order)
+	if nil == capture {
+		return "", RequestError{fmt.Sprintf("No paypal capture found for payment %s", payment.Id), NotFoundError}
+	}
+
+	refundRequest := &paypalRefundRequest{
+		Amount: &paypalOrderAmount{
+			CurrencyCode: payment.Currency,
+			Value:        strconv.FormatFloat(amount, 'f', 2, 64),
+		},
+	}
+
+	refund := &paypalRefund{}
+	err = paypalProcessor.callApi("POST", fmt.Sprintf("%s/%s/refund", PAYPAL_CAPTURES_PATH, capture.ID), refundRequest, refund)
+	if nil != err {
+		log.Print(err)
+		log.Print("Failed refunding payment with processor")
+		payment.UpdatePaymentProcessorResponses(err)
+		return "", convertPaypalError(err)
+	}
+
+	jsonErr := payment.UpdatePaymentProcessorResponses(refund)
+	if nil != jsonErr {
+		log.Print(jsonErr)
+		log.Printf("Unable to marshal refund response %s from paypal", refund.ID)
+	}
+
+	return refund.ID, nil
+}
+
+func (paypalProcessor *PaypalProcessor) getOrderStatus(payment *Payment) (string, error) {
+	order, err := paypalProcessor.getOrder(payment)
+	if nil != err {
+		return "", err
+	}
+
+	return getPaypalOrderStatus(order), nil
+}
+
+func getPaypalOrderStatus(order *paypalOrder) string {
+	switch order.Status {
+	case "CREATED", "SAVED", "APPROVED", "PAYER_ACTION_REQUIRED":
+		return "pending"
+	case "COMPLETED":
+		capture := getPaypalCapture(order)
+		if nil == capture {
+			return "failure"
+		}
+
+		switch capture.Status {
+		case "COMPLETED", "PARTIALLY_REFUNDED", "REFUNDED":
+			return "success"
+		case "PENDING":
+			return "pending"
+		default:
+			return "failure"
+		}
+	default:
+		return "failure"
+	}
+}
+
+func getPaypalCapture(order *paypalOrder) *paypalCapture {
+	for _, purchaseUnit := range order.PurchaseUnits {
+		if nil != purchaseUnit.Payments && len(purchaseUnit.Payments.Captures) > 0 {
+			return &purchaseUnit.Payments.Captures[0]
+		}
+	}
+
+	return nil
+}
+
+func getPaypalApprovalUrl(links []paypalsdk.Links) string {
+	for _, link := range links {
+		if link.Rel == "approve" || link.Rel == "payer-action" {
+			return link.Href
+		}
+	}
+
+	return ""
+}
+
+//Client errors are final while server errors can be retried
+func convertPaypalError(err error) error {
+	errorResponse, ok := err.(*paypalsdk.ErrorResponse)
+	if !ok || nil == errorResponse.Response {
+		return ConvertNetworkError(PAYPAL_PROCESSOR, err)
+	}
+
+	message := errorResponse.Message
+	if len(errorResponse.Details) > 0 && len(errorResponse.Details[0].Issue) > 0 {
+		message = fmt.Sprintf("%s: %s", errorResponse.Message, errorResponse.Details[0].Issue)
+	}
+
+	switch statusCode := errorResponse.Response.StatusCode; {
+	case statusCode == http.StatusNotFound:
+		return RequestError{message, NotFoundError}
+	case statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		return RequestError{message, ServiceUnavailableError}
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return RequestError{message, ServerError}
+	default:
+		return RequestError{message, BadRequestError}
+	}
+}
@@ -0,0 +1,43 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func signPreviewToken(secret string, campaignName string, expires string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s\n%s", campaignName, expires)))
+	return mac.Sum(nil)
+}
+
+//Preview tokens let draft campaigns be viewed before they are published. Format is expires.signature
+func CreatePreviewToken(secret string, campaignName string, expiresAt time.Time) string {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	signature := signPreviewToken(secret, campaignName, expires)
+	return fmt.Sprintf("%s.%s", expires, base64.RawURLEncoding.EncodeToString(signature))
+}
+
+func VerifyPreviewToken(secret string, campaignName string, token string, now time.Time) bool {
+	if len(secret) == 0 {
+		return false
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if nil != err || now.Unix() > expiresAt {
+		return false
+	}
+
+	actual, err := base64.RawURLEncoding.DecodeString(parts[1])
+	return nil == err && hmac.Equal(signPreviewToken(secret, campaignName, parts[0]), actual)
+}
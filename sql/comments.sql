@@ -4,6 +4,8 @@ COMMENT ON SCHEMA funders IS 'Funders schema holds all objects for application';
 
 COMMENT ON TYPE account_type IS 'Enumeration for type of payment';
 COMMENT ON TYPE payment_status IS 'Enumeration for status of payment';
+COMMENT ON TYPE reservation_status IS 'Enumeration for status of perk reservation';
+COMMENT ON TYPE campaign_status IS 'Enumeration for lifecycle status of campaign';
 
 -- Campaigns
 
@@ -14,9 +16,11 @@ COMMENT ON COLUMN campaigns.name IS 'Name of the campaign';
 COMMENT ON COLUMN campaigns.description IS 'Description of the campaign';
 COMMENT ON COLUMN campaigns.goal IS 'Monetary goal of the campaign';
 COMMENT ON COLUMN campaigns.currency IS 'Currency of the goal of the campaign';
-COMMENT ON COLUMN campaigns.start_date IS 'The starting date of the campaign';
-COMMENT ON COLUMN campaigns.end_date IS 'The ending date of the campaign';
+COMMENT ON COLUMN campaigns.start_date IS 'The instant the campaign launches';
+COMMENT ON COLUMN campaigns.end_date IS 'The instant the campaign closes';
+COMMENT ON COLUMN campaigns.time_zone IS 'IANA time zone of the campaign (e.g. America/New_York) used to enter and display the start and end dates';
 COMMENT ON COLUMN campaigns.flexible IS 'Flag if campaign is flexible or not.  Flexible is if campaign is all or none';
+COMMENT ON COLUMN campaigns.status IS 'Lifecycle status of the campaign.  Scheduled campaigns go live on the start date and live campaigns succeed or fail on the end date';
 COMMENT ON COLUMN campaigns.active IS 'Flag for if campaign is active or not';
 COMMENT ON COLUMN campaigns.created_at IS 'Timestamp of campaign creation';
 COMMENT ON COLUMN campaigns.updated_at IS 'Timestamp of last time campaign was updated';
@@ -53,13 +57,33 @@ COMMENT ON INDEX p_name_idx IS 'B-tree index for name column for perks';
 
 COMMENT ON SEQUENCE perks_id_seq IS 'Primary key sequence for perks table.  Values are obfuscated since they''re used on public interfaces';
 
+-- Stretch goals
+
+COMMENT ON TABLE stretch_goals IS 'Stretch goals table contains amounts beyond the goal of a campaign that unlock more for backers';
+
+COMMENT ON COLUMN stretch_goals.id IS 'Primary key id of the stretch goals table';
+COMMENT ON COLUMN stretch_goals.campaign_id IS 'Reference to campaign of the stretch goal';
+COMMENT ON COLUMN stretch_goals.amount IS 'Amount raised that reaches the stretch goal';
+COMMENT ON COLUMN stretch_goals.title IS 'Title of the stretch goal';
+COMMENT ON COLUMN stretch_goals.description IS 'Description of the stretch goal';
+COMMENT ON COLUMN stretch_goals.perk_id IS 'Reference to perk unlocked when the stretch goal is reached.  Optional';
+COMMENT ON COLUMN stretch_goals.created_at IS 'Timestamp of stretch goal creation';
+COMMENT ON COLUMN stretch_goals.updated_at IS 'Timestamp of last time stretch goal was updated';
+
+COMMENT ON CONSTRAINT stretch_goals_pkey ON stretch_goals IS 'Primary key constraint for stretch goals id column';
+COMMENT ON CONSTRAINT stretch_goals_campaign_id_fkey ON stretch_goals IS 'Foreign key constraint for campaigns id column';
+COMMENT ON CONSTRAINT stretch_goals_perk_id_fkey ON stretch_goals IS 'Foreign key constraint for perks id column';
+COMMENT ON CONSTRAINT stretch_goals_amount_check ON stretch_goals IS 'Check constraint used to enforce that a stretch goal amount is more than zero';
+COMMENT ON INDEX sg_amount_idx IS 'B-tree index for campaign id and amount columns for stretch goals';
+COMMENT ON INDEX sg_title_idx IS 'B-tree index for title column for stretch goals';
+
 -- Payments
 
 COMMENT ON TABLE payments IS 'Payments table contains all the payment transactions for the crowdfunding campaigns';
 
 COMMENT ON COLUMN payments.id IS 'Primary key id of the payments table';
 COMMENT ON COLUMN payments.campaign_id IS 'Reference to campaign that the payment is associated with';
-COMMENT ON COLUMN payments.perk_id IS 'Reference to perk that the payment is associated with';
+COMMENT ON COLUMN payments.perk_id IS 'Reference to perk that the payment is associated with. NULL for donations without a perk and payments for several perks';
 COMMENT ON COLUMN payments.account_type IS 'The type of method used for payment';
 COMMENT ON COLUMN payments.name_on_payment IS 'The name of account owner';
 COMMENT ON COLUMN payments.full_name IS 'Full name used for shipping';
@@ -68,8 +92,9 @@ COMMENT ON COLUMN payments.address2 IS 'Optional secondary address for perk';
 COMMENT ON COLUMN payments.city IS 'Shipping city for perk';
 COMMENT ON COLUMN payments.postal_code IS 'Shipping postal code for perk';
 COMMENT ON COLUMN payments.country IS 'Shipping country for perk';
-COMMENT ON COLUMN payments.amount IS 'Amount of the payment';
+COMMENT ON COLUMN payments.amount IS 'Amount of the payment. At least the total price of the payment items';
 COMMENT ON COLUMN payments.currency IS 'Currency of the payment';
+COMMENT ON COLUMN payments.amount_refunded IS 'Total amount refunded for the payment';
 COMMENT ON COLUMN payments.status IS 'Current status of the payment';
 COMMENT ON COLUMN payments.contact_email IS 'Contact e-mail of backer';
 COMMENT ON COLUMN payments.contact_opt_in IS 'Flag if user wants to opt in for future mailings';
@@ -77,6 +102,7 @@ COMMENT ON COLUMN payments.advertise IS 'Whether to advertise user''s payment';
 COMMENT ON COLUMN payments.advertise_other IS 'Use alternate value to advertise user''s payment';
 COMMENT ON COLUMN payments.payment_processor_responses IS 'Transaction responses from payment processor';
 COMMENT ON COLUMN payments.payment_processor_used IS 'Payment processor used to process this payment';
+COMMENT ON COLUMN payments.payment_processor_transaction_id IS 'Transaction id of this payment with the payment processor';
 COMMENT ON COLUMN payments.pledge_id IS 'Reference to pledge that payment is associated with';
 COMMENT ON COLUMN payments.replied_to IS 'Whether payment user was replied to or not';
 COMMENT ON COLUMN payments.created_at IS 'Timestamp of payment creation.';
@@ -88,7 +114,126 @@ COMMENT ON CONSTRAINT payments_perk_id_fkey ON payments IS 'Foreign key constrai
 COMMENT ON CONSTRAINT payments_pledge_id_fkey ON payments IS 'Foreign key constraint for pledges id column';
 COMMENT ON CONSTRAINT payments_contact_email_check ON payments IS 'Check constraint for payments table to make sure contact email is valid if provided';
 COMMENT ON CONSTRAINT payments_amount_check ON payments IS 'Check constraint for payments table to make sure payment amount is positive';
-COMMENT ON INDEX payments_pledge_id_idx IS 'B-tree index for pledge_id column for payments';
+COMMENT ON CONSTRAINT payments_check ON payments IS 'Check constraint for payments table to make sure refunded amount is not more than the payment amount';
+COMMENT ON INDEX payments_pledge_id_idx IS 'Unique B-tree index for pledge_id column for payments so a pledge has one payment that has not failed or expired';
+COMMENT ON INDEX payments_status_idx IS 'B-tree index for status and created_at columns for sweeping stale pending payments';
+COMMENT ON INDEX payments_transaction_id_idx IS 'B-tree index for payment processor and transaction id columns for payments';
+
+-- Payment items
+
+COMMENT ON TABLE payment_items IS 'Payment items table contains the perks and quantities bought with each payment';
+
+COMMENT ON COLUMN payment_items.payment_id IS 'Reference to payment that the item was bought with';
+COMMENT ON COLUMN payment_items.perk_id IS 'Reference to perk that was bought';
+COMMENT ON COLUMN payment_items.quantity IS 'Number of the perk bought';
+COMMENT ON COLUMN payment_items.price IS 'Price of a single perk when the payment was made';
+COMMENT ON COLUMN payment_items.created_at IS 'Timestamp of payment item creation.';
+
+COMMENT ON CONSTRAINT payment_items_pkey ON payment_items IS 'Primary key constraint for payment id and perk id columns';
+COMMENT ON CONSTRAINT payment_items_payment_id_fkey ON payment_items IS 'Foreign key constraint for payments id column';
+COMMENT ON CONSTRAINT payment_items_perk_id_fkey ON payment_items IS 'Foreign key constraint for perks id column';
+COMMENT ON CONSTRAINT payment_items_quantity_check ON payment_items IS 'Check constraint for payment items table to make sure quantity is positive';
+COMMENT ON CONSTRAINT payment_items_price_check ON payment_items IS 'Check constraint for payment items table to make sure price is positive';
+COMMENT ON INDEX payment_items_perk_id_idx IS 'B-tree index for perk_id column for payment items';
+
+-- Perk reservations
+
+COMMENT ON TABLE perk_reservations IS 'Perk reservations table holds perks for pending payments so limited perks can not be oversold';
+
+COMMENT ON COLUMN perk_reservations.payment_id IS 'Id of the payment the perk is reserved for. The payment may not be recorded yet';
+COMMENT ON COLUMN perk_reservations.perk_id IS 'Reference to perk that is reserved';
+COMMENT ON COLUMN perk_reservations.quantity IS 'Number of the perk reserved';
+COMMENT ON COLUMN perk_reservations.status IS 'Held until the payment is counted (converted) or fails (released). Held reservations past expires_at no longer reserve the perk';
+COMMENT ON COLUMN perk_reservations.expires_at IS 'Timestamp the reservation stops holding the perk';
+COMMENT ON COLUMN perk_reservations.created_at IS 'Timestamp of reservation creation.';
+COMMENT ON COLUMN perk_reservations.updated_at IS 'Timestamp of last time reservation was updated';
+
+COMMENT ON CONSTRAINT perk_reservations_pkey ON perk_reservations IS 'Primary key constraint for payment id and perk id columns';
+COMMENT ON CONSTRAINT perk_reservations_perk_id_fkey ON perk_reservations IS 'Foreign key constraint for perks id column';
+COMMENT ON CONSTRAINT perk_reservations_quantity_check ON perk_reservations IS 'Check constraint for perk reservations table to make sure quantity is positive';
+COMMENT ON INDEX perk_reservations_perk_id_idx IS 'B-tree index for perk_id, status and expires_at columns for perk reservations';
+
+-- Refunds
+
+COMMENT ON TABLE refunds IS 'Refunds table contains all the refunds issued against payments';
+
+COMMENT ON COLUMN refunds.id IS 'Primary key id of the refunds table';
+COMMENT ON COLUMN refunds.payment_id IS 'Reference to payment that the refund is associated with';
+COMMENT ON COLUMN refunds.amount IS 'Amount of the refund';
+COMMENT ON COLUMN refunds.reason IS 'Optional reason for the refund';
+COMMENT ON COLUMN refunds.payment_processor_refund_id IS 'Refund id of this refund with the payment processor';
+COMMENT ON COLUMN refunds.created_at IS 'Timestamp of refund creation.';
+
+COMMENT ON CONSTRAINT refunds_pkey ON refunds IS 'Primary key constraint for refunds id column';
+COMMENT ON CONSTRAINT refunds_payment_id_fkey ON refunds IS 'Foreign key constraint for payments id column';
+COMMENT ON CONSTRAINT refunds_payment_id_payment_processor_refund_id_key ON refunds IS 'Unique constraint so a processor refund is only recorded once per payment';
+COMMENT ON CONSTRAINT refunds_amount_check ON refunds IS 'Check constraint for refunds table to make sure refund amount is positive';
+
+-- Campaign settlements
+
+COMMENT ON TABLE campaign_settlements IS 'Campaign settlements table contains the capture or void decision for authorized payments of ended all-or-nothing campaigns';
+
+COMMENT ON COLUMN campaign_settlements.campaign_id IS 'Reference to campaign that was settled';
+COMMENT ON COLUMN campaign_settlements.goal_met IS 'Whether authorized payments are captured (goal met) or voided';
+COMMENT ON COLUMN campaign_settlements.amt_raised IS 'Amount raised when the campaign was settled';
+COMMENT ON COLUMN campaign_settlements.created_at IS 'Timestamp of settlement decision.';
+
+COMMENT ON CONSTRAINT campaign_settlements_pkey ON campaign_settlements IS 'Primary key constraint for campaign settlements campaign id column';
+COMMENT ON CONSTRAINT campaign_settlements_campaign_id_fkey ON campaign_settlements IS 'Foreign key constraint for campaigns id column';
+
+-- Processor events
+
+COMMENT ON TABLE processor_events IS 'Processor events table contains webhook events already received from payment processors';
+
+COMMENT ON COLUMN processor_events.id IS 'Event id assigned by the payment processor';
+COMMENT ON COLUMN processor_events.payment_processor IS 'Payment processor that sent the event';
+COMMENT ON COLUMN processor_events.type IS 'Event type assigned by the payment processor';
+COMMENT ON COLUMN processor_events.created_at IS 'Timestamp of event receipt.';
+
+COMMENT ON CONSTRAINT processor_events_pkey ON processor_events IS 'Primary key constraint for processor events id and payment processor columns';
+
+-- Batch jobs
+
+COMMENT ON TABLE batch_jobs IS 'Batch jobs table contains asynchronous requests waiting to be processed';
+
+COMMENT ON COLUMN batch_jobs.id IS 'Primary key id of the batch jobs table';
+COMMENT ON COLUMN batch_jobs.queue IS 'Batch processor queue of the request';
+COMMENT ON COLUMN batch_jobs.payload IS 'Request serialized as JSON.  Removed once processed';
+COMMENT ON COLUMN batch_jobs.attempts IS 'Number of failed attempts to process the request';
+COMMENT ON COLUMN batch_jobs.available_at IS 'Timestamp the request can next be attempted';
+COMMENT ON COLUMN batch_jobs.error IS 'Error from the last failed attempt';
+COMMENT ON COLUMN batch_jobs.created_at IS 'Timestamp of request receipt.';
+
+COMMENT ON CONSTRAINT batch_jobs_pkey ON batch_jobs IS 'Primary key constraint for batch jobs id column';
+COMMENT ON INDEX batch_jobs_queue_idx IS 'B-tree index for queue and available_at columns for batch jobs';
+
+-- Dead letters
+
+COMMENT ON TABLE dead_letters IS 'Dead letters table contains asynchronous requests that failed every attempt or could not be retried';
+
+COMMENT ON COLUMN dead_letters.id IS 'Primary key id of the dead letters table';
+COMMENT ON COLUMN dead_letters.queue IS 'Batch processor queue of the request';
+COMMENT ON COLUMN dead_letters.payload IS 'Request serialized as JSON';
+COMMENT ON COLUMN dead_letters.attempts IS 'Number of failed attempts to process the request';
+COMMENT ON COLUMN dead_letters.error IS 'Error from the last failed attempt';
+COMMENT ON COLUMN dead_letters.created_at IS 'Timestamp the request was dead lettered.';
+
+COMMENT ON CONSTRAINT dead_letters_pkey ON dead_letters IS 'Primary key constraint for dead letters id column';
+
+-- Idempotency keys
+
+COMMENT ON TABLE idempotency_keys IS 'Idempotency keys table contains responses to payment and pledge requests so repeated requests are not processed twice';
+
+COMMENT ON COLUMN idempotency_keys.key IS 'Idempotency key sent by the client';
+COMMENT ON COLUMN idempotency_keys.endpoint IS 'Endpoint the request was sent to';
+COMMENT ON COLUMN idempotency_keys.fingerprint IS 'SHA-256 hash of the request.  Repeated requests must match';
+COMMENT ON COLUMN idempotency_keys.resource_id IS 'Id of the payment or pledge created by the request';
+COMMENT ON COLUMN idempotency_keys.response_code IS 'HTTP status code of the response.  Null while the request is processed';
+COMMENT ON COLUMN idempotency_keys.response_body IS 'Body of the response';
+COMMENT ON COLUMN idempotency_keys.created_at IS 'Timestamp of request receipt.';
+
+COMMENT ON CONSTRAINT idempotency_keys_pkey ON idempotency_keys IS 'Primary key constraint for idempotency keys key and endpoint columns';
+COMMENT ON INDEX idempotency_keys_created_at_idx IS 'B-tree index for created_at column for expiring idempotency keys';
 
 -- Pledges
 
@@ -96,11 +241,11 @@ COMMENT ON TABLE pledges IS 'Pledges table contains all the pledged donations fo
 
 COMMENT ON COLUMN pledges.id IS 'Primary key id of the payments table';
 COMMENT ON COLUMN pledges.campaign_id IS 'Reference to campaign that the pledge is associated with';
-COMMENT ON COLUMN pledges.perk_id IS 'Reference to perk that the pledge is associated with';
+COMMENT ON COLUMN pledges.perk_id IS 'Reference to perk that the pledge is associated with. NULL for donations without a perk';
 COMMENT ON COLUMN pledges.contact_email IS 'Contact e-mail of pledger';
 COMMENT ON COLUMN pledges.phone_number IS 'Phone number of pledger';
 COMMENT ON COLUMN pledges.contact_opt_in IS 'Flag if user wants to opt in for future mailings';
-COMMENT ON COLUMN pledges.amount IS 'Amount of the pledge';
+COMMENT ON COLUMN pledges.amount IS 'Amount of the pledge. At least the perk price';
 COMMENT ON COLUMN pledges.currency IS 'Currency of the pledge';
 COMMENT ON COLUMN pledges.advertise IS 'Whether to advertise user''s pledge';
 COMMENT ON COLUMN pledges.advertise_name IS 'Name to advertise user''s pledge';
@@ -115,6 +260,7 @@ COMMENT ON CONSTRAINT pledges_perk_id_fkey ON pledges IS 'Foreign key constraint
 COMMENT ON CONSTRAINT pledges_contact_email_check ON pledges IS 'Check constraint for pledges table to make sure contact email is valid if provided';
 COMMENT ON CONSTRAINT pledges_check ON pledges IS 'Check constraint for pledges table to make sure at least one of contact email or phone number is provided';
 COMMENT ON CONSTRAINT pledges_check1 ON pledges IS 'Check constraint for pledges table to make sure an advertised name is provided if advertisement is requested';
+COMMENT ON CONSTRAINT pledges_amount_check ON pledges IS 'Check constraint for pledges table to make sure pledge amount is positive';
 
 -- Campaign backers
 
@@ -133,6 +279,7 @@ COMMENT ON COLUMN campaign_backers.amt_pledged IS 'Amount of money pledged in th
 COMMENT ON COLUMN campaign_backers.num_pledgers IS 'Number of pledgers in the campaign';
 COMMENT ON COLUMN campaign_backers.start_date IS 'Start date of the campaign';
 COMMENT ON COLUMN campaign_backers.end_date IS 'End date of the campaign';
+COMMENT ON COLUMN campaign_backers.time_zone IS 'Time zone of the campaign';
 COMMENT ON COLUMN campaign_backers.flexible IS 'Flag if campaign is flexible or not.  Flexible is if campaign is all or none';
 COMMENT ON COLUMN campaign_backers.active IS 'Flag if campaign is active or not';
 COMMENT ON COLUMN campaign_backers.created_at IS 'Timestamp of campaign creation';
@@ -140,7 +287,7 @@ COMMENT ON COLUMN campaign_backers.updated_at IS 'Timestamp of last time campaig
 
 -- Perk claims
 
-COMMENT ON VIEW perk_claims IS 'Perk claims is the perks table with aggregated data with the number of items claimed sourced from the payments table';
+COMMENT ON VIEW perk_claims IS 'Perk claims is the perks table with aggregated data with the number of items claimed sourced from the payment items table';
 
 COMMENT ON RULE "_RETURN" ON perk_claims IS 'Internal rule for perk_claims view';
 
@@ -154,7 +301,7 @@ COMMENT ON COLUMN perk_claims.currency IS 'Currency of the perk';
 COMMENT ON COLUMN perk_claims.available_for_payment IS 'Amount of available items to buy for the perk';
 COMMENT ON COLUMN perk_claims.available_for_pledge IS 'Amount of available items to pledge for the perk';
 COMMENT ON COLUMN perk_claims.ship_date IS 'Ship date of the perk';
-COMMENT ON COLUMN perk_claims.num_claimed IS 'Number of items claimed for the perk';
+COMMENT ON COLUMN perk_claims.num_claimed IS 'Number of items claimed for the perk. Sum of the quantities bought with counted payments';
 COMMENT ON COLUMN perk_claims.num_pledged IS 'Number of items pledged for the perk';
 COMMENT ON COLUMN perk_claims.active IS 'Flag if perk is active or not';
 COMMENT ON COLUMN perk_claims.created_at IS 'Timestamp of perk creation.';
@@ -181,6 +328,7 @@ COMMENT ON COLUMN active_payments.postal_code IS 'Shipping postal code for perk'
 COMMENT ON COLUMN active_payments.country IS 'Shipping country for perk';
 COMMENT ON COLUMN active_payments.amount IS 'Amount of the payment';
 COMMENT ON COLUMN active_payments.currency IS 'Currency of the payment';
+COMMENT ON COLUMN active_payments.amount_refunded IS 'Total amount refunded for the payment';
 COMMENT ON COLUMN active_payments.status IS 'Current status of the payment';
 COMMENT ON COLUMN active_payments.contact_email IS 'Contact e-mail of backer';
 COMMENT ON COLUMN active_payments.contact_opt_in IS 'Flag if user wants to opt in for future mailings';
@@ -188,6 +336,7 @@ COMMENT ON COLUMN active_payments.advertise IS 'Whether to advertise user''s pay
 COMMENT ON COLUMN active_payments.advertise_other IS 'Use alternate value to advertise user''s payment';
 COMMENT ON COLUMN active_payments.payment_processor_responses IS 'Transaction responses from payment processor';
 COMMENT ON COLUMN active_payments.payment_processor_used IS 'Payment processor used to process this payment';
+COMMENT ON COLUMN active_payments.payment_processor_transaction_id IS 'Transaction id of this payment with the payment processor';
 COMMENT ON COLUMN active_payments.pledge_id IS 'Reference to pledge that payment is associated with';
 COMMENT ON COLUMN active_payments.replied_to IS 'Whether payment user was replied to or not';
 COMMENT ON COLUMN active_payments.created_at IS 'Timestamp of payment creation.';
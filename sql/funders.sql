@@ -4,9 +4,13 @@ CREATE SCHEMA IF NOT EXISTS funders;
 
 SET search_path TO funders,public;
 
-CREATE TYPE account_type AS ENUM('credit_card', 'paypal', 'bitcoin');
+CREATE TYPE account_type AS ENUM('credit_card', 'paypal', 'bitcoin', 'manual', 'bank_transfer');
 
-CREATE TYPE payment_status AS ENUM('success', 'failure', 'pending');
+CREATE TYPE payment_status AS ENUM('success', 'failure', 'pending', 'refunded', 'partially_refunded', 'authorized', 'voided', 'expired');
+
+CREATE TYPE reservation_status AS ENUM('held', 'converted', 'released');
+
+CREATE TYPE campaign_status AS ENUM('draft', 'scheduled', 'live', 'succeeded', 'failed', 'cancelled');
 
 CREATE TABLE campaigns
 (
@@ -15,9 +19,11 @@ CREATE TABLE campaigns
     description VARCHAR NOT NULL,
     goal NUMERIC NOT NULL,
     currency VARCHAR NOT NULL,
-    start_date DATE NOT NULL,
-    end_date DATE NOT NULL,
+    start_date TIMESTAMPTZ NOT NULL,
+    end_date TIMESTAMPTZ NOT NULL,
+    time_zone VARCHAR NOT NULL DEFAULT('UTC'),
     flexible BOOLEAN NOT NULL DEFAULT(false),
+    status campaign_status NOT NULL DEFAULT('draft'),
     active BOOLEAN NOT NULL DEFAULT(true),
     created_at TIMESTAMP NOT NULL,
     updated_at TIMESTAMP NOT NULL,
@@ -51,11 +57,27 @@ ALTER SEQUENCE perks_id_seq INCREMENT BY 3 START WITH 31337 RESTART WITH 31337;
 
 CREATE UNIQUE INDEX p_name_idx ON perks(name, campaign_id);
 
+CREATE TABLE stretch_goals
+(
+    id SERIAL8 NOT NULL PRIMARY KEY,
+    campaign_id INT8 NOT NULL REFERENCES campaigns (id) ON DELETE CASCADE,
+    amount NUMERIC NOT NULL,
+    title VARCHAR NOT NULL,
+    description VARCHAR NOT NULL,
+    perk_id INT8 NULL REFERENCES perks (id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    CHECK(amount > 0)
+);
+
+CREATE UNIQUE INDEX sg_amount_idx ON stretch_goals(campaign_id, amount);
+CREATE UNIQUE INDEX sg_title_idx ON stretch_goals(title, campaign_id);
+
 CREATE TABLE pledges
 (
     id UUID NOT NULL PRIMARY KEY,
     campaign_id INT8 NOT NULL REFERENCES campaigns (id) ON DELETE CASCADE,
-    perk_id INT8 NOT NULL REFERENCES perks (id) ON DELETE CASCADE,
+    perk_id INT8 NULL REFERENCES perks (id) ON DELETE CASCADE,
     contact_email VARCHAR NULL,
     phone_number VARCHAR NULL,
     contact_opt_in BOOLEAN NOT NULL DEFAULT(true),
@@ -69,6 +91,7 @@ CREATE TABLE pledges
     updated_at TIMESTAMP NOT NULL,
     CHECK(contact_email IS NULL OR contact_email ~* '^[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+$'),
     CHECK(contact_email IS NOT NULL OR phone_number IS NOT NULL),
+    CHECK(amount > 0),
     CHECK(advertise = FALSE OR (advertise = TRUE AND advertise_name IS NOT NULL))
 );
 
@@ -76,7 +99,7 @@ CREATE TABLE payments
 (
     id UUID NOT NULL PRIMARY KEY,
     campaign_id INT8 NOT NULL REFERENCES campaigns (id) ON DELETE CASCADE,
-    perk_id INT8 NOT NULL REFERENCES perks (id) ON DELETE CASCADE,
+    perk_id INT8 NULL REFERENCES perks (id) ON DELETE CASCADE,
     account_type ACCOUNT_TYPE NOT NULL,
     name_on_payment VARCHAR NOT NULL,
     full_name VARCHAR NOT NULL,
@@ -87,6 +110,7 @@ CREATE TABLE payments
     country VARCHAR NOT NULL,
     amount NUMERIC NOT NULL,
     currency VARCHAR NOT NULL,
+    amount_refunded NUMERIC NOT NULL DEFAULT 0,
     status PAYMENT_STATUS NOT NULL,
     contact_email VARCHAR NULL,
     contact_opt_in BOOLEAN NOT NULL DEFAULT(true),
@@ -94,15 +118,121 @@ CREATE TABLE payments
     advertise_other VARCHAR NULL,
     payment_processor_responses JSONB[] NULL,
     payment_processor_used VARCHAR NULL,
+    payment_processor_transaction_id VARCHAR NULL,
     pledge_id UUID NULL REFERENCES pledges (id) ON DELETE SET NULL,
     replied_to BOOLEAN NOT NULL DEFAULT FALSE,
     created_at TIMESTAMP NOT NULL,
     updated_at TIMESTAMP NOT NULL,
     CHECK(contact_email IS NULL OR contact_email ~* '^[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+$'),
+    CHECK(amount > 0),
+    CHECK(amount_refunded >= 0 AND amount_refunded <= amount)
+);
+
+CREATE UNIQUE INDEX payments_pledge_id_idx ON payments(pledge_id) WHERE status NOT IN ('failure', 'expired');
+
+CREATE INDEX payments_status_idx ON payments(status, created_at);
+
+CREATE INDEX payments_transaction_id_idx ON payments(payment_processor_used, payment_processor_transaction_id);
+
+CREATE TABLE payment_items
+(
+    payment_id UUID NOT NULL REFERENCES payments (id) ON DELETE CASCADE,
+    perk_id INT8 NOT NULL REFERENCES perks (id) ON DELETE CASCADE,
+    quantity INT8 NOT NULL,
+    price NUMERIC NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(payment_id, perk_id),
+    CHECK(quantity > 0),
+    CHECK(price > 0)
+);
+
+CREATE INDEX payment_items_perk_id_idx ON payment_items(perk_id);
+
+-- Payments made before line items were added claim their single perk
+INSERT INTO payment_items(payment_id, perk_id, quantity, price, created_at) SELECT id, perk_id, 1, amount, created_at FROM payments WHERE perk_id IS NOT NULL ON CONFLICT DO NOTHING;
+
+CREATE TABLE perk_reservations
+(
+    payment_id UUID NOT NULL,
+    perk_id INT8 NOT NULL REFERENCES perks (id) ON DELETE CASCADE,
+    quantity INT8 NOT NULL,
+    status RESERVATION_STATUS NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(payment_id, perk_id),
+    CHECK(quantity > 0)
+);
+
+CREATE INDEX perk_reservations_perk_id_idx ON perk_reservations(perk_id, status, expires_at);
+
+CREATE TABLE refunds
+(
+    id UUID NOT NULL PRIMARY KEY,
+    payment_id UUID NOT NULL REFERENCES payments (id) ON DELETE CASCADE,
+    amount NUMERIC NOT NULL,
+    reason VARCHAR NULL,
+    payment_processor_refund_id VARCHAR NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    UNIQUE(payment_id, payment_processor_refund_id),
     CHECK(amount > 0)
 );
 
-CREATE UNIQUE INDEX payments_pledge_id_idx ON payments(pledge_id, status);
+CREATE TABLE campaign_settlements
+(
+    campaign_id INT8 NOT NULL PRIMARY KEY REFERENCES campaigns (id) ON DELETE CASCADE,
+    goal_met BOOLEAN NOT NULL,
+    amt_raised NUMERIC NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE processor_events
+(
+    id VARCHAR NOT NULL,
+    payment_processor VARCHAR NOT NULL,
+    type VARCHAR NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(id, payment_processor)
+);
+
+CREATE TABLE batch_jobs
+(
+    id BIGSERIAL NOT NULL,
+    queue VARCHAR NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    available_at TIMESTAMP NOT NULL,
+    error VARCHAR NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(id)
+);
+
+CREATE INDEX batch_jobs_queue_idx ON batch_jobs(queue, available_at);
+
+CREATE TABLE dead_letters
+(
+    id BIGSERIAL NOT NULL,
+    queue VARCHAR NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL,
+    error VARCHAR NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(id)
+);
+
+CREATE TABLE idempotency_keys
+(
+    key VARCHAR(255) NOT NULL,
+    endpoint VARCHAR NOT NULL,
+    fingerprint VARCHAR NOT NULL,
+    resource_id UUID NOT NULL,
+    response_code INTEGER NULL,
+    response_body VARCHAR NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(key, endpoint)
+);
+
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys(created_at);
 
 CREATE OR REPLACE VIEW campaign_backers
 AS
@@ -117,17 +247,19 @@ SELECT id,
        CASE WHEN num_pledgers IS NULL THEN 0 ELSE num_pledgers END,
        start_date,
        end_date,
+       time_zone,
        flexible,
+       status,
        active,
        campaigns.created_at,
        campaigns.updated_at
 FROM campaigns
 LEFT OUTER JOIN
     (SELECT campaign_id,
-            sum(amount) AS amt_raised,
+            sum(amount - amount_refunded) AS amt_raised,
             COUNT(1) AS num_backers
     FROM payments
-    WHERE status = 'success'
+    WHERE status IN ('success', 'partially_refunded', 'authorized')
     GROUP BY campaign_id) backers
 ON campaigns.id = backers.campaign_id
 LEFT OUTER JOIN
@@ -160,12 +292,14 @@ FROM perks
 INNER JOIN campaigns
 ON perks.campaign_id = campaigns.id
 LEFT OUTER JOIN
-    (SELECT campaign_id,
-            perk_id,
-            COUNT(1) AS num_claimed
-    FROM payments
-    WHERE status = 'success'
-    GROUP BY campaign_id, perk_id) claimed
+    (SELECT payments.campaign_id,
+            payment_items.perk_id,
+            sum(payment_items.quantity) AS num_claimed
+    FROM payment_items
+    INNER JOIN payments
+    ON payment_items.payment_id = payments.id
+    WHERE payments.status IN ('success', 'partially_refunded', 'authorized')
+    GROUP BY payments.campaign_id, payment_items.perk_id) claimed
 ON perks.campaign_id = claimed.campaign_id
     AND perks.id = claimed.perk_id
 LEFT OUTER JOIN
@@ -196,6 +330,7 @@ SELECT
     country,
     amount,
     payments.currency,
+    amount_refunded,
     status,
     contact_email,
     contact_opt_in,
@@ -203,6 +338,7 @@ SELECT
     advertise_other,
     payment_processor_responses,
     payment_processor_used,
+    payment_processor_transaction_id,
     pledge_id,
     payments.replied_to,
     payments.created_at,
@@ -210,9 +346,9 @@ SELECT
 FROM payments
 INNER JOIN campaigns
 ON payments.campaign_id = campaigns.id
-INNER JOIN perks
+LEFT OUTER JOIN perks
 ON payments.perk_id = perks.id
-WHERE campaigns.active = TRUE AND perks.active = TRUE;
+WHERE campaigns.active = TRUE AND (payments.perk_id IS NULL OR perks.active = TRUE);
 
 CREATE OR REPLACE VIEW active_pledges
 AS
@@ -238,11 +374,17 @@ SELECT
 FROM pledges
 INNER JOIN campaigns
 ON pledges.campaign_id = campaigns.id
-INNER JOIN perks
+LEFT OUTER JOIN perks
 ON pledges.perk_id = perks.id
-LEFT OUTER JOIN payments
-ON pledges.id = payments.pledge_id
-WHERE campaigns.active = TRUE AND perks.active = TRUE
+LEFT OUTER JOIN LATERAL
+    (SELECT id,
+            status
+    FROM payments
+    WHERE payments.pledge_id = pledges.id
+    ORDER BY created_at DESC
+    LIMIT 1) payments
+ON TRUE
+WHERE campaigns.active = TRUE AND (pledges.perk_id IS NULL OR perks.active = TRUE)
 AND pledges.id NOT IN (SELECT pledge_id FROM payments WHERE status = 'success' AND pledge_id IS NOT NULL);
 
 CREATE OR REPLACE VIEW advertisements
@@ -258,7 +400,7 @@ SELECT
 FROM active_payments
 INNER JOIN campaign_backers
 ON active_payments.campaign_id = campaign_backers.id
-WHERE active_payments.status = 'success'
+WHERE active_payments.status IN ('success', 'partially_refunded', 'authorized')
 UNION ALL
 SELECT
     'pledge',
@@ -1,8 +1,8 @@
 -- Projects
 
-INSERT INTO funders.campaigns VALUES (DEFAULT, 'alpha', 'Alpha is the best consumer electronics product ever', 10000, 'USD', '2016-05-01', '2016-11-01', DEFAULT, DEFAULT, current_timestamp, current_timestamp);
-INSERT INTO funders.campaigns VALUES (DEFAULT, 'omega', 'Omega is the worst consumer electronics product ever', 50000, 'USD', '2017-08-01', '2017-10-01', DEFAULT, DEFAULT, current_timestamp, current_timestamp);
-INSERT INTO funders.campaigns VALUES (DEFAULT, 'kappa', 'Kappa is an alright consumer electronics product', 75000, 'USD', '2016-07-01', '2016-09-01', DEFAULT, DEFAULT, current_timestamp, current_timestamp);
+INSERT INTO funders.campaigns(name, description, goal, currency, start_date, end_date, time_zone, status, created_at, updated_at) VALUES ('alpha', 'Alpha is the best consumer electronics product ever', 10000, 'USD', '2016-05-01 00:00:00-04:00', '2016-11-01 00:00:00-04:00', 'America/New_York', 'scheduled', current_timestamp, current_timestamp);
+INSERT INTO funders.campaigns(name, description, goal, currency, start_date, end_date, time_zone, status, created_at, updated_at) VALUES ('omega', 'Omega is the worst consumer electronics product ever', 50000, 'USD', '2017-08-01 00:00:00-04:00', '2017-10-01 00:00:00-04:00', 'America/New_York', 'scheduled', current_timestamp, current_timestamp);
+INSERT INTO funders.campaigns(name, description, goal, currency, start_date, end_date, time_zone, status, created_at, updated_at) VALUES ('kappa', 'Kappa is an alright consumer electronics product', 75000, 'USD', '2016-07-01 00:00:00-04:00', '2016-09-01 00:00:00-04:00', 'America/New_York', 'scheduled', current_timestamp, current_timestamp);
 
 -- Perks
 
@@ -25,12 +25,24 @@ INSERT INTO funders.pledges VALUES ('00a5c040-459d-4ebc-9c7f-13385943ae2d', 3133
 
 -- Payments
 
-INSERT INTO funders.payments VALUES ('3891fb08-f548-428c-80dc-e02f27ca2bdf', 31337, 31337, 'credit_card', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 25, 'USD', 'success', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', NULL, DEFAULT, current_timestamp, current_timestamp);
-INSERT INTO funders.payments VALUES ('0a245453-67fc-4ecb-a89a-f6e0ca393804', 31337, 31337, 'credit_card', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 25, 'USD', 'success', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', NULL, DEFAULT, current_timestamp, current_timestamp);
-INSERT INTO funders.payments VALUES ('5d5e0c4b-157f-467f-ae0d-bf699143a2f4', 31337, 31340, 'credit_card', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 500, 'USD', 'success', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', NULL, DEFAULT, current_timestamp, current_timestamp);
-INSERT INTO funders.payments VALUES ('74c2c75e-0f1a-4394-88a2-15b5cb298def', 31337, 31340, 'credit_card', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 500, 'USD', 'failure', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', NULL, DEFAULT, current_timestamp, current_timestamp);
-INSERT INTO funders.payments VALUES ('81e07c03-80a0-4d0e-a00c-ce764204da70', 31337, 31340, 'credit_card', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 500, 'USD', 'failure', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', NULL, DEFAULT, current_timestamp, current_timestamp);
-INSERT INTO funders.payments VALUES ('cef6fab5-ddb0-442e-ab10-b281dd982525', 31337, 31340, 'paypal', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 500, 'USD', 'pending', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', NULL, DEFAULT, current_timestamp, current_timestamp);
-INSERT INTO funders.payments VALUES ('da9204a5-515f-4ecd-8e9f-3e4ef0939d5e', 31337, 31337, 'paypal', 'John Doe', 'John Doe', '55555 White Plains Road', 'Apt. 555', 'Bronx', '10467', 'USA', 25, 'USD', 'failure', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'paypal', '5ccf7b22-6868-4583-8790-11898d9b51b8', DEFAULT, current_timestamp, current_timestamp);
-INSERT INTO funders.payments VALUES ('cb891624-f200-4baf-9025-8abb96c6a382', 31337, 31337, 'paypal', 'John Doe', 'John Doe', '55555 White Plains Road', 'Apt. 555', 'Bronx', '10467', 'USA', 25, 'USD', 'success', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'paypal', '5ccf7b22-6868-4583-8790-11898d9b51b8', DEFAULT, current_timestamp, current_timestamp);
-INSERT INTO funders.payments VALUES ('17de3a69-f097-4d45-9aeb-589dfd4dba4b', 31337, 31337, 'paypal', 'Philly Queens', 'Philly Queens', '55555 White Plains Road', 'Apt. 555', 'Queens', '10097', 'USA', 25, 'USD', 'failure', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'paypal', '592bec2a-14bd-4de8-8538-90c568b5770f', DEFAULT, current_timestamp, current_timestamp);
+INSERT INTO funders.payments VALUES ('3891fb08-f548-428c-80dc-e02f27ca2bdf', 31337, 31337, 'credit_card', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 25, 'USD', DEFAULT, 'success', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', DEFAULT, NULL, DEFAULT, current_timestamp, current_timestamp);
+INSERT INTO funders.payments VALUES ('0a245453-67fc-4ecb-a89a-f6e0ca393804', 31337, 31337, 'credit_card', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 25, 'USD', DEFAULT, 'success', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', DEFAULT, NULL, DEFAULT, current_timestamp, current_timestamp);
+INSERT INTO funders.payments VALUES ('5d5e0c4b-157f-467f-ae0d-bf699143a2f4', 31337, 31340, 'credit_card', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 500, 'USD', DEFAULT, 'success', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', DEFAULT, NULL, DEFAULT, current_timestamp, current_timestamp);
+INSERT INTO funders.payments VALUES ('74c2c75e-0f1a-4394-88a2-15b5cb298def', 31337, 31340, 'credit_card', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 500, 'USD', DEFAULT, 'failure', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', DEFAULT, NULL, DEFAULT, current_timestamp, current_timestamp);
+INSERT INTO funders.payments VALUES ('81e07c03-80a0-4d0e-a00c-ce764204da70', 31337, 31340, 'credit_card', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 500, 'USD', DEFAULT, 'failure', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', DEFAULT, NULL, DEFAULT, current_timestamp, current_timestamp);
+INSERT INTO funders.payments VALUES ('cef6fab5-ddb0-442e-ab10-b281dd982525', 31337, 31340, 'paypal', 'Donovan James', 'Donovan James', '12 East Tremont Avenue', DEFAULT, 'Bronx', '10467', 'USA', 500, 'USD', DEFAULT, 'pending', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'stripe', DEFAULT, NULL, DEFAULT, current_timestamp, current_timestamp);
+INSERT INTO funders.payments VALUES ('da9204a5-515f-4ecd-8e9f-3e4ef0939d5e', 31337, 31337, 'paypal', 'John Doe', 'John Doe', '55555 White Plains Road', 'Apt. 555', 'Bronx', '10467', 'USA', 25, 'USD', DEFAULT, 'failure', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'paypal', DEFAULT, '5ccf7b22-6868-4583-8790-11898d9b51b8', DEFAULT, current_timestamp, current_timestamp);
+INSERT INTO funders.payments VALUES ('cb891624-f200-4baf-9025-8abb96c6a382', 31337, 31337, 'paypal', 'John Doe', 'John Doe', '55555 White Plains Road', 'Apt. 555', 'Bronx', '10467', 'USA', 25, 'USD', DEFAULT, 'success', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'paypal', DEFAULT, '5ccf7b22-6868-4583-8790-11898d9b51b8', DEFAULT, current_timestamp, current_timestamp);
+INSERT INTO funders.payments VALUES ('17de3a69-f097-4d45-9aeb-589dfd4dba4b', 31337, 31337, 'paypal', 'Philly Queens', 'Philly Queens', '55555 White Plains Road', 'Apt. 555', 'Queens', '10097', 'USA', 25, 'USD', DEFAULT, 'failure', DEFAULT, DEFAULT, DEFAULT, DEFAULT, DEFAULT, 'paypal', DEFAULT, '592bec2a-14bd-4de8-8538-90c568b5770f', DEFAULT, current_timestamp, current_timestamp);
+
+-- Payment items
+
+INSERT INTO funders.payment_items VALUES ('3891fb08-f548-428c-80dc-e02f27ca2bdf', 31337, 1, 25, current_timestamp);
+INSERT INTO funders.payment_items VALUES ('0a245453-67fc-4ecb-a89a-f6e0ca393804', 31337, 1, 25, current_timestamp);
+INSERT INTO funders.payment_items VALUES ('5d5e0c4b-157f-467f-ae0d-bf699143a2f4', 31340, 1, 500, current_timestamp);
+INSERT INTO funders.payment_items VALUES ('74c2c75e-0f1a-4394-88a2-15b5cb298def', 31340, 1, 500, current_timestamp);
+INSERT INTO funders.payment_items VALUES ('81e07c03-80a0-4d0e-a00c-ce764204da70', 31340, 1, 500, current_timestamp);
+INSERT INTO funders.payment_items VALUES ('cef6fab5-ddb0-442e-ab10-b281dd982525', 31340, 1, 500, current_timestamp);
+INSERT INTO funders.payment_items VALUES ('da9204a5-515f-4ecd-8e9f-3e4ef0939d5e', 31337, 1, 25, current_timestamp);
+INSERT INTO funders.payment_items VALUES ('cb891624-f200-4baf-9025-8abb96c6a382', 31337, 1, 25, current_timestamp);
+INSERT INTO funders.payment_items VALUES ('17de3a69-f097-4d45-9aeb-589dfd4dba4b', 31337, 1, 25, current_timestamp);
@@ -0,0 +1,497 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/martini-contrib/binding"
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/charge"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	STRIPE_PROCESSOR             = "stripe"
+	STRIPE_SECONDARY_PROCESSOR   = "stripe_secondary"
+	STRIPE_SIGNATURE_HEADER      = "Stripe-Signature"
+	STRIPE_PAYMENT_ID_METADATA   = "payment_id"
+	STRIPE_TOKEN_PREFIX          = "tok_"
+	STRIPE_PAYMENT_METHOD_PREFIX = "pm_"
+)
+
+type StripeProcessor struct {
+	Name              string
+	Key               string
+	WebhookSecret     string
+	WebhookTolerance  time.Duration
+	LegacyCardNumbers bool
+}
+
+//The client library shares one backend between stripe accounts
+func SetStripeTimeout(timeout time.Duration) {
+	stripe.SetHTTPClient(&http.Client{Timeout: timeout})
+}
+
+func NewStripeProcessor(key string) *StripeProcessor {
+	stripeProcessor := new(StripeProcessor)
+	stripeProcessor.Name = STRIPE_PROCESSOR
+	stripeProcessor.Key = key
+	return stripeProcessor
+}
+
+func (stripeProcessor *StripeProcessor) GetName() string {
+	return stripeProcessor.Name
+}
+
+func (stripeProcessor *StripeProcessor) Validate(payment *Payment, errors binding.Errors) binding.Errors {
+	hasCardNumber := payment.HasCardDetails()
+
+	//Card numbers are only sent to stripe directly in legacy mode
+	if payment.AccountType == "credit_card" && len(payment.CreditCardToken) > 0 {
+		if !strings.HasPrefix(payment.CreditCardToken, STRIPE_TOKEN_PREFIX) && !strings.HasPrefix(payment.CreditCardToken, STRIPE_PAYMENT_METHOD_PREFIX) {
+			errors = addError(errors, []string{"creditCardToken"}, binding.TypeError, "Credit card token must be a stripe token or payment method id")
+		}
+
+		if hasCardNumber {
+			errors = addError(errors, []string{"creditCardToken", "creditCardAccountNumber", "creditCardExpirationDate", "creditCardCvv"}, binding.TypeError, "Credit card account number, expiration date and cvv can not be sent with a credit card token")
+		}
+	} else if payment.AccountType == "credit_card" && hasCardNumber && !stripeProcessor.LegacyCardNumbers {
+		errors = addError(errors, []string{"creditCardAccountNumber", "creditCardExpirationDate", "creditCardCvv"}, binding.TypeError, "Credit card account numbers are not accepted.  Send a stripe token or payment method id as the credit card token")
+	} else if payment.AccountType == "credit_card" && stripeProcessor.LegacyCardNumbers && (len(payment.CreditCardAccountNumber) == 0 || len(payment.CreditCardExpirationDate) == 0 || len(payment.CreditCardCvv) == 0 || len(payment.CreditCardPostalCode) == 0) {
+		errors = addError(errors, []string{"accountType", "creditCardToken", "creditCardAccountNumber", "creditCardExpirationDate", "creditCardCvv", "creditCardPostalCode"}, binding.RequiredError, "Credit card token or account number, expiration date, cvv and postal code required with credit_card account type")
+	} else if payment.AccountType == "credit_card" && !stripeProcessor.LegacyCardNumbers {
+		errors = addError(errors, []string{"accountType", "creditCardToken"}, binding.RequiredError, "Credit card token required with credit_card account type")
+	}
+
+	return errors
+}
+
+func (stripeProcessor *StripeProcessor) Charge(payment *Payment) error {
+	return stripeProcessor.charge(payment, true)
+}
+
+func (stripeProcessor *StripeProcessor) SupportsAuthorization(payment *Payment) bool {
+	return payment.AccountType == "credit_card"
+}
+
+func (stripeProcessor *StripeProcessor) Authorize(payment *Payment) error {
+	if !stripeProcessor.SupportsAuthorization(payment) {
+		return RequestError{"Only credit card payments can be authorized", ServiceNotImplementedError}
+	}
+
+	return stripeProcessor.charge(payment, false)
+}
+
+func (stripeProcessor *StripeProcessor) Capture(payment *Payment) error {
+	if len(payment.PaymentProcessorTransactionId) == 0 {
+		return RequestError{fmt.Sprintf("No stripe charge found for payment %s", payment.Id), NotFoundError}
+	}
+
+	if IsStripePaymentIntent(payment.PaymentProcessorTransactionId) {
+		return stripeProcessor.capturePaymentIntent(payment)
+	}
+
+	ch, err := stripeProcessor.getChargeClient().Capture(payment.PaymentProcessorTransactionId, nil)
+	if nil == err {
+		log.Printf("Successfully captured payment %s with processor", payment.Id)
+
+		jsonErr := payment.UpdatePaymentProcessorResponses(ch)
+		if nil != jsonErr {
+			log.Print(jsonErr)
+			log.Printf("Unable to marshal capture response (%#v) from stripe", ch)
+		}
+
+		payment.UpdateStatus("success")
+	} else {
+		log.Print(err)
+		log.Print("Failed capturing payment with processor")
+		payment.PaymentProcessorResponses = FormatPaymentProcessorResponse(err.Error())
+		err = stripeProcessor.convertError(payment, err)
+
+		//Declined or expired authorizations can never be captured
+		if requestErr, ok := err.(RequestError); ok && requestErr.Type == BadRequestError {
+			payment.UpdateStatus("failure")
+		}
+	}
+
+	return err
+}
+
+//Refunding an uncaptured charge releases the authorization
+func (stripeProcessor *StripeProcessor) Void(payment *Payment) error {
+	if len(payment.PaymentProcessorTransactionId) == 0 {
+		return RequestError{fmt.Sprintf("No stripe charge found for payment %s", payment.Id), NotFoundError}
+	}
+
+	if IsStripePaymentIntent(payment.PaymentProcessorTransactionId) {
+		return stripeProcessor.voidPaymentIntent(payment)
+	}
+
+	body := &url.Values{
+		"charge": {payment.PaymentProcessorTransactionId},
+	}
+	body.Add(fmt.Sprintf("metadata[%s]", STRIPE_PAYMENT_ID_METADATA), payment.Id)
+
+	refund := &stripe.Refund{}
+	err := stripe.GetBackend(stripe.APIBackend).Call("POST", "/refunds", stripeProcessor.Key, body, nil, refund)
+	if nil == err {
+		log.Printf("Successfully voided payment %s with processor", payment.Id)
+
+		jsonErr := payment.UpdatePaymentProcessorResponses(refund)
+		if nil != jsonErr {
+			log.Print(jsonErr)
+			log.Printf("Unable to marshal void response (%#v) from stripe", refund)
+		}
+
+		payment.UpdateStatus("voided")
+	} else {
+		log.Print(err)
+		log.Print("Failed voiding payment with processor")
+		payment.PaymentProcessorResponses = FormatPaymentProcessorResponse(err.Error())
+		err = stripeProcessor.convertError(nil, err)
+	}
+
+	return err
+}
+
+func (stripeProcessor *StripeProcessor) charge(payment *Payment, capture bool) error {
+	var sourceParams *stripe.SourceParams
+	var err error
+
+	if payment.AccountType == "credit_card" && len(payment.CreditCardToken) > 0 {
+		return stripeProcessor.chargePaymentIntent(payment, capture)
+	} else if payment.AccountType == "credit_card" {
+		sourceParams, err = stripeProcessor.makeCreditCardSource(payment)
+		if nil != err {
+			return err
+		}
+	} else {
+		return RequestError{"Only credit card payments are currently supported", ServiceNotImplementedError}
+	}
+
+	if nil == payment.Campaign {
+		return RequestError{fmt.Sprintf("Campaign not found %d", payment.CampaignId), NotFoundError}
+	}
+
+	address := stripe.Address{
+		Line1:   payment.Address1,
+		Line2:   payment.Address2,
+		City:    payment.City,
+		Zip:     payment.PostalCode,
+		Country: payment.Country,
+	}
+
+	chargeParams := &stripe.ChargeParams{
+		Amount:    stripeAmount(payment.Amount),
+		Currency:  stripe.Currency(payment.Currency),
+		Desc:      getStripeDescription(payment),
+		Email:     payment.ContactEmail,
+		Statement: fmt.Sprintf("Campaign(%s)", payment.Campaign.Name),
+		Source:    sourceParams,
+		NoCapture: !capture,
+	}
+
+	//Shipping details are not kept for payments loaded from the database
+	if len(payment.FullName) > 0 {
+		chargeParams.Shipping = &stripe.ShippingDetails{
+			Name:    payment.FullName,
+			Address: address,
+		}
+	}
+
+	chargeParams.AddMeta(STRIPE_PAYMENT_ID_METADATA, payment.Id)
+
+	//Repeated requests with the same idempotency key never charge twice
+	chargeParams.IdempotencyKey = stripeProcessor.getIdempotencyKey(payment)
+
+	ch, err := stripeProcessor.getChargeClient().New(chargeParams)
+	if nil == err {
+		log.Print("Successfully processed payment with processor")
+
+		jsonErr := payment.UpdatePaymentProcessorResponses(ch)
+		if nil != jsonErr {
+			log.Print(jsonErr)
+			log.Printf("Unable to marshal charge response (%#v) from stripe", ch)
+		}
+
+		payment.PaymentProcessorTransactionId = ch.ID
+
+		if ch.Paid && !ch.Captured {
+			payment.UpdateStatus("authorized")
+		} else if ch.Paid {
+			payment.UpdateStatus("success")
+		} else {
+			payment.UpdateStatus("failure")
+			payment.UpdateFailureReason(ch.FailMsg)
+		}
+	} else {
+		log.Print(err)
+		log.Print("Failed processing payment with processor")
+		payment.PaymentProcessorResponses = FormatPaymentProcessorResponse(err.Error())
+		payment.UpdateStatus("failure")
+		err = stripeProcessor.convertError(payment, err)
+	}
+
+	return err
+}
+
+//Retries, requeues and timeouts of a payment reuse its key so stripe charges it once. Client keys take precedence
+func (stripeProcessor *StripeProcessor) getIdempotencyKey(payment *Payment) string {
+	if len(payment.IdempotencyKey) > 0 {
+		return payment.IdempotencyKey
+	}
+
+	return fmt.Sprintf("%s-%s", stripeProcessor.GetName(), payment.Id)
+}
+
+func getStripeDescription(payment *Payment) string {
+	if payment.IsDonation() {
+		return fmt.Sprintf("Payment id %s on donation to campaign %d.", payment.Id, payment.CampaignId)
+	} else if payment.HasMultipleItems() {
+		return fmt.Sprintf("Payment id %s on charge for perks %s of campaign %d.", payment.Id, payment.GetItemsDescription(), payment.CampaignId)
+	}
+
+	return fmt.Sprintf("Payment id %s on charge for perk %d of campaign %d.", payment.Id, payment.PerkId, payment.CampaignId)
+}
+
+func (stripeProcessor *StripeProcessor) Complete(payment *Payment, completion PaymentCompletion) error {
+	if IsStripePaymentIntent(payment.PaymentProcessorTransactionId) {
+		return stripeProcessor.completePaymentIntent(payment)
+	}
+
+	return RequestError{fmt.Sprintf("Unsupported payment update account type %s", payment.AccountType), ServiceNotImplementedError}
+}
+
+func (stripeProcessor *StripeProcessor) Refund(payment *Payment, amount float64) (string, error) {
+	if len(payment.PaymentProcessorTransactionId) == 0 {
+		return "", RequestError{fmt.Sprintf("No stripe charge found for payment %s", payment.Id), NotFoundError}
+	}
+
+	//Refunds are not part of the vendored client so call the backend directly
+	body := &url.Values{
+		"amount": {strconv.FormatUint(stripeAmount(amount), 10)},
+	}
+	body.Add(fmt.Sprintf("metadata[%s]", STRIPE_PAYMENT_ID_METADATA), payment.Id)
+
+	var err error
+	refund := &stripe.Refund{}
+	if IsStripePaymentIntent(payment.PaymentProcessorTransactionId) {
+		body.Add("payment_intent", payment.PaymentProcessorTransactionId)
+		err = stripeProcessor.callApi("POST", "/refunds", body, "", refund)
+	} else {
+		body.Add("charge", payment.PaymentProcessorTransactionId)
+		err = stripe.GetBackend(stripe.APIBackend).Call("POST", "/refunds", stripeProcessor.Key, body, nil, refund)
+	}
+	if nil == err {
+		jsonErr := payment.UpdatePaymentProcessorResponses(refund)
+		if nil != jsonErr {
+			log.Print(jsonErr)
+			log.Printf("Unable to marshal refund response (%#v) from stripe", refund)
+		}
+	} else {
+		log.Print(err)
+		log.Print("Failed refunding payment with processor")
+		payment.PaymentProcessorResponses = FormatPaymentProcessorResponse(err.Error())
+		return "", stripeProcessor.convertError(nil, err)
+	}
+
+	return refund.ID, nil
+}
+
+func (stripeProcessor *StripeProcessor) GetStatus(payment *Payment) (string, error) {
+	//Charges that timed out before their id was recorded are found by payment id
+	if len(payment.PaymentProcessorTransactionId) == 0 {
+		transactionId, err := stripeProcessor.findTransactionId(payment)
+		if nil != err {
+			return "", err
+		}
+		payment.PaymentProcessorTransactionId = transactionId
+	}
+
+	if IsStripePaymentIntent(payment.PaymentProcessorTransactionId) {
+		return stripeProcessor.getPaymentIntentStatus(payment)
+	}
+
+	ch, err := stripeProcessor.getChargeClient().Get(payment.PaymentProcessorTransactionId, nil)
+	if nil != err {
+		return "", stripeProcessor.convertError(nil, err)
+	}
+
+	switch ch.Status {
+	case "succeeded":
+		return "success", nil
+	case "pending":
+		return "pending", nil
+	default:
+		return "failure", nil
+	}
+}
+
+func (stripeProcessor *StripeProcessor) ParseWebhookEvent(payload []byte, signatureHeader string) (*stripe.Event, error) {
+	err := stripeProcessor.verifyWebhookSignature(payload, signatureHeader)
+	if nil != err {
+		return nil, err
+	}
+
+	event := &stripe.Event{}
+	err = json.Unmarshal(payload, event)
+	if nil != err {
+		return nil, RequestError{fmt.Sprintf("Unable to parse stripe event: %s", err.Error()), BadRequestError}
+	}
+
+	if len(event.ID) == 0 || nil == event.Data || nil == event.Data.Obj {
+		return nil, RequestError{"Stripe event is missing id or data", BadRequestError}
+	}
+
+	return event, nil
+}
+
+//Header format is t=timestamp,v1=signature[,v1=signature...]
+func (stripeProcessor *StripeProcessor) verifyWebhookSignature(payload []byte, signatureHeader string) error {
+	if len(stripeProcessor.WebhookSecret) == 0 {
+		return RequestError{"Stripe webhook secret is not set", ServiceNotImplementedError}
+	}
+
+	var timestamp int64
+	var signatures []string
+
+	for _, pair := range strings.Split(signatureHeader, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "t":
+			timestamp, _ = strconv.ParseInt(parts[1], 10, 64)
+		case "v1":
+			signatures = append(signatures, parts[1])
+		}
+	}
+
+	if timestamp <= 0 || len(signatures) == 0 {
+		return RequestError{fmt.Sprintf("Invalid %s header", STRIPE_SIGNATURE_HEADER), BadRequestError}
+	}
+
+	if stripeProcessor.WebhookTolerance > 0 {
+		age := time.Since(time.Unix(timestamp, 0))
+		if age > stripeProcessor.WebhookTolerance || age < -stripeProcessor.WebhookTolerance {
+			return RequestError{fmt.Sprintf("Stripe event timestamp %d is outside of tolerance", timestamp), BadRequestError}
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte(stripeProcessor.WebhookSecret))
+	mac.Write([]byte(fmt.Sprintf("%d.", timestamp)))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+
+	for _, signature := range signatures {
+		actual, err := hex.DecodeString(signature)
+		if nil == err && hmac.Equal(expected, actual) {
+			return nil
+		}
+	}
+
+	return RequestError{"Stripe event signature does not match", BadRequestError}
+}
+
+func (stripeProcessor *StripeProcessor) getChargeClient() charge.Client {
+	return charge.Client{B: stripe.GetBackend(stripe.APIBackend), Key: stripeProcessor.Key}
+}
+
+func (stripeProcessor *StripeProcessor) convertError(payment *Payment, err error) error {
+	if stripeErr, ok := err.(*stripe.Error); ok {
+		switch stripeErr.Code {
+		case stripe.IncorrectNum:
+			fallthrough
+		case stripe.InvalidNum:
+			fallthrough
+		case stripe.InvalidExpM:
+			fallthrough
+		case stripe.InvalidExpY:
+			fallthrough
+		case stripe.InvalidCvc:
+			fallthrough
+		case stripe.ExpiredCard:
+			fallthrough
+		case stripe.IncorrectCvc:
+			fallthrough
+		case stripe.IncorrectZip:
+			fallthrough
+		case stripe.CardDeclined:
+			fallthrough
+		case stripe.Missing:
+			fallthrough
+		case stripe.ProcessingErr:
+			err = RequestError{stripeErr.Msg, BadRequestError}
+		case stripe.RateLimit:
+			err = RequestError{stripeErr.Msg, ServiceUnavailableError}
+		default:
+			if stripeErr.HTTPStatusCode >= 500 {
+				err = RequestError{stripeErr.Msg, ServiceUnavailableError}
+			} else {
+				err = RequestError{stripeErr.Msg, ServerError}
+			}
+		}
+
+		if nil != payment {
+			payment.UpdateFailureReason(stripeErr.Msg)
+		}
+	} else if netErr, ok := err.(net.Error); ok {
+		//Timed out, cut off or unreachable
+		requestErr := ConvertNetworkError(STRIPE_PROCESSOR, netErr)
+		if nil != payment {
+			payment.UpdateFailureReason(requestErr.Message)
+		}
+		err = requestErr
+	} else {
+		errorMsg := "Really bad Server error"
+		if nil != payment {
+			payment.UpdateFailureReason(errorMsg)
+		}
+		err = RequestError{errorMsg, ServerError}
+	}
+
+	return err
+}
+
+func (stripeProcessor *StripeProcessor) makeCreditCardSource(payment *Payment) (*stripe.SourceParams, error) {
+	if len(payment.CreditCardToken) > 0 {
+		return &stripe.SourceParams{Token: payment.CreditCardToken}, nil
+	} else if !stripeProcessor.LegacyCardNumbers {
+		return nil, RequestError{"Credit card token required", BadRequestError}
+	}
+
+	creditCardExpirationDate, err := time.Parse(TIME_LAYOUT, payment.CreditCardExpirationDate)
+	if nil != err {
+		return nil, RequestError{err.Error(), BadRequestError}
+	}
+
+	cardParams := &stripe.CardParams{
+		Month:  strconv.Itoa(int(creditCardExpirationDate.Month())),
+		Year:   strconv.Itoa(creditCardExpirationDate.Year()),
+		Number: payment.CreditCardAccountNumber,
+		CVC:    payment.CreditCardCvv,
+		Name:   payment.NameOnPayment,
+	}
+
+	sourceParams := stripe.SourceParams{
+		Card: cardParams,
+	}
+
+	return &sourceParams, nil
+}
+
+//Value is in cents
+func stripeAmount(amount float64) uint64 {
+	return uint64(math.Floor(amount*100 + 0.5))
+}
@@ -0,0 +1,285 @@
+package common
+
+import (
+	"fmt"
+	"github.com/stripe/stripe-go"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	STRIPE_PAYMENT_INTENT_PREFIX      = "pi_"
+	STRIPE_PAYMENT_INTENT_API_VERSION = "2022-11-15"
+)
+
+type stripePaymentIntent struct {
+	ID               string `json:"id"`
+	Status           string `json:"status"`
+	ClientSecret     string `json:"client_secret"`
+	LatestCharge     string `json:"latest_charge"`
+	LastPaymentError *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"last_payment_error"`
+	NextAction *struct {
+		Type          string `json:"type"`
+		RedirectToUrl *struct {
+			Url string `json:"url"`
+		} `json:"redirect_to_url"`
+	} `json:"next_action"`
+}
+
+type stripeSearchResult struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+//Card payments made with tokens or payment methods go through payment intents
+func IsStripePaymentIntent(transactionId string) bool {
+	return strings.HasPrefix(transactionId, STRIPE_PAYMENT_INTENT_PREFIX)
+}
+
+//The vendored client pins an API version that predates payment intents
+func (stripeProcessor *StripeProcessor) callApi(method string, path string, body *url.Values, idempotencyKey string, v interface{}) error {
+	backend, ok := stripe.GetBackend(stripe.APIBackend).(stripe.BackendConfiguration)
+	if !ok {
+		return RequestError{"Stripe backend does not support payment intents", ServiceNotImplementedError}
+	}
+
+	var reader io.Reader
+	if nil != body {
+		reader = strings.NewReader(body.Encode())
+	}
+
+	req, err := backend.NewRequest(method, path, stripeProcessor.Key, "application/x-www-form-urlencoded", reader, &stripe.Params{IdempotencyKey: idempotencyKey})
+	if nil != err {
+		return err
+	}
+
+	req.Header.Set("Stripe-Version", STRIPE_PAYMENT_INTENT_API_VERSION)
+	return backend.Do(req, v)
+}
+
+func (stripeProcessor *StripeProcessor) chargePaymentIntent(payment *Payment, capture bool) error {
+	if nil == payment.Campaign {
+		return RequestError{fmt.Sprintf("Campaign not found %d", payment.CampaignId), NotFoundError}
+	}
+
+	body := &url.Values{
+		"amount":      {strconv.FormatUint(stripeAmount(payment.Amount), 10)},
+		"currency":    {strings.ToLower(payment.Currency)},
+		"description": {getStripeDescription(payment)},
+		"confirm":     {"true"},
+	}
+
+	if strings.HasPrefix(payment.CreditCardToken, STRIPE_PAYMENT_METHOD_PREFIX) {
+		body.Add("payment_method", payment.CreditCardToken)
+	} else {
+		body.Add("payment_method_data[type]", "card")
+		body.Add("payment_method_data[card][token]", payment.CreditCardToken)
+	}
+
+	//Authorized payments are captured when all-or-nothing campaigns are settled
+	if !capture {
+		body.Add("capture_method", "manual")
+	}
+
+	//Customers without a return url authenticate with stripe.js using the client secret
+	if len(payment.StripeReturnUrl) > 0 {
+		body.Add("return_url", payment.StripeReturnUrl)
+	} else {
+		body.Add("use_stripe_sdk", "true")
+	}
+
+	if len(payment.ContactEmail) > 0 {
+		body.Add("receipt_email", payment.ContactEmail)
+	}
+
+	//Shipping details are not kept for payments loaded from the database
+	if len(payment.FullName) > 0 {
+		body.Add("shipping[name]", payment.FullName)
+		body.Add("shipping[address][line1]", payment.Address1)
+		body.Add("shipping[address][line2]", payment.Address2)
+		body.Add("shipping[address][city]", payment.City)
+		body.Add("shipping[address][postal_code]", payment.PostalCode)
+		body.Add("shipping[address][country]", payment.Country)
+	}
+
+	body.Add(fmt.Sprintf("metadata[%s]", STRIPE_PAYMENT_ID_METADATA), payment.Id)
+
+	paymentIntent := new(stripePaymentIntent)
+	err := stripeProcessor.callApi("POST", "/payment_intents", body, stripeProcessor.getIdempotencyKey(payment), paymentIntent)
+	if nil != err {
+		log.Print(err)
+		log.Print("Failed processing payment intent with processor")
+		payment.PaymentProcessorResponses = FormatPaymentProcessorResponse(err.Error())
+		payment.UpdateStatus("failure")
+		return stripeProcessor.convertError(payment, err)
+	}
+
+	log.Printf("Successfully created payment intent %s with processor", paymentIntent.ID)
+	return stripeProcessor.updatePaymentIntentStatus(payment, paymentIntent)
+}
+
+//Payments stay pending while the customer authenticates
+func (stripeProcessor *StripeProcessor) updatePaymentIntentStatus(payment *Payment, paymentIntent *stripePaymentIntent) error {
+	//Client secrets are only returned to the customer
+	response := *paymentIntent
+	response.ClientSecret = ""
+
+	jsonErr := payment.UpdatePaymentProcessorResponses(&response)
+	if nil != jsonErr {
+		log.Print(jsonErr)
+		log.Printf("Unable to marshal payment intent response %s from stripe", paymentIntent.ID)
+	}
+
+	payment.PaymentProcessorTransactionId = paymentIntent.ID
+	payment.UpdateStripeNextAction("", "")
+
+	switch paymentIntent.Status {
+	case "succeeded":
+		payment.UpdateStatus("success")
+	case "requires_capture":
+		payment.UpdateStatus("authorized")
+	case "requires_action", "requires_confirmation":
+		var redirectUrl string
+		if nil != paymentIntent.NextAction && nil != paymentIntent.NextAction.RedirectToUrl {
+			redirectUrl = paymentIntent.NextAction.RedirectToUrl.Url
+		}
+
+		log.Printf("Payment intent %s requires customer authentication", paymentIntent.ID)
+		payment.UpdateStripeNextAction(paymentIntent.ClientSecret, redirectUrl)
+		payment.UpdateStatus("pending")
+	case "processing":
+		payment.UpdateStatus("pending")
+	case "canceled":
+		payment.UpdateStatus("failure")
+		payment.UpdateFailureReason("Payment intent canceled with processor")
+	default:
+		failureReason := "Payment method declined by processor"
+		if nil != paymentIntent.LastPaymentError && len(paymentIntent.LastPaymentError.Message) > 0 {
+			failureReason = paymentIntent.LastPaymentError.Message
+		}
+
+		payment.UpdateStatus("failure")
+		payment.UpdateFailureReason(failureReason)
+		return RequestError{failureReason, BadRequestError}
+	}
+
+	return nil
+}
+
+//Confirms payment intents once the customer has authenticated
+func (stripeProcessor *StripeProcessor) completePaymentIntent(payment *Payment) error {
+	paymentIntent := new(stripePaymentIntent)
+	err := stripeProcessor.callApi("GET", "/payment_intents/"+payment.PaymentProcessorTransactionId, nil, "", paymentIntent)
+	if nil == err && paymentIntent.Status == "requires_confirmation" {
+		body := &url.Values{}
+		if len(payment.StripeReturnUrl) > 0 {
+			body.Add("return_url", payment.StripeReturnUrl)
+		}
+
+		err = stripeProcessor.callApi("POST", fmt.Sprintf("/payment_intents/%s/confirm", paymentIntent.ID), body, "", paymentIntent)
+	}
+
+	if nil != err {
+		log.Print(err)
+		log.Print("Failed completing payment intent with processor")
+		return stripeProcessor.convertError(nil, err)
+	}
+
+	err = stripeProcessor.updatePaymentIntentStatus(payment, paymentIntent)
+	if nil == err && payment.GetStatus() == "pending" && paymentIntent.Status != "processing" {
+		return RequestError{fmt.Sprintf("Payment %s still requires customer authentication", payment.Id), BadRequestError}
+	}
+
+	return err
+}
+
+func (stripeProcessor *StripeProcessor) capturePaymentIntent(payment *Payment) error {
+	paymentIntent := new(stripePaymentIntent)
+	err := stripeProcessor.callApi("POST", fmt.Sprintf("/payment_intents/%s/capture", payment.PaymentProcessorTransactionId), nil, "", paymentIntent)
+	if nil != err {
+		log.Print(err)
+		log.Print("Failed capturing payment intent with processor")
+		payment.PaymentProcessorResponses = FormatPaymentProcessorResponse(err.Error())
+		err = stripeProcessor.convertError(payment, err)
+
+		//Declined or expired authorizations can never be captured
+		if requestErr, ok := err.(RequestError); ok && requestErr.Type == BadRequestError {
+			payment.UpdateStatus("failure")
+		}
+
+		return err
+	}
+
+	log.Printf("Successfully captured payment %s with processor", payment.Id)
+	return stripeProcessor.updatePaymentIntentStatus(payment, paymentIntent)
+}
+
+//Canceling an uncaptured payment intent releases the authorization
+func (stripeProcessor *StripeProcessor) voidPaymentIntent(payment *Payment) error {
+	paymentIntent := new(stripePaymentIntent)
+	err := stripeProcessor.callApi("POST", fmt.Sprintf("/payment_intents/%s/cancel", payment.PaymentProcessorTransactionId), nil, "", paymentIntent)
+	if nil != err {
+		log.Print(err)
+		log.Print("Failed voiding payment intent with processor")
+		payment.PaymentProcessorResponses = FormatPaymentProcessorResponse(err.Error())
+		return stripeProcessor.convertError(nil, err)
+	}
+
+	log.Printf("Successfully voided payment %s with processor", payment.Id)
+
+	paymentIntent.ClientSecret = ""
+	jsonErr := payment.UpdatePaymentProcessorResponses(paymentIntent)
+	if nil != jsonErr {
+		log.Print(jsonErr)
+		log.Printf("Unable to marshal void response %s from stripe", paymentIntent.ID)
+	}
+
+	payment.UpdateStatus("voided")
+	return nil
+}
+
+//Payment intents are searched before charges made from sources
+func (stripeProcessor *StripeProcessor) findTransactionId(payment *Payment) (string, error) {
+	query := url.Values{
+		"query": {fmt.Sprintf("metadata['%s']:'%s'", STRIPE_PAYMENT_ID_METADATA, payment.Id)},
+	}
+
+	for _, path := range []string{"/payment_intents/search", "/charges/search"} {
+		result := new(stripeSearchResult)
+		err := stripeProcessor.callApi("GET", fmt.Sprintf("%s?%s", path, query.Encode()), nil, "", result)
+		if nil != err {
+			return "", stripeProcessor.convertError(nil, err)
+		} else if len(result.Data) > 0 {
+			log.Printf("Found stripe transaction %s for payment %s", result.Data[0].ID, payment.Id)
+			return result.Data[0].ID, nil
+		}
+	}
+
+	return "", RequestError{fmt.Sprintf("No stripe charge found for payment %s", payment.Id), NotFoundError}
+}
+
+func (stripeProcessor *StripeProcessor) getPaymentIntentStatus(payment *Payment) (string, error) {
+	paymentIntent := new(stripePaymentIntent)
+	err := stripeProcessor.callApi("GET", "/payment_intents/"+payment.PaymentProcessorTransactionId, nil, "", paymentIntent)
+	if nil != err {
+		return "", stripeProcessor.convertError(nil, err)
+	}
+
+	switch paymentIntent.Status {
+	case "succeeded":
+		return "success", nil
+	case "requires_capture":
+		return "authorized", nil
+	case "requires_action", "requires_confirmation", "processing":
+		return "pending", nil
+	default:
+		return "failure", nil
+	}
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func updateTestPaymentIntent(t *testing.T, paymentIntentJson string) (*Payment, error) {
+	paymentIntent := new(stripePaymentIntent)
+	err := json.Unmarshal([]byte(paymentIntentJson), paymentIntent)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	payment := new(Payment)
+	payment.UpdateStripeNextAction("pi_previous_secret", "https://example.com/previous")
+	err = NewStripeProcessor("sk_test").updatePaymentIntentStatus(payment, paymentIntent)
+	return payment, err
+}
+
+func TestPaymentIntentRequiresAction(t *testing.T) {
+	payment, err := updateTestPaymentIntent(t, `{"id": "pi_test", "status": "requires_action", "client_secret": "pi_test_secret", "next_action": {"type": "redirect_to_url", "redirect_to_url": {"url": "https://hooks.stripe.com/3d_secure"}}}`)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	clientSecret, redirectUrl := payment.GetStripeNextAction()
+	if payment.GetStatus() != "pending" || clientSecret != "pi_test_secret" || redirectUrl != "https://hooks.stripe.com/3d_secure" {
+		t.Fatalf("Expected pending payment with next action but status was %s with redirect %s", payment.GetStatus(), redirectUrl)
+	}
+	if payment.PaymentProcessorTransactionId != "pi_test" {
+		t.Fatalf("Expected transaction id pi_test but was %s", payment.PaymentProcessorTransactionId)
+	}
+
+	//Client secrets are returned to the customer but never recorded
+	if strings.Contains(payment.PaymentProcessorResponses, "pi_test_secret") {
+		t.Fatal("Expected client secret to be left out of the recorded response")
+	}
+}
+
+func TestPaymentIntentRequiresActionWithStripeSdk(t *testing.T) {
+	payment, err := updateTestPaymentIntent(t, `{"id": "pi_test", "status": "requires_action", "client_secret": "pi_test_secret", "next_action": {"type": "use_stripe_sdk"}}`)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	clientSecret, redirectUrl := payment.GetStripeNextAction()
+	if payment.GetStatus() != "pending" || clientSecret != "pi_test_secret" || len(redirectUrl) > 0 {
+		t.Fatalf("Expected pending payment authenticated with the client secret but status was %s with redirect %s", payment.GetStatus(), redirectUrl)
+	}
+}
+
+func TestPaymentIntentStatuses(t *testing.T) {
+	statuses := map[string]string{
+		"succeeded":        "success",
+		"requires_capture": "authorized",
+		"processing":       "pending",
+		"canceled":         "failure",
+	}
+
+	for paymentIntentStatus, status := range statuses {
+		payment, err := updateTestPaymentIntent(t, `{"id": "pi_test", "status": "`+paymentIntentStatus+`", "client_secret": "pi_test_secret"}`)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		clientSecret, redirectUrl := payment.GetStripeNextAction()
+		if payment.GetStatus() != status || len(clientSecret) > 0 || len(redirectUrl) > 0 {
+			t.Errorf("Expected %s payment intent to leave payment %s without a next action but was %s", paymentIntentStatus, status, payment.GetStatus())
+		}
+	}
+}
+
+func TestPaymentIntentDeclined(t *testing.T) {
+	payment, err := updateTestPaymentIntent(t, `{"id": "pi_test", "status": "requires_payment_method", "last_payment_error": {"code": "card_declined", "message": "Your card was declined."}}`)
+	if requestErr, ok := err.(RequestError); !ok || requestErr.Type != BadRequestError {
+		t.Fatalf("Expected declined payment intent to be a bad request but was %v", err)
+	}
+	if payment.GetStatus() != "failure" || payment.GetFailureReason() != "Your card was declined." {
+		t.Fatalf("Expected failed payment with the decline reason but status was %s with reason %s", payment.GetStatus(), payment.GetFailureReason())
+	}
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const testStripeEvent = `{"id": "evt_test", "type": "charge.succeeded", "data": {"object": {"id": "ch_test", "status": "succeeded"}}}`
+
+func newTestStripeProcessor() *StripeProcessor {
+	stripeProcessor := NewStripeProcessor("sk_test")
+	stripeProcessor.WebhookSecret = "whsec_test"
+	stripeProcessor.WebhookTolerance = 5 * time.Minute
+	return stripeProcessor
+}
+
+func signStripePayload(secret string, timestamp time.Time, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%d.%s", timestamp.Unix(), payload)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func getStripeErrorType(err error) ErrorType {
+	requestErr, _ := err.(RequestError)
+	return requestErr.Type
+}
+
+func TestStripeParseWebhookEvent(t *testing.T) {
+	stripeProcessor := newTestStripeProcessor()
+	now := time.Now()
+	header := fmt.Sprintf("t=%d,v1=%s", now.Unix(), signStripePayload("whsec_test", now, testStripeEvent))
+
+	event, err := stripeProcessor.ParseWebhookEvent([]byte(testStripeEvent), header)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if event.ID != "evt_test" || event.Type != "charge.succeeded" || event.Data.Obj["id"] != "ch_test" {
+		t.Fatalf("Unexpected event %s (%s)", event.ID, event.Type)
+	}
+}
+
+func TestStripeWebhookSignatureAcceptsAnyMatchingSignature(t *testing.T) {
+	stripeProcessor := newTestStripeProcessor()
+	now := time.Now()
+
+	//Stripe sends a signature for each active secret while secrets are rolled
+	header := fmt.Sprintf("t=%d, v1=%s, v1=%s, v0=ignored", now.Unix(), signStripePayload("whsec_old", now, testStripeEvent), signStripePayload("whsec_test", now, testStripeEvent))
+	err := stripeProcessor.verifyWebhookSignature([]byte(testStripeEvent), header)
+	if nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestStripeWebhookSignatureRejectsInvalidEvents(t *testing.T) {
+	stripeProcessor := newTestStripeProcessor()
+	now := time.Now()
+	stale := now.Add(-10 * time.Minute)
+
+	tests := []struct {
+		name    string
+		payload string
+		header  string
+	}{
+		{"wrong secret", testStripeEvent, fmt.Sprintf("t=%d,v1=%s", now.Unix(), signStripePayload("whsec_other", now, testStripeEvent))},
+		{"modified payload", `{"id": "evt_test", "type": "charge.refunded"}`, fmt.Sprintf("t=%d,v1=%s", now.Unix(), signStripePayload("whsec_test", now, testStripeEvent))},
+		{"modified timestamp", testStripeEvent, fmt.Sprintf("t=%d,v1=%s", now.Unix()+1, signStripePayload("whsec_test", now, testStripeEvent))},
+		{"stale timestamp", testStripeEvent, fmt.Sprintf("t=%d,v1=%s", stale.Unix(), signStripePayload("whsec_test", stale, testStripeEvent))},
+		{"malformed signature", testStripeEvent, fmt.Sprintf("t=%d,v1=not-hex", now.Unix())},
+		{"missing signature", testStripeEvent, fmt.Sprintf("t=%d", now.Unix())},
+		{"missing timestamp", testStripeEvent, fmt.Sprintf("v1=%s", signStripePayload("whsec_test", now, testStripeEvent))},
+		{"missing header", testStripeEvent, ""},
+	}
+
+	for _, test := range tests {
+		err := stripeProcessor.verifyWebhookSignature([]byte(test.payload), test.header)
+		if getStripeErrorType(err) != BadRequestError {
+			t.Errorf("Expected bad request for %s but was %v", test.name, err)
+		}
+	}
+}
+
+func TestStripeWebhookSignatureToleranceDisabled(t *testing.T) {
+	stripeProcessor := newTestStripeProcessor()
+	stripeProcessor.WebhookTolerance = 0
+	stale := time.Now().Add(-24 * time.Hour)
+
+	header := fmt.Sprintf("t=%d,v1=%s", stale.Unix(), signStripePayload("whsec_test", stale, testStripeEvent))
+	err := stripeProcessor.verifyWebhookSignature([]byte(testStripeEvent), header)
+	if nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestStripeWebhookSignatureRequiresSecret(t *testing.T) {
+	stripeProcessor := NewStripeProcessor("sk_test")
+	now := time.Now()
+
+	header := fmt.Sprintf("t=%d,v1=%s", now.Unix(), signStripePayload("", now, testStripeEvent))
+	err := stripeProcessor.verifyWebhookSignature([]byte(testStripeEvent), header)
+	if getStripeErrorType(err) != ServiceNotImplementedError {
+		t.Fatalf("Expected webhooks to be disabled without a secret but was %v", err)
+	}
+}
+
+func TestStripeParseWebhookEventRequiresData(t *testing.T) {
+	stripeProcessor := newTestStripeProcessor()
+	now := time.Now()
+	payload := `{"id": "evt_test", "type": "charge.succeeded"}`
+
+	header := fmt.Sprintf("t=%d,v1=%s", now.Unix(), signStripePayload("whsec_test", now, payload))
+	_, err := stripeProcessor.ParseWebhookEvent([]byte(payload), header)
+	if getStripeErrorType(err) != BadRequestError {
+		t.Fatalf("Expected bad request for event without data but was %v", err)
+	}
+}
+
+func TestStripeAmountRoundsToCents(t *testing.T) {
+	amounts := map[float64]uint64{
+		0.29:    29,
+		4.999:   500,
+		6.67:    667,
+		10:      1000,
+		19.99:   1999,
+		3.33333: 333,
+	}
+
+	for amount, expected := range amounts {
+		if actual := stripeAmount(amount); actual != expected {
+			t.Errorf("Expected %f to be %d cents but was %d", amount, expected, actual)
+		}
+	}
+}